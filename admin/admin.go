@@ -0,0 +1,334 @@
+// Package admin serves the cache inspection and flushing API
+package admin
+
+import (
+	"cmp"
+	"encoding/json"
+	"github.com/perbu/hazelnut/cache"
+	"github.com/perbu/hazelnut/clientip"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cache is what the admin API needs from the cache
+type Cache interface {
+	Stats() cache.Stats
+	Flush()
+	Delete(key string) bool
+}
+
+// KeyFunc maps a request for a URL to its cache key
+type KeyFunc func(req *http.Request) string
+
+// Ranger iterates over the objects in the cache, as the lru, map and disk caches do
+type Ranger interface {
+	Range(fn func(key string, value cache.ObjCore, expires time.Time) bool)
+}
+
+// Purger deletes every object tagged with a surrogate key and returns how many it deleted
+type Purger interface {
+	Purge(key string) int
+}
+
+// Maintainer switches maintenance mode, in which clients get a maintenance page instead of
+// the backends' responses
+type Maintainer interface {
+	SetMaintenance(on bool)
+	Maintenance() bool
+}
+
+// Handler serves the admin API to clients on the allow-list
+type Handler struct {
+	cache   Cache
+	key     KeyFunc
+	allow   []netip.Prefix
+	proxies clientip.Proxies // trusted proxies, the allow-list applies to the client behind them
+	mux     *http.ServeMux
+	logger  *slog.Logger
+	purger  Purger     // optional, purges by surrogate key
+	ranger  Ranger     // optional, finds the objects a ban matches
+	maint   Maintainer // optional, switches maintenance mode
+}
+
+// New creates the admin API. Requests from addresses outside allow get a 403.
+func New(logger *slog.Logger, c Cache, key KeyFunc, allow []netip.Prefix) *Handler {
+	h := &Handler{
+		cache:  c,
+		key:    key,
+		allow:  allow,
+		mux:    http.NewServeMux(),
+		logger: logger.With("package", "admin"),
+	}
+	h.mux.HandleFunc("GET /cache/stats", h.stats)
+	h.mux.HandleFunc("POST /cache/flush", h.flush)
+	h.mux.HandleFunc("GET /cache/object", h.object)
+	h.mux.HandleFunc("DELETE /cache/object", h.deleteObject)
+	h.mux.HandleFunc("DELETE /cache/surrogate", h.purgeSurrogate)
+	h.mux.HandleFunc("POST /cache/ban", h.ban)
+	h.mux.HandleFunc("GET /maintenance", h.maintenance)
+	h.mux.HandleFunc("POST /maintenance", h.setMaintenance)
+	return h
+}
+
+// SetTrustedProxies sets the proxies whose X-Forwarded-For is believed, so the allow-list applies
+// to the client behind them rather than to the proxy
+func (h *Handler) SetTrustedProxies(prefixes []netip.Prefix) {
+	h.proxies = clientip.Proxies(prefixes)
+}
+
+// SetPurger enables purging by surrogate key
+func (h *Handler) SetPurger(p Purger) {
+	h.purger = p
+}
+
+// SetMaintainer enables switching maintenance mode
+func (h *Handler) SetMaintainer(m Maintainer) {
+	h.maint = m
+}
+
+// SetRanger enables bans, and deleting the variants of an object along with it. r iterates over
+// the same objects the cache given to New deletes.
+func (h *Handler) SetRanger(r Ranger) {
+	h.ranger = r
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.allowed(r) {
+		h.logger.Warn("admin request denied", "remote", r.RemoteAddr, "client", h.proxies.ClientAddr(r), "path", r.URL.Path)
+		writeJSON(w, http.StatusForbidden, errorResponse{Error: "forbidden"})
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// allowed reports whether the client address is on the allow-list
+func (h *Handler) allowed(r *http.Request) bool {
+	addr := h.proxies.ClientAddr(r)
+	if !addr.IsValid() {
+		return false
+	}
+	for _, prefix := range h.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type flushResponse struct {
+	Flushed int64 `json:"flushed"` // objects in the cache before the flush
+}
+
+type deleteResponse struct {
+	URL     string `json:"url"`
+	Deleted bool   `json:"deleted"`
+}
+
+func (h *Handler) stats(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, h.cache.Stats())
+}
+
+func (h *Handler) flush(w http.ResponseWriter, _ *http.Request) {
+	objects := h.cache.Stats().Objects
+	h.cache.Flush()
+	h.logger.Info("cache flushed", "objects", objects)
+	writeJSON(w, http.StatusOK, flushResponse{Flushed: objects})
+}
+
+// objectKey returns the cache key of the absolute URL in the url parameter. When there is none
+// it writes a 400 and returns false.
+func (h *Handler) objectKey(w http.ResponseWriter, r *http.Request) (string, *http.Request, bool) {
+	raw := r.URL.Query().Get("url")
+	u, err := url.Parse(raw)
+	if raw == "" || err != nil || u.Host == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "url must be an absolute URL"})
+		return "", nil, false
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return "", nil, false
+	}
+	return h.key(req), req, true
+}
+
+type objectResponse struct {
+	URL             string     `json:"url"`
+	Status          int        `json:"status"`
+	Expires         *time.Time `json:"expires,omitempty"`           // absent when the object never expires
+	OriginLatencyMs float64    `json:"origin_latency_ms,omitempty"` // how long the backend took to send the headers
+	OriginSize      int64      `json:"origin_size,omitempty"`       // body bytes as the backend sent them
+}
+
+// object describes a cached object without counting a lookup. The cache is scanned for it, which
+// takes as long as a ban.
+func (h *Handler) object(w http.ResponseWriter, r *http.Request) {
+	if h.ranger == nil {
+		writeJSON(w, http.StatusNotImplemented, errorResponse{Error: "the cache doesn't support inspecting objects"})
+		return
+	}
+	key, _, ok := h.objectKey(w, r)
+	if !ok {
+		return
+	}
+	var resp *objectResponse
+	h.ranger.Range(func(k string, value cache.ObjCore, expires time.Time) bool {
+		if k != key {
+			return true
+		}
+		resp = &objectResponse{
+			URL:             r.URL.Query().Get("url"),
+			Status:          cmp.Or(value.Status, http.StatusOK),
+			OriginLatencyMs: float64(value.FetchLatency.Microseconds()) / 1000,
+			OriginSize:      value.OriginSize,
+		}
+		if !expires.IsZero() {
+			resp.Expires = &expires
+		}
+		return false
+	})
+	if resp == nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "not cached"})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) deleteObject(w http.ResponseWriter, r *http.Request) {
+	raw := r.URL.Query().Get("url")
+	key, req, ok := h.objectKey(w, r)
+	if !ok {
+		return
+	}
+	deleted := h.cache.Delete(key)
+	// the variants of the object, by country, device, protocol or cookie, are stored under keys
+	// of their own. With a ranger they are found by the host and URL that filled them, as for a ban.
+	if h.ranger != nil {
+		var variants []string
+		h.ranger.Range(func(k string, value cache.ObjCore, _ time.Time) bool {
+			if strings.EqualFold(value.Host, req.Host) && value.URL == req.URL.RequestURI() {
+				variants = append(variants, k)
+			}
+			return true
+		})
+		for _, k := range variants {
+			if h.cache.Delete(k) {
+				deleted = true
+			}
+		}
+	}
+	h.logger.Info("cache object deleted", "url", raw, "deleted", deleted)
+	status := http.StatusOK
+	if !deleted {
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, deleteResponse{URL: raw, Deleted: deleted})
+}
+
+type purgeResponse struct {
+	Keys   []string `json:"keys"`
+	Purged int      `json:"purged"` // objects deleted from the cache
+}
+
+func (h *Handler) purgeSurrogate(w http.ResponseWriter, r *http.Request) {
+	if h.purger == nil {
+		writeJSON(w, http.StatusNotImplemented, errorResponse{Error: "surrogate keys are not enabled"})
+		return
+	}
+	keys := r.URL.Query()["key"]
+	if len(keys) == 0 {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "key is required"})
+		return
+	}
+	purged := 0
+	for _, key := range keys {
+		purged += h.purger.Purge(key)
+	}
+	h.logger.Info("cache objects purged by surrogate key", "keys", keys, "purged", purged)
+	writeJSON(w, http.StatusOK, purgeResponse{Keys: keys, Purged: purged})
+}
+
+type banResponse struct {
+	URL    string `json:"url"`
+	Host   string `json:"host,omitempty"`
+	Banned int    `json:"banned"` // objects deleted from the cache
+}
+
+// ban deletes the objects whose URL matches a regular expression, optionally only for one host.
+// The cache is scanned right away, so the objects are gone when the response is sent.
+func (h *Handler) ban(w http.ResponseWriter, r *http.Request) {
+	if h.ranger == nil {
+		writeJSON(w, http.StatusNotImplemented, errorResponse{Error: "the cache doesn't support bans"})
+		return
+	}
+	pattern, host := r.URL.Query().Get("url"), r.URL.Query().Get("host")
+	if pattern == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "url is required"})
+		return
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	// deleting from within Range isn't allowed, collect the keys first
+	var keys []string
+	h.ranger.Range(func(key string, value cache.ObjCore, _ time.Time) bool {
+		if (host == "" || strings.EqualFold(value.Host, host)) && value.URL != "" && re.MatchString(value.URL) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	banned := 0
+	for _, key := range keys {
+		if h.cache.Delete(key) {
+			banned++
+		}
+	}
+	h.logger.Info("cache objects banned", "url", pattern, "host", host, "banned", banned)
+	writeJSON(w, http.StatusOK, banResponse{URL: pattern, Host: host, Banned: banned})
+}
+
+type maintenanceResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (h *Handler) maintenance(w http.ResponseWriter, _ *http.Request) {
+	if h.maint == nil {
+		writeJSON(w, http.StatusNotImplemented, errorResponse{Error: "maintenance mode is not available"})
+		return
+	}
+	writeJSON(w, http.StatusOK, maintenanceResponse{Enabled: h.maint.Maintenance()})
+}
+
+// setMaintenance turns maintenance mode on or off as the enabled parameter says
+func (h *Handler) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	if h.maint == nil {
+		writeJSON(w, http.StatusNotImplemented, errorResponse{Error: "maintenance mode is not available"})
+		return
+	}
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "enabled must be true or false"})
+		return
+	}
+	h.maint.SetMaintenance(enabled)
+	h.logger.Info("maintenance mode set", "enabled", enabled, "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, maintenanceResponse{Enabled: enabled})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,365 @@
+package admin
+
+import (
+	"encoding/json"
+	"github.com/perbu/hazelnut/cache"
+	"github.com/perbu/hazelnut/cache/mapcache"
+	"github.com/perbu/hazelnut/cache/surrogate"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c := mapcache.New()
+	key := func(req *http.Request) string {
+		return cache.MakeKey(req, false, cache.QueryPolicy{})
+	}
+	h := New(logger, c, key, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+
+	store := func(rawURL string) {
+		req := httptest.NewRequest(http.MethodGet, rawURL, nil)
+		c.Set(key(req), cache.ObjCore{Headers: make(http.Header), Body: []byte("hello")})
+	}
+	do := func(method, target, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Denies clients outside the allow-list", func(t *testing.T) {
+		rec := do(http.MethodGet, "/cache/stats", "192.0.2.1:1234")
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", rec.Code)
+		}
+	})
+
+	t.Run("Allow-list applies to the client behind a trusted proxy", func(t *testing.T) {
+		h.SetTrustedProxies([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+		defer h.SetTrustedProxies(nil)
+		for remote, want := range map[string]int{"192.0.2.1:1234": http.StatusOK, "198.51.100.1:1234": http.StatusForbidden} {
+			req := httptest.NewRequest(http.MethodGet, "/cache/stats", nil)
+			req.RemoteAddr = remote
+			req.Header.Set("X-Forwarded-For", "127.0.0.1")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != want {
+				t.Errorf("From %s: expected status %d, got %d", remote, want, rec.Code)
+			}
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		store("http://example.com/a")
+		store("http://example.com/b")
+		c.Get(key(httptest.NewRequest(http.MethodGet, "http://example.com/a", nil)))
+		c.Get(key(httptest.NewRequest(http.MethodGet, "http://example.com/missing", nil)))
+
+		rec := do(http.MethodGet, "/cache/stats", "127.0.0.1:1234")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected Content-Type application/json, got %q", ct)
+		}
+		var stats cache.Stats
+		if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+			t.Fatalf("Failed to decode stats: %v", err)
+		}
+		if stats.Objects != 2 || stats.Bytes != 10 {
+			t.Errorf("Expected 2 objects and 10 bytes, got %+v", stats)
+		}
+		if stats.Hits != 1 || stats.Misses != 1 || stats.HitRatio != 0.5 {
+			t.Errorf("Expected 1 hit, 1 miss and a ratio of 0.5, got %+v", stats)
+		}
+	})
+
+	t.Run("Delete one object", func(t *testing.T) {
+		target := "/cache/object?url=" + url.QueryEscape("http://example.com/a")
+		rec := do(http.MethodDelete, target, "127.0.0.1:1234")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rec.Code)
+		}
+		var resp deleteResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if !resp.Deleted || resp.URL != "http://example.com/a" {
+			t.Errorf("Unexpected response %+v", resp)
+		}
+		if got := c.Stats().Objects; got != 1 {
+			t.Errorf("Expected 1 object left, got %d", got)
+		}
+
+		rec = do(http.MethodDelete, target, "127.0.0.1:1234")
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404 for an object that isn't cached, got %d", rec.Code)
+		}
+	})
+
+	t.Run("Delete the variants of an object", func(t *testing.T) {
+		h.SetRanger(c)
+		defer h.SetRanger(nil)
+		before := c.Stats().Objects
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/variants?a=1", nil)
+		for _, variant := range []string{"geo:NO", "device:mobile", "proto:HTTP/2.0"} {
+			_ = c.Set(cache.MakeKey(req, false, cache.QueryPolicy{}, variant), cache.ObjCore{Body: []byte("hello"), Host: req.Host, URL: req.URL.RequestURI()})
+		}
+		other := httptest.NewRequest(http.MethodGet, "http://example.org/variants?a=1", nil)
+		_ = c.Set(cache.MakeKey(other, false, cache.QueryPolicy{}, "geo:NO"), cache.ObjCore{Body: []byte("hello"), Host: other.Host, URL: other.URL.RequestURI()})
+
+		rec := do(http.MethodDelete, "/cache/object?url="+url.QueryEscape("http://example.com/variants?a=1"), "127.0.0.1:1234")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 when only variants are cached, got %d", rec.Code)
+		}
+		if got := c.Stats().Objects; got != before+1 {
+			t.Errorf("Expected only the example.org variant left, got %d objects for %d before", got, before)
+		}
+		c.Delete(cache.MakeKey(other, false, cache.QueryPolicy{}, "geo:NO"))
+	})
+
+	t.Run("Delete needs an absolute url", func(t *testing.T) {
+		rec := do(http.MethodDelete, "/cache/object?url=/a", "127.0.0.1:1234")
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", rec.Code)
+		}
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		store("http://example.com/c")
+		rec := do(http.MethodPost, "/cache/flush", "127.0.0.1:1234")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rec.Code)
+		}
+		var resp flushResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if resp.Flushed != 2 {
+			t.Errorf("Expected 2 objects flushed, got %d", resp.Flushed)
+		}
+		if got := c.Stats(); got.Objects != 0 || got.Hits != 0 {
+			t.Errorf("Expected an empty cache with reset stats, got %+v", got)
+		}
+	})
+
+	t.Run("Purge by surrogate key", func(t *testing.T) {
+		rec := do(http.MethodDelete, "/cache/surrogate?key=product-1", "127.0.0.1:1234")
+		if rec.Code != http.StatusNotImplemented {
+			t.Errorf("Expected status 501 without surrogate keys, got %d", rec.Code)
+		}
+
+		index := surrogate.New()
+		index.Cache = c
+		h.SetPurger(index)
+		for path, keys := range map[string]string{"/p1": "product-1 home", "/p2": "product-2 home", "/p3": "product-3"} {
+			obj := cache.ObjCore{Headers: http.Header{surrogate.Header: {keys}}, Body: []byte("hello")}
+			_ = index.Set(key(httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)), obj)
+		}
+
+		rec = do(http.MethodDelete, "/cache/surrogate?key=home&key=product-3", "127.0.0.1:1234")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rec.Code)
+		}
+		var resp purgeResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if resp.Purged != 3 || len(resp.Keys) != 2 {
+			t.Errorf("Expected 3 objects purged for 2 keys, got %+v", resp)
+		}
+		if got := c.Stats().Objects; got != 0 {
+			t.Errorf("Expected an empty cache, got %d objects", got)
+		}
+
+		rec = do(http.MethodDelete, "/cache/surrogate", "127.0.0.1:1234")
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 without a key, got %d", rec.Code)
+		}
+	})
+
+	t.Run("Ban by URL pattern", func(t *testing.T) {
+		rec := do(http.MethodPost, "/cache/ban?url=^/products/", "127.0.0.1:1234")
+		if rec.Code != http.StatusNotImplemented {
+			t.Errorf("Expected status 501 without a ranger, got %d", rec.Code)
+		}
+
+		h.SetRanger(c)
+		for _, rawURL := range []string{
+			"http://example.com/products/1", "http://example.com/products/2?color=red",
+			"http://example.org/products/1", "http://example.com/about",
+		} {
+			req := httptest.NewRequest(http.MethodGet, rawURL, nil)
+			_ = c.Set(key(req), cache.ObjCore{Body: []byte("hello"), Host: req.Host, URL: req.URL.RequestURI()})
+		}
+
+		ban := func(target string) banResponse {
+			t.Helper()
+			rec := do(http.MethodPost, target, "127.0.0.1:1234")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			var resp banResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			return resp
+		}
+		if resp := ban("/cache/ban?url=" + url.QueryEscape("^/products/") + "&host=EXAMPLE.com"); resp.Banned != 2 {
+			t.Errorf("Expected 2 objects banned for example.com, got %+v", resp)
+		}
+		if got := c.Stats().Objects; got != 2 {
+			t.Errorf("Expected 2 objects left, got %d", got)
+		}
+		if resp := ban("/cache/ban?url=" + url.QueryEscape("^/products/")); resp.Banned != 1 {
+			t.Errorf("Expected the example.org object banned without a host, got %+v", resp)
+		}
+		if rec := do(http.MethodPost, "/cache/ban?url=(", "127.0.0.1:1234"); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for a bad pattern, got %d", rec.Code)
+		}
+		if rec := do(http.MethodPost, "/cache/ban", "127.0.0.1:1234"); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 without a pattern, got %d", rec.Code)
+		}
+	})
+
+	t.Run("Inspect one object", func(t *testing.T) {
+		h.SetRanger(nil)
+		target := "/cache/object?url=" + url.QueryEscape("http://example.com/slow")
+		if rec := do(http.MethodGet, target, "127.0.0.1:1234"); rec.Code != http.StatusNotImplemented {
+			t.Errorf("Expected status 501 without a ranger, got %d", rec.Code)
+		}
+
+		h.SetRanger(c)
+		if rec := do(http.MethodGet, target, "127.0.0.1:1234"); rec.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404 for an object that isn't cached, got %d", rec.Code)
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/slow", nil)
+		// stored without a TTL, so it never expires
+		_ = c.SetWithTTL(key(req), cache.ObjCore{Body: []byte("hello"), FetchLatency: 1500 * time.Millisecond, OriginSize: 42}, 0)
+		hits := c.Stats().Hits
+		rec := do(http.MethodGet, target, "127.0.0.1:1234")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rec.Code)
+		}
+		var resp objectResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		want := objectResponse{URL: "http://example.com/slow", Status: http.StatusOK, OriginLatencyMs: 1500, OriginSize: 42}
+		if resp != want {
+			t.Errorf("Expected %+v, got %+v", want, resp)
+		}
+		if c.Stats().Hits != hits {
+			t.Error("Expected inspecting not to count as a hit")
+		}
+	})
+
+	t.Run("Wrong method", func(t *testing.T) {
+		rec := do(http.MethodGet, "/cache/flush", "127.0.0.1:1234")
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status 405, got %d", rec.Code)
+		}
+	})
+}
+
+func TestRequireAuth(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	basic := func(username, password string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(username, password) }
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	tests := []struct {
+		name      string
+		creds     Credentials
+		auth      func(*http.Request)
+		status    int
+		challenge []string
+	}{
+		{"no credentials configured", Credentials{}, nil, http.StatusOK, nil},
+		{"basic auth", Credentials{Username: "ops", Password: "secret"}, basic("ops", "secret"), http.StatusOK, nil},
+		{"wrong password", Credentials{Username: "ops", Password: "secret"}, basic("ops", "guess"), http.StatusUnauthorized, []string{"Basic"}},
+		{"wrong username", Credentials{Username: "ops", Password: "secret"}, basic("root", "secret"), http.StatusUnauthorized, []string{"Basic"}},
+		{"missing", Credentials{Username: "ops", Password: "secret"}, nil, http.StatusUnauthorized, []string{"Basic"}},
+		{"bearer token", Credentials{Token: "t0ken"}, bearer("t0ken"), http.StatusOK, nil},
+		{"wrong token", Credentials{Token: "t0ken"}, bearer("guess"), http.StatusUnauthorized, []string{"Bearer"}},
+		{"token for basic auth", Credentials{Username: "ops", Password: "secret"}, bearer("secret"), http.StatusUnauthorized, []string{"Basic"}},
+		{"either, token", Credentials{Username: "ops", Password: "secret", Token: "t0ken"}, bearer("t0ken"), http.StatusOK, nil},
+		{"either, basic", Credentials{Username: "ops", Password: "secret", Token: "t0ken"}, basic("ops", "secret"), http.StatusOK, nil},
+		{"either, missing", Credentials{Username: "ops", Password: "secret", Token: "t0ken"}, nil, http.StatusUnauthorized, []string{"Basic", "Bearer"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.auth != nil {
+				tt.auth(req)
+			}
+			rec := httptest.NewRecorder()
+			RequireAuth(logger, next, tt.creds).ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, rec.Code)
+			}
+			challenges := rec.Header().Values("WWW-Authenticate")
+			if len(challenges) != len(tt.challenge) {
+				t.Fatalf("Expected challenges for %v, got %v", tt.challenge, challenges)
+			}
+			for i, scheme := range tt.challenge {
+				if !strings.HasPrefix(challenges[i], scheme+" ") {
+					t.Errorf("Expected a %s challenge, got %q", scheme, challenges[i])
+				}
+			}
+		})
+	}
+}
+
+// maintainer records the maintenance mode set through the admin API
+type maintainer struct{ on bool }
+
+func (m *maintainer) SetMaintenance(on bool) { m.on = on }
+func (m *maintainer) Maintenance() bool      { return m.on }
+
+func TestMaintenance(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := New(logger, mapcache.New(), nil, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	do := func(method, target string) (int, maintenanceResponse) {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var resp maintenanceResponse
+		_ = json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+
+	if code, _ := do(http.MethodGet, "/maintenance"); code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 without a maintainer, got %d", code)
+	}
+	m := &maintainer{}
+	h.SetMaintainer(m)
+	if code, resp := do(http.MethodPost, "/maintenance?enabled=true"); code != http.StatusOK || !resp.Enabled || !m.on {
+		t.Errorf("Expected maintenance mode on, got %d %+v", code, resp)
+	}
+	if code, resp := do(http.MethodGet, "/maintenance"); code != http.StatusOK || !resp.Enabled {
+		t.Errorf("Expected maintenance mode reported on, got %d %+v", code, resp)
+	}
+	if code, _ := do(http.MethodPost, "/maintenance?enabled=maybe"); code != http.StatusBadRequest || !m.on {
+		t.Errorf("Expected 400 for a bad value and no change, got %d", code)
+	}
+	if code, resp := do(http.MethodPost, "/maintenance?enabled=false"); code != http.StatusOK || resp.Enabled || m.on {
+		t.Errorf("Expected maintenance mode off, got %d %+v", code, resp)
+	}
+}
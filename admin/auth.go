@@ -0,0 +1,71 @@
+package admin
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Credentials are what a client must present to use a protected handler: the basic auth
+// username and password, the bearer token, or either when both are set.
+type Credentials struct {
+	Username string
+	Password string
+	Token    string
+}
+
+// Enabled reports whether any credentials are set
+func (c Credentials) Enabled() bool {
+	return c.Username != "" || c.Token != ""
+}
+
+// RequireAuth wraps next so that only clients presenting creds reach it, the others get a 401
+// with a WWW-Authenticate header for each scheme accepted. Without credentials next is returned
+// as it is.
+func RequireAuth(logger *slog.Logger, next http.Handler, creds Credentials) http.Handler {
+	if !creds.Enabled() {
+		return next
+	}
+	logger = logger.With("package", "admin")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if creds.valid(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logger.Warn("unauthorized request", "remote", r.RemoteAddr, "path", r.URL.Path)
+		if creds.Username != "" {
+			w.Header().Add("WWW-Authenticate", `Basic realm="hazelnut", charset="UTF-8"`)
+		}
+		if creds.Token != "" {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="hazelnut"`)
+		}
+		writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "unauthorized"})
+	})
+}
+
+// valid reports whether r carries the credentials. The comparisons take the same time whatever
+// is sent, so the credentials can't be guessed from how long they take.
+func (c Credentials) valid(r *http.Request) bool {
+	if c.Username != "" {
+		if username, password, ok := r.BasicAuth(); ok {
+			usernameOK, passwordOK := equal(username, c.Username), equal(password, c.Password)
+			return usernameOK && passwordOK
+		}
+	}
+	if c.Token != "" {
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return equal(strings.TrimSpace(token), c.Token)
+		}
+	}
+	return false
+}
+
+// equal compares two secrets in constant time. They are hashed first so that not even their
+// lengths can be told apart.
+func equal(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
@@ -2,34 +2,126 @@ package backend
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/perbu/hazelnut/metrics"
 )
 
 // Fetcher is an interface that both Client and Router implement
 type Fetcher interface {
-	Fetch(req *http.Request) (*http.Response, bool)
+	Fetch(req *http.Request) (*http.Response, Cacheability)
+}
+
+// Reasons a response is not cacheable
+const (
+	UncacheableFetchFailed = "fetch_failed" // the backend couldn't be reached, the response is a fallback
+	UncacheableMethod      = "method"       // the request method isn't GET or HEAD, the response is cacheable otherwise
+	UncacheableStatus      = "status"       // the status code isn't in the cacheable set
+	UncacheableSetCookie   = "set_cookie"   // the response sets a cookie
+	UncacheableTooLarge    = "too_large"    // the response is larger than max_response_bytes
+	UncacheableMalformed   = "malformed"    // the response violates HTTP and was replaced by an error
+)
+
+// Cacheability is the backend's verdict on whether a response may be cached.
+// The response headers may still rule it out, this only covers what they don't.
+type Cacheability struct {
+	Cacheable bool
+	Reason    string // one of the Uncacheable reasons when not cacheable, empty otherwise
+}
+
+// uncacheable returns a verdict against caching for reason
+func uncacheable(reason string) Cacheability {
+	return Cacheability{Reason: reason}
+}
+
+// defaultCacheableStatus are the status codes whose responses may be cached unless
+// SetCacheableStatus says otherwise. Partial content and temporary redirects are left out, error
+// responses other than 404 and 410 are left to negative caching.
+var defaultCacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// DefaultCacheableStatus returns the status codes whose responses may be cached when no list is
+// configured, in ascending order
+func DefaultCacheableStatus() []int {
+	return slices.Sorted(maps.Keys(defaultCacheableStatus))
+}
+
+// cacheableMethods are the methods whose responses may be cached without a method policy
+var cacheableMethods = map[string]bool{
+	http.MethodGet:  true,
+	http.MethodHead: true,
 }
 
+// Default connection pool settings. All connections go to a single origin, so the per-host
+// limit, which Go keeps at 2 by default, applies to every virtual host name sent to it.
+const (
+	DefaultMaxIdleConns        = 1000
+	DefaultMaxIdleConnsPerHost = 100
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// Default backend timeouts. There is no limit on the whole exchange by default, so large bodies
+// can take as long as they need once the response has started.
+const (
+	DefaultDialTimeout     = 10 * time.Second // connecting, the TLS handshake excluded
+	DefaultResponseTimeout = 30 * time.Second // from sending the request to the response headers
+)
+
+// Policies for responses larger than the configured maximum size
+const (
+	OversizeAbort  = "abort"  // fail the fetch and serve an error
+	OversizeStream = "stream" // pass the body through to the client but don't cache it
+)
+
 type Client struct {
-	httpClient *http.Client
-	target     string
-	port       int
-	scheme     string
-	logger     *slog.Logger
+	httpClient       *http.Client
+	target           string
+	port             int
+	scheme           string
+	maxResponseBytes int64
+	oversizePolicy   string
+	cacheSetCookie   bool           // responses with Set-Cookie may be cached
+	cacheableStatus  map[int]bool   // status codes whose responses may be cached
+	reqHeaders       http.Header    // set on every request to the backend
+	hostOverride     string         // Host header sent to the backend instead of the client's
+	insecureTLS      bool           // don't verify the backend's certificate
+	rootCAs          *x509.CertPool // verify the backend's certificate against these, nil means the system's
+	serverName       string         // SNI and certificate name, empty means the request's host
+	transport        *http.Transport
+	dialer           *net.Dialer
+	metrics          *metrics.Metrics // nil means requests aren't counted
+	proto            atomic.Value     // protocol of the last response, to log when it changes
+	logger           *slog.Logger
 }
 
 // New creates a new backend Client that forces connections to the specified target host and port,
 // while leaving the HTTP Host header and URL intact.
 func New(logger *slog.Logger, target string, port int) *Client {
 	dialer := &net.Dialer{
-		Timeout: 30 * time.Second,
+		Timeout: DefaultDialTimeout,
 	}
 
 	transport := &http.Transport{
@@ -37,22 +129,59 @@ func New(logger *slog.Logger, target string, port int) *Client {
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			// Instead of using the provided addr, use our target.
 			fixedAddr := fmt.Sprintf("%s:%d", target, port)
-			logger.Info("dialing backend", "addr", fixedAddr)
+			requestLogger(logger, ctx).Info("dialing backend", "addr", fixedAddr)
 			return dialer.DialContext(ctx, network, fixedAddr)
 		},
+		// a custom DialContext turns HTTP/2 off unless it is asked for
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          DefaultMaxIdleConns,
+		MaxIdleConnsPerHost:   DefaultMaxIdleConnsPerHost,
+		IdleConnTimeout:       DefaultIdleConnTimeout,
+		ResponseHeaderTimeout: DefaultResponseTimeout,
 	}
 
 	httpClient := &http.Client{
-		Timeout:   30 * time.Second,
 		Transport: transport,
 	}
 
 	return &Client{
-		httpClient: httpClient,
-		target:     target,
-		port:       port,
-		scheme:     "https", // default scheme
-		logger:     logger.With("package", "backend"),
+		httpClient:      httpClient,
+		transport:       transport,
+		dialer:          dialer,
+		target:          target,
+		port:            port,
+		scheme:          "https", // default scheme
+		oversizePolicy:  OversizeAbort,
+		cacheableStatus: defaultCacheableStatus,
+		logger:          logger.With("package", "backend"),
+	}
+}
+
+// SetMaxResponseBytes limits the size of response bodies read from the backend.
+// A max of 0 disables the limit. The policy decides what happens to larger responses,
+// either OversizeAbort or OversizeStream.
+func (c *Client) SetMaxResponseBytes(max int64, policy string) {
+	c.maxResponseBytes = max
+	if policy == OversizeAbort || policy == OversizeStream {
+		c.oversizePolicy = policy
+	}
+}
+
+// SetMetrics counts the requests to the backend and the failed ones in m, labeled with Name
+func (c *Client) SetMetrics(m *metrics.Metrics) {
+	c.metrics = m
+}
+
+// countRequest counts a request to the backend, and a failure when it was answered with a
+// fallback: the backend couldn't be reached, was too slow or sent too much
+func (c *Client) countRequest(failed bool) {
+	if c.metrics == nil {
+		return
+	}
+	name := c.Name()
+	c.metrics.BackendRequests.WithLabelValues(name).Inc()
+	if failed {
+		c.metrics.BackendFailures.WithLabelValues(name).Inc()
 	}
 }
 
@@ -63,33 +192,277 @@ func (c *Client) SetScheme(scheme string) {
 	}
 }
 
+// SetCacheSetCookie allows caching responses that carry a Set-Cookie header. They aren't
+// cached by default, since the cookie would be handed to every client served from the cache.
+func (c *Client) SetCacheSetCookie(enabled bool) {
+	c.cacheSetCookie = enabled
+}
+
+// SetCacheableStatus sets the status codes whose responses may be cached, replacing the default
+// of 200, 203, 204, 300, 301, 404 and 410. Responses with any other status are passed on uncached,
+// whatever their Cache-Control says, unless negative caching takes them. An empty list restores
+// the default.
+func (c *Client) SetCacheableStatus(codes []int) {
+	if len(codes) == 0 {
+		c.cacheableStatus = defaultCacheableStatus
+		return
+	}
+	c.cacheableStatus = make(map[int]bool, len(codes))
+	for _, code := range codes {
+		c.cacheableStatus[code] = true
+	}
+}
+
+// SetRequestHeaders sets static headers on every request to the backend, replacing any the
+// client sent, such as an API key or a User-Agent the origin requires. A "Host" entry overrides
+// the Host header instead, which net/http keeps apart from the other headers. The headers are
+// set on a copy of the request, they never reach the cached object or the client.
+func (c *Client) SetRequestHeaders(headers map[string]string) {
+	c.reqHeaders, c.hostOverride = nil, ""
+	for name, value := range headers {
+		if strings.EqualFold(name, "Host") {
+			c.hostOverride = value
+			continue
+		}
+		if c.reqHeaders == nil {
+			c.reqHeaders = http.Header{}
+		}
+		c.reqHeaders.Set(name, value)
+	}
+}
+
+// withRequestHeaders returns beReq with the static request headers set, a copy when there are any
+func (c *Client) withRequestHeaders(beReq *http.Request) *http.Request {
+	if c.reqHeaders == nil && c.hostOverride == "" {
+		return beReq
+	}
+	beReq = beReq.Clone(beReq.Context())
+	for name, values := range c.reqHeaders {
+		beReq.Header[name] = values
+	}
+	if c.hostOverride != "" {
+		beReq.Host = c.hostOverride
+	}
+	return beReq
+}
+
+// SetConnectionPool tunes the pool of idle connections kept to the backend: the total, the
+// number per host name and how long an idle connection is kept. 0 keeps the default.
+// Call before the first Fetch.
+func (c *Client) SetConnectionPool(maxIdle, maxIdlePerHost int, idleTimeout time.Duration) {
+	c.transport.MaxIdleConns = cmp.Or(maxIdle, DefaultMaxIdleConns)
+	c.transport.MaxIdleConnsPerHost = cmp.Or(maxIdlePerHost, DefaultMaxIdleConnsPerHost)
+	c.transport.IdleConnTimeout = cmp.Or(idleTimeout, DefaultIdleConnTimeout)
+	c.logger.Info("backend connection pool",
+		"target", fmt.Sprintf("%s:%d", c.target, c.port),
+		"maxIdleConns", c.transport.MaxIdleConns,
+		"maxIdleConnsPerHost", c.transport.MaxIdleConnsPerHost,
+		"idleConnTimeout", c.transport.IdleConnTimeout)
+}
+
+// SetTimeouts sets how long connecting to the backend may take, how long the backend may take
+// to send the response headers once the request is sent, and a limit on the whole exchange,
+// reading the body included. 0 keeps the default for dial and response, and means no limit for
+// total: a large download may take as long as it needs once it has started.
+// Call before the first Fetch.
+func (c *Client) SetTimeouts(dial, response, total time.Duration) {
+	c.dialer.Timeout = cmp.Or(dial, DefaultDialTimeout)
+	c.transport.ResponseHeaderTimeout = cmp.Or(response, DefaultResponseTimeout)
+	c.httpClient.Timeout = total
+	c.logger.Info("backend timeouts",
+		"target", fmt.Sprintf("%s:%d", c.target, c.port),
+		"dialTimeout", c.dialer.Timeout,
+		"responseTimeout", c.transport.ResponseHeaderTimeout,
+		"timeout", total)
+}
+
+// Budget returns how long the backend may take before its response headers arrive: the dial
+// and response timeouts, capped by the total timeout when there is one.
+func (c *Client) Budget() time.Duration {
+	budget := c.dialer.Timeout + c.transport.ResponseHeaderTimeout
+	if c.httpClient.Timeout > 0 {
+		budget = min(budget, c.httpClient.Timeout)
+	}
+	return budget
+}
+
+// SetTLS sets how the backend's certificate is verified. With insecureSkipVerify it isn't
+// verified at all. Otherwise it is verified against rootCAs, or the system roots when nil.
+// Call before the first Fetch.
+func (c *Client) SetTLS(insecureSkipVerify bool, rootCAs *x509.CertPool) {
+	if insecureSkipVerify {
+		c.logger.Warn("TLS certificate verification is DISABLED for this backend, it can be impersonated",
+			"target", fmt.Sprintf("%s:%d", c.target, c.port))
+	}
+	c.insecureTLS, c.rootCAs = insecureSkipVerify, rootCAs
+	c.setTLSConfig()
+}
+
+// SetServerName sets the name sent as SNI in the TLS handshake, and that the backend's
+// certificate is verified against, for origins whose certificate doesn't name the hosts clients
+// ask for. Empty means the host of the request, the default. Call before the first Fetch.
+func (c *Client) SetServerName(name string) {
+	c.serverName = name
+	c.setTLSConfig()
+}
+
+// setTLSConfig builds the transport's TLS configuration from the TLS settings, none when they
+// are all defaults
+func (c *Client) setTLSConfig() {
+	if !c.insecureTLS && c.rootCAs == nil && c.serverName == "" {
+		c.transport.TLSClientConfig = nil
+		return
+	}
+	c.transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: c.insecureTLS,
+		RootCAs:            c.rootCAs,
+		ServerName:         c.serverName,
+	}
+}
+
+// LoadCAFile reads a PEM file with one or more CA certificates into a pool for SetTLS
+func LoadCAFile(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// SetHTTP2 enables or disables HTTP/2 to the backend, it is enabled by default. HTTP/2 is
+// negotiated over TLS, plain http backends always get HTTP/1.1. Call before the first Fetch.
+func (c *Client) SetHTTP2(enabled bool) {
+	// with a custom DialContext the transport only attempts HTTP/2 when forced to
+	c.transport.ForceAttemptHTTP2 = enabled
+}
+
 // GetScheme returns the current scheme
 func (c *Client) GetScheme() string {
 	return c.scheme
 }
 
-// Fetch fetches something from the backend.
-func (c *Client) Fetch(beReq *http.Request) (*http.Response, bool) {
+// Name identifies the origin the backend sends requests to, as scheme://host:port
+func (c *Client) Name() string {
+	return fmt.Sprintf("%s://%s", c.scheme, net.JoinHostPort(c.target, fmt.Sprint(c.port)))
+}
+
+// Fetch fetches something from the backend and decides whether the response may be cached.
+func (c *Client) Fetch(beReq *http.Request) (*http.Response, Cacheability) {
 	// Set the URL scheme if not already set
 	if beReq.URL.Scheme == "" {
 		beReq.URL.Scheme = c.scheme
 	}
 
-	c.logger.Debug("fetching from backend",
+	logger := requestLogger(c.logger, beReq.Context())
+	logger.Debug("fetching from backend",
 		"url", beReq.URL.String(),
 		"host", beReq.Host,
 		"target", fmt.Sprintf("%s:%d", c.target, c.port))
 
-	beResp, err := c.httpClient.Do(beReq)
+	beResp, err := c.httpClient.Do(c.withRequestHeaders(beReq))
 	if err != nil {
-		c.logger.Error("backend request failed, serving nuts",
+		if errors.Is(beReq.Context().Err(), context.Canceled) {
+			// the client went away and canceled the request, the backend isn't to blame
+			c.countRequest(false)
+			logger.Debug("backend request canceled", "error", err, "url", beReq.URL)
+			return nuts(http.StatusBadGateway), uncacheable(UncacheableFetchFailed)
+		}
+		c.countRequest(true)
+		status := failureStatus(err)
+		logger.Error("backend request failed, serving nuts",
 			"error", err,
+			"status", status,
 			"url", beReq.URL,
 			"host", beReq.Host,
 			"target", fmt.Sprintf("%s:%d", c.target, c.port))
-		return nuts(), false
+		return nuts(status), uncacheable(UncacheableFetchFailed)
+	}
+	if proto := beResp.Proto; c.proto.Swap(proto) != proto {
+		c.logger.Info("backend protocol negotiated",
+			"proto", proto,
+			"target", fmt.Sprintf("%s:%d", c.target, c.port))
+	}
+	verdict := c.cacheability(beReq, beResp)
+	if c.maxResponseBytes > 0 {
+		if beResp.ContentLength > c.maxResponseBytes {
+			logger.Warn("backend response exceeds max_response_bytes",
+				"url", beReq.URL,
+				"contentLength", beResp.ContentLength,
+				"max", c.maxResponseBytes,
+				"policy", c.oversizePolicy)
+			if c.oversizePolicy == OversizeAbort {
+				// the backend answered, it isn't a failure of the backend
+				c.countRequest(false)
+				_ = beResp.Body.Close()
+				return nuts(http.StatusBadGateway), uncacheable(UncacheableTooLarge)
+			}
+			verdict = uncacheable(UncacheableTooLarge)
+		}
+		beResp.Body = &limitedBody{
+			rc:     beResp.Body,
+			max:    c.maxResponseBytes,
+			stream: c.oversizePolicy == OversizeStream,
+		}
+	}
+	c.countRequest(false)
+	return beResp, verdict
+}
+
+// cacheability decides whether beResp, the response to beReq, may be cached. The method is
+// checked last: a method policy may cache the method anyway, so UncacheableMethod means the
+// response passed every other check.
+func (c *Client) cacheability(beReq *http.Request, beResp *http.Response) Cacheability {
+	switch {
+	case !c.cacheableStatus[beResp.StatusCode]:
+		return uncacheable(UncacheableStatus)
+	case !c.cacheSetCookie && len(beResp.Header.Values("Set-Cookie")) > 0:
+		return uncacheable(UncacheableSetCookie)
+	case !cacheableMethods[beReq.Method] && beReq.Method != "":
+		return uncacheable(UncacheableMethod)
 	}
-	return beResp, beResp.StatusCode <= 299
+	return Cacheability{Cacheable: true}
+}
+
+// OverflowError is returned when reading a backend body that is larger than the configured limit.
+// When StreamThrough is set the body can still be read to the end, but it must not be cached.
+type OverflowError struct {
+	Limit         int64
+	StreamThrough bool
+}
+
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("backend response exceeds %d bytes", e.Limit)
+}
+
+// limitedBody wraps a response body and reports an OverflowError once the limit has been crossed.
+// With the stream policy the error is reported once and the remaining bytes are passed through,
+// otherwise every read after the limit fails.
+type limitedBody struct {
+	rc     io.ReadCloser
+	max    int64
+	n      int64
+	stream bool
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.n > l.max && !l.stream {
+		return 0, &OverflowError{Limit: l.max}
+	}
+	n, err := l.rc.Read(p)
+	crossed := l.n <= l.max && l.n+int64(n) > l.max
+	l.n += int64(n)
+	if crossed {
+		return n, &OverflowError{Limit: l.max, StreamThrough: l.stream}
+	}
+	return n, err
+}
+
+func (l *limitedBody) Close() error {
+	return l.rc.Close()
 }
 
 // Router manages multiple backend clients based on virtual hosts
@@ -117,6 +490,16 @@ func (r *Router) AddBackend(host string, backend *Client) {
 	r.logger.Info("added backend for host", "host", host, "target", backend.target)
 }
 
+// Replace atomically swaps the default backend and the virtual host backends.
+// Requests already in flight finish on the backend they were routed to.
+func (r *Router) Replace(defaultBackend *Client, backends map[string]*Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.defaultBackend = defaultBackend
+	r.backends = backends
+	r.logger.Info("replaced backends", "default", defaultBackend.target, "virtualHosts", len(backends))
+}
+
 // GetBackend returns the backend for the specified host or the default backend if not found
 func (r *Router) GetBackend(host string) *Client {
 	r.mu.RLock()
@@ -129,28 +512,50 @@ func (r *Router) GetBackend(host string) *Client {
 }
 
 // Fetch routes the request to the appropriate backend based on the Host header
-func (r *Router) Fetch(beReq *http.Request) (*http.Response, bool) {
+func (r *Router) Fetch(beReq *http.Request) (*http.Response, Cacheability) {
 	backend := r.GetBackend(beReq.Host)
-	r.logger.Debug("routing request", "host", beReq.Host, "backend", backend.target)
+	requestLogger(r.logger, beReq.Context()).Debug("routing request", "host", beReq.Host, "backend", backend.target)
 	return backend.Fetch(beReq)
 }
 
 // GetScheme returns the scheme of the default backend
 // This is needed for compatibility with tests that access this method
 func (r *Router) GetScheme() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.defaultBackend.GetScheme()
 }
 
-func nuts() *http.Response {
+// fallbackName is the X-Backend-Name used to mark synthesized fallback responses
+const fallbackName = "nuts"
+
+// IsFallback reports whether the response was synthesized because the backend request failed
+func IsFallback(resp *http.Response) bool {
+	return resp != nil && resp.Header.Get("X-Backend-Name") == fallbackName
+}
+
+// failureStatus classifies a failed backend request: 504 Gateway Timeout when the backend was
+// too slow, whether connecting or answering, and 502 Bad Gateway when it couldn't be reached at
+// all, such as a failed DNS lookup or a refused connection.
+func failureStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// nuts returns the fallback response for a failed backend request with status
+func nuts(status int) *http.Response {
 	header := http.Header{}
 	header.Add("Content-Type", "text/html")
-	header.Add("X-Backend-Name", "nuts")
+	header.Add("X-Backend-Name", fallbackName)
 
 	bodyBytes := []byte("<html><body><h1>I have a confuse</h1></body></html>")
 	body := io.NopCloser(bytes.NewBuffer(bodyBytes))
 
 	return &http.Response{
-		StatusCode: http.StatusInternalServerError,
+		StatusCode: status,
 		Header:     header,
 		Body:       body,
 	}
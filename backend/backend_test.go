@@ -1,14 +1,26 @@
 package backend
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/perbu/hazelnut/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestBackendRequest(t *testing.T) {
@@ -50,8 +62,8 @@ func TestBackendRequest(t *testing.T) {
 		req.Header.Set("X-Custom-Header", "test-value")
 
 		// Make the request through the backend
-		resp, ok := b.Fetch(req)
-		if !ok {
+		resp, verdict := b.Fetch(req)
+		if !verdict.Cacheable {
 			t.Fatalf("Backend request failed, unexpected failure")
 		}
 		defer resp.Body.Close()
@@ -93,9 +105,9 @@ func TestBackendRequest(t *testing.T) {
 		}
 
 		// Make the request through the backend
-		resp, ok := badBackend.Fetch(req)
-		if ok {
-			t.Errorf("Expected failed backend request (ok=false), got success")
+		resp, verdict := badBackend.Fetch(req)
+		if verdict.Cacheable || verdict.Reason != UncacheableFetchFailed {
+			t.Errorf("Expected failed backend request to be uncacheable, got %+v", verdict)
 		}
 		defer resp.Body.Close()
 
@@ -110,3 +122,475 @@ func TestBackendRequest(t *testing.T) {
 		}
 	})
 }
+
+func TestBackendMetrics(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.NewWithRegistry(prometheus.NewRegistry())
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			w.Header().Set("Content-Length", "100")
+			fmt.Fprint(w, strings.Repeat("x", 100))
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer origin.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	newClient := func(url string) *Client {
+		hostParts := strings.Split(strings.TrimPrefix(url, "http://"), ":")
+		port := 80
+		fmt.Sscanf(hostParts[1], "%d", &port)
+		b := New(logger, hostParts[0], port)
+		b.SetScheme("http")
+		b.SetMetrics(m)
+		b.SetMaxResponseBytes(10, OversizeAbort)
+		return b
+	}
+	up, down := newClient(origin.URL), newClient(closed.URL)
+	for _, path := range []string{"/", "/", "/large"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		resp, _ := up.Fetch(req)
+		resp.Body.Close()
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	resp, _ := down.Fetch(req)
+	resp.Body.Close()
+
+	tests := []struct {
+		backend            string
+		requests, failures float64
+	}{
+		{up.Name(), 3, 0}, // an oversize response is refused, the backend didn't fail
+		{down.Name(), 1, 1},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(m.BackendRequests.WithLabelValues(tt.backend)); got != tt.requests {
+			t.Errorf("Expected %v requests to %s, got %v", tt.requests, tt.backend, got)
+		}
+		if got := testutil.ToFloat64(m.BackendFailures.WithLabelValues(tt.backend)); got != tt.failures {
+			t.Errorf("Expected %v failures of %s, got %v", tt.failures, tt.backend, got)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	var trace []string
+	traced := func(name string) FetchMiddleware {
+		return func(next Fetcher) Fetcher {
+			return FetcherFunc(func(req *http.Request) (*http.Response, Cacheability) {
+				trace = append(trace, name+">")
+				resp, verdict := next.Fetch(req)
+				trace = append(trace, "<"+name)
+				return resp, verdict
+			})
+		}
+	}
+	var seen http.Header
+	base := FetcherFunc(func(req *http.Request) (*http.Response, Cacheability) {
+		trace = append(trace, "fetch")
+		seen = req.Header
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, Cacheability{Cacheable: true}
+	})
+	var logs strings.Builder
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	f := Chain(base, traced("a"), InjectHeaders(http.Header{"x-token": {"secret"}}), LogRequests(logger), traced("b"))
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/path", nil)
+	resp, verdict := f.Fetch(req)
+	if resp.StatusCode != http.StatusOK || !verdict.Cacheable {
+		t.Fatalf("Expected the base response, got %d %+v", resp.StatusCode, verdict)
+	}
+	if got := strings.Join(trace, " "); got != "a> b> fetch <b <a" {
+		t.Errorf("Expected the first middleware outermost, got %s", got)
+	}
+	if seen.Get("X-Token") != "secret" || req.Header.Get("X-Token") != "" {
+		t.Errorf("Expected the header on a copy of the request, fetched %v, original %v", seen, req.Header)
+	}
+	if !strings.Contains(logs.String(), "backend fetch") || !strings.Contains(logs.String(), "path=/path status=200") {
+		t.Errorf("Expected the fetch to be logged, got %q", logs.String())
+	}
+
+	if _, ok := Chain(base, traced("a")).(Upgrader); ok {
+		t.Error("Expected no upgrades from a chain around a Fetcher that can't upgrade")
+	}
+	client := New(logger, "localhost", 80)
+	if _, ok := Chain(client, traced("a")).(Upgrader); !ok {
+		t.Error("Expected a chain around a Client to upgrade")
+	}
+	if Chain(client) != Fetcher(client) {
+		t.Error("Expected an empty chain to return the Fetcher itself")
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var got *http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	hostParts := strings.Split(strings.TrimPrefix(ts.URL, "http://"), ":")
+	port := 80
+	fmt.Sscanf(hostParts[1], "%d", &port)
+	b := New(logger, hostParts[0], port)
+	b.SetScheme("http")
+	b.SetRequestHeaders(map[string]string{"X-Api-Key": "secret", "user-agent": "hazelnut", "Host": "origin.internal"})
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("User-Agent", "curl")
+	resp, verdict := b.Fetch(req)
+	defer resp.Body.Close()
+	if !verdict.Cacheable {
+		t.Fatalf("Expected a cacheable response, got %+v", verdict)
+	}
+	if got.Header.Get("X-Api-Key") != "secret" || got.Header.Get("User-Agent") != "hazelnut" || got.Host != "origin.internal" {
+		t.Errorf("Expected the configured headers at the backend, got %v host %q", got.Header, got.Host)
+	}
+	if req.Header.Get("X-Api-Key") != "" || req.Header.Get("User-Agent") != "curl" || req.Host != "example.com" {
+		t.Errorf("Expected the caller's request untouched, got %v host %q", req.Header, req.Host)
+	}
+	if resp.Header.Get("X-Api-Key") != "" {
+		t.Error("Expected the request headers not to reach the response")
+	}
+}
+
+func TestFailureStatus(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		origin  string
+		timeout time.Duration
+		status  int
+	}{
+		{"timeout", slow.URL, 50 * time.Millisecond, http.StatusGatewayTimeout},
+		{"connection refused", closed.URL, time.Second, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostParts := strings.Split(strings.TrimPrefix(tt.origin, "http://"), ":")
+			port := 80
+			fmt.Sscanf(hostParts[1], "%d", &port)
+			b := New(logger, hostParts[0], port)
+			b.SetScheme("http")
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/", nil)
+			resp, verdict := b.Fetch(req)
+			defer resp.Body.Close()
+			if verdict.Reason != UncacheableFetchFailed || !IsFallback(resp) {
+				t.Fatalf("Expected a fallback response, got %+v", verdict)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// answers after a delay given in the query, the body follows the headers after another
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers, _ := time.ParseDuration(r.URL.Query().Get("headers"))
+		body, _ := time.ParseDuration(r.URL.Query().Get("body"))
+		time.Sleep(headers)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(body)
+		fmt.Fprint(w, "finally")
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		name              string
+		slowConnect       bool
+		dial, resp, total time.Duration
+		query             string
+		status            int
+	}{
+		{"slow to connect", true, 50 * time.Millisecond, time.Second, 0, "", http.StatusGatewayTimeout},
+		{"slow to respond", false, time.Second, 50 * time.Millisecond, 0, "headers=500ms", http.StatusGatewayTimeout},
+		{"slow body without a total limit", false, 50 * time.Millisecond, 50 * time.Millisecond, 0, "body=200ms", http.StatusOK},
+		{"slow body over the total limit", false, time.Second, time.Second, 100 * time.Millisecond, "body=500ms", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostParts := strings.Split(strings.TrimPrefix(origin.URL, "http://"), ":")
+			port := 80
+			fmt.Sscanf(hostParts[1], "%d", &port)
+			b := New(logger, hostParts[0], port)
+			b.SetScheme("http")
+			b.SetTimeouts(tt.dial, tt.resp, tt.total)
+			if tt.slowConnect {
+				// stalls every connection attempt until the dial times out
+				b.dialer.ControlContext = func(ctx context.Context, _, _ string, _ syscall.RawConn) error {
+					<-ctx.Done()
+					return ctx.Err()
+				}
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/?"+tt.query, nil)
+			t0 := time.Now()
+			resp, _ := b.Fetch(req)
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+			body, err := io.ReadAll(resp.Body)
+			switch {
+			case tt.status != http.StatusOK:
+				if elapsed := time.Since(t0); elapsed > 400*time.Millisecond {
+					t.Errorf("Expected the timeout to fail the fetch early, took %v", elapsed)
+				}
+			case tt.total > 0:
+				if err == nil {
+					t.Errorf("Expected the total limit to cut the body off, got %q", body)
+				}
+			default:
+				if err != nil || string(body) != "finally" {
+					t.Errorf("Expected the whole body, got %q (%v)", body, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheability(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("cookie") {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		}
+		var status int
+		fmt.Sscanf(r.URL.Query().Get("status"), "%d", &status)
+		if status != 0 {
+			w.WriteHeader(status)
+		}
+	}))
+	defer ts.Close()
+
+	hostParts := strings.Split(strings.TrimPrefix(ts.URL, "http://"), ":")
+	port := 80
+	fmt.Sscanf(hostParts[1], "%d", &port)
+
+	tests := []struct {
+		name      string
+		method    string
+		query     string
+		setCookie bool
+		want      Cacheability
+	}{
+		{"plain GET", http.MethodGet, "", false, Cacheability{Cacheable: true}},
+		{"permanent redirect", http.MethodGet, "status=301", false, Cacheability{Cacheable: true}},
+		{"POST", http.MethodPost, "", false, Cacheability{Reason: UncacheableMethod}},
+		{"PATCH", http.MethodPatch, "", false, Cacheability{Reason: UncacheableMethod}},
+		{"DELETE", http.MethodDelete, "", false, Cacheability{Reason: UncacheableMethod}},
+		{"OPTIONS", http.MethodOptions, "", false, Cacheability{Reason: UncacheableMethod}},
+		{"HEAD", http.MethodHead, "", false, Cacheability{Cacheable: true}},
+		{"POST server error", http.MethodPost, "status=500", false, Cacheability{Reason: UncacheableStatus}},
+		{"POST Set-Cookie", http.MethodPost, "cookie", false, Cacheability{Reason: UncacheableSetCookie}},
+		{"server error", http.MethodGet, "status=500", false, Cacheability{Reason: UncacheableStatus}},
+		{"not found", http.MethodGet, "status=404", false, Cacheability{Cacheable: true}},
+		{"gone", http.MethodGet, "status=410", false, Cacheability{Cacheable: true}},
+		{"permanent redirect keeping the method", http.MethodGet, "status=308", false, Cacheability{Reason: UncacheableStatus}},
+		{"temporary redirect", http.MethodGet, "status=302", false, Cacheability{Reason: UncacheableStatus}},
+		{"partial content", http.MethodGet, "status=206", false, Cacheability{Reason: UncacheableStatus}},
+		{"Set-Cookie", http.MethodGet, "cookie", false, Cacheability{Reason: UncacheableSetCookie}},
+		{"Set-Cookie allowed", http.MethodGet, "cookie", true, Cacheability{Cacheable: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New(logger, hostParts[0], port)
+			b.SetScheme("http")
+			b.SetCacheSetCookie(tt.setCookie)
+			req := httptest.NewRequest(tt.method, "http://example.com/?"+tt.query, nil)
+			req.RequestURI = ""
+			resp, got := b.Fetch(req)
+			defer resp.Body.Close()
+			if got != tt.want {
+				t.Errorf("Fetch() verdict = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Cacheable status set", func(t *testing.T) {
+		b := New(logger, hostParts[0], port)
+		b.SetScheme("http")
+		b.SetCacheableStatus([]int{http.StatusOK, http.StatusNotFound, http.StatusGone})
+		for query, want := range map[string]Cacheability{
+			"status=200": {Cacheable: true},
+			"status=404": {Cacheable: true},
+			"status=410": {Cacheable: true},
+			"status=301": {Reason: UncacheableStatus},
+		} {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/?"+query, nil)
+			req.RequestURI = ""
+			resp, got := b.Fetch(req)
+			resp.Body.Close()
+			if got != want {
+				t.Errorf("%s: Fetch() verdict = %+v, want %+v", query, got, want)
+			}
+		}
+
+		b.SetCacheableStatus(nil)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/?status=301", nil)
+		req.RequestURI = ""
+		resp, got := b.Fetch(req)
+		resp.Body.Close()
+		if !got.Cacheable {
+			t.Errorf("Expected the default set back, got %+v", got)
+		}
+	})
+}
+
+func TestHTTP2(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	hostParts := strings.Split(strings.TrimPrefix(ts.URL, "https://"), ":")
+	port := 443
+	fmt.Sscanf(hostParts[1], "%d", &port)
+
+	tests := []struct {
+		name    string
+		enabled bool
+		want    int
+	}{
+		{"Enabled", true, 2},
+		{"Disabled", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New(logger, hostParts[0], port)
+			// trust the test server's certificate
+			b.transport.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+			b.SetHTTP2(tt.enabled)
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.RequestURI = ""
+			resp, _ := b.Fetch(req)
+			defer resp.Body.Close()
+			if resp.ProtoMajor != tt.want {
+				t.Errorf("Expected HTTP/%d, got %s", tt.want, resp.Proto)
+			}
+		})
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	b := New(logger, "localhost", 80)
+	if b.transport.MaxIdleConnsPerHost != DefaultMaxIdleConnsPerHost {
+		t.Errorf("Expected %d idle connections per host by default, got %d", DefaultMaxIdleConnsPerHost, b.transport.MaxIdleConnsPerHost)
+	}
+	b.SetConnectionPool(50, 0, time.Minute)
+	if b.transport.MaxIdleConns != 50 || b.transport.MaxIdleConnsPerHost != DefaultMaxIdleConnsPerHost || b.transport.IdleConnTimeout != time.Minute {
+		t.Errorf("Expected 50, %d, 1m, got %d, %d, %v", DefaultMaxIdleConnsPerHost,
+			b.transport.MaxIdleConns, b.transport.MaxIdleConnsPerHost, b.transport.IdleConnTimeout)
+	}
+}
+
+func TestTLSVerification(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secret origin")
+	}))
+	defer ts.Close()
+
+	hostParts := strings.Split(strings.TrimPrefix(ts.URL, "https://"), ":")
+	port := 443
+	fmt.Sscanf(hostParts[1], "%d", &port)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, pemBytes, 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	pool, err := LoadCAFile(caFile)
+	if err != nil {
+		t.Fatalf("LoadCAFile failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		insecure bool
+		rootCAs  *x509.CertPool
+		ok       bool
+	}{
+		{"System roots reject the test CA", false, nil, false},
+		{"Custom CA", false, pool, true},
+		{"Verification disabled", true, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New(logger, hostParts[0], port)
+			b.SetTLS(tt.insecure, tt.rootCAs)
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.RequestURI = ""
+			resp, verdict := b.Fetch(req)
+			defer resp.Body.Close()
+			if ok := verdict.Reason != UncacheableFetchFailed; ok != tt.ok {
+				t.Errorf("Expected the fetch to succeed: %v, got verdict %+v", tt.ok, verdict)
+			}
+		})
+	}
+
+	t.Run("Server name", func(t *testing.T) {
+		// the test certificate is issued for example.com, not for the address dialed
+		var sni string
+		ts.TLS.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, nil
+		}
+		defer func() { ts.TLS.GetConfigForClient = nil }()
+		b := New(logger, hostParts[0], port)
+		b.SetTLS(false, pool)
+		b.SetServerName("example.com")
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req.RequestURI = ""
+		resp, verdict := b.Fetch(req)
+		defer resp.Body.Close()
+		if verdict.Reason == UncacheableFetchFailed {
+			t.Errorf("Expected the certificate to verify for the server name, got verdict %+v", verdict)
+		}
+		if sni != "example.com" {
+			t.Errorf("Expected SNI example.com, got %q", sni)
+		}
+	})
+
+	t.Run("CA file without certificates", func(t *testing.T) {
+		empty := filepath.Join(t.TempDir(), "empty.pem")
+		if err := os.WriteFile(empty, []byte("nothing here"), 0o600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		if _, err := LoadCAFile(empty); err == nil {
+			t.Error("Expected an error for a file without certificates")
+		}
+	})
+}
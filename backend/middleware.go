@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// FetchMiddleware decorates a Fetcher, to change requests before they are fetched, responses
+// before they are cached, or to answer without the backend at all
+type FetchMiddleware func(Fetcher) Fetcher
+
+// FetcherFunc lets an ordinary function serve as a Fetcher
+type FetcherFunc func(req *http.Request) (*http.Response, Cacheability)
+
+// Fetch calls f(req)
+func (f FetcherFunc) Fetch(req *http.Request) (*http.Response, Cacheability) {
+	return f(req)
+}
+
+// Chain wraps f in the middlewares. The first one is the outermost: it sees each request first
+// and each response last. When f can upgrade connections the chain can too, but upgrades go
+// straight to f: a switched connection has no response for the middlewares to act on.
+func Chain(f Fetcher, middlewares ...FetchMiddleware) Fetcher {
+	if len(middlewares) == 0 {
+		return f
+	}
+	chained := f
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		chained = middlewares[i](chained)
+	}
+	if upgrader, ok := f.(Upgrader); ok {
+		return upgradingChain{Fetcher: chained, Upgrader: upgrader}
+	}
+	return chained
+}
+
+// upgradingChain is a chain of middlewares around a Fetcher that can also upgrade connections
+type upgradingChain struct {
+	Fetcher
+	Upgrader
+}
+
+// LogRequests logs every fetch with its status, whether it may be cached and how long it took
+func LogRequests(logger *slog.Logger) FetchMiddleware {
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(req *http.Request) (*http.Response, Cacheability) {
+			t0 := time.Now()
+			resp, verdict := next.Fetch(req)
+			requestLogger(logger, req.Context()).Info("backend fetch",
+				"method", req.Method,
+				"host", req.Host,
+				"path", req.URL.Path,
+				"status", resp.StatusCode,
+				"cacheable", verdict.Cacheable,
+				"reason", verdict.Reason,
+				"duration", time.Since(t0))
+			return resp, verdict
+		})
+	}
+}
+
+// InjectHeaders sets headers on every request, replacing any the client sent, such as the
+// credentials of an origin that requires them. They are set on a copy of the request.
+func InjectHeaders(headers http.Header) FetchMiddleware {
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(req *http.Request) (*http.Response, Cacheability) {
+			req = req.Clone(req.Context())
+			for name, values := range headers {
+				req.Header[http.CanonicalHeaderKey(name)] = values
+			}
+			return next.Fetch(req)
+		})
+	}
+}
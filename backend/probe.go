@@ -0,0 +1,58 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+)
+
+// BackendState is the outcome of probing a backend
+type BackendState struct {
+	Host      string `json:"host,omitempty"` // virtual host, empty for the default backend
+	Target    string `json:"target"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Probe checks the backend is reachable by opening, and closing, a TCP connection to it
+func (c *Client) Probe(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(c.target, fmt.Sprint(c.port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Probe probes the default backend and the virtual host backends at the same time. The default
+// backend comes first, followed by the virtual hosts in name order.
+func (r *Router) Probe(ctx context.Context) []BackendState {
+	r.mu.RLock()
+	hosts := slices.Sorted(maps.Keys(r.backends))
+	clients := []*Client{r.defaultBackend}
+	for _, host := range hosts {
+		clients = append(clients, r.backends[host])
+	}
+	r.mu.RUnlock()
+
+	states := make([]BackendState, len(clients))
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		states[i] = BackendState{Target: c.target}
+		if i > 0 {
+			states[i].Host = hosts[i-1]
+		}
+		wg.Go(func() {
+			if err := c.Probe(ctx); err != nil {
+				states[i].Error = err.Error()
+				return
+			}
+			states[i].Reachable = true
+		})
+	}
+	wg.Wait()
+	return states
+}
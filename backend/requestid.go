@@ -0,0 +1,32 @@
+package backend
+
+import (
+	"context"
+	"log/slog"
+)
+
+// RequestIDHeader carries the ID of a request from the client through hazelnut to the backend
+const RequestIDHeader = "X-Request-Id"
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID id. The backend adds it to the
+// log lines of requests with this context.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, empty if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns logger with the request ID carried by ctx, if any
+func requestLogger(logger *slog.Logger, ctx context.Context) *slog.Logger {
+	if id := RequestID(ctx); id != "" {
+		return logger.With("request_id", id)
+	}
+	return logger
+}
@@ -0,0 +1,49 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Upgrader is implemented by fetchers that can pass a connection upgrade, like a WebSocket
+// handshake, through to the backend. Both Client and Router implement it.
+type Upgrader interface {
+	Upgrade(beReq *http.Request) *http.Response
+}
+
+// Upgrade sends a request asking to switch protocols to the backend. When the backend agrees
+// with a 101 Switching Protocols, the body of the response is the connection to the backend,
+// an io.ReadWriteCloser. The client timeout and the response size limit don't apply, they
+// would cut the upgraded connection short. When the backend can't be reached the fallback
+// response is returned, like Fetch does.
+func (c *Client) Upgrade(beReq *http.Request) *http.Response {
+	if beReq.URL.Scheme == "" {
+		beReq.URL.Scheme = c.scheme
+	}
+	logger := requestLogger(c.logger, beReq.Context())
+	logger.Debug("upgrading backend connection",
+		"url", beReq.URL.String(),
+		"upgrade", beReq.Header.Get("Upgrade"),
+		"target", fmt.Sprintf("%s:%d", c.target, c.port))
+
+	// the transport sends requests with an Upgrade header over HTTP/1.1, even to HTTP/2 backends
+	beResp, err := c.transport.RoundTrip(c.withRequestHeaders(beReq))
+	c.countRequest(err != nil)
+	if err != nil {
+		status := failureStatus(err)
+		logger.Error("backend upgrade failed, serving nuts",
+			"error", err,
+			"status", status,
+			"url", beReq.URL,
+			"target", fmt.Sprintf("%s:%d", c.target, c.port))
+		return nuts(status)
+	}
+	return beResp
+}
+
+// Upgrade routes the upgrade request to the appropriate backend based on the Host header
+func (r *Router) Upgrade(beReq *http.Request) *http.Response {
+	backend := r.GetBackend(beReq.Host)
+	requestLogger(r.logger, beReq.Context()).Debug("routing upgrade", "host", beReq.Host, "backend", backend.target)
+	return backend.Upgrade(beReq)
+}
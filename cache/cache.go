@@ -2,30 +2,248 @@ package cache
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
 )
 
 type ObjCore struct {
+	Status  int // HTTP status code, 0 means 200
 	Headers http.Header
 	Body    []byte
+	// Fingerprint identifies the request that filled the object, it is only set in key integrity mode
+	Fingerprint string
+	// Hits is how often the object has been found in the cache, this lookup included. It is set by Get.
+	Hits uint64
+	// BodyFile is the file holding the body, set instead of Body by caches that keep bodies on disk
+	BodyFile string
+	// Host and URL are the host and the request URI, path and query, of the request that filled
+	// the object. Bans match against them.
+	Host string
+	URL  string
+	// FetchLatency is how long the backend took to send the response headers, and OriginSize the
+	// length of the body as the backend sent it, before it was decoded for storing
+	FetchLatency time.Duration
+	OriginSize   int64
+	// Immutable objects are served to clients asking for a fresh copy too, NoTransform ones are
+	// served as they are, never compressed or run through ESI
+	Immutable   bool
+	NoTransform bool
 }
 
 // type Key string
 
-// MakeKey takes a http.Request and a flag indicating whether to ignore the host,
-// and returns a 32 byte sha256 hash of the request.
-func MakeKey(r *http.Request, ignoreHost bool) string {
+// Stats is a snapshot of the cache contents and its hit ratio
+type Stats struct {
+	Objects  int64   `json:"objects"`   // objects currently stored
+	Bytes    int64   `json:"bytes"`     // cost currently accounted against the cache size
+	Hits     uint64  `json:"hits"`      // lookups that found an object
+	Misses   uint64  `json:"misses"`    // lookups that didn't
+	HitRatio float64 `json:"hit_ratio"` // hits / (hits + misses), 0 before the first lookup
+}
+
+// EvictFunc is called when an object leaves the cache because it was evicted
+// to make room or because it expired. size is the length of the body.
+type EvictFunc func(key string, size int64)
+
+// Query modes for the cache key
+const (
+	QueryFull     = "full"     // all parameters, sorted by name, except the ignored ones
+	QueryIgnore   = "ignore"   // the query string is not part of the key
+	QuerySelected = "selected" // only the listed parameters
+)
+
+// QueryPolicy decides how the query string goes into the cache key
+type QueryPolicy struct {
+	Mode   string   // QueryFull (the default when empty), QueryIgnore or QuerySelected
+	Params []string // QuerySelected: the parameters to include
+	Ignore []string // QueryFull: parameters to leave out, a trailing * matches a prefix (utm_*)
+}
+
+// Normalize returns the query string of u as it goes into the cache key.
+// Parameters are sorted by name so their order in the request doesn't matter; the order of
+// repeated values is kept since it may be meaningful. A query that can't be parsed is used verbatim.
+func (p QueryPolicy) Normalize(u *url.URL) string {
+	if p.Mode == QueryIgnore || u.RawQuery == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return u.RawQuery
+	}
+	for name := range values {
+		switch p.Mode {
+		case QuerySelected:
+			if !slices.Contains(p.Params, name) {
+				delete(values, name)
+			}
+		default:
+			if matchesAny(p.Ignore, name) {
+				delete(values, name)
+			}
+		}
+	}
+	// Encode sorts by name
+	return values.Encode()
+}
+
+// PathPolicy decides how the request path is canonicalized before it goes into the cache key
+type PathPolicy struct {
+	Lowercase bool // fold the path to lower case
+	Clean     bool // merge repeated slashes and resolve "." and ".." segments
+}
+
+// Canonical returns the canonical form of urlPath. A trailing slash is kept, "/a/" and "/a" may
+// well be different resources.
+func (p PathPolicy) Canonical(urlPath string) string {
+	if p.Clean {
+		trailing := strings.HasSuffix(urlPath, "/")
+		urlPath = path.Clean("/" + urlPath)
+		if trailing && urlPath != "/" {
+			urlPath += "/"
+		}
+	}
+	if p.Lowercase {
+		urlPath = strings.ToLower(urlPath)
+	}
+	return urlPath
+}
+
+// matchesAny reports whether name matches one of the patterns, a trailing * matches a prefix
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyPolicy decides which parts of a request make up its cache key. The zero value keys on the
+// method, the host, the path and the whole query string.
+type KeyPolicy struct {
+	IgnoreHost   bool        // leave out the host, all hosts share objects
+	IgnorePath   bool        // leave out the path, all paths share objects
+	IgnoreMethod bool        // leave out the method, cached methods like POST share objects with GET
+	Query        QueryPolicy // how the query string goes in
+	Headers      []string    // request headers whose values are folded in
+}
+
+// Key returns a 32 byte sha256 hash of the parts of r the policy keys on.
+// Variants, such as a client's country, are folded into the key so each variant gets its own entry.
+func (p KeyPolicy) Key(r *http.Request, variants ...string) string {
+	c := p.Components(r, variants...)
 	sh := sha256.New()
-	// Only include the host in the key if we're not ignoring it
-	if !ignoreHost {
-		_, _ = sh.Write([]byte(r.Host))
-	}
-
-	// Always include the path in the key
-	_, _ = sh.Write([]byte(r.URL.Path))
-	// Always include the parameters too
-	_, _ = sh.Write([]byte(r.URL.RawQuery))
-	sum := sh.Sum(nil)
-	// Return the key as a string
-	return string(sum)
+	// every part is separated, so POST for host "x" and GET for host "POSTx" differ
+	_, _ = sh.Write([]byte(c.Method))
+	_, _ = sh.Write([]byte{0})
+	_, _ = sh.Write([]byte(c.Host))
+	_, _ = sh.Write([]byte{0})
+	_, _ = sh.Write([]byte(c.Path))
+	// Include the normalized parameters, separated so "/a?b" and "/ab?" differ
+	_, _ = sh.Write([]byte{'?'})
+	_, _ = sh.Write([]byte(c.Query))
+	write := func(v string) {
+		_, _ = sh.Write([]byte{0})
+		_, _ = sh.Write([]byte(v))
+	}
+	for _, h := range c.Headers {
+		write("header:" + h)
+	}
+	for _, v := range c.Variants {
+		write(v)
+	}
+	return string(sh.Sum(nil))
+}
+
+// KeyComponents are the parts of a request that went into its key, as Key hashes them. Parts the
+// policy leaves out are empty, and so is the method of GET and HEAD, which share their objects.
+type KeyComponents struct {
+	Method   string
+	Host     string
+	Path     string
+	Query    string   // normalized
+	Headers  []string // name=values
+	Variants []string
+}
+
+// Components returns the parts of r the policy keys on, readable, to tell why two requests do
+// or don't share an object
+func (p KeyPolicy) Components(r *http.Request, variants ...string) KeyComponents {
+	var c KeyComponents
+	// GET and HEAD share an entry, other cached methods get their own
+	if !p.IgnoreMethod && r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != "" {
+		c.Method = r.Method
+	}
+	if !p.IgnoreHost {
+		c.Host = r.Host
+	}
+	if !p.IgnorePath {
+		c.Path = r.URL.Path
+	}
+	c.Query = p.Query.Normalize(r.URL)
+	for _, name := range p.Headers {
+		c.Headers = append(c.Headers, http.CanonicalHeaderKey(name)+"="+strings.Join(r.Header.Values(name), ","))
+	}
+	c.Variants = variants
+	return c
+}
+
+// LogValue logs the components as a group, leaving out the empty ones
+func (c KeyComponents) LogValue() slog.Value {
+	var attrs []slog.Attr
+	for _, a := range []struct {
+		name  string
+		value string
+	}{{"method", c.Method}, {"host", c.Host}, {"path", c.Path}, {"query", c.Query}} {
+		if a.value != "" {
+			attrs = append(attrs, slog.String(a.name, a.value))
+		}
+	}
+	for _, a := range []struct {
+		name   string
+		values []string
+	}{{"headers", c.Headers}, {"variants", c.Variants}} {
+		if len(a.values) > 0 {
+			attrs = append(attrs, slog.Any(a.name, a.values))
+		}
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Fingerprint returns a short digest of the request as the cache key should see it: the method,
+// with HEAD counted as GET, and the host, the path and the normalized query unless the policy
+// leaves them out. It is computed independently of Key, so two requests with the same key but
+// different fingerprints point at a keying bug. Headers, cookies and variants are left out, they
+// don't change the resource.
+func (p KeyPolicy) Fingerprint(r *http.Request) string {
+	method := r.Method
+	if method == http.MethodHead || method == "" || p.IgnoreMethod {
+		method = http.MethodGet
+	}
+	host, urlPath := r.Host, r.URL.Path
+	if p.IgnoreHost {
+		host = ""
+	}
+	if p.IgnorePath {
+		urlPath = ""
+	}
+	sum := sha256.Sum256([]byte(method + " " + host + urlPath + "?" + p.Query.Normalize(r.URL)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// MakeKey takes a http.Request, a flag indicating whether to ignore the host and the policy
+// for the query string, and returns a 32 byte sha256 hash of the request.
+// It is the key of a KeyPolicy with only these two set.
+func MakeKey(r *http.Request, ignoreHost bool, query QueryPolicy, variants ...string) string {
+	return KeyPolicy{IgnoreHost: ignoreHost, Query: query}.Key(r, variants...)
 }
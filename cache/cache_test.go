@@ -0,0 +1,312 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestQueryPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy QueryPolicy
+		a, b   string
+		same   bool
+	}{
+		{"different values differ", QueryPolicy{}, "/search?q=a", "/search?q=b", false},
+		{"parameter order doesn't matter", QueryPolicy{}, "/search?q=a&page=2", "/search?page=2&q=a", true},
+		{"repeated value order matters", QueryPolicy{}, "/search?t=a&t=b", "/search?t=b&t=a", false},
+		{"query and path don't blur", QueryPolicy{}, "/a?b", "/ab", false},
+		{"ignored prefix", QueryPolicy{Ignore: []string{"utm_*"}}, "/p?id=1&utm_source=x", "/p?id=1&utm_medium=y", true},
+		{"ignored exact", QueryPolicy{Ignore: []string{"fbclid"}}, "/p?id=1&fbclid=z", "/p?id=1", true},
+		{"ignore mode", QueryPolicy{Mode: QueryIgnore}, "/p?id=1", "/p?id=2", true},
+		{"selected mode keeps listed", QueryPolicy{Mode: QuerySelected, Params: []string{"id"}}, "/p?id=1", "/p?id=2", false},
+		{"selected mode drops others", QueryPolicy{Mode: QuerySelected, Params: []string{"id"}}, "/p?id=1&sort=asc", "/p?sort=desc&id=1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ka := MakeKey(httptest.NewRequest("GET", "http://example.com"+tt.a, nil), false, tt.policy)
+			kb := MakeKey(httptest.NewRequest("GET", "http://example.com"+tt.b, nil), false, tt.policy)
+			if (ka == kb) != tt.same {
+				t.Errorf("%s vs %s: same key = %v, want %v", tt.a, tt.b, ka == kb, tt.same)
+			}
+		})
+	}
+}
+
+func TestPathPolicy(t *testing.T) {
+	tests := []struct {
+		policy PathPolicy
+		in     string
+		want   string
+	}{
+		{PathPolicy{}, "/A//b/../c", "/A//b/../c"},
+		{PathPolicy{Lowercase: true}, "/Docs/Intro", "/docs/intro"},
+		{PathPolicy{Clean: true}, "/a//b/./c/../d", "/a/b/d"},
+		{PathPolicy{Clean: true}, "/a//b/", "/a/b/"},
+		{PathPolicy{Clean: true}, "/../..", "/"},
+		{PathPolicy{Clean: true}, "", "/"},
+		{PathPolicy{Lowercase: true, Clean: true}, "/Docs//Intro/./", "/docs/intro/"},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Canonical(tt.in); got != tt.want {
+			t.Errorf("%+v.Canonical(%q) = %q, want %q", tt.policy, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFreshnessFor(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		ttl       time.Duration
+		cacheable bool
+	}{
+		{"no headers", nil, DefaultTTL, true},
+		{"max-age", map[string]string{"Cache-Control": "public, max-age=60"}, time.Minute, true},
+		{"s-maxage wins", map[string]string{"Cache-Control": "max-age=60, s-maxage=120"}, 2 * time.Minute, true},
+		{"max-age zero", map[string]string{"Cache-Control": "max-age=0"}, 0, false},
+		{"no-store", map[string]string{"Cache-Control": "no-store, max-age=60"}, 0, false},
+		{"private", map[string]string{"Cache-Control": "private"}, 0, false},
+		{"no-cache", map[string]string{"Cache-Control": "no-cache"}, 0, false},
+		{"bad max-age", map[string]string{"Cache-Control": "max-age=soon"}, DefaultTTL, true},
+		{"expires in the past", map[string]string{"Expires": now.Add(-time.Hour).UTC().Format(http.TimeFormat)}, 0, false},
+		{"invalid expires", map[string]string{"Expires": "0"}, 0, false},
+		{"max-age beats expires", map[string]string{"Cache-Control": "max-age=60", "Expires": "0"}, time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := make(http.Header)
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			ttl, cacheable := FreshnessFor(h)
+			if ttl != tt.ttl || cacheable != tt.cacheable {
+				t.Errorf("FreshnessFor() = %v, %v, want %v, %v", ttl, cacheable, tt.ttl, tt.cacheable)
+			}
+		})
+	}
+
+	t.Run("expires against a skewed date", func(t *testing.T) {
+		// the origin's clock is a day behind: by ours the response expired long ago
+		date := now.Add(-24 * time.Hour).UTC()
+		h := make(http.Header)
+		h.Set("Date", date.Format(http.TimeFormat))
+		h.Set("Expires", date.Add(time.Hour).Format(http.TimeFormat))
+		h.Set("Age", "600")
+		if ttl, cacheable := FreshnessFor(h); ttl != 50*time.Minute || !cacheable {
+			t.Errorf("FreshnessFor() = %v, %v, want %v, true", ttl, cacheable, 50*time.Minute)
+		}
+		// and a day ahead: by ours the response would be fresh for a day too long
+		date = now.Add(24 * time.Hour).UTC()
+		h.Set("Date", date.Format(http.TimeFormat))
+		h.Set("Expires", date.Add(time.Hour).Format(http.TimeFormat))
+		h.Del("Age")
+		if ttl, cacheable := FreshnessFor(h); ttl != time.Hour || !cacheable {
+			t.Errorf("FreshnessFor() = %v, %v, want %v, true", ttl, cacheable, time.Hour)
+		}
+	})
+
+	t.Run("expires with an invalid date", func(t *testing.T) {
+		h := make(http.Header)
+		h.Set("Date", "yesterday")
+		h.Set("Expires", now.Add(time.Hour).UTC().Format(http.TimeFormat))
+		ttl, cacheable := FreshnessFor(h)
+		if !cacheable || ttl <= 59*time.Minute || ttl > time.Hour {
+			t.Errorf("Expected about an hour, got %v, %v", ttl, cacheable)
+		}
+	})
+
+	t.Run("expires less age", func(t *testing.T) {
+		h := make(http.Header)
+		h.Set("Expires", now.Add(time.Hour).UTC().Format(http.TimeFormat))
+		h.Set("Age", "600")
+		ttl, cacheable := FreshnessFor(h)
+		if !cacheable || ttl <= 49*time.Minute || ttl > 50*time.Minute {
+			t.Errorf("Expected about 50 minutes, got %v, %v", ttl, cacheable)
+		}
+	})
+}
+
+func TestSharedWithAuthorization(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    bool
+	}{
+		{"no headers", nil, false},
+		{"max-age only", http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"public", http.Header{"Cache-Control": {"Public, max-age=60"}}, true},
+		{"s-maxage", http.Header{"Cache-Control": {"s-maxage=60"}}, true},
+		{"must-revalidate", http.Header{"Cache-Control": {"max-age=60", "must-revalidate"}}, true},
+		{"private", http.Header{"Cache-Control": {"private"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SharedWithAuthorization(tt.headers); got != tt.want {
+				t.Errorf("SharedWithAuthorization() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseDirectives(t *testing.T) {
+	tests := []struct {
+		name                   string
+		headers                http.Header
+		immutable, noTransform bool
+		ttl                    time.Duration // neither changes the lifetime
+	}{
+		{"no headers", nil, false, false, DefaultTTL},
+		{"max-age only", http.Header{"Cache-Control": {"max-age=60"}}, false, false, time.Minute},
+		{"immutable with max-age", http.Header{"Cache-Control": {"public, max-age=31536000, Immutable"}}, true, false, 365 * 24 * time.Hour},
+		{"no-transform with max-age", http.Header{"Cache-Control": {"max-age=60", "no-transform"}}, false, true, time.Minute},
+		{"both", http.Header{"Cache-Control": {"max-age=60, immutable, no-transform"}}, true, true, time.Minute},
+		{"argument isn't the directive", http.Header{"Cache-Control": {`max-age=60, community="immutable"`}}, false, false, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Immutable(tt.headers); got != tt.immutable {
+				t.Errorf("Immutable() = %v, want %v", got, tt.immutable)
+			}
+			if got := NoTransform(tt.headers); got != tt.noTransform {
+				t.Errorf("NoTransform() = %v, want %v", got, tt.noTransform)
+			}
+			if ttl, cacheable := FreshnessFor(tt.headers); ttl != tt.ttl || !cacheable {
+				t.Errorf("FreshnessFor() = %v, %v, want %v, true", ttl, cacheable, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestRequestDirectiveFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    RequestDirective
+	}{
+		{"no headers", nil, RequestDefault},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, RequestRefresh},
+		{"max-age zero", http.Header{"Cache-Control": {"max-age=0"}}, RequestRefresh},
+		{"max-age above zero", http.Header{"Cache-Control": {"max-age=60"}}, RequestDefault},
+		{"no-store wins", http.Header{"Cache-Control": {"no-cache", "No-Store"}}, RequestBypass},
+		{"pragma", http.Header{"Pragma": {"no-cache"}}, RequestRefresh},
+		{"cache-control beats pragma", http.Header{"Cache-Control": {"max-stale"}, "Pragma": {"no-cache"}}, RequestDefault},
+		{"unknown directive", http.Header{"Cache-Control": {"only-if-cached"}}, RequestDefault},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RequestDirectiveFor(tt.headers); got != tt.want {
+				t.Errorf("RequestDirectiveFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	base := func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "http://example.com/a?q=1", nil)
+		r.Header.Set("Accept-Language", "en")
+		r.AddCookie(&http.Cookie{Name: "currency", Value: "EUR"})
+		return r
+	}
+	// each change makes the request differ from base in one component
+	changes := map[string]func(r *http.Request){
+		"host":     func(r *http.Request) { r.Host = "example.org" },
+		"path":     func(r *http.Request) { r.URL.Path = "/b" },
+		"method":   func(r *http.Request) { r.Method = http.MethodGet },
+		"query":    func(r *http.Request) { r.URL.RawQuery = "q=2" },
+		"header":   func(r *http.Request) { r.Header.Set("Accept-Language", "fr") },
+		"cookie":   func(r *http.Request) { r.Header.Set("Cookie", "currency=USD") },
+		"no other": func(r *http.Request) { r.Header.Set("User-Agent", "curl") },
+	}
+	tests := []struct {
+		name   string
+		policy KeyPolicy
+		shared []string // changes that keep the key
+	}{
+		{"default", KeyPolicy{}, []string{"header", "cookie", "no other"}},
+		{"ignore host", KeyPolicy{IgnoreHost: true}, []string{"host", "header", "cookie", "no other"}},
+		{"ignore path", KeyPolicy{IgnorePath: true}, []string{"path", "header", "cookie", "no other"}},
+		{"ignore method", KeyPolicy{IgnoreMethod: true}, []string{"method", "header", "cookie", "no other"}},
+		{"ignore query", KeyPolicy{Query: QueryPolicy{Mode: QueryIgnore}}, []string{"query", "header", "cookie", "no other"}},
+		{"headers", KeyPolicy{Headers: []string{"accept-language"}}, []string{"cookie", "no other"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.policy.Key(base())
+			for change, apply := range changes {
+				r := base()
+				apply(r)
+				shared := tt.policy.Key(r) == want
+				if shared != slices.Contains(tt.shared, change) {
+					t.Errorf("Changing the %s: shared key = %v, want %v", change, shared, !shared)
+				}
+			}
+		})
+	}
+
+	t.Run("MakeKey is the key of the equivalent policy", func(t *testing.T) {
+		r := base()
+		if MakeKey(r, true, QueryPolicy{}, "geo:NL") != (KeyPolicy{IgnoreHost: true}).Key(r, "geo:NL") {
+			t.Error("Expected MakeKey to match KeyPolicy.Key")
+		}
+	})
+
+	t.Run("components are what the key hashes", func(t *testing.T) {
+		p := KeyPolicy{Headers: []string{"accept-language"}}
+		// a key that changes strands every object in a snapshot, it must only change on purpose
+		if got := fmt.Sprintf("%x", p.Key(base(), "geo:NL")); got != "15315ee7a0e497cc87b8025d394c0cd38121442bec8095554e4cda59a4ca9f63" {
+			t.Errorf("Key changed, got %s", got)
+		}
+		want := KeyComponents{
+			Method:   http.MethodPost,
+			Host:     "example.com",
+			Path:     "/a",
+			Query:    "q=1",
+			Headers:  []string{"Accept-Language=en"},
+			Variants: []string{"geo:NL"},
+		}
+		if got := p.Components(base(), "geo:NL"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Components = %+v, want %+v", got, want)
+		}
+		r := base()
+		r.Method = http.MethodGet
+		if got := (KeyPolicy{IgnoreHost: true}).Components(r); got.Method != "" || got.Host != "" {
+			t.Errorf("Expected no method for GET and no host when ignored, got %+v", got)
+		}
+	})
+
+	t.Run("parts don't run into each other", func(t *testing.T) {
+		post, get := base(), base()
+		post.Host = "x"
+		get.Method, get.Host = http.MethodGet, "POSTx"
+		if (KeyPolicy{}).Key(post) == (KeyPolicy{}).Key(get) {
+			t.Error("Expected POST for x and GET for POSTx to have different keys")
+		}
+		withPath, withoutPath := base(), base()
+		withPath.Host, withPath.URL.Path = "example.com", "*"
+		withoutPath.Host, withoutPath.URL.Path = "example.com*", ""
+		if (KeyPolicy{}).Key(withPath) == (KeyPolicy{}).Key(withoutPath) {
+			t.Error("Expected the host and path to be separated")
+		}
+	})
+
+	t.Run("fingerprint follows the policy", func(t *testing.T) {
+		p := KeyPolicy{IgnorePath: true}
+		a, b := base(), base()
+		b.URL.Path = "/b"
+		if p.Fingerprint(a) != p.Fingerprint(b) {
+			t.Error("Expected requests sharing a key to share a fingerprint")
+		}
+		b.Host = "example.org"
+		if p.Fingerprint(a) == p.Fingerprint(b) {
+			t.Error("Expected requests for other hosts to have other fingerprints")
+		}
+	})
+}
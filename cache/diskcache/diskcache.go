@@ -0,0 +1,258 @@
+// Package diskcache is a cache for objects too large to keep in memory. Bodies are kept in
+// files, only the headers stay in memory.
+package diskcache
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/perbu/hazelnut/cache"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// bodySuffix names the body files, files with it are removed when the cache is created
+const bodySuffix = ".body"
+
+// DiskCache keeps bodies in files in a directory and evicts the least recently used objects
+// once the bodies take up more than the maximum size. Objects returned by Get have BodyFile
+// set instead of Body.
+type DiskCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *diskEntry, most recently used in front
+	size    int64      // bytes of the bodies on disk
+	seq     uint64     // names the next body file
+	hits    uint64
+	misses  uint64
+	onEvict cache.EvictFunc
+}
+
+// diskEntry is an object whose body is in a file
+type diskEntry struct {
+	key     string
+	obj     cache.ObjCore // Body is nil, BodyFile names the file
+	size    int64
+	expires time.Time // zero means it never expires
+}
+
+// New creates a cache that keeps up to maxSize bytes of bodies in dir. The directory belongs to
+// the cache: body files left behind by an earlier run are removed.
+func New(dir string, maxSize int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "*"+bodySuffix))
+	if err != nil {
+		return nil, fmt.Errorf("filepath.Glob: %w", err)
+	}
+	for _, name := range stale {
+		if err := os.Remove(name); err != nil {
+			return nil, fmt.Errorf("removing stale body: %w", err)
+		}
+	}
+	return &DiskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+// SetOnEvict registers a callback for objects that are evicted or expire.
+// It must be called before the cache is used.
+func (s *DiskCache) SetOnEvict(fn cache.EvictFunc) {
+	s.onEvict = fn
+}
+
+// Get returns the object with its BodyFile set. The file may be removed by an eviction at any
+// time; once it is opened it stays readable until it is closed.
+func (s *DiskCache) Get(key string) (cache.ObjCore, bool) {
+	obj, _, found := s.GetWithExpiry(key)
+	return obj, found
+}
+
+// GetWithExpiry is Get that also returns when the object expires, zero for never
+func (s *DiskCache) GetWithExpiry(key string) (cache.ObjCore, time.Time, bool) {
+	s.mu.Lock()
+	el, found := s.entries[key]
+	if !found {
+		s.misses++
+		s.mu.Unlock()
+		return cache.ObjCore{}, time.Time{}, false
+	}
+	e := el.Value.(*diskEntry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		s.remove(el)
+		s.misses++
+		s.mu.Unlock()
+		s.evicted(e)
+		return cache.ObjCore{}, time.Time{}, false
+	}
+	s.lru.MoveToFront(el)
+	s.hits++
+	e.obj.Hits++
+	obj, expires := e.obj, e.expires
+	s.mu.Unlock()
+	return obj, expires, true
+}
+
+// Set adds an object to the cache with its TTL taken from the response headers.
+// Objects the headers say not to cache are not stored.
+func (s *DiskCache) Set(key string, value cache.ObjCore) error {
+	ttl, cacheable := cache.FreshnessFor(value.Headers)
+	if !cacheable {
+		return nil
+	}
+	return s.SetWithTTL(key, value, ttl)
+}
+
+// SetWithTTL writes the body of the object to a file and adds it to the cache with a specific
+// TTL, 0 means no expiry. Objects larger than the whole cache are not stored. It fails when the
+// body can't be written.
+func (s *DiskCache) SetWithTTL(key string, value cache.ObjCore, ttl time.Duration) error {
+	size := int64(len(value.Body))
+	if size > s.maxSize {
+		return nil
+	}
+	name := s.nextName()
+	if err := os.WriteFile(name, value.Body, 0o600); err != nil {
+		_ = os.Remove(name)
+		return fmt.Errorf("writing body: %w", err)
+	}
+	s.add(key, value, name, size, ttl)
+	return nil
+}
+
+// CreateTemp creates a file in the cache's directory for a body that is too large to hold in
+// memory, to be stored with SetFileWithTTL. Files that are never stored are removed with the
+// stale bodies when the next cache is created in the directory.
+func (s *DiskCache) CreateTemp() (*os.File, error) {
+	return os.CreateTemp(s.dir, "spill-*"+bodySuffix)
+}
+
+// SetFileWithTTL adds an object whose body is in the file value.BodyFile, made by CreateTemp,
+// with a specific TTL, 0 means no expiry. The file is moved into the cache, an object larger than
+// the whole cache is not stored and the file is left where it is. On error the file is left too.
+func (s *DiskCache) SetFileWithTTL(key string, value cache.ObjCore, ttl time.Duration) error {
+	info, err := os.Stat(value.BodyFile)
+	if err != nil {
+		return fmt.Errorf("os.Stat: %w", err)
+	}
+	if info.Size() > s.maxSize {
+		return nil
+	}
+	name := s.nextName()
+	if err := os.Rename(value.BodyFile, name); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	s.add(key, value, name, info.Size(), ttl)
+	return nil
+}
+
+// nextName returns the name of the file for the next body stored
+func (s *DiskCache) nextName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return filepath.Join(s.dir, fmt.Sprintf("%016x%s", s.seq, bodySuffix))
+}
+
+// add adds an object whose body of size bytes is in the file name, and evicts the least recently
+// used objects until the bodies fit
+func (s *DiskCache) add(key string, value cache.ObjCore, name string, size int64, ttl time.Duration) {
+	e := &diskEntry{key: key, obj: value, size: size}
+	e.obj.Body = nil
+	e.obj.BodyFile = name
+	e.obj.Hits = 0
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+
+	s.mu.Lock()
+	if old, found := s.entries[key]; found {
+		// replaced, not evicted
+		s.remove(old)
+	}
+	s.entries[key] = s.lru.PushFront(e)
+	s.size += size
+	var evicted []*diskEntry
+	for s.size > s.maxSize {
+		oldest := s.lru.Back()
+		evicted = append(evicted, oldest.Value.(*diskEntry))
+		s.remove(oldest)
+	}
+	s.mu.Unlock()
+	for _, e := range evicted {
+		s.evicted(e)
+	}
+}
+
+// Delete removes an object, it reports whether the object was in the cache
+func (s *DiskCache) Delete(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, found := s.entries[key]
+	if found {
+		s.remove(el)
+	}
+	return found
+}
+
+// Range calls fn for every object in the cache with the time it expires, zero for never.
+// It stops when fn returns false. fn must not call back into the cache.
+func (s *DiskCache) Range(fn func(key string, value cache.ObjCore, expires time.Time) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for el := s.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*diskEntry)
+		if !fn(e.key, e.obj, e.expires) {
+			return
+		}
+	}
+}
+
+// Flush removes every object and resets the statistics
+func (s *DiskCache) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for el := s.lru.Front(); el != nil; el = s.lru.Front() {
+		s.remove(el)
+	}
+	s.hits, s.misses = 0, 0
+}
+
+// Stats returns the current object count, size and hit ratio
+func (s *DiskCache) Stats() cache.Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := cache.Stats{
+		Objects: int64(len(s.entries)),
+		Bytes:   s.size,
+		Hits:    s.hits,
+		Misses:  s.misses,
+	}
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRatio = float64(st.Hits) / float64(total)
+	}
+	return st
+}
+
+// remove takes an object out of the cache and removes its body file, s.mu must be held
+func (s *DiskCache) remove(el *list.Element) {
+	e := s.lru.Remove(el).(*diskEntry)
+	delete(s.entries, e.key)
+	s.size -= e.size
+	_ = os.Remove(e.obj.BodyFile)
+}
+
+// evicted calls the eviction callback for e, s.mu must not be held
+func (s *DiskCache) evicted(e *diskEntry) {
+	if s.onEvict != nil {
+		s.onEvict(e.key, e.size)
+	}
+}
@@ -0,0 +1,166 @@
+package diskcache
+
+import (
+	"github.com/perbu/hazelnut/cache"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func object(body string) cache.ObjCore {
+	return cache.ObjCore{
+		Headers: http.Header{"Content-Type": {"text/plain"}},
+		Body:    []byte(body),
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	t.Run("Bodies are kept in files", func(t *testing.T) {
+		c, err := New(t.TempDir(), 1024)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		if err := c.SetWithTTL("key", object("on disk"), 0); err != nil {
+			t.Fatalf("SetWithTTL failed: %v", err)
+		}
+		obj, found := c.Get("key")
+		if !found {
+			t.Fatal("Expected the object to be found")
+		}
+		if obj.Body != nil || obj.Headers.Get("Content-Type") != "text/plain" {
+			t.Errorf("Expected headers in memory and no body, got %+v", obj)
+		}
+		body, err := os.ReadFile(obj.BodyFile)
+		if err != nil || string(body) != "on disk" {
+			t.Errorf("Expected the body in %s, got %q (%v)", obj.BodyFile, body, err)
+		}
+		if obj, _ := c.Get("key"); obj.Hits != 2 {
+			t.Errorf("Expected 2 hits, got %d", obj.Hits)
+		}
+		if !c.Delete("key") {
+			t.Error("Expected Delete to find the object")
+		}
+		if _, err := os.Stat(obj.BodyFile); !os.IsNotExist(err) {
+			t.Errorf("Expected Delete to remove the body file, got %v", err)
+		}
+	})
+
+	t.Run("Files made by CreateTemp are moved in", func(t *testing.T) {
+		c, err := New(t.TempDir(), 10)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		store := func(key, body string) string {
+			f, err := c.CreateTemp()
+			if err != nil {
+				t.Fatalf("CreateTemp failed: %v", err)
+			}
+			defer f.Close()
+			f.WriteString(body)
+			obj := object("")
+			obj.Body, obj.BodyFile = nil, f.Name()
+			if err := c.SetFileWithTTL(key, obj, 0); err != nil {
+				t.Fatalf("SetFileWithTTL failed: %v", err)
+			}
+			return f.Name()
+		}
+		temp := store("key", "spilled")
+		obj, found := c.Get("key")
+		if !found || obj.BodyFile == temp {
+			t.Fatalf("Expected the object with a body file of the cache's own, got %+v", obj)
+		}
+		if body, err := os.ReadFile(obj.BodyFile); err != nil || string(body) != "spilled" {
+			t.Errorf("Expected the body in %s, got %q (%v)", obj.BodyFile, body, err)
+		}
+		if st := c.Stats(); st.Bytes != 7 {
+			t.Errorf("Expected 7 bytes, got %d", st.Bytes)
+		}
+		// too large for the cache, the file stays with the caller
+		temp = store("large", "more than ten bytes")
+		if _, found := c.Get("large"); found {
+			t.Error("Expected an object larger than the cache not to be stored")
+		}
+		if _, err := os.Stat(temp); err != nil {
+			t.Errorf("Expected the file of a refused object to be left, got %v", err)
+		}
+	})
+
+	t.Run("Least recently used objects are evicted", func(t *testing.T) {
+		c, err := New(t.TempDir(), 10)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		var evicted []string
+		c.SetOnEvict(func(key string, size int64) { evicted = append(evicted, key) })
+		_ = c.SetWithTTL("a", object("aaaa"), 0)
+		_ = c.SetWithTTL("b", object("bbbb"), 0)
+		c.Get("a")
+		_ = c.SetWithTTL("c", object("cccc"), 0)
+		if len(evicted) != 1 || evicted[0] != "b" {
+			t.Errorf("Expected b to be evicted, got %v", evicted)
+		}
+		if st := c.Stats(); st.Objects != 2 || st.Bytes != 8 {
+			t.Errorf("Expected 2 objects of 8 bytes, got %+v", st)
+		}
+		_ = c.SetWithTTL("huge", object("far too large"), 0)
+		if _, found := c.Get("huge"); found {
+			t.Error("Expected an object larger than the cache not to be stored")
+		}
+	})
+
+	t.Run("Range visits every object", func(t *testing.T) {
+		c, err := New(t.TempDir(), 1024)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		_ = c.SetWithTTL("a", object("aaaa"), 0)
+		_ = c.SetWithTTL("b", object("bbbb"), time.Minute)
+		seen := make(map[string]bool)
+		c.Range(func(key string, value cache.ObjCore, expires time.Time) bool {
+			seen[key] = value.BodyFile != "" && (key == "a") == expires.IsZero()
+			return true
+		})
+		if len(seen) != 2 || !seen["a"] || !seen["b"] {
+			t.Errorf("Expected both objects with their body files and expiry, got %v", seen)
+		}
+	})
+
+	t.Run("Expired objects are misses", func(t *testing.T) {
+		c, err := New(t.TempDir(), 1024)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		_ = c.SetWithTTL("key", object("short lived"), 10*time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		if _, found := c.Get("key"); found {
+			t.Error("Expected the expired object to be a miss")
+		}
+		if st := c.Stats(); st.Objects != 0 || st.Bytes != 0 {
+			t.Errorf("Expected the expired object to be removed, got %+v", st)
+		}
+	})
+
+	t.Run("Stale bodies and flushed objects are removed", func(t *testing.T) {
+		dir := t.TempDir()
+		stale := filepath.Join(dir, "0000000000000001.body")
+		if err := os.WriteFile(stale, []byte("left behind"), 0o600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		c, err := New(dir, 1024)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		if _, err := os.Stat(stale); !os.IsNotExist(err) {
+			t.Errorf("Expected New to remove the stale body, got %v", err)
+		}
+		_ = c.SetWithTTL("a", object("a"), 0)
+		_ = c.SetWithTTL("b", object("b"), 0)
+		c.Flush()
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		if len(files) != 0 || c.Stats().Objects != 0 {
+			t.Errorf("Expected Flush to remove everything, got %v", files)
+		}
+	})
+}
@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTTL is the lifetime of a cacheable response that doesn't say how long it is fresh
+const DefaultTTL = 5 * time.Minute
+
+// dateFormats are the date formats accepted in the Expires and Date headers
+var dateFormats = []string{
+	time.RFC1123,
+	time.RFC1123Z,
+	time.RFC850,
+	time.ANSIC,
+}
+
+// FreshnessFor determines from the response headers whether a response may be stored in a
+// shared cache and for how long. It considers:
+//   - Cache-Control: no-store, private and no-cache forbid caching
+//   - Cache-Control: s-maxage, which takes precedence over max-age for a shared cache
+//   - Expires, less the Date header, or the local time when there is none, and less the Age header
+//
+// A lifetime of zero or an Expires in the past makes the response not cacheable. A response
+// without any of these is cacheable for DefaultTTL.
+func FreshnessFor(headers http.Header) (ttl time.Duration, cacheable bool) {
+	maxAge, sMaxAge := -1, -1
+	for _, line := range headers.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(line, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			switch {
+			case directive == "no-store", directive == "private", directive == "no-cache":
+				// no-cache may be stored but must be revalidated, which we don't do
+				return 0, false
+			case strings.HasPrefix(directive, "s-maxage="):
+				sMaxAge = parseSeconds(strings.TrimPrefix(directive, "s-maxage="))
+			case strings.HasPrefix(directive, "max-age="):
+				maxAge = parseSeconds(strings.TrimPrefix(directive, "max-age="))
+			}
+		}
+	}
+	switch {
+	case sMaxAge >= 0:
+		return time.Duration(sMaxAge) * time.Second, sMaxAge > 0
+	case maxAge >= 0:
+		return time.Duration(maxAge) * time.Second, maxAge > 0
+	}
+
+	if expires := headers.Get("Expires"); expires != "" {
+		expiresTime, ok := parseDate(expires)
+		if !ok {
+			// An invalid Expires means already expired
+			return 0, false
+		}
+		// Against the origin's clock when it sent its Date, so a skewed clock on either side
+		// doesn't change the lifetime
+		ttl := time.Until(expiresTime)
+		if date, ok := parseDate(headers.Get("Date")); ok {
+			ttl = expiresTime.Sub(date)
+		}
+		if age := parseSeconds(headers.Get("Age")); age > 0 {
+			ttl -= time.Duration(age) * time.Second
+		}
+		if ttl <= 0 {
+			return 0, false
+		}
+		return ttl, true
+	}
+
+	return DefaultTTL, true
+}
+
+// SharedWithAuthorization reports whether the response to a request with an Authorization header
+// may be stored in a shared cache. RFC 9111 section 3.5 only allows it when Cache-Control says so
+// with public, s-maxage or must-revalidate; otherwise the response is likely meant for one user.
+func SharedWithAuthorization(headers http.Header) bool {
+	for _, line := range headers.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(line, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "public" || directive == "must-revalidate" || strings.HasPrefix(directive, "s-maxage=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Immutable reports whether Cache-Control marks the response immutable: it won't change while
+// it is fresh, so a client reloading it needn't get it from the backend again (RFC 8246)
+func Immutable(headers http.Header) bool {
+	return hasDirective(headers, "immutable")
+}
+
+// NoTransform reports whether Cache-Control forbids transforming the response body on the way
+// to the client, such as compressing it or processing ESI (RFC 9111 section 5.2.2.6)
+func NoTransform(headers http.Header) bool {
+	return hasDirective(headers, "no-transform")
+}
+
+// hasDirective reports whether the Cache-Control header has a directive without an argument
+func hasDirective(headers http.Header, name string) bool {
+	for _, line := range headers.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequestDirective is what the Cache-Control of a client's request asks of the cache
+type RequestDirective int
+
+const (
+	RequestDefault RequestDirective = iota // a cached object may be served
+	RequestRefresh                         // fetch a fresh copy from the backend and cache it
+	RequestBypass                          // fetch from the backend and don't cache the response
+)
+
+// RequestDirectiveFor determines from the request headers how the client wants the cache used:
+//   - Cache-Control: no-store bypasses the cache
+//   - Cache-Control: no-cache or max-age=0 refresh the cached object
+//   - Pragma: no-cache refreshes as well, unless the request has a Cache-Control header
+//
+// Other directives, like max-stale or a max-age above zero, are ignored.
+func RequestDirectiveFor(headers http.Header) RequestDirective {
+	lines := headers.Values("Cache-Control")
+	if len(lines) == 0 {
+		for _, line := range headers.Values("Pragma") {
+			if strings.EqualFold(strings.TrimSpace(line), "no-cache") {
+				return RequestRefresh
+			}
+		}
+		return RequestDefault
+	}
+	directive := RequestDefault
+	for _, line := range lines {
+		for d := range strings.SplitSeq(line, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			switch {
+			case d == "no-store":
+				return RequestBypass
+			case d == "no-cache", strings.HasPrefix(d, "max-age=") && parseSeconds(strings.TrimPrefix(d, "max-age=")) == 0:
+				directive = RequestRefresh
+			}
+		}
+	}
+	return directive
+}
+
+// parseDate parses an HTTP date in any of the accepted formats
+func parseDate(s string) (time.Time, bool) {
+	for _, format := range dateFormats {
+		if t, err := time.Parse(format, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseSeconds parses a delta-seconds value, -1 when it isn't one
+func parseSeconds(s string) int {
+	seconds, err := strconv.Atoi(strings.Trim(s, `"`))
+	if err != nil || seconds < 0 {
+		return -1
+	}
+	return seconds
+}
@@ -3,18 +3,43 @@ package lrucache
 import (
 	"github.com/dgraph-io/ristretto/v2"
 	"github.com/perbu/hazelnut/cache"
-	"net/http"
-	"strconv"
-	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type LRUCache struct {
-	cache *ristretto.Cache[string, cache.ObjCore]
+	cache    *ristretto.Cache[string, entry]
+	onEvict  cache.EvictFunc
+	onDrop   DropFunc
+	flushing atomic.Bool // a flush isn't reported as evictions
+}
+
+// DropFunc is called with an object that leaves the cache without being deleted: evicted to
+// make room, expired, or refused by the admission policy when it was set. expires is when the
+// object expires, zero for never.
+type DropFunc func(key string, obj cache.ObjCore, expires time.Time)
+
+// entry is what goes into ristretto. Ristretto only hands the hashed key to
+// its eviction callback, so we keep the string key next to the object.
+type entry struct {
+	key     string
+	obj     cache.ObjCore
+	expires time.Time      // zero means it never expires
+	hits    *atomic.Uint64 // shared by the copies ristretto hands out
+}
+
+// newEntry wraps an object stored for ttl, 0 means no expiry
+func newEntry(key string, obj cache.ObjCore, ttl time.Duration) entry {
+	e := entry{key: key, obj: obj, hits: new(atomic.Uint64)}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	return e
 }
 
 func New(maxObj, maxSize int64) (*LRUCache, error) {
-	config := &ristretto.Config[string, cache.ObjCore]{
+	c := &LRUCache{}
+	config := &ristretto.Config[string, entry]{
 		// A rule-of-thumb is to set NumCounters to 10× the capacity.
 		NumCounters: maxObj * 10,
 		// MaxCost is the total cost allowed in the cache.
@@ -23,8 +48,26 @@ func New(maxObj, maxSize int64) (*LRUCache, error) {
 		BufferItems: 64,
 		// Cost function: here we use the length of the Body as the cost.
 		// You could customize this further if needed.
-		Cost: func(value cache.ObjCore) int64 {
-			return int64(len(value.Body))
+		Cost: func(value entry) int64 {
+			return int64(len(value.obj.Body))
+		},
+		// Metrics backs Stats: object count, cost and the hit ratio.
+		Metrics: true,
+		OnEvict: func(item *ristretto.Item[entry]) {
+			if c.flushing.Load() {
+				return
+			}
+			if c.onDrop != nil {
+				c.onDrop(item.Value.key, item.Value.obj, item.Value.expires)
+			}
+			if c.onEvict != nil {
+				c.onEvict(item.Value.key, int64(len(item.Value.obj.Body)))
+			}
+		},
+		OnReject: func(item *ristretto.Item[entry]) {
+			if c.onDrop != nil && !c.flushing.Load() {
+				c.onDrop(item.Value.key, item.Value.obj, item.Value.expires)
+			}
 		},
 		// You can set TtlTickerDurationInSec if needed.
 	}
@@ -34,10 +77,21 @@ func New(maxObj, maxSize int64) (*LRUCache, error) {
 	if err != nil {
 		return nil, err
 	}
+	c.cache = rCache
+	return c, nil
+}
+
+// SetOnEvict registers a callback for objects that are evicted or expire.
+// It must be called before the cache is used.
+func (s *LRUCache) SetOnEvict(fn cache.EvictFunc) {
+	s.onEvict = fn
+}
 
-	return &LRUCache{
-		cache: rCache,
-	}, nil
+// SetOnDrop registers a callback for objects that leave the cache without being deleted, with
+// the object itself, see DropFunc. It is called on ristretto's goroutine, before the eviction
+// callback. It must be called before the cache is used.
+func (s *LRUCache) SetOnDrop(fn DropFunc) {
+	s.onDrop = fn
 }
 
 func (s *LRUCache) Get(key string) (cache.ObjCore, bool) {
@@ -45,115 +99,64 @@ func (s *LRUCache) Get(key string) (cache.ObjCore, bool) {
 	if !found {
 		return cache.ObjCore{}, false
 	}
-	return value, true
+	obj := value.obj
+	obj.Hits = value.hits.Add(1)
+	return obj, true
 }
 
-// Set adds an object to the cache with automatic TTL calculation based on response headers
-func (s *LRUCache) Set(key string, value cache.ObjCore) {
-	ttl := calculateTTL(value.Headers)
-	if ttl == 0 {
-		// Default behavior, no expiration
-		s.cache.Set(key, value, int64(len(value.Body)))
-	} else {
-		s.cache.SetWithTTL(key, value, int64(len(value.Body)), ttl)
+// Set adds an object to the cache with its TTL taken from the response headers.
+// Objects the headers say not to cache are not stored. It never fails.
+func (s *LRUCache) Set(key string, value cache.ObjCore) error {
+	ttl, cacheable := cache.FreshnessFor(value.Headers)
+	if !cacheable {
+		return nil
 	}
+	s.cache.SetWithTTL(key, newEntry(key, value, ttl), int64(len(value.Body)), ttl)
+	return nil
 }
 
-// SetWithTTL explicitly sets an object in the cache with a specific TTL
-func (s *LRUCache) SetWithTTL(key string, value cache.ObjCore, ttl time.Duration) {
-	s.cache.SetWithTTL(key, value, int64(len(value.Body)), ttl)
+// SetWithTTL explicitly sets an object in the cache with a specific TTL. It never fails.
+func (s *LRUCache) SetWithTTL(key string, value cache.ObjCore, ttl time.Duration) error {
+	s.cache.SetWithTTL(key, newEntry(key, value, ttl), int64(len(value.Body)), ttl)
+	return nil
 }
 
-// calculateTTL determines appropriate cache lifetime from response headers
-// Returns 0 for objects that should use the default cache behavior (no expiration)
-// Considers:
-// - Cache-Control: max-age, s-maxage, no-cache, no-store, private, must-revalidate
-// - Expires header
-// - Age header
-func calculateTTL(headers http.Header) time.Duration {
-	// Check for Cache-Control directives that prevent caching
-	cacheControl := headers.Get("Cache-Control")
-	if cacheControl != "" {
-		directives := strings.SplitSeq(cacheControl, ",")
-		for directive := range directives {
-			directive = strings.TrimSpace(directive)
-
-			// Check for no-store directive - don't cache at all
-			if directive == "no-store" {
-				return -1 // Negative value means don't cache
-			}
-
-			// Check for private directive - typically shouldn't be cached by shared cache
-			if directive == "private" {
-				return -1
-			}
+// Range calls fn for every object in the cache with the time it expires, zero for never.
+// It stops when fn returns false.
+func (s *LRUCache) Range(fn func(key string, value cache.ObjCore, expires time.Time) bool) {
+	s.cache.IterValues(func(e entry) bool {
+		return !fn(e.key, e.obj, e.expires)
+	})
+}
 
-			// Check for no-cache directive - can be stored but must be revalidated
-			if directive == "no-cache" {
-				return -1
-			}
+// Wait blocks until the sets so far have been applied. Ristretto applies them asynchronously.
+func (s *LRUCache) Wait() {
+	s.cache.Wait()
+}
 
-			// Check for s-maxage (takes precedence over max-age for shared caches)
-			if after, ok := strings.CutPrefix(directive, "s-maxage="); ok {
-				seconds, err := strconv.Atoi(after)
-				if err == nil && seconds > 0 {
-					return time.Duration(seconds) * time.Second
-				}
-			}
+// Delete removes an object, it reports whether the object was in the cache
+func (s *LRUCache) Delete(key string) bool {
+	// GetTTL doesn't count as a lookup in the hit ratio.
+	_, found := s.cache.GetTTL(key)
+	s.cache.Del(key)
+	return found
+}
 
-			// Check for max-age
-			if after, ok := strings.CutPrefix(directive, "max-age="); ok {
-				seconds, err := strconv.Atoi(after)
-				if err == nil && seconds > 0 {
-					return time.Duration(seconds) * time.Second
-				}
-			}
-		}
-	}
+// Flush removes every object and resets the statistics
+func (s *LRUCache) Flush() {
+	s.flushing.Store(true)
+	defer s.flushing.Store(false)
+	s.cache.Clear()
+}
 
-	// Check Expires header if no max-age was found
-	expires := headers.Get("Expires")
-	if expires != "" {
-		// Parse the expires header in various formats
-		formats := []string{
-			time.RFC1123,
-			time.RFC1123Z,
-			time.RFC850,
-			time.ANSIC,
-		}
-
-		var expiresTime time.Time
-		var err error
-
-		// Try each format until we find one that works
-		for _, format := range formats {
-			expiresTime, err = time.Parse(format, expires)
-			if err == nil {
-				break
-			}
-		}
-
-		if err == nil {
-			// Calculate TTL as difference between expiration time and now
-			ttl := time.Until(expiresTime)
-			if ttl > 0 {
-				// Account for Age header if present
-				age := headers.Get("Age")
-				if age != "" {
-					ageSeconds, err := strconv.Atoi(age)
-					if err == nil && ageSeconds > 0 {
-						ttl -= time.Duration(ageSeconds) * time.Second
-						if ttl <= 0 {
-							return -1 // Already expired
-						}
-					}
-				}
-				return ttl
-			}
-			return -1 // Already expired
-		}
+// Stats returns the current object count, size and hit ratio
+func (s *LRUCache) Stats() cache.Stats {
+	m := s.cache.Metrics
+	return cache.Stats{
+		Objects:  int64(m.KeysAdded() - m.KeysEvicted()),
+		Bytes:    int64(m.CostAdded() - m.CostEvicted()),
+		Hits:     m.Hits(),
+		Misses:   m.Misses(),
+		HitRatio: m.Ratio(),
 	}
-
-	// Default case: use default cache behavior
-	return 0
 }
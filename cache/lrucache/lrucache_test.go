@@ -7,6 +7,8 @@ import (
 	"github.com/perbu/hazelnut/cache"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -162,3 +164,80 @@ func TestCache(t *testing.T) {
 		}
 	})
 }
+
+func TestOnEvict(t *testing.T) {
+	c, err := New(10, 1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	var mu sync.Mutex
+	evicted := make(map[string]int64)
+	c.SetOnEvict(func(key string, size int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		evicted[key] = size
+	})
+
+	// Each object takes up a fair share of the 1KB, so filling it up has to evict.
+	body := bytes.Repeat([]byte("x"), 200)
+	for i := range 20 {
+		c.Set(fmt.Sprintf("key-%d", i), cache.ObjCore{Headers: make(http.Header), Body: body})
+		c.cache.Wait()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(evicted) == 0 {
+		t.Fatal("Expected the eviction callback to be called")
+	}
+	for key, size := range evicted {
+		if !strings.HasPrefix(key, "key-") {
+			t.Errorf("Unexpected evicted key %q", key)
+		}
+		if size != int64(len(body)) {
+			t.Errorf("Expected evicted size %d, got %d", len(body), size)
+		}
+	}
+}
+
+func TestDeleteFlushStats(t *testing.T) {
+	c, err := New(10, 1<<20)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	evictions := 0
+	c.SetOnEvict(func(string, int64) { evictions++ })
+
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, cache.ObjCore{Headers: make(http.Header), Body: []byte("hello")})
+	}
+	c.cache.Wait()
+	c.Get("a")
+	c.Get("missing")
+
+	stats := c.Stats()
+	if stats.Objects != 3 || stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Expected 3 objects, 1 hit and 1 miss, got %+v", stats)
+	}
+
+	if !c.Delete("a") {
+		t.Error("Expected Delete to report the object was cached")
+	}
+	if c.Delete("a") {
+		t.Error("Expected a second Delete to report nothing was cached")
+	}
+	if _, found := c.Get("a"); found {
+		t.Error("Expected the deleted object to be gone")
+	}
+
+	c.Flush()
+	if _, found := c.Get("b"); found {
+		t.Error("Expected the cache to be empty after a flush")
+	}
+	if got := c.Stats().Objects; got != 0 {
+		t.Errorf("Expected 0 objects after a flush, got %d", got)
+	}
+	if evictions != 0 {
+		t.Errorf("Expected deletes and flushes not to count as evictions, got %d", evictions)
+	}
+}
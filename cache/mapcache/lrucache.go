@@ -3,40 +3,198 @@ package mapcache
 import (
 	"github.com/perbu/hazelnut/cache"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type MAPCache struct {
-	mu    sync.RWMutex
-	cache map[string]cache.ObjCore
+	mu      sync.RWMutex
+	cache   map[string]mapEntry
+	size    int64 // bytes of the bodies stored
+	maxSize int64 // budget for size, 0 means unbounded
+	onEvict cache.EvictFunc
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+// mapEntry is an object with its expiry time, zero means it never expires
+type mapEntry struct {
+	obj     cache.ObjCore
+	expires time.Time
+	hits    *atomic.Uint64
 }
 
 func New() *MAPCache {
 	return &MAPCache{
-		cache: make(map[string]cache.ObjCore),
+		cache: make(map[string]mapEntry),
 	}
 }
 
+// SetMaxSize sets a budget for the bytes of the bodies stored, 0 (the default) leaves the map
+// unbounded. When an object doesn't fit, expired objects are evicted first and then objects
+// picked at random, until it does. Objects larger than the whole budget aren't stored.
+// It must be called before the cache is used.
+func (s *MAPCache) SetMaxSize(maxSize int64) {
+	s.maxSize = maxSize
+}
+
+// SetOnEvict registers a callback for objects that expire, or are evicted to stay within the
+// size budget. Expiry is noticed on Get. It must be called before the cache is used.
+func (s *MAPCache) SetOnEvict(fn cache.EvictFunc) {
+	s.onEvict = fn
+}
+
 func (s *MAPCache) Get(key string) (cache.ObjCore, bool) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
 	value, found := s.cache[key]
+	s.mu.RUnlock()
 	if !found {
+		s.misses.Add(1)
+		return cache.ObjCore{}, false
+	}
+	if !value.expires.IsZero() && time.Now().After(value.expires) {
+		s.expire(key)
+		s.misses.Add(1)
 		return cache.ObjCore{}, false
 	}
-	return value, true
+	s.hits.Add(1)
+	obj := value.obj
+	obj.Hits = value.hits.Add(1)
+	return obj, true
 }
 
-// Set adds an object to the cache with automatic TTL calculation based on response headers
-func (s *MAPCache) Set(key string, value cache.ObjCore) {
+// expire removes an expired object and calls the eviction callback
+func (s *MAPCache) expire(key string) {
+	s.mu.Lock()
+	value, found := s.cache[key]
+	// It may have been replaced with a fresh object since we looked.
+	if !found || value.expires.IsZero() || time.Now().Before(value.expires) {
+		s.mu.Unlock()
+		return
+	}
+	s.remove(key, value)
+	s.mu.Unlock()
+	if s.onEvict != nil {
+		s.onEvict(key, int64(len(value.obj.Body)))
+	}
+}
+
+// remove deletes the entry for key. The caller holds the lock.
+func (s *MAPCache) remove(key string, e mapEntry) {
+	delete(s.cache, key)
+	s.size -= int64(len(e.obj.Body))
+}
+
+// store puts e in the map, evicting objects to make room when it would exceed the budget, and
+// returns the evicted. An object larger than the budget only replaces the one stored for key.
+// The caller holds the lock and calls onEvict for the evicted.
+func (s *MAPCache) store(key string, e mapEntry) (evicted map[string]int64) {
+	size := int64(len(e.obj.Body))
+	if old, found := s.cache[key]; found {
+		s.remove(key, old)
+	}
+	if s.maxSize > 0 && size > s.maxSize {
+		return nil
+	}
+	if s.maxSize > 0 && s.size+size > s.maxSize {
+		evicted = make(map[string]int64)
+		now := time.Now()
+		// expired objects make room first, then any object will do. Map iteration order is
+		// random enough to spread evictions over the cache.
+		for _, expiredOnly := range []bool{true, false} {
+			for k, other := range s.cache {
+				if s.size+size <= s.maxSize {
+					break
+				}
+				if expiredOnly && (other.expires.IsZero() || now.Before(other.expires)) {
+					continue
+				}
+				s.remove(k, other)
+				evicted[k] = int64(len(other.obj.Body))
+			}
+		}
+	}
+	s.cache[key] = e
+	s.size += size
+	return evicted
+}
+
+// evicted calls the eviction callback for the objects store evicted, without the lock held
+func (s *MAPCache) evicted(objects map[string]int64) {
+	if s.onEvict == nil {
+		return
+	}
+	for key, size := range objects {
+		s.onEvict(key, size)
+	}
+}
+
+// Set adds an object to the cache with automatic TTL calculation based on response headers.
+// It never fails.
+func (s *MAPCache) Set(key string, value cache.ObjCore) error {
+	ttl, cacheable := cache.FreshnessFor(value.Headers)
+	if !cacheable {
+		return nil
+	}
+	return s.SetWithTTL(key, value, ttl)
+}
+
+// SetWithTTL explicitly sets an object in the cache with a specific TTL. It never fails.
+func (s *MAPCache) SetWithTTL(key string, value cache.ObjCore, ttl time.Duration) error {
+	e := mapEntry{obj: value, hits: new(atomic.Uint64)}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	s.mu.Lock()
+	evicted := s.store(key, e)
+	s.mu.Unlock()
+	s.evicted(evicted)
+	return nil
+}
+
+// Delete removes an object, it reports whether the object was in the cache
+func (s *MAPCache) Delete(key string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.cache[key] = value
+	e, found := s.cache[key]
+	if found {
+		s.remove(key, e)
+	}
+	return found
 }
 
-// SetWithTTL explicitly sets an object in the cache with a specific TTL
-func (s *MAPCache) SetWithTTL(key string, value cache.ObjCore, ttl time.Duration) {
+// Flush removes every object and resets the statistics
+func (s *MAPCache) Flush() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.cache[key] = value
+	s.cache = make(map[string]mapEntry)
+	s.size = 0
+	s.hits.Store(0)
+	s.misses.Store(0)
+}
+
+// Stats returns the current object count, size and hit ratio.
+// Expired objects that haven't been looked up since are still counted.
+func (s *MAPCache) Stats() cache.Stats {
+	s.mu.RLock()
+	st := cache.Stats{Objects: int64(len(s.cache)), Bytes: s.size}
+	s.mu.RUnlock()
+	st.Hits = s.hits.Load()
+	st.Misses = s.misses.Load()
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRatio = float64(st.Hits) / float64(total)
+	}
+	return st
+}
+
+// Range calls fn for every object in the cache with the time it expires, zero for never.
+// It stops when fn returns false. fn must not call back into the cache.
+func (s *MAPCache) Range(fn func(key string, value cache.ObjCore, expires time.Time) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, e := range s.cache {
+		if !fn(key, e.obj, e.expires) {
+			return
+		}
+	}
 }
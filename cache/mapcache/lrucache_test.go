@@ -0,0 +1,129 @@
+package mapcache
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/perbu/hazelnut/cache"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMaxSize(t *testing.T) {
+	c := New()
+	c.SetMaxSize(1000)
+	evicted := make(map[string]int64)
+	c.SetOnEvict(func(key string, size int64) {
+		evicted[key] = size
+	})
+	obj := func(size int) cache.ObjCore {
+		return cache.ObjCore{Headers: make(http.Header), Body: bytes.Repeat([]byte("x"), size)}
+	}
+
+	for i := range 20 {
+		c.Set(fmt.Sprintf("key-%d", i), obj(200))
+		if st := c.Stats(); st.Bytes > 1000 {
+			t.Fatalf("Expected at most 1000 bytes after %d sets, got %d", i+1, st.Bytes)
+		}
+	}
+	if st := c.Stats(); st.Objects != 5 || st.Bytes != 1000 {
+		t.Errorf("Expected 5 objects of 1000 bytes, got %d of %d", st.Objects, st.Bytes)
+	}
+	if len(evicted) != 15 {
+		t.Errorf("Expected 15 evictions, got %d", len(evicted))
+	}
+	if _, found := c.Get("key-19"); !found {
+		t.Error("Expected the last object set to be cached")
+	}
+
+	t.Run("expired objects go first", func(t *testing.T) {
+		c.Flush()
+		clear(evicted)
+		c.Set("keep-1", obj(300))
+		c.SetWithTTL("expired", obj(300), time.Millisecond)
+		c.Set("keep-2", obj(300))
+		time.Sleep(5 * time.Millisecond)
+		c.Set("new", obj(300))
+		if _, found := evicted["expired"]; !found || len(evicted) != 1 {
+			t.Errorf("Expected only the expired object to be evicted, got %v", evicted)
+		}
+	})
+
+	t.Run("replacing an object frees its bytes", func(t *testing.T) {
+		c.Flush()
+		clear(evicted)
+		for range 10 {
+			c.Set("same", obj(600))
+		}
+		if st := c.Stats(); st.Objects != 1 || st.Bytes != 600 || len(evicted) != 0 {
+			t.Errorf("Expected one object of 600 bytes and no evictions, got %d of %d and %v", st.Objects, st.Bytes, evicted)
+		}
+		c.Delete("same")
+		if st := c.Stats(); st.Bytes != 0 {
+			t.Errorf("Expected no bytes after the delete, got %d", st.Bytes)
+		}
+	})
+
+	t.Run("objects larger than the budget aren't stored", func(t *testing.T) {
+		c.Flush()
+		c.Set("small", obj(100))
+		c.Set("huge", obj(2000))
+		if _, found := c.Get("huge"); found {
+			t.Error("Expected the huge object not to be cached")
+		}
+		if _, found := c.Get("small"); !found {
+			t.Error("Expected the small object to stay")
+		}
+	})
+
+	t.Run("unbounded by default", func(t *testing.T) {
+		c := New()
+		for i := range 100 {
+			c.Set(fmt.Sprintf("key-%d", i), obj(1000))
+		}
+		if st := c.Stats(); st.Objects != 100 {
+			t.Errorf("Expected all 100 objects, got %d", st.Objects)
+		}
+	})
+}
+
+func TestSet(t *testing.T) {
+	c := New()
+	obj := func(cacheControl string) cache.ObjCore {
+		return cache.ObjCore{Headers: http.Header{"Cache-Control": {cacheControl}}, Body: []byte("x")}
+	}
+	expires := func(key string) (time.Time, bool) {
+		var at time.Time
+		found := false
+		c.Range(func(k string, _ cache.ObjCore, e time.Time) bool {
+			if k == key {
+				at, found = e, true
+			}
+			return !found
+		})
+		return at, found
+	}
+
+	c.Set("fresh", obj("max-age=60"))
+	at, found := expires("fresh")
+	if !found {
+		t.Fatal("Expected the fresh object to be cached")
+	}
+	if d := time.Until(at); d <= 55*time.Second || d > 60*time.Second {
+		t.Errorf("Expected the object to expire in 60s, got %v", d)
+	}
+
+	c.Set("no-store", obj("no-store"))
+	if _, found := c.Get("no-store"); found {
+		t.Error("Expected the no-store object not to be cached")
+	}
+
+	c.Set("short", obj("max-age=1"))
+	if _, found := c.Get("short"); !found {
+		t.Fatal("Expected the short-lived object to be cached")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, found := c.Get("short"); found {
+		t.Error("Expected the short-lived object to have expired")
+	}
+}
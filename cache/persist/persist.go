@@ -0,0 +1,223 @@
+// Package persist saves the cache contents to disk and restores them on startup,
+// so a restart doesn't begin with a cold cache.
+package persist
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/perbu/hazelnut/cache"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileName is the snapshot file in the persistence directory
+const fileName = "hazelnut-cache.gob"
+
+// formatVersion is written at the start of the snapshot, files with another version are ignored.
+// Version 2 separates the parts of cache keys, the keys of older snapshots are never looked up.
+const formatVersion = 2
+
+// Cache is what the persister needs from the cache
+type Cache interface {
+	SetWithTTL(key string, value cache.ObjCore, ttl time.Duration) error
+	Range(fn func(key string, value cache.ObjCore, expires time.Time) bool)
+}
+
+// waiter is implemented by caches that apply sets asynchronously
+type waiter interface {
+	Wait()
+}
+
+// record is a single cached object in the snapshot
+type record struct {
+	Key     string
+	Status  int
+	Headers http.Header
+	Body    []byte
+	Expires time.Time // zero means it never expires
+	// Fingerprint was added without a format version bump, gob leaves it empty in older snapshots
+	Fingerprint string
+	// and so were these, older snapshots restore objects without origin metadata or directives
+	FetchLatency time.Duration
+	OriginSize   int64
+	Immutable    bool
+	NoTransform  bool
+}
+
+// Persister snapshots a cache to a directory and restores it
+type Persister struct {
+	cache    Cache
+	dir      string
+	interval time.Duration
+	logger   *slog.Logger
+}
+
+// New creates a persister for c that keeps its snapshot in dir. Run saves a snapshot every
+// interval, 0 means only on shutdown.
+func New(logger *slog.Logger, c Cache, dir string, interval time.Duration) *Persister {
+	return &Persister{
+		cache:    c,
+		dir:      dir,
+		interval: interval,
+		logger:   logger.With("package", "persist"),
+	}
+}
+
+// Save writes a snapshot of the cache. The snapshot is written to a temporary file and
+// renamed into place, so a crash while saving leaves the previous snapshot intact.
+func (p *Persister) Save() (int, error) {
+	now := time.Now()
+	var records []record
+	p.cache.Range(func(key string, value cache.ObjCore, expires time.Time) bool {
+		if expires.IsZero() || expires.After(now) {
+			records = append(records, record{
+				Key:     key,
+				Status:  value.Status,
+				Headers: value.Headers,
+				Body:    value.Body,
+				Expires: expires,
+				// key integrity checks keep working after a restart
+				Fingerprint:  value.Fingerprint,
+				FetchLatency: value.FetchLatency,
+				OriginSize:   value.OriginSize,
+				Immutable:    value.Immutable,
+				NoTransform:  value.NoTransform,
+			})
+		}
+		return true
+	})
+
+	if err := os.MkdirAll(p.dir, 0o755); err != nil {
+		return 0, fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	tmp, err := os.CreateTemp(p.dir, fileName+".*")
+	if err != nil {
+		return 0, fmt.Errorf("os.CreateTemp: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	w := bufio.NewWriter(tmp)
+	enc := gob.NewEncoder(w)
+	err = enc.Encode(formatVersion)
+	for i := 0; err == nil && i < len(records); i++ {
+		err = enc.Encode(&records[i])
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(p.dir, fileName)); err != nil {
+		return 0, fmt.Errorf("os.Rename: %w", err)
+	}
+	return len(records), nil
+}
+
+// Restore loads the snapshot into the cache with the TTL each object has left, objects
+// that have expired in the meantime are skipped. A missing snapshot is not an error. A
+// truncated or corrupt snapshot restores the objects before the damage and reports it.
+func (p *Persister) Restore() (int, error) {
+	f, err := os.Open(filepath.Join(p.dir, fileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	var version int
+	if err := dec.Decode(&version); err != nil {
+		return 0, fmt.Errorf("reading snapshot header: %w", err)
+	}
+	if version != formatVersion {
+		return 0, fmt.Errorf("snapshot format version %d, want %d", version, formatVersion)
+	}
+
+	w, _ := p.cache.(waiter)
+	restored := 0
+	for {
+		var r record
+		err := dec.Decode(&r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return restored, fmt.Errorf("snapshot damaged after %d objects: %w", restored, err)
+		}
+		var ttl time.Duration
+		if !r.Expires.IsZero() {
+			ttl = time.Until(r.Expires)
+			if ttl <= 0 {
+				continue
+			}
+		}
+		obj := cache.ObjCore{
+			Status:       r.Status,
+			Headers:      r.Headers,
+			Body:         r.Body,
+			Fingerprint:  r.Fingerprint,
+			FetchLatency: r.FetchLatency,
+			OriginSize:   r.OriginSize,
+			Immutable:    r.Immutable,
+			NoTransform:  r.NoTransform,
+		}
+		if err := p.cache.SetWithTTL(r.Key, obj, ttl); err != nil {
+			return restored, fmt.Errorf("restoring object %d: %w", restored+1, err)
+		}
+		restored++
+		if w != nil && restored%1000 == 0 {
+			// don't outrun the cache's set buffer, it drops sets when it is full
+			w.Wait()
+		}
+	}
+	if w != nil {
+		w.Wait()
+	}
+	return restored, nil
+}
+
+// Run saves a snapshot every interval and once more when ctx is done
+func (p *Persister) Run(ctx context.Context) error {
+	var tick <-chan time.Time
+	if p.interval > 0 {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			p.save()
+		case <-ctx.Done():
+			p.save()
+			return nil
+		}
+	}
+}
+
+// save saves a snapshot and logs the outcome
+func (p *Persister) save() {
+	t0 := time.Now()
+	n, err := p.Save()
+	if err != nil {
+		p.logger.Error("saving cache snapshot failed", "dir", p.dir, "error", err)
+		return
+	}
+	p.logger.Info("cache snapshot saved", "dir", p.dir, "objects", n, "duration", time.Since(t0))
+}
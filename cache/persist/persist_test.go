@@ -0,0 +1,154 @@
+package persist
+
+import (
+	"context"
+	"fmt"
+	"github.com/perbu/hazelnut/cache"
+	"github.com/perbu/hazelnut/cache/lrucache"
+	"github.com/perbu/hazelnut/cache/mapcache"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func object(body string) cache.ObjCore {
+	h := make(http.Header)
+	h.Set("Content-Type", "text/plain")
+	return cache.ObjCore{Status: http.StatusOK, Headers: h, Body: []byte(body)}
+}
+
+func TestPersist(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	t.Run("Round trip honors the remaining TTL", func(t *testing.T) {
+		dir := t.TempDir()
+		src := mapcache.New()
+		src.SetWithTTL("forever", object("a"), 0)
+		hour := object("b")
+		hour.FetchLatency, hour.OriginSize = 120*time.Millisecond, 1
+		src.SetWithTTL("hour", hour, time.Hour)
+		src.SetWithTTL("soon", object("c"), 50*time.Millisecond)
+
+		n, err := New(logger, src, dir, 0).Save()
+		if err != nil || n != 3 {
+			t.Fatalf("Expected 3 objects saved, got %d, %v", n, err)
+		}
+		time.Sleep(100 * time.Millisecond) // "soon" expires between save and restore
+
+		dst := mapcache.New()
+		n, err = New(logger, dst, dir, 0).Restore()
+		if err != nil || n != 2 {
+			t.Fatalf("Expected 2 objects restored, got %d, %v", n, err)
+		}
+		obj, found := dst.Get("hour")
+		if !found || string(obj.Body) != "b" || obj.Headers.Get("Content-Type") != "text/plain" || obj.Status != http.StatusOK ||
+			obj.FetchLatency != 120*time.Millisecond || obj.OriginSize != 1 {
+			t.Errorf("Expected the object to be restored as saved, got %+v", obj)
+		}
+		if _, found := dst.Get("soon"); found {
+			t.Error("Expected the expired object to be skipped")
+		}
+		dst.Range(func(key string, _ cache.ObjCore, expires time.Time) bool {
+			switch key {
+			case "forever":
+				if !expires.IsZero() {
+					t.Errorf("Expected %s to never expire, got %v", key, expires)
+				}
+			case "hour":
+				if left := time.Until(expires); left <= 59*time.Minute || left > time.Hour {
+					t.Errorf("Expected about an hour left for %s, got %v", key, left)
+				}
+			}
+			return true
+		})
+	})
+
+	t.Run("Round trip through lrucache", func(t *testing.T) {
+		dir := t.TempDir()
+		src, err := lrucache.New(100, 1<<20)
+		if err != nil {
+			t.Fatalf("Failed to create cache: %v", err)
+		}
+		for i := range 10 {
+			src.SetWithTTL(fmt.Sprintf("key-%d", i), object("body"), time.Hour)
+		}
+		src.Wait()
+		if n, err := New(logger, src, dir, 0).Save(); err != nil || n != 10 {
+			t.Fatalf("Expected 10 objects saved, got %d, %v", n, err)
+		}
+
+		dst, err := lrucache.New(100, 1<<20)
+		if err != nil {
+			t.Fatalf("Failed to create cache: %v", err)
+		}
+		if n, err := New(logger, dst, dir, 0).Restore(); err != nil || n != 10 {
+			t.Fatalf("Expected 10 objects restored, got %d, %v", n, err)
+		}
+		if _, found := dst.Get("key-3"); !found {
+			t.Error("Expected a restored object to be found")
+		}
+	})
+
+	t.Run("Missing snapshot", func(t *testing.T) {
+		n, err := New(logger, mapcache.New(), t.TempDir(), 0).Restore()
+		if err != nil || n != 0 {
+			t.Errorf("Expected nothing restored and no error, got %d, %v", n, err)
+		}
+	})
+
+	t.Run("Truncated snapshot restores what it can", func(t *testing.T) {
+		dir := t.TempDir()
+		src := mapcache.New()
+		for i := range 20 {
+			src.SetWithTTL(fmt.Sprintf("key-%d", i), object("some body to take up room"), 0)
+		}
+		if _, err := New(logger, src, dir, 0).Save(); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		path := filepath.Join(dir, fileName)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if err := os.Truncate(path, info.Size()/2); err != nil {
+			t.Fatalf("Truncate failed: %v", err)
+		}
+
+		n, err := New(logger, mapcache.New(), dir, 0).Restore()
+		if err == nil {
+			t.Error("Expected the damage to be reported")
+		}
+		if n == 0 || n >= 20 {
+			t.Errorf("Expected some but not all objects restored, got %d", n)
+		}
+	})
+
+	t.Run("Garbage snapshot", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, fileName), []byte("not a snapshot"), 0o600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		n, err := New(logger, mapcache.New(), dir, 0).Restore()
+		if err == nil || n != 0 {
+			t.Errorf("Expected an error and nothing restored, got %d, %v", n, err)
+		}
+	})
+
+	t.Run("Run saves on shutdown", func(t *testing.T) {
+		dir := t.TempDir()
+		src := mapcache.New()
+		src.SetWithTTL("key", object("a"), 0)
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		if err := New(logger, src, dir, time.Hour).Run(ctx); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, fileName)); err != nil {
+			t.Errorf("Expected a snapshot on shutdown: %v", err)
+		}
+	})
+}
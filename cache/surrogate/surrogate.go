@@ -0,0 +1,189 @@
+// Package surrogate indexes cached objects by the surrogate keys of their responses, so every
+// object carrying a key can be purged at once
+package surrogate
+
+import (
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/perbu/hazelnut/cache"
+)
+
+// Header is the response header listing the surrogate keys of an object, separated by spaces
+const Header = "Surrogate-Key"
+
+// Cache is the cache the index is kept for
+type Cache interface {
+	Get(key string) (cache.ObjCore, bool)
+	Set(key string, value cache.ObjCore) error
+	SetWithTTL(key string, value cache.ObjCore, ttl time.Duration) error
+	Delete(key string) bool
+	Flush()
+	Stats() cache.Stats
+}
+
+// Index maps surrogate keys to the cache keys of the objects tagged with them. It wraps Cache:
+// objects are indexed as they are stored and dropped from the index as they are deleted, while
+// evictions have to be reported with Evicted from the cache's eviction callback.
+//
+// A purge removes every object stored before it started. An object stored while a purge runs
+// may survive it, as may one stored again just as its previous copy is evicted.
+type Index struct {
+	Cache // the indexed cache, it must be set before the index is used
+
+	mu   sync.Mutex
+	tags map[string]map[string]struct{} // surrogate key -> cache keys
+	keys map[string][]string            // cache key -> surrogate keys
+}
+
+// FileCache is implemented by caches that keep bodies in files, a body too large to buffer is
+// written to a file made by CreateTemp and moved into the cache by SetFileWithTTL
+type FileCache interface {
+	CreateTemp() (*os.File, error)
+	SetFileWithTTL(key string, value cache.ObjCore, ttl time.Duration) error
+}
+
+// FileIndex is the Index of a cache that keeps bodies in files. It passes the file methods on,
+// so bodies can still be stored from files, and indexes the objects stored that way.
+type FileIndex struct {
+	*Index
+	Files FileCache // the indexed cache, the same one as Index.Cache
+}
+
+// CreateTemp makes a file to store a body from
+func (x *FileIndex) CreateTemp() (*os.File, error) {
+	return x.Files.CreateTemp()
+}
+
+// SetFileWithTTL stores an object whose body is in a file made by CreateTemp for ttl and
+// indexes it by its surrogate keys
+func (x *FileIndex) SetFileWithTTL(key string, value cache.ObjCore, ttl time.Duration) error {
+	x.Track(key, value)
+	if err := x.Files.SetFileWithTTL(key, value, ttl); err != nil {
+		x.Evicted(key)
+		return err
+	}
+	return nil
+}
+
+// New returns an empty index
+func New() *Index {
+	return &Index{
+		tags: make(map[string]map[string]struct{}),
+		keys: make(map[string][]string),
+	}
+}
+
+// Keys returns the surrogate keys listed in h, without duplicates
+func Keys(h http.Header) []string {
+	var keys []string
+	for _, line := range h.Values(Header) {
+		for _, k := range strings.Fields(line) {
+			if !slices.Contains(keys, k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// Set stores an object and indexes it by its surrogate keys
+func (x *Index) Set(key string, value cache.ObjCore) error {
+	x.Track(key, value)
+	if err := x.Cache.Set(key, value); err != nil {
+		x.Evicted(key)
+		return err
+	}
+	return nil
+}
+
+// SetWithTTL stores an object for ttl and indexes it by its surrogate keys
+func (x *Index) SetWithTTL(key string, value cache.ObjCore, ttl time.Duration) error {
+	x.Track(key, value)
+	if err := x.Cache.SetWithTTL(key, value, ttl); err != nil {
+		x.Evicted(key)
+		return err
+	}
+	return nil
+}
+
+// Delete removes an object from the cache and the index
+func (x *Index) Delete(key string) bool {
+	x.Evicted(key)
+	return x.Cache.Delete(key)
+}
+
+// Flush empties the cache and the index
+func (x *Index) Flush() {
+	x.mu.Lock()
+	clear(x.tags)
+	clear(x.keys)
+	x.mu.Unlock()
+	x.Cache.Flush()
+}
+
+// Track indexes an object that is already in the cache, such as one restored from a snapshot.
+// An object stored before under the same key is replaced in the index.
+func (x *Index) Track(key string, value cache.ObjCore) {
+	tags := Keys(value.Headers)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.untrack(key)
+	if len(tags) == 0 {
+		return
+	}
+	x.keys[key] = tags
+	for _, tag := range tags {
+		if x.tags[tag] == nil {
+			x.tags[tag] = make(map[string]struct{})
+		}
+		x.tags[tag][key] = struct{}{}
+	}
+}
+
+// Evicted drops an object that left the cache from the index
+func (x *Index) Evicted(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.untrack(key)
+}
+
+// untrack removes key from the index, x.mu must be held
+func (x *Index) untrack(key string) {
+	for _, tag := range x.keys[key] {
+		delete(x.tags[tag], key)
+		if len(x.tags[tag]) == 0 {
+			delete(x.tags, tag)
+		}
+	}
+	delete(x.keys, key)
+}
+
+// Purge deletes every object tagged with the surrogate key tag and returns how many were in the cache
+func (x *Index) Purge(tag string) int {
+	x.mu.Lock()
+	keys := slices.Collect(maps.Keys(x.tags[tag]))
+	for _, key := range keys {
+		x.untrack(key)
+	}
+	x.mu.Unlock()
+	purged := 0
+	for _, key := range keys {
+		if x.Cache.Delete(key) {
+			purged++
+		}
+	}
+	return purged
+}
+
+// Len returns the number of surrogate keys and of objects in the index
+func (x *Index) Len() (tags, objects int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return len(x.tags), len(x.keys)
+}
@@ -0,0 +1,102 @@
+package surrogate
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/perbu/hazelnut/cache"
+	"github.com/perbu/hazelnut/cache/mapcache"
+)
+
+// tagged returns an object with the surrogate keys header set to keys
+func tagged(keys string) cache.ObjCore {
+	return cache.ObjCore{Headers: http.Header{Header: {keys}}, Body: []byte("body")}
+}
+
+func TestKeys(t *testing.T) {
+	h := http.Header{Header: {"product-1  category-a", "product-1 home"}}
+	if got, want := Keys(h), []string{"product-1", "category-a", "home"}; !slices.Equal(got, want) {
+		t.Errorf("Keys() = %q, want %q", got, want)
+	}
+	if got := Keys(http.Header{}); got != nil {
+		t.Errorf("Expected no keys, got %q", got)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	x := New()
+	x.Cache = mapcache.New()
+	_ = x.Set("a", tagged("product-1 category-a"))
+	_ = x.Set("b", tagged("product-2 category-a"))
+	_ = x.Set("c", tagged("product-1"))
+	_ = x.Set("d", cache.ObjCore{Body: []byte("untagged")})
+
+	if got := x.Purge("product-1"); got != 2 {
+		t.Errorf("Expected 2 objects purged, got %d", got)
+	}
+	for key, want := range map[string]bool{"a": false, "b": true, "c": false, "d": true} {
+		if _, found := x.Get(key); found != want {
+			t.Errorf("Expected %s found = %v", key, want)
+		}
+	}
+	// a was purged, so category-a only tags b
+	if tags, objects := x.Len(); tags != 2 || objects != 1 {
+		t.Errorf("Expected 2 tags and 1 object in the index, got %d and %d", tags, objects)
+	}
+	if got := x.Purge("product-1"); got != 0 {
+		t.Errorf("Expected nothing left to purge, got %d", got)
+	}
+
+	t.Run("a replaced object is retagged", func(t *testing.T) {
+		_ = x.Set("b", tagged("product-3"))
+		if got := x.Purge("category-a"); got != 0 {
+			t.Errorf("Expected the old tags to be gone, purged %d", got)
+		}
+		if got := x.Purge("product-3"); got != 1 {
+			t.Errorf("Expected the new tag to purge b, purged %d", got)
+		}
+	})
+
+	t.Run("deleted, evicted and flushed objects leave the index", func(t *testing.T) {
+		_ = x.Set("e", tagged("gone"))
+		_ = x.Set("f", tagged("gone"))
+		x.Delete("e")
+		x.Evicted("f")
+		if tags, objects := x.Len(); tags != 0 || objects != 0 {
+			t.Errorf("Expected an empty index, got %d tags and %d objects", tags, objects)
+		}
+		_ = x.Set("g", tagged("flushed"))
+		x.Flush()
+		if tags, objects := x.Len(); tags != 0 || objects != 0 {
+			t.Errorf("Expected an empty index after a flush, got %d tags and %d objects", tags, objects)
+		}
+	})
+}
+
+func TestConcurrentPurge(t *testing.T) {
+	x := New()
+	x.Cache = mapcache.New()
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Go(func() {
+			for i := range 200 {
+				key := fmt.Sprintf("%d-%d", w, i)
+				_ = x.Set(key, tagged(fmt.Sprintf("all worker-%d", w)))
+				if i%10 == 0 {
+					x.Purge(fmt.Sprintf("worker-%d", (w+1)%8))
+				}
+			}
+		})
+	}
+	wg.Wait()
+	x.Purge("all")
+	if tags, objects := x.Len(); tags != 0 || objects != 0 {
+		t.Errorf("Expected an empty index, got %d tags and %d objects", tags, objects)
+	}
+	if objects := x.Stats().Objects; objects != 0 {
+		t.Errorf("Expected an empty cache, got %d objects", objects)
+	}
+}
@@ -0,0 +1,208 @@
+// Package tieredcache keeps hot objects in memory and the long tail on disk. Lookups check the
+// memory tier first and fall back to the disk tier, disk hits are promoted back into memory.
+package tieredcache
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/perbu/hazelnut/cache"
+	"github.com/perbu/hazelnut/cache/diskcache"
+	"github.com/perbu/hazelnut/cache/lrucache"
+)
+
+// TieredCache combines a memory tier and a disk tier. By default every object is written to
+// both, the memory tier holds the ones in use and the disk tier all of them. With demotion,
+// objects are only written to memory and move to disk when the memory tier evicts them, so each
+// object lives in one tier and the disk isn't written for objects that never leave memory.
+// Objects keep the TTL they have left when they move between the tiers.
+type TieredCache struct {
+	mem     *lrucache.LRUCache
+	disk    *diskcache.DiskCache
+	demote  bool
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+	onEvict cache.EvictFunc
+}
+
+// New combines mem and disk into a tiered cache, demote selects demotion over writing objects
+// to both tiers. The tiers belong to the cache, it registers their callbacks.
+func New(mem *lrucache.LRUCache, disk *diskcache.DiskCache, demote bool) *TieredCache {
+	t := &TieredCache{mem: mem, disk: disk, demote: demote}
+	mem.SetOnDrop(t.dropped)
+	disk.SetOnEvict(t.diskEvicted)
+	return t
+}
+
+// SetOnEvict registers a callback for objects that leave both tiers because they were evicted or
+// expired. An object that moves to disk isn't evicted. It must be called before the cache is used.
+func (t *TieredCache) SetOnEvict(fn cache.EvictFunc) {
+	t.onEvict = fn
+}
+
+// Get returns the object from memory, or from disk with its body read back into memory. A disk
+// hit is promoted to the memory tier, with demotion it leaves the disk tier.
+func (t *TieredCache) Get(key string) (cache.ObjCore, bool) {
+	if obj, found := t.mem.Get(key); found {
+		t.hits.Add(1)
+		return obj, true
+	}
+	obj, expires, found := t.disk.GetWithExpiry(key)
+	if !found {
+		t.misses.Add(1)
+		return cache.ObjCore{}, false
+	}
+	body, err := os.ReadFile(obj.BodyFile)
+	if err != nil {
+		// evicted since the lookup
+		t.misses.Add(1)
+		return cache.ObjCore{}, false
+	}
+	obj.Body, obj.BodyFile = body, ""
+	if ttl, ok := remaining(expires); ok {
+		if t.demote {
+			// first, the memory tier may refuse the object and demote it again right away
+			t.disk.Delete(key)
+		}
+		_ = t.mem.SetWithTTL(key, obj, ttl)
+	}
+	t.hits.Add(1)
+	return obj, true
+}
+
+// Set adds an object to the cache with its TTL taken from the response headers.
+// Objects the headers say not to cache are not stored.
+func (t *TieredCache) Set(key string, value cache.ObjCore) error {
+	ttl, cacheable := cache.FreshnessFor(value.Headers)
+	if !cacheable {
+		return nil
+	}
+	return t.SetWithTTL(key, value, ttl)
+}
+
+// SetWithTTL adds an object to the cache with a specific TTL, 0 means no expiry. Without demotion
+// it fails when the body can't be written to disk, and then isn't stored in memory either.
+func (t *TieredCache) SetWithTTL(key string, value cache.ObjCore, ttl time.Duration) error {
+	if t.demote {
+		// an older copy on disk mustn't be promoted over this one
+		t.disk.Delete(key)
+	} else if err := t.disk.SetWithTTL(key, value, ttl); err != nil {
+		return err
+	}
+	return t.mem.SetWithTTL(key, value, ttl)
+}
+
+// CreateTemp creates a file in the disk tier for a body that is too large to hold in memory, to
+// be stored with SetFileWithTTL
+func (t *TieredCache) CreateTemp() (*os.File, error) {
+	return t.disk.CreateTemp()
+}
+
+// SetFileWithTTL adds an object whose body is in the file value.BodyFile, made by CreateTemp, to
+// the disk tier only: it was too large to hold in memory. Any older copy in memory is deleted.
+func (t *TieredCache) SetFileWithTTL(key string, value cache.ObjCore, ttl time.Duration) error {
+	t.mem.Delete(key)
+	return t.disk.SetFileWithTTL(key, value, ttl)
+}
+
+// Delete removes an object from both tiers, it reports whether it was in either
+func (t *TieredCache) Delete(key string) bool {
+	inMem := t.mem.Delete(key)
+	onDisk := t.disk.Delete(key)
+	return inMem || onDisk
+}
+
+// Range calls fn for every object in the cache with the time it expires, zero for never. Objects
+// in memory come first, objects only on disk have BodyFile set instead of Body. It stops when fn
+// returns false. fn must not call back into the cache.
+func (t *TieredCache) Range(fn func(key string, value cache.ObjCore, expires time.Time) bool) {
+	seen := make(map[string]struct{})
+	more := true
+	t.mem.Range(func(key string, value cache.ObjCore, expires time.Time) bool {
+		seen[key] = struct{}{}
+		more = fn(key, value, expires)
+		return more
+	})
+	if !more {
+		return
+	}
+	t.disk.Range(func(key string, value cache.ObjCore, expires time.Time) bool {
+		if _, found := seen[key]; found {
+			return true
+		}
+		return fn(key, value, expires)
+	})
+}
+
+// Wait blocks until the sets so far have been applied to the memory tier, which applies them
+// asynchronously
+func (t *TieredCache) Wait() {
+	t.mem.Wait()
+}
+
+// Flush removes every object from both tiers and resets the statistics
+func (t *TieredCache) Flush() {
+	t.mem.Flush()
+	t.disk.Flush()
+	t.hits.Store(0)
+	t.misses.Store(0)
+}
+
+// Stats returns the current object count and size, and the hit ratio of lookups in either tier.
+// Without demotion the disk tier holds every object and its count and size are reported, with
+// demotion those of both tiers are added up.
+func (t *TieredCache) Stats() cache.Stats {
+	st := t.disk.Stats()
+	if t.demote {
+		mem := t.mem.Stats()
+		st.Objects += mem.Objects
+		st.Bytes += mem.Bytes
+	}
+	st.Hits, st.Misses = t.hits.Load(), t.misses.Load()
+	st.HitRatio = 0
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRatio = float64(st.Hits) / float64(total)
+	}
+	return st
+}
+
+// dropped is called when the memory tier evicts an object or refuses to store it. Without
+// demotion the object is still on disk. With it the object moves to disk, unless it has expired
+// or can't be written.
+func (t *TieredCache) dropped(key string, obj cache.ObjCore, expires time.Time) {
+	if !t.demote {
+		return
+	}
+	if ttl, ok := remaining(expires); ok && t.disk.SetWithTTL(key, obj, ttl) == nil {
+		return
+	}
+	t.evicted(key, int64(len(obj.Body)))
+}
+
+// diskEvicted is called when the disk tier evicts an object or finds it expired. Without
+// demotion a copy may still be in memory, it goes too so the memory tier only holds objects
+// that are on disk.
+func (t *TieredCache) diskEvicted(key string, size int64) {
+	if !t.demote {
+		t.mem.Delete(key)
+	}
+	t.evicted(key, size)
+}
+
+// evicted calls the eviction callback
+func (t *TieredCache) evicted(key string, size int64) {
+	if t.onEvict != nil {
+		t.onEvict(key, size)
+	}
+}
+
+// remaining returns the TTL left until expires, 0 for no expiry. It reports false when the
+// object has expired.
+func remaining(expires time.Time) (time.Duration, bool) {
+	if expires.IsZero() {
+		return 0, true
+	}
+	ttl := time.Until(expires)
+	return ttl, ttl > 0
+}
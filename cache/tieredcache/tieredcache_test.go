@@ -0,0 +1,191 @@
+package tieredcache
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perbu/hazelnut/cache"
+	"github.com/perbu/hazelnut/cache/diskcache"
+	"github.com/perbu/hazelnut/cache/lrucache"
+)
+
+func object(body string) cache.ObjCore {
+	return cache.ObjCore{
+		Headers: http.Header{"Content-Type": {"text/plain"}},
+		Body:    []byte(body),
+	}
+}
+
+// newTiers creates a memory tier of memSize bytes and a disk tier of diskSize bytes
+func newTiers(t testing.TB, memSize, diskSize int64) (*lrucache.LRUCache, *diskcache.DiskCache) {
+	mem, err := lrucache.New(100, memSize)
+	if err != nil {
+		t.Fatalf("lrucache.New failed: %v", err)
+	}
+	disk, err := diskcache.New(t.TempDir(), diskSize)
+	if err != nil {
+		t.Fatalf("diskcache.New failed: %v", err)
+	}
+	return mem, disk
+}
+
+func TestTieredCache(t *testing.T) {
+	t.Run("Objects are written to both tiers and promoted from disk", func(t *testing.T) {
+		mem, disk := newTiers(t, 1024*1024, 1024)
+		c := New(mem, disk, false)
+		if err := c.SetWithTTL("key", object("both tiers"), 0); err != nil {
+			t.Fatalf("SetWithTTL failed: %v", err)
+		}
+		c.Wait()
+		if _, found := mem.Get("key"); !found {
+			t.Fatal("Expected the object in memory")
+		}
+		if _, found := disk.Get("key"); !found {
+			t.Fatal("Expected the object on disk")
+		}
+
+		// as if the memory tier had evicted it
+		mem.Delete("key")
+		obj, found := c.Get("key")
+		if !found || string(obj.Body) != "both tiers" || obj.BodyFile != "" {
+			t.Fatalf("Expected the body read back from disk, got %+v", obj)
+		}
+		c.Wait()
+		if _, found := mem.Get("key"); !found {
+			t.Error("Expected the disk hit to be promoted to memory")
+		}
+		if _, found := disk.Get("key"); !found {
+			t.Error("Expected the object to stay on disk")
+		}
+		if st := c.Stats(); st.Objects != 1 || st.Hits != 1 || st.Misses != 0 {
+			t.Errorf("Expected 1 object and 1 hit, got %+v", st)
+		}
+	})
+
+	t.Run("Objects leaving memory are demoted to disk", func(t *testing.T) {
+		mem, disk := newTiers(t, 64, 1024)
+		c := New(mem, disk, true)
+		var evicted []string
+		c.SetOnEvict(func(key string, size int64) { evicted = append(evicted, key) })
+		// larger than the memory tier, it's refused and goes to disk
+		body := strings.Repeat("x", 100)
+		if err := c.SetWithTTL("key", object(body), time.Minute); err != nil {
+			t.Fatalf("SetWithTTL failed: %v", err)
+		}
+		c.Wait()
+		if _, found := mem.Get("key"); found {
+			t.Error("Expected the object not to fit in memory")
+		}
+		if _, found := disk.Get("key"); !found {
+			t.Fatal("Expected the object to be demoted to disk")
+		}
+		obj, found := c.Get("key")
+		if !found || string(obj.Body) != body {
+			t.Errorf("Expected the demoted object to be found, got %+v", obj)
+		}
+		c.Wait()
+		if _, found := disk.Get("key"); !found {
+			t.Error("Expected the object to be demoted again after its promotion was refused")
+		}
+		if len(evicted) != 0 {
+			t.Errorf("Expected demotion not to count as eviction, got %v", evicted)
+		}
+	})
+
+	t.Run("TTLs are honored at both tiers", func(t *testing.T) {
+		mem, disk := newTiers(t, 1024*1024, 1024)
+		c := New(mem, disk, false)
+		_ = c.SetWithTTL("short", object("short lived"), 20*time.Millisecond)
+		_ = c.SetWithTTL("long", object("long lived"), time.Minute)
+		c.Wait()
+		mem.Delete("short")
+		mem.Delete("long")
+		time.Sleep(30 * time.Millisecond)
+		if _, found := c.Get("short"); found {
+			t.Error("Expected the expired object to be a miss on disk")
+		}
+		if _, found := c.Get("long"); !found {
+			t.Fatal("Expected the fresh object to be found on disk")
+		}
+		c.Wait()
+		c.Range(func(key string, _ cache.ObjCore, expires time.Time) bool {
+			if key == "long" && (expires.IsZero() || time.Until(expires) > time.Minute-30*time.Millisecond) {
+				t.Errorf("Expected the promoted object to keep the TTL it had left, expires %v", expires)
+			}
+			return true
+		})
+	})
+
+	t.Run("Disk evictions remove the memory copy", func(t *testing.T) {
+		mem, disk := newTiers(t, 1024*1024, 10)
+		c := New(mem, disk, false)
+		var evicted []string
+		c.SetOnEvict(func(key string, size int64) { evicted = append(evicted, key) })
+		_ = c.SetWithTTL("a", object("aaaaaaaa"), 0)
+		c.Wait()
+		_ = c.SetWithTTL("b", object("bbbbbbbb"), 0)
+		c.Wait()
+		if len(evicted) != 1 || evicted[0] != "a" {
+			t.Fatalf("Expected a to be evicted, got %v", evicted)
+		}
+		if _, found := c.Get("a"); found {
+			t.Error("Expected the evicted object to be gone from memory too")
+		}
+	})
+
+	t.Run("Delete and Flush clear both tiers", func(t *testing.T) {
+		mem, disk := newTiers(t, 1024*1024, 1024)
+		c := New(mem, disk, false)
+		_ = c.SetWithTTL("a", object("a"), 0)
+		_ = c.SetWithTTL("b", object("b"), 0)
+		c.Wait()
+		if !c.Delete("a") || c.Delete("a") {
+			t.Error("Expected Delete to find the object only once")
+		}
+		c.Flush()
+		if _, found := c.Get("b"); found {
+			t.Error("Expected Flush to remove the object from both tiers")
+		}
+	})
+}
+
+func BenchmarkMemoryHit(b *testing.B) {
+	mem, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		b.Fatalf("lrucache.New failed: %v", err)
+	}
+	_ = mem.SetWithTTL("key", object(strings.Repeat("x", 16*1024)), 0)
+	mem.Wait()
+	for b.Loop() {
+		if _, found := mem.Get("key"); !found {
+			b.Fatal("Expected a hit")
+		}
+	}
+}
+
+func BenchmarkTieredMemoryHit(b *testing.B) {
+	mem, disk := newTiers(b, 1024*1024, 1024*1024)
+	c := New(mem, disk, false)
+	_ = c.SetWithTTL("key", object(strings.Repeat("x", 16*1024)), 0)
+	c.Wait()
+	for b.Loop() {
+		if _, found := c.Get("key"); !found {
+			b.Fatal("Expected a hit")
+		}
+	}
+}
+
+func BenchmarkTieredDiskHit(b *testing.B) {
+	// the memory tier is too small for the object, every hit is read from disk
+	mem, disk := newTiers(b, 1024, 1024*1024)
+	c := New(mem, disk, false)
+	_ = c.SetWithTTL("key", object(strings.Repeat("x", 16*1024)), 0)
+	c.Wait()
+	for b.Loop() {
+		if _, found := c.Get("key"); !found {
+			b.Fatal("Expected a hit")
+		}
+	}
+}
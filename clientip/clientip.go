@@ -0,0 +1,72 @@
+// Package clientip finds the address of the client that sent a request, looking through the
+// proxies in front of Hazelnut that are trusted to say who their client was
+package clientip
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Proxies are the address prefixes of trusted proxies. A trusted proxy's X-Forwarded-For is
+// believed, anybody else's is ignored. The zero value trusts no one.
+type Proxies []netip.Prefix
+
+// Trusted reports whether addr is a trusted proxy
+func (p Proxies) Trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddr returns the address of the client of req. When the directly connected peer is a
+// trusted proxy, X-Forwarded-For is walked from the right, the end the proxies appended to, and
+// the first address that isn't a trusted proxy is the client. Entries further left were written
+// by someone who isn't trusted and are never looked at, so they can't be spoofed. When every
+// entry is a trusted proxy the leftmost is returned, and when an entry can't be parsed the proxy
+// that forwarded it.
+func (p Proxies) ClientAddr(req *http.Request) netip.Addr {
+	addr := Peer(req)
+	if !addr.IsValid() || !p.Trusted(addr) {
+		return addr
+	}
+	var hops []string
+	for _, line := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(line, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseHop(strings.TrimSpace(hops[i]))
+		if !ok {
+			return addr
+		}
+		addr = hop
+		if !p.Trusted(addr) {
+			return addr
+		}
+	}
+	return addr
+}
+
+// Peer returns the address of the directly connected peer of req, which may be a proxy
+func Peer(req *http.Request) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
+
+// parseHop parses an X-Forwarded-For entry, an address that some proxies follow with a port
+func parseHop(s string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), true
+	}
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
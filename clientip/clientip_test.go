@@ -0,0 +1,51 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	proxies := Proxies{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+	tests := []struct {
+		name   string
+		peer   string
+		xff    []string
+		policy Proxies
+		want   string
+	}{
+		{"no proxies trusted", "10.0.0.1:1234", []string{"203.0.113.7"}, nil, "10.0.0.1"},
+		{"untrusted peer can't spoof", "198.51.100.1:1234", []string{"203.0.113.7"}, proxies, "198.51.100.1"},
+		{"trusted peer", "10.0.0.1:1234", []string{"203.0.113.7"}, proxies, "203.0.113.7"},
+		{"trusted peer without header", "10.0.0.1:1234", nil, proxies, "10.0.0.1"},
+		{"rightmost untrusted wins", "10.0.0.1:1234", []string{"192.0.2.66, 203.0.113.7, 10.1.2.3"}, proxies, "203.0.113.7"},
+		{"header lines are joined", "10.0.0.1:1234", []string{"192.0.2.66", "203.0.113.7, 10.1.2.3"}, proxies, "203.0.113.7"},
+		{"all trusted", "10.0.0.1:1234", []string{"10.9.9.9, 10.1.2.3"}, proxies, "10.9.9.9"},
+		{"entry with a port", "10.0.0.1:1234", []string{"203.0.113.7:5555"}, proxies, "203.0.113.7"},
+		{"garbage stops the walk", "10.0.0.1:1234", []string{"203.0.113.7, unknown, 10.1.2.3"}, proxies, "10.1.2.3"},
+		{"ipv6", "[fd00::1]:1234", []string{"2001:db8::7"}, proxies, "2001:db8::7"},
+		{"mapped peer", "[::ffff:10.0.0.1]:1234", []string{"203.0.113.7"}, proxies, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.peer
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := tt.policy.ClientAddr(req); got != netip.MustParseAddr(tt.want) {
+				t.Errorf("ClientAddr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("unparseable peer", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "pipe"
+		if got := proxies.ClientAddr(req); got.IsValid() {
+			t.Errorf("Expected no address, got %v", got)
+		}
+	})
+}
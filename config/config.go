@@ -1,11 +1,20 @@
 package config
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"log/slog"
+	"maps"
+	"math"
+	"mime"
+	"net"
+	"net/netip"
 	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -18,42 +27,275 @@ type Config struct {
 	Frontend       FrontendConfig           `yaml:"frontend"`
 	Cache          CacheConfig              `yaml:"cache"`
 	Logging        LoggingConfig            `yaml:"logging"`
+	GeoIP          GeoIPConfig              `yaml:"geoip"`
+	Admin          AdminConfig              `yaml:"admin"`
+	Warmup         WarmupConfig             `yaml:"warmup"`
+	Devices        DeviceConfig             `yaml:"devices"`
+	Shutdown       ShutdownConfig           `yaml:"shutdown"`
+}
+
+// ShutdownConfig controls the order and pace of a graceful shutdown
+type ShutdownConfig struct {
+	DrainTimeout time.Duration `yaml:"drain_timeout"` // How long requests in flight get to finish, default 30s
+	FinalScrape  time.Duration `yaml:"final_scrape"`  // How long metrics stay up after the frontend has drained, default 0
+}
+
+// BypassRuleConfig matches requests that are never cached. Every condition that is set must match.
+type BypassRuleConfig struct {
+	PathPrefix string `yaml:"path_prefix"` // The path starts with this
+	Path       string `yaml:"path"`        // Go regular expression matched against the path
+	Header     string `yaml:"header"`      // The request has this header
+	Cookie     string `yaml:"cookie"`      // The request has this cookie
+}
+
+// TTLRuleConfig overrides the TTL of responses to requests whose path matches. Every path
+// condition that is set must match.
+type TTLRuleConfig struct {
+	PathPrefix string        `yaml:"path_prefix"` // The path starts with this
+	Path       string        `yaml:"path"`        // Go regular expression matched against the path
+	TTL        time.Duration `yaml:"ttl"`         // How long matching responses are cached
+	Force      bool          `yaml:"force"`       // Also cache responses whose Cache-Control says no-store, private or no-cache
+}
+
+// DeviceConfig enables classifying clients by device from their User-Agent
+type DeviceConfig struct {
+	Enabled bool               `yaml:"enabled"` // Fold the device class into the cache key
+	Header  string             `yaml:"header"`  // Request header carrying the device class to the backend, default X-Device-Type
+	Rules   []DeviceRuleConfig `yaml:"rules"`   // Tried in order, the default rules tell bot and mobile from desktop
+}
+
+// DeviceRuleConfig puts user agents matching a regular expression in a device class
+type DeviceRuleConfig struct {
+	Class   string `yaml:"class"`
+	Pattern string `yaml:"pattern"` // Go regular expression, add (?i) to ignore case
+}
+
+// WarmupConfig lists URLs requested at startup to fill the cache
+type WarmupConfig struct {
+	URLs        []string `yaml:"urls"`        // URLs to warm
+	Sitemap     string   `yaml:"sitemap"`     // URL of a sitemap.xml whose URLs are warmed as well
+	Concurrency int      `yaml:"concurrency"` // URLs warmed at the same time, default 4
+}
+
+// AdminConfig controls access to the admin API served on the metrics port
+type AdminConfig struct {
+	Allow    []string `yaml:"allow"`    // Client addresses or CIDR prefixes allowed to use it, default loopback only
+	Username string   `yaml:"username"` // Basic auth required on the metrics port, with password (optional)
+	Password string   `yaml:"password"`
+	Token    string   `yaml:"token"` // Bearer token accepted on the metrics port (optional)
+}
+
+// GetAllow returns the parsed allow-list, loopback addresses when none is configured
+func (ac *AdminConfig) GetAllow() ([]netip.Prefix, error) {
+	if len(ac.Allow) == 0 {
+		return []netip.Prefix{
+			netip.MustParsePrefix("127.0.0.0/8"),
+			netip.MustParsePrefix("::1/128"),
+		}, nil
+	}
+	return parsePrefixes(ac.Allow)
+}
+
+// parsePrefixes parses a list of addresses and CIDR prefixes, an address is a prefix of its own
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", entry, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %q: %w", entry, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// GeoIPConfig enables country lookups of the client IP
+type GeoIPConfig struct {
+	Database string `yaml:"database"` // Path to a MaxMind Country or City database, empty disables GeoIP
+	Header   string `yaml:"header"`   // Request header carrying the country to the backend, default X-Country-Code
 }
 
 type LoggingConfig struct {
-	Level  string `yaml:"level"`  // debug,info,warn,error
-	Format string `yaml:"format"` // json or text
+	Level         string   `yaml:"level"`          // debug,info,warn,error
+	Format        string   `yaml:"format"`         // json or text
+	DumpBodies    int      `yaml:"dump_bodies"`    // Bytes of request and response bodies logged at debug level, 0 disables
+	RedactHeaders []string `yaml:"redact_headers"` // Headers left out of body dumps, on top of Authorization and cookies
+	AccessLog     string   `yaml:"access_log"`     // File the access log is appended to, "stdout" or empty to disable
+	AccessFormat  string   `yaml:"access_format"`  // common or combined, default combined
 }
 
 // BackendConfig contains backend-specific configuration
 type BackendConfig struct {
-	Target  string        `yaml:"target"`
-	Timeout time.Duration `yaml:"timeout"`
+	Target           string            `yaml:"target"`
+	Timeout          time.Duration     `yaml:"timeout"`                 // limit on the whole exchange, body included, 0 means none
+	DialTimeout      time.Duration     `yaml:"dial_timeout"`            // how long connecting may take, default 10s
+	ResponseTimeout  time.Duration     `yaml:"response_timeout"`        // how long until the response headers arrive, default 30s
+	MaxResponseBytes string            `yaml:"max_response_bytes"`      // e.g. "100M", empty means unlimited
+	OversizePolicy   string            `yaml:"oversize_policy"`         // abort or stream
+	CacheSetCookie   bool              `yaml:"cache_set_cookie"`        // cache responses carrying Set-Cookie, off by default
+	CacheableStatus  []int             `yaml:"cacheable_status"`        // status codes that may be cached, default 200, 203, 204, 300, 301, 404 and 410
+	HTTP2            *bool             `yaml:"http2"`                   // negotiate HTTP/2 with https backends, default true
+	MaxIdleConns     int               `yaml:"max_idle_conns"`          // idle connections kept to the backend, default 1000
+	MaxIdlePerHost   int               `yaml:"max_idle_conns_per_host"` // the same per host name, default 100
+	IdleConnTimeout  time.Duration     `yaml:"idle_conn_timeout"`       // how long an idle connection is kept, default 90s
+	InsecureSkipTLS  bool              `yaml:"insecure_skip_verify"`    // don't verify the backend's certificate, for testing only
+	CAFile           string            `yaml:"ca_file"`                 // PEM file with the CAs the backend's certificate is verified against
+	ServerName       string            `yaml:"server_name"`             // TLS name sent as SNI and verified in the certificate, default the request's host
+	RequestHeaders   map[string]string `yaml:"request_headers"`         // set on every backend request, a Host entry overrides the Host header
 }
 
-// ParseTarget parses the target baseUrl into scheme, host and port
+// GetHTTP2 reports whether HTTP/2 is negotiated with the backend
+func (bc *BackendConfig) GetHTTP2() bool {
+	return bc.HTTP2 == nil || *bc.HTTP2
+}
+
+// GetMaxResponseBytes returns the parsed maximum response size, 0 means unlimited
+func (bc *BackendConfig) GetMaxResponseBytes() (int64, error) {
+	if bc.MaxResponseBytes == "" {
+		return 0, nil
+	}
+	return ParseSize(bc.MaxResponseBytes)
+}
+
+// ParseTarget parses the target URL into scheme, host and port. Without a port in the URL, the
+// port is the scheme's default: 443 for https and 80 for http. Targets without an http or https
+// scheme, without a host or with a port out of range are rejected.
 func (bc *BackendConfig) ParseTarget() (string, string, int, error) {
 	u, err := url.Parse(bc.Target)
 	if err != nil {
-		return "", "", 0, fmt.Errorf("url.Parse(%q): %w", bc.Target, err)
+		return "", "", 0, err
 	}
-	port, err := strconv.Atoi(u.Port())
-	if err != nil {
+	var port int
+	switch u.Scheme {
+	case "https":
+		port = 443
+	case "http":
 		port = 80
+	default:
+		return "", "", 0, fmt.Errorf("%q must start with http:// or https://", bc.Target)
+	}
+	if u.Hostname() == "" {
+		return "", "", 0, fmt.Errorf("%q has no host", bc.Target)
+	}
+	if p := u.Port(); p != "" {
+		port, err = strconv.Atoi(p)
+		if err != nil || port < 1 || port > math.MaxUint16 {
+			return "", "", 0, fmt.Errorf("%q has an invalid port", bc.Target)
+		}
 	}
 	return u.Scheme, u.Hostname(), port, nil
-
 }
 
 // FrontendConfig contains frontend-specific configuration
 type FrontendConfig struct {
-	BaseURL     string `yaml:"base_url"`
-	MetricsPort int    `yaml:"metricsport"`
-	Cert        string `yaml:"cert"`
-	Key         string `yaml:"key"`
+	BaseURL        string              `yaml:"base_url"`
+	Listen         []string            `yaml:"listen"` // Addresses to listen on, like ":8080" or "[::1]:8080", instead of the one of base_url
+	MetricsPort    int                 `yaml:"metricsport"`
+	Cert           string              `yaml:"cert"`
+	Key            string              `yaml:"key"`
+	DeadlineHeader string              `yaml:"deadline_header"` // Header sent to the backend with the ms left before the request deadline
+	Forwarded      *bool               `yaml:"forwarded"`       // Send X-Forwarded-* and Forwarded headers to the backend, default true
+	Gzip           *bool               `yaml:"gzip"`            // Compress cached text for clients that accept gzip, default true
+	H2C            bool                `yaml:"h2c"`             // Also serve HTTP/2 without TLS, for load balancers that terminate TLS
+	OptionsAllow   []string            `yaml:"options_allow"`   // Methods listed in the Allow header of the response to OPTIONS *
+	TrustedProxies []string            `yaml:"trusted_proxies"` // Addresses or CIDR prefixes of proxies whose X-Forwarded-For is believed
+	Via            string              `yaml:"via"`             // Pseudonym in the Via header, like the host name, default hazelnut
+	Malformed      ErrorResponseConfig `yaml:"malformed"`       // Served instead of a backend response that violates HTTP
+	Timeouts       TimeoutsConfig      `yaml:"timeouts"`        // Protect against slow clients holding connections open
+	StripHeaders   StripHeadersConfig  `yaml:"strip_headers"`   // Headers removed from backend responses
+	ErrorPage      ErrorPageConfig     `yaml:"error_page"`      // Served when the backend can't be reached
+	Maintenance    MaintenanceConfig   `yaml:"maintenance"`     // Served instead of the backends while maintenance mode is on
+	HeaderRules    HeaderRulesConfig   `yaml:"header_rules"`    // Change response headers before caching and before sending
+}
+
+// HeaderRulesConfig are the rules changing response headers, each list is applied in order
+type HeaderRulesConfig struct {
+	Store  []HeaderRuleConfig `yaml:"store"`  // Applied to backend responses before they are cached
+	Client []HeaderRuleConfig `yaml:"client"` // Applied to every response as it is sent, hits included
+}
+
+// HeaderRuleConfig changes one response header
+type HeaderRuleConfig struct {
+	Action string `yaml:"action"` // set, add, remove or rewrite
+	Name   string `yaml:"name"`   // Header name
+	Value  string `yaml:"value"`  // Value set or added, the replacement for rewrite ($1 expands a group)
+	Match  string `yaml:"match"`  // Go regular expression matched against each value, rewrite only
+}
+
+// MaintenanceConfig is the page served with a 503 while maintenance mode is on. The admin API
+// switches it on and off.
+type MaintenanceConfig struct {
+	Enabled     bool          `yaml:"enabled"`      // Start in maintenance mode
+	ContentType string        `yaml:"content_type"` // default text/html; charset=utf-8
+	Body        string        `yaml:"body"`         // default a page saying the service is down for maintenance
+	File        string        `yaml:"file"`         // file holding the body, instead of body
+	RetryAfter  time.Duration `yaml:"retry_after"`  // sent in Retry-After, default 1m
+	ServeHits   bool          `yaml:"serve_hits"`   // Keep serving cached objects, only misses get the page
+}
+
+// ErrorPageConfig is the page served when the backend can't be reached. Without one a built-in
+// page is served, a 504 when the backend timed out and a 502 otherwise.
+type ErrorPageConfig struct {
+	Status      int    `yaml:"status"`       // 4xx or 5xx, default 504 on a timeout and 502 otherwise
+	ContentType string `yaml:"content_type"` // default text/html; charset=utf-8
+	Body        string `yaml:"body"`         // default a page naming the status
+	File        string `yaml:"file"`         // file holding the body, instead of body
+}
+
+// StripHeadersConfig controls which headers of backend responses reach clients and the cache
+type StripHeadersConfig struct {
+	Headers   []string `yaml:"headers"`    // Removed on top of the hop-by-hop headers
+	Replace   bool     `yaml:"replace"`    // Headers replaces the hop-by-hop headers instead
+	SetCookie bool     `yaml:"set_cookie"` // Keep Set-Cookie out of cached objects, only the client of the fill gets it
+}
+
+// TimeoutsConfig are the client timeouts of the frontend, 0 means the default
+type TimeoutsConfig struct {
+	ReadHeader time.Duration `yaml:"read_header"` // Reading the request headers, default 10s
+	Read       time.Duration `yaml:"read"`        // Reading the whole request, default 1m
+	Write      time.Duration `yaml:"write"`       // Writing the whole response, default no limit as it cuts off slow downloads
+	Idle       time.Duration `yaml:"idle"`        // Keep-alive connections waiting for the next request, default 2m
 }
 
-// GetListenAddr returns the formatted listen address
+// ErrorResponseConfig is an error response served by hazelnut itself
+type ErrorResponseConfig struct {
+	Status int    `yaml:"status"` // 4xx or 5xx, default 502
+	Body   string `yaml:"body"`   // plain text body
+}
+
+// GetForwarded reports whether the forwarding headers are sent to the backend
+func (fc *FrontendConfig) GetForwarded() bool {
+	return fc.Forwarded == nil || *fc.Forwarded
+}
+
+// GetGzip reports whether cached objects are compressed for clients that accept gzip
+func (fc *FrontendConfig) GetGzip() bool {
+	return fc.Gzip == nil || *fc.Gzip
+}
+
+// GetTrustedProxies returns the parsed trusted proxies, none when the list is empty
+func (fc *FrontendConfig) GetTrustedProxies() ([]netip.Prefix, error) {
+	return parsePrefixes(fc.TrustedProxies)
+}
+
+// GetListenAddrs returns the addresses to listen on: the listen list, or the address of the
+// base URL when it is empty
+func (fc *FrontendConfig) GetListenAddrs() []string {
+	if len(fc.Listen) > 0 {
+		return fc.Listen
+	}
+	return []string{fc.GetListenAddr()}
+}
+
+// GetListenAddr returns the formatted listen address of the base URL
 func (fc *FrontendConfig) GetListenAddr() string {
 	// parse the port from the base URL
 	u, err := url.Parse(fc.BaseURL)
@@ -73,44 +315,173 @@ func (fc *FrontendConfig) GetListenAddr() string {
 
 // CacheConfig contains cache-specific configuration
 type CacheConfig struct {
-	MaxObj     string `yaml:"maxobj"`
-	MaxCost    string `yaml:"maxcost"`
-	IgnoreHost bool   `yaml:"ignorehost"` // When true, cache keys are generated without considering the host
+	Type            string                       `yaml:"type"` // lru (default) bounded by maxobj and maxcost, map: bounded by maxcost, evicts at random, or tiered: lru in front of disk_dir
+	MaxObj          string                       `yaml:"maxobj"`
+	MaxCost         string                       `yaml:"maxcost"`
+	IgnoreHost      bool                         `yaml:"ignorehost"`           // When true, cache keys are generated without considering the host
+	Methods         map[string]MethodCacheConfig `yaml:"methods"`              // Per-method caching policy, GET and HEAD are cached by default
+	MaxObjectSize   string                       `yaml:"max_object_size"`      // Largest body that is cached, defaults to maxcost. Larger ones are streamed
+	BufferLimit     string                       `yaml:"buffer_limit"`         // Largest body a miss buffers in memory, larger ones spill to disk_dir or are streamed
+	NegativeTTL     time.Duration                `yaml:"negative_ttl"`         // How long 404 and 410 responses are cached, 0 disables
+	Negative5xx     bool                         `yaml:"negative_cache_5xx"`   // Also negatively cache 5xx responses
+	TTLJitter       int                          `yaml:"ttl_jitter"`           // Shorten TTLs randomly by up to this percentage, 0 (default) disables
+	FillEvents      bool                         `yaml:"fill_events"`          // Emit cache fill progress metrics and debug events
+	Query           QueryConfig                  `yaml:"query"`                // How the query string goes into the cache key
+	Path            PathConfig                   `yaml:"path"`                 // How the path is canonicalized into the cache key
+	Key             KeyConfig                    `yaml:"key"`                  // Which parts of a request make up the cache key
+	VaryCookies     []string                     `yaml:"vary_cookies"`         // Cookies folded into the key, Vary: Cookie responses are only cached when set
+	MaxFills        int                          `yaml:"max_fills"`            // Misses fetching from the backend at the same time, 0 means no limit
+	MaxFillsPerKey  int                          `yaml:"max_fills_per_key"`    // The same for a single cache key, 0 means no limit
+	Persist         PersistConfig                `yaml:"persist"`              // Save the cache to disk and restore it on startup
+	DiskDir         string                       `yaml:"disk_dir"`             // Keep bodies in files in this directory instead of in memory, maxcost bounds them
+	DiskSize        string                       `yaml:"disk_size"`            // With type tiered, the bytes of bodies kept on disk, defaults to maxcost
+	Demote          bool                         `yaml:"demote"`               // With type tiered, move objects evicted from memory to disk instead of writing all objects to both
+	MinFetchLatency time.Duration                `yaml:"min_fetch_latency"`    // Only cache responses that took at least this long to fetch, 0 disables
+	KeyIntegrity    bool                         `yaml:"key_integrity"`        // Fingerprint objects and treat hits filled by another request as misses
+	RangeFill       bool                         `yaml:"range_fill"`           // Fetch and cache the whole object on range requests, serve ranges from it
+	ContentType     string                       `yaml:"default_content_type"` // Content-Type for responses without one, "sniff" detects it from the body
+	KeyProtocol     bool                         `yaml:"key_protocol"`         // Fold the client's HTTP version into the key, HTTP/1.1 and HTTP/2 get separate objects
+	LogKeys         bool                         `yaml:"log_keys"`             // Log the readable parts of cache keys at debug level
+	StoreRetries    int                          `yaml:"store_retries"`        // Retries of a failed store to an external cache, default 3
+	StoreBackoff    time.Duration                `yaml:"store_backoff"`        // Wait before the first retry, doubled for each next one, default 50ms
+	HitsHeader      bool                         `yaml:"hits_header"`          // Send X-Cache-Hits with the number of hits of the object served
+	IgnoreClientCC  bool                         `yaml:"ignore_client_cc"`     // Ignore Cache-Control and Pragma on requests, clients can't refresh or bypass the cache
+	CacheAuthorized bool                         `yaml:"cache_authorized"`     // Cache responses to requests with Authorization even when they don't say they may be shared
+	ESI             bool                         `yaml:"esi"`                  // Process ESI tags in HTML responses sent with Surrogate-Control: content="ESI/1.0"
+	SurrogateKeys   bool                         `yaml:"surrogate_keys"`       // Index objects by their Surrogate-Key header, for purging by key through the admin API
+	HostConflict    string                       `yaml:"ignorehost_conflict"`  // With ignorehost and virtual hosts: warn (default), error, or backend to key on the routed backend
+	StatsInterval   time.Duration                `yaml:"stats_interval"`       // How often the hit ratio gauge is updated, default 1m
+	Bypass          []BypassRuleConfig           `yaml:"bypass"`               // Requests matching any rule go to the backend and are never cached
+	TTLRules        []TTLRuleConfig              `yaml:"ttl_rules"`            // Override the TTL of responses by path, the first matching rule applies
+	LogStats        bool                         `yaml:"log_stats"`            // Log a summary of the cache statistics every stats_interval
 }
 
-// ParseSize parses a human-readable size into an int64
-func ParseSize(size string) int64 {
-	var value int64
-	var unit string
+// KeyConfig decides which parts of a request make up the cache key, the query string is keyed as
+// cache.query says
+type KeyConfig struct {
+	Host    *bool    `yaml:"host"`    // Key on the host, default true. ignorehost is a shortcut for false
+	Path    *bool    `yaml:"path"`    // Key on the path, default true
+	Method  *bool    `yaml:"method"`  // Give cached methods other than GET and HEAD their own objects, default true
+	Headers []string `yaml:"headers"` // Request headers whose values are folded into the key
+	Cookies []string `yaml:"cookies"` // Cookies whose values are folded into the key, like vary_cookies without allowing Vary: Cookie
+}
 
-	n, _ := fmt.Sscanf(size, "%d%s", &value, &unit)
-	if n < 1 {
-		return 0
+// GetIgnoreHost reports whether the host is left out of the cache key
+func (cc *CacheConfig) GetIgnoreHost() bool {
+	return cc.IgnoreHost || (cc.Key.Host != nil && !*cc.Key.Host)
+}
+
+// GetPath reports whether the path goes into the cache key
+func (kc *KeyConfig) GetPath() bool {
+	return kc.Path == nil || *kc.Path
+}
+
+// GetMethod reports whether the method goes into the cache key
+func (kc *KeyConfig) GetMethod() bool {
+	return kc.Method == nil || *kc.Method
+}
+
+// PersistConfig controls saving the cache to disk
+type PersistConfig struct {
+	Dir      string        `yaml:"dir"`      // Directory for the snapshot, empty disables persistence
+	Interval time.Duration `yaml:"interval"` // How often a snapshot is saved, 0 means only on shutdown
+}
+
+// QueryConfig controls how the query string is normalized into the cache key
+type QueryConfig struct {
+	Mode   string   `yaml:"mode"`   // full (default), ignore or selected
+	Params []string `yaml:"params"` // With mode selected, the parameters included in the key
+	Ignore []string `yaml:"ignore"` // With mode full, parameters left out of the key, e.g. utm_*
+}
+
+// PathConfig controls how the request path is canonicalized into the cache key
+type PathConfig struct {
+	Lowercase bool   `yaml:"lowercase"` // Fold the path to lower case
+	Clean     bool   `yaml:"clean"`     // Merge repeated slashes and resolve . and .. segments
+	Forward   string `yaml:"forward"`   // Path sent to the backend: raw (default) or canonical
+}
+
+// MethodCacheConfig controls caching of responses to a single request method
+type MethodCacheConfig struct {
+	Cache bool          `yaml:"cache"` // Whether responses to this method are cached
+	TTL   time.Duration `yaml:"ttl"`   // Overrides the TTL from the response headers when set
+}
+
+// ParseSize parses a human-readable size into an int64.
+// Decimal units K, M and G (and the aliases KB, MB and GB) are 1000-based, binary units
+// Ki, Mi and Gi (and KiB, MiB and GiB) are 1024-based. Units are case-insensitive and a
+// plain number has no unit.
+func ParseSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	digits := strings.IndexFunc(size, func(r rune) bool { return r < '0' || r > '9' })
+	if digits == -1 {
+		digits = len(size)
+	}
+	if digits == 0 {
+		return 0, fmt.Errorf("%q is not a size, expected a number with an optional unit", size)
+	}
+	value, err := strconv.ParseInt(size[:digits], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a size: %w", size, err)
 	}
 
-	var multiplier int64 = 1
+	var multiplier int64
+	unit := strings.TrimSpace(size[digits:])
 	switch strings.ToUpper(unit) {
-	case "K":
+	case "":
+		multiplier = 1
+	case "K", "KB":
 		multiplier = 1000
-	case "M":
-		multiplier = 1000000
-	case "G":
-		multiplier = 1000000000
+	case "M", "MB":
+		multiplier = 1000 * 1000
+	case "G", "GB":
+		multiplier = 1000 * 1000 * 1000
+	case "KI", "KIB":
+		multiplier = 1 << 10
+	case "MI", "MIB":
+		multiplier = 1 << 20
+	case "GI", "GIB":
+		multiplier = 1 << 30
+	default:
+		return 0, fmt.Errorf("%q has unknown unit %q, expected one of K, M, G, Ki, Mi, Gi", size, unit)
 	}
-
-	return value * multiplier
+	if value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("%q is too large", size)
+	}
+	return value * multiplier, nil
 }
 
 // GetMaxObjects returns the parsed max objects value
-func (cc *CacheConfig) GetMaxObjects() int64 {
+func (cc *CacheConfig) GetMaxObjects() (int64, error) {
 	return ParseSize(cc.MaxObj)
 }
 
 // GetMaxSize returns the parsed max size value
-func (cc *CacheConfig) GetMaxSize() int64 {
+func (cc *CacheConfig) GetMaxSize() (int64, error) {
 	return ParseSize(cc.MaxCost)
 }
 
+// GetDiskSize returns the parsed disk tier size, maxcost when unset
+func (cc *CacheConfig) GetDiskSize() (int64, error) {
+	return ParseSize(cmp.Or(cc.DiskSize, cc.MaxCost))
+}
+
+// GetMaxObjectSize returns the parsed max object size, 0 when unset
+func (cc *CacheConfig) GetMaxObjectSize() (int64, error) {
+	if cc.MaxObjectSize == "" {
+		return 0, nil
+	}
+	return ParseSize(cc.MaxObjectSize)
+}
+
+// GetBufferLimit returns the parsed buffer limit, 0 when unset
+func (cc *CacheConfig) GetBufferLimit() (int64, error) {
+	if cc.BufferLimit == "" {
+		return 0, nil
+	}
+	return ParseSize(cc.BufferLimit)
+}
+
 // GetLogLevel returns the configured log level as a slog.Level
 func (c *Config) GetLogLevel() slog.Level {
 	switch strings.ToLower(c.Logging.Level) {
@@ -127,13 +498,339 @@ func (c *Config) GetLogLevel() slog.Level {
 	}
 }
 
+// Validate checks the configuration for missing or malformed values.
+// All problems are reported together, each naming the offending field.
+func (c *Config) Validate() error {
+	var errs []error
+	errs = append(errs, c.DefaultBackend.validate("default_backend")...)
+	// in order, so the errors are reported in the same order every time
+	hosts := make(map[string]string, len(c.VirtualHosts)) // by lower case name
+	for _, host := range slices.Sorted(maps.Keys(c.VirtualHosts)) {
+		if host == "" {
+			errs = append(errs, errors.New("virtualhosts: host name must not be empty"))
+		}
+		if other, found := hosts[strings.ToLower(host)]; found {
+			errs = append(errs, fmt.Errorf("virtualhosts: %q and %q are the same host, host names aren't case sensitive", other, host))
+		}
+		hosts[strings.ToLower(host)] = host
+		bc := c.VirtualHosts[host]
+		errs = append(errs, bc.validate(fmt.Sprintf("virtualhosts[%q]", host))...)
+	}
+
+	for i, addr := range c.Frontend.Listen {
+		if _, port, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("frontend.listen[%d]: %w", i, err))
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			errs = append(errs, fmt.Errorf("frontend.listen[%d]: %q has no valid port", i, addr))
+		}
+	}
+	if c.Frontend.BaseURL == "" {
+		errs = append(errs, errors.New("frontend.base_url: must not be empty"))
+	} else if u, err := url.Parse(c.Frontend.BaseURL); err != nil {
+		errs = append(errs, fmt.Errorf("frontend.base_url: %w", err))
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		errs = append(errs, fmt.Errorf("frontend.base_url: %q must start with http:// or https://", c.Frontend.BaseURL))
+	}
+	if (c.Frontend.Cert == "") != (c.Frontend.Key == "") {
+		errs = append(errs, errors.New("frontend.cert and frontend.key: must be set together"))
+	}
+
+	if _, err := c.Cache.GetMaxObjects(); err != nil {
+		errs = append(errs, fmt.Errorf("cache.maxobj: %w", err))
+	}
+	if _, err := c.Cache.GetMaxSize(); err != nil {
+		errs = append(errs, fmt.Errorf("cache.maxcost: %w", err))
+	}
+	if _, err := c.Cache.GetMaxObjectSize(); err != nil {
+		errs = append(errs, fmt.Errorf("cache.max_object_size: %w", err))
+	}
+	if _, err := c.Cache.GetBufferLimit(); err != nil {
+		errs = append(errs, fmt.Errorf("cache.buffer_limit: %w", err))
+	}
+
+	switch c.Cache.Query.Mode {
+	case "", "full", "ignore", "selected":
+	default:
+		errs = append(errs, fmt.Errorf("cache.query.mode: %q is not one of full, ignore, selected", c.Cache.Query.Mode))
+	}
+	switch c.Cache.HostConflict {
+	case "", "warn", "backend":
+	case "error":
+		if c.Cache.GetIgnoreHost() && len(c.VirtualHosts) > 0 {
+			errs = append(errs, errors.New("cache.ignorehost_conflict: ignorehost is set while virtualhosts route hosts to different backends"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("cache.ignorehost_conflict: %q is not one of warn, error, backend", c.Cache.HostConflict))
+	}
+	switch c.Cache.Path.Forward {
+	case "", "raw", "canonical":
+	default:
+		errs = append(errs, fmt.Errorf("cache.path.forward: %q is not one of raw, canonical", c.Cache.Path.Forward))
+	}
+	if s := c.Frontend.Malformed.Status; s != 0 && (s < 400 || s > 599) {
+		errs = append(errs, fmt.Errorf("frontend.malformed.status: %d is not a 4xx or 5xx status", s))
+	}
+	if s := c.Frontend.ErrorPage.Status; s != 0 && (s < 400 || s > 599) {
+		errs = append(errs, fmt.Errorf("frontend.error_page.status: %d is not a 4xx or 5xx status", s))
+	}
+	if c.Frontend.ErrorPage.Body != "" && c.Frontend.ErrorPage.File != "" {
+		errs = append(errs, errors.New("frontend.error_page: body and file can't both be set"))
+	}
+	if c.Frontend.Maintenance.Body != "" && c.Frontend.Maintenance.File != "" {
+		errs = append(errs, errors.New("frontend.maintenance: body and file can't both be set"))
+	}
+	if c.Frontend.Maintenance.RetryAfter < 0 {
+		errs = append(errs, errors.New("frontend.maintenance.retry_after: must not be negative"))
+	}
+	timeouts := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"read_header", c.Frontend.Timeouts.ReadHeader},
+		{"read", c.Frontend.Timeouts.Read},
+		{"write", c.Frontend.Timeouts.Write},
+		{"idle", c.Frontend.Timeouts.Idle},
+	}
+	for _, t := range timeouts {
+		if t.d < 0 {
+			errs = append(errs, fmt.Errorf("frontend.timeouts.%s: must not be negative", t.name))
+		}
+	}
+	if slices.Contains(c.Cache.Key.Headers, "") {
+		errs = append(errs, errors.New("cache.key.headers: empty header name"))
+	}
+	if slices.Contains(c.Cache.Key.Cookies, "") {
+		errs = append(errs, errors.New("cache.key.cookies: empty cookie name"))
+	}
+	if len(c.Cache.Key.Cookies) > 0 && len(c.Cache.VaryCookies) > 0 {
+		errs = append(errs, errors.New("cache.key.cookies: can't be combined with cache.vary_cookies, list the cookies in one of them"))
+	}
+	if slices.Contains(c.Frontend.StripHeaders.Headers, "") {
+		errs = append(errs, errors.New("frontend.strip_headers.headers: empty header name"))
+	}
+	for i, rule := range c.Frontend.HeaderRules.Store {
+		errs = append(errs, rule.validate(fmt.Sprintf("frontend.header_rules.store[%d]", i))...)
+	}
+	for i, rule := range c.Frontend.HeaderRules.Client {
+		errs = append(errs, rule.validate(fmt.Sprintf("frontend.header_rules.client[%d]", i))...)
+	}
+	if _, err := c.Frontend.GetTrustedProxies(); err != nil {
+		errs = append(errs, fmt.Errorf("frontend.trusted_proxies: %w", err))
+	}
+	if strings.ContainsAny(c.Frontend.Via, " \t\r\n,") {
+		errs = append(errs, fmt.Errorf("frontend.via: %q must be a single word, like a host name", c.Frontend.Via))
+	}
+	if c.Cache.StoreRetries < 0 {
+		errs = append(errs, errors.New("cache.store_retries: must not be negative"))
+	}
+	if c.Cache.StoreBackoff < 0 {
+		errs = append(errs, errors.New("cache.store_backoff: must not be negative"))
+	}
+	if c.Shutdown.DrainTimeout < 0 {
+		errs = append(errs, errors.New("shutdown.drain_timeout: must not be negative"))
+	}
+	if c.Shutdown.FinalScrape < 0 {
+		errs = append(errs, errors.New("shutdown.final_scrape: must not be negative"))
+	}
+	if ct := c.Cache.ContentType; ct != "" && ct != "sniff" {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			errs = append(errs, fmt.Errorf("cache.default_content_type: %w", err))
+		}
+	}
+	if c.Cache.MaxFills < 0 {
+		errs = append(errs, errors.New("cache.max_fills: must not be negative"))
+	}
+	if c.Cache.MaxFillsPerKey < 0 {
+		errs = append(errs, errors.New("cache.max_fills_per_key: must not be negative"))
+	}
+	if c.Cache.MinFetchLatency < 0 {
+		errs = append(errs, errors.New("cache.min_fetch_latency: must not be negative"))
+	}
+	if c.Cache.Persist.Interval < 0 {
+		errs = append(errs, errors.New("cache.persist.interval: must not be negative"))
+	}
+	for i, rule := range c.Cache.Bypass {
+		if rule == (BypassRuleConfig{}) {
+			errs = append(errs, fmt.Errorf("cache.bypass[%d]: needs at least one of path_prefix, path, header, cookie", i))
+		}
+		if _, err := regexp.Compile(rule.Path); err != nil {
+			errs = append(errs, fmt.Errorf("cache.bypass[%d].path: %w", i, err))
+		}
+	}
+	for i, rule := range c.Cache.TTLRules {
+		if rule.PathPrefix == "" && rule.Path == "" {
+			errs = append(errs, fmt.Errorf("cache.ttl_rules[%d]: needs path_prefix or path", i))
+		}
+		if _, err := regexp.Compile(rule.Path); err != nil {
+			errs = append(errs, fmt.Errorf("cache.ttl_rules[%d].path: %w", i, err))
+		}
+		if rule.TTL <= 0 {
+			errs = append(errs, fmt.Errorf("cache.ttl_rules[%d].ttl: must be positive", i))
+		}
+	}
+	if c.Cache.StatsInterval < 0 {
+		errs = append(errs, errors.New("cache.stats_interval: must not be negative"))
+	}
+	switch c.Cache.Type {
+	case "", "lru":
+	case "map":
+		if c.Cache.DiskDir != "" {
+			errs = append(errs, errors.New("cache.type: map can't be combined with cache.disk_dir"))
+		}
+	case "tiered":
+		if c.Cache.DiskDir == "" {
+			errs = append(errs, errors.New("cache.type: tiered needs cache.disk_dir"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("cache.type: %q is not one of lru, map, tiered", c.Cache.Type))
+	}
+	if _, err := c.Cache.GetDiskSize(); err != nil {
+		errs = append(errs, fmt.Errorf("cache.disk_size: %w", err))
+	}
+	if c.Cache.DiskDir != "" && c.Cache.Persist.Dir != "" {
+		errs = append(errs, errors.New("cache.disk_dir: can't be combined with cache.persist"))
+	}
+	if c.Cache.NegativeTTL < 0 {
+		errs = append(errs, errors.New("cache.negative_ttl: must not be negative"))
+	}
+	if c.Cache.TTLJitter < 0 || c.Cache.TTLJitter > 50 {
+		errs = append(errs, errors.New("cache.ttl_jitter: must be a percentage between 0 and 50"))
+	}
+
+	if _, err := c.Admin.GetAllow(); err != nil {
+		errs = append(errs, fmt.Errorf("admin.allow: %w", err))
+	}
+	if (c.Admin.Username == "") != (c.Admin.Password == "") {
+		errs = append(errs, errors.New("admin.username: username and password must be set together"))
+	}
+
+	for i, rule := range c.Devices.Rules {
+		if rule.Class == "" {
+			errs = append(errs, fmt.Errorf("devices.rules[%d].class: must not be empty", i))
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			errs = append(errs, fmt.Errorf("devices.rules[%d].pattern: %w", i, err))
+		}
+	}
+
+	if c.Warmup.Concurrency < 0 {
+		errs = append(errs, errors.New("warmup.concurrency: must not be negative"))
+	}
+	if c.Warmup.Sitemap != "" {
+		if u, err := url.Parse(c.Warmup.Sitemap); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("warmup.sitemap: %q must be an http:// or https:// URL", c.Warmup.Sitemap))
+		}
+	}
+
+	switch c.Logging.AccessFormat {
+	case "", "common", "combined":
+	default:
+		errs = append(errs, fmt.Errorf("logging.access_format: %q is not one of common, combined", c.Logging.AccessFormat))
+	}
+	if c.Logging.DumpBodies < 0 {
+		errs = append(errs, errors.New("logging.dump_bodies: must not be negative"))
+	}
+	switch c.Logging.Format {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("logging.format: %q is not one of text, json", c.Logging.Format))
+	}
+	switch strings.ToLower(c.Logging.Level) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		errs = append(errs, fmt.Errorf("logging.level: %q is not one of debug, info, warn, error", c.Logging.Level))
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks a single header rule, field is the config path used in error messages
+func (hr *HeaderRuleConfig) validate(field string) []error {
+	var errs []error
+	if hr.Name == "" {
+		errs = append(errs, fmt.Errorf("%s.name: must not be empty", field))
+	}
+	if strings.ContainsAny(hr.Value, "\r\n") {
+		errs = append(errs, fmt.Errorf("%s.value: must not contain a line break", field))
+	}
+	switch hr.Action {
+	case "set", "add", "remove":
+		if hr.Match != "" {
+			errs = append(errs, fmt.Errorf("%s.match: only used by rewrite", field))
+		}
+	case "rewrite":
+		if hr.Match == "" {
+			errs = append(errs, fmt.Errorf("%s.match: must not be empty for rewrite", field))
+		} else if _, err := regexp.Compile(hr.Match); err != nil {
+			errs = append(errs, fmt.Errorf("%s.match: %w", field, err))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%s.action: %q is not one of set, add, remove, rewrite", field, hr.Action))
+	}
+	return errs
+}
+
+// validate checks a single backend, field is the config path used in error messages
+func (bc *BackendConfig) validate(field string) []error {
+	var errs []error
+	if bc.Target == "" {
+		return []error{fmt.Errorf("%s.target: must not be empty", field)}
+	}
+	if _, _, _, err := bc.ParseTarget(); err != nil {
+		errs = append(errs, fmt.Errorf("%s.target: %w", field, err))
+	}
+	if bc.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("%s.timeout: must not be negative", field))
+	}
+	if bc.DialTimeout < 0 {
+		errs = append(errs, fmt.Errorf("%s.dial_timeout: must not be negative", field))
+	}
+	if bc.ResponseTimeout < 0 {
+		errs = append(errs, fmt.Errorf("%s.response_timeout: must not be negative", field))
+	}
+	if _, err := bc.GetMaxResponseBytes(); err != nil {
+		errs = append(errs, fmt.Errorf("%s.max_response_bytes: %w", field, err))
+	}
+	if bc.MaxIdleConns < 0 {
+		errs = append(errs, fmt.Errorf("%s.max_idle_conns: must not be negative", field))
+	}
+	if bc.MaxIdlePerHost < 0 {
+		errs = append(errs, fmt.Errorf("%s.max_idle_conns_per_host: must not be negative", field))
+	}
+	if bc.IdleConnTimeout < 0 {
+		errs = append(errs, fmt.Errorf("%s.idle_conn_timeout: must not be negative", field))
+	}
+	for _, code := range bc.CacheableStatus {
+		if code < 100 || code > 599 {
+			errs = append(errs, fmt.Errorf("%s.cacheable_status: %d is not a status code", field, code))
+		}
+	}
+	for name, value := range bc.RequestHeaders {
+		switch {
+		case name == "":
+			errs = append(errs, fmt.Errorf("%s.request_headers: empty header name", field))
+		case strings.ContainsAny(name+value, "\r\n"):
+			errs = append(errs, fmt.Errorf("%s.request_headers: %s contains a line break", field, name))
+		}
+	}
+	if bc.ServerName != "" {
+		if scheme, _, _, err := bc.ParseTarget(); err == nil && scheme != "https" {
+			errs = append(errs, fmt.Errorf("%s.server_name: only applies to https targets", field))
+		}
+	}
+	switch bc.OversizePolicy {
+	case "", "abort", "stream":
+	default:
+		errs = append(errs, fmt.Errorf("%s.oversize_policy: %q is not one of abort, stream", field, bc.OversizePolicy))
+	}
+	return errs
+}
+
 // LoadConfig loads configuration from a YAML file
 func LoadConfig(path string) (*Config, error) {
 	// Set default values
 	cfg := &Config{
 		DefaultBackend: BackendConfig{
-			Target:  "https://www.varnish-software.com:443",
-			Timeout: 30 * time.Second,
+			Target: "https://www.varnish-software.com:443",
 		},
 		Frontend: FrontendConfig{
 			BaseURL:     "http://localhost:8080",
@@ -161,5 +858,9 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("parsing config file: %w", err)
 	}
 
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
 	return cfg, nil
 }
@@ -0,0 +1,253 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns a config that passes validation, tests break one field at a time
+func validConfig() *Config {
+	return &Config{
+		DefaultBackend: BackendConfig{Target: "http://localhost:8000"},
+		Frontend:       FrontendConfig{BaseURL: "http://localhost:8080"},
+		Cache:          CacheConfig{MaxObj: "1M", MaxCost: "1G"},
+		Logging:        LoggingConfig{Level: "info", Format: "text"},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Expected valid config, got: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		field  string
+	}{
+		{"empty default target", func(c *Config) { c.DefaultBackend.Target = "" }, "default_backend.target"},
+		{"default target without scheme", func(c *Config) { c.DefaultBackend.Target = "localhost:8000" }, "default_backend.target"},
+		{"default target unparseable", func(c *Config) { c.DefaultBackend.Target = "http://%zz" }, "default_backend.target"},
+		{"default target without host", func(c *Config) { c.DefaultBackend.Target = "http://" }, "default_backend.target"},
+		{"bad oversize policy", func(c *Config) { c.DefaultBackend.OversizePolicy = "truncate" }, "default_backend.oversize_policy"},
+		{"bad max response bytes", func(c *Config) { c.DefaultBackend.MaxResponseBytes = "lots" }, "default_backend.max_response_bytes"},
+		{"negative idle conns", func(c *Config) { c.DefaultBackend.MaxIdlePerHost = -1 }, "default_backend.max_idle_conns_per_host"},
+		{"header rule without action", func(c *Config) {
+			c.Frontend.HeaderRules.Client = []HeaderRuleConfig{{Name: "Server"}}
+		}, "frontend.header_rules.client[0].action"},
+		{"rewrite header rule without match", func(c *Config) {
+			c.Frontend.HeaderRules.Store = []HeaderRuleConfig{{Action: "rewrite", Name: "Location"}}
+		}, "frontend.header_rules.store[0].match"},
+		{"rewrite header rule with bad match", func(c *Config) {
+			c.Frontend.HeaderRules.Store = []HeaderRuleConfig{{Action: "rewrite", Name: "Location", Match: "("}}
+		}, "frontend.header_rules.store[0].match"},
+		{"negative stats interval", func(c *Config) { c.Cache.StatsInterval = -time.Second }, "cache.stats_interval"},
+		{"empty bypass rule", func(c *Config) { c.Cache.Bypass = []BypassRuleConfig{{}} }, "cache.bypass[0]"},
+		{"bad bypass path", func(c *Config) { c.Cache.Bypass = []BypassRuleConfig{{Path: "(admin"}} }, "cache.bypass[0].path"},
+		{"ttl rule without path", func(c *Config) { c.Cache.TTLRules = []TTLRuleConfig{{TTL: time.Hour}} }, "cache.ttl_rules[0]"},
+		{"bad ttl rule path", func(c *Config) { c.Cache.TTLRules = []TTLRuleConfig{{Path: "(img", TTL: time.Hour}} }, "cache.ttl_rules[0].path"},
+		{"ttl rule without ttl", func(c *Config) { c.Cache.TTLRules = []TTLRuleConfig{{PathPrefix: "/img"}} }, "cache.ttl_rules[0].ttl"},
+		{"listen address without port", func(c *Config) { c.Frontend.Listen = []string{":8080", "localhost"} }, "frontend.listen[1]"},
+		{"listen address with bad port", func(c *Config) { c.Frontend.Listen = []string{"localhost:http"} }, "frontend.listen[0]"},
+		{"unknown cache type", func(c *Config) { c.Cache.Type = "arc" }, "cache.type"},
+		{"map cache with disk bodies", func(c *Config) { c.Cache.Type = "map"; c.Cache.DiskDir = "/tmp/bodies" }, "cache.type"},
+		{"tiered cache without disk", func(c *Config) { c.Cache.Type = "tiered" }, "cache.type"},
+		{"bad disk size", func(c *Config) { c.Cache.DiskSize = "lots" }, "cache.disk_size"},
+		{"bad buffer limit", func(c *Config) { c.Cache.BufferLimit = "lots" }, "cache.buffer_limit"},
+		{"ttl jitter too large", func(c *Config) { c.Cache.TTLJitter = 80 }, "cache.ttl_jitter"},
+		{"request header with line break", func(c *Config) {
+			c.DefaultBackend.RequestHeaders = map[string]string{"X-Api-Key": "secret\r\nX-Evil: 1"}
+		}, "default_backend.request_headers"},
+		{"negative dial timeout", func(c *Config) { c.DefaultBackend.DialTimeout = -time.Second }, "default_backend.dial_timeout"},
+		{"server name for http", func(c *Config) { c.DefaultBackend.ServerName = "origin.internal" }, "default_backend.server_name"},
+		{"bad cacheable status", func(c *Config) { c.DefaultBackend.CacheableStatus = []int{200, 2000} }, "default_backend.cacheable_status"},
+		{"negative response timeout", func(c *Config) {
+			c.VirtualHosts = map[string]BackendConfig{"example.com": {Target: "http://example.com", ResponseTimeout: -time.Second}}
+		}, `virtualhosts["example.com"].response_timeout`},
+		{"virtual hosts differing in case", func(c *Config) {
+			c.VirtualHosts = map[string]BackendConfig{"example.com": {Target: "http://a"}, "Example.com": {Target: "http://b"}}
+		}, "virtualhosts: "},
+		{"bad virtual host target", func(c *Config) {
+			c.VirtualHosts = map[string]BackendConfig{"example.com": {Target: "ftp://example.com"}}
+		}, `virtualhosts["example.com"].target`},
+		{"empty base url", func(c *Config) { c.Frontend.BaseURL = "" }, "frontend.base_url"},
+		{"base url without scheme", func(c *Config) { c.Frontend.BaseURL = "localhost:8080" }, "frontend.base_url"},
+		{"cert without key", func(c *Config) { c.Frontend.Cert = "cert.pem" }, "frontend.cert"},
+		{"negative write timeout", func(c *Config) { c.Frontend.Timeouts.Write = -time.Second }, "frontend.timeouts.write"},
+		{"empty key header", func(c *Config) { c.Cache.Key.Headers = []string{"Accept-Language", ""} }, "cache.key.headers"},
+		{"empty key cookie", func(c *Config) { c.Cache.Key.Cookies = []string{""} }, "cache.key.cookies"},
+		{"key and vary cookies", func(c *Config) {
+			c.Cache.Key.Cookies = []string{"currency"}
+			c.Cache.VaryCookies = []string{"lang"}
+		}, "cache.key.cookies"},
+		{"empty strip header", func(c *Config) { c.Frontend.StripHeaders.Headers = []string{""} }, "frontend.strip_headers.headers"},
+		{"error page status not an error", func(c *Config) { c.Frontend.ErrorPage.Status = 302 }, "frontend.error_page.status"},
+		{"error page with body and file", func(c *Config) {
+			c.Frontend.ErrorPage.Body, c.Frontend.ErrorPage.File = "down", "down.html"
+		}, "frontend.error_page"},
+		{"malformed status not an error", func(c *Config) { c.Frontend.Malformed.Status = 200 }, "frontend.malformed.status"},
+		{"negative final scrape", func(c *Config) { c.Shutdown.FinalScrape = -time.Second }, "shutdown.final_scrape"},
+		{"bad default content type", func(c *Config) { c.Cache.ContentType = "text/" }, "cache.default_content_type"},
+		{"bad maxobj", func(c *Config) { c.Cache.MaxObj = "many" }, "cache.maxobj"},
+		{"bad maxcost unit", func(c *Config) { c.Cache.MaxCost = "1T" }, "cache.maxcost"},
+		{"ignorehost with virtual hosts", func(c *Config) {
+			c.Cache.IgnoreHost, c.Cache.HostConflict = true, "error"
+			c.VirtualHosts = map[string]BackendConfig{"example.com": {Target: "http://example.com"}}
+		}, "cache.ignorehost_conflict"},
+		{"key without host with virtual hosts", func(c *Config) {
+			c.Cache.Key.Host, c.Cache.HostConflict = new(bool), "error"
+			c.VirtualHosts = map[string]BackendConfig{"example.com": {Target: "http://example.com"}}
+		}, "cache.ignorehost_conflict"},
+		{"bad ignorehost conflict policy", func(c *Config) { c.Cache.HostConflict = "ignore" }, "cache.ignorehost_conflict"},
+		{"bad path forward mode", func(c *Config) { c.Cache.Path.Forward = "lowercase" }, "cache.path.forward"},
+		{"disk cache with persistence", func(c *Config) {
+			c.Cache.DiskDir, c.Cache.Persist.Dir = "/var/cache/hazelnut/bodies", "/var/cache/hazelnut"
+		}, "cache.disk_dir"},
+		{"negative max fills", func(c *Config) { c.Cache.MaxFillsPerKey = -1 }, "cache.max_fills_per_key"},
+		{"negative store retries", func(c *Config) { c.Cache.StoreRetries = -1 }, "cache.store_retries"},
+		{"bad device pattern", func(c *Config) {
+			c.Devices.Rules = []DeviceRuleConfig{{Class: "tv", Pattern: "smart(tv"}}
+		}, "devices.rules[0].pattern"},
+		{"relative warmup sitemap", func(c *Config) { c.Warmup.Sitemap = "/sitemap.xml" }, "warmup.sitemap"},
+		{"bad admin allow entry", func(c *Config) { c.Admin.Allow = []string{"10.0.0.0/33"} }, "admin.allow"},
+		{"admin username without password", func(c *Config) { c.Admin.Username = "ops" }, "admin.username"},
+		{"admin password without username", func(c *Config) { c.Admin.Password = "secret" }, "admin.username"},
+		{"unknown log format", func(c *Config) { c.Logging.Format = "xml" }, "logging.format"},
+		{"empty log format", func(c *Config) { c.Logging.Format = "" }, "logging.format"},
+		{"maintenance body and file", func(c *Config) {
+			c.Frontend.Maintenance.Body = "down"
+			c.Frontend.Maintenance.File = "down.html"
+		}, "frontend.maintenance"},
+		{"negative maintenance retry", func(c *Config) { c.Frontend.Maintenance.RetryAfter = -time.Second }, "frontend.maintenance.retry_after"},
+		{"invalid trusted proxy", func(c *Config) { c.Frontend.TrustedProxies = []string{"10.0.0.0/33"} }, "frontend.trusted_proxies"},
+		{"via with a space", func(c *Config) { c.Frontend.Via = "1.1 cache" }, "frontend.via"},
+		{"unknown access log format", func(c *Config) { c.Logging.AccessFormat = "apache" }, "logging.access_format"},
+		{"negative body dump", func(c *Config) { c.Logging.DumpBodies = -1 }, "logging.dump_bodies"},
+		{"unknown log level", func(c *Config) { c.Logging.Level = "verbose" }, "logging.level"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.modify(c)
+			err := c.Validate()
+			if err == nil {
+				t.Fatalf("Expected validation error for %s", tt.field)
+			}
+			if !strings.Contains(err.Error(), tt.field) {
+				t.Errorf("Expected error to name %s, got: %v", tt.field, err)
+			}
+		})
+	}
+
+	t.Run("reports all errors together", func(t *testing.T) {
+		c := validConfig()
+		c.DefaultBackend.Target = ""
+		c.Logging.Format = "xml"
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), "default_backend.target") || !strings.Contains(err.Error(), "logging.format") {
+			t.Errorf("Expected both errors to be reported, got: %v", err)
+		}
+	})
+}
+
+func TestLoadConfigValidates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("logging:\n  format: xml\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "logging.format") {
+		t.Errorf("Expected LoadConfig to reject the config, got: %v", err)
+	}
+
+	for _, file := range []string{"../config.yaml", "../config.example.yaml"} {
+		if _, err := LoadConfig(file); err != nil {
+			t.Errorf("Expected %s to load, got: %v", file, err)
+		}
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		scheme string
+		host   string
+		port   int
+		err    bool
+	}{
+		{target: "https://example.com", scheme: "https", host: "example.com", port: 443},
+		{target: "http://example.com", scheme: "http", host: "example.com", port: 80},
+		{target: "https://example.com:8443", scheme: "https", host: "example.com", port: 8443},
+		{target: "http://[::1]:8080/", scheme: "http", host: "::1", port: 8080},
+		{target: "example.com:8443", err: true},
+		{target: "https://", err: true},
+		{target: "https://example.com:0", err: true},
+		{target: "https://example.com:70000", err: true},
+		{target: "https://example.com:https", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			bc := BackendConfig{Target: tt.target}
+			scheme, host, port, err := bc.ParseTarget()
+			if tt.err {
+				if err == nil {
+					t.Errorf("Expected an error, got %s %s %d", scheme, host, port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if scheme != tt.scheme || host != tt.host || port != tt.port {
+				t.Errorf("Expected %s %s %d, got %s %s %d", tt.scheme, tt.host, tt.port, scheme, host, port)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"100", 100, false},
+		{"0", 0, false},
+		{"1K", 1000, false},
+		{"1k", 1000, false},
+		{"1KB", 1000, false},
+		{"2M", 2000000, false},
+		{"2mb", 2000000, false},
+		{"1G", 1000000000, false},
+		{"1GB", 1000000000, false},
+		{"1Ki", 1024, false},
+		{"1KiB", 1024, false},
+		{"1kib", 1024, false},
+		{"64Mi", 64 << 20, false},
+		{"64MiB", 64 << 20, false},
+		{"2Gi", 2 << 30, false},
+		{"2GiB", 2 << 30, false},
+		{" 10M ", 10000000, false},
+		{"", 0, true},
+		{"M", 0, true},
+		{"abc", 0, true},
+		{"-1", 0, true},
+		{"1.5G", 0, true},
+		{"1T", 0, true},
+		{"10 M x", 0, true},
+		{"9999999999999G", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSize(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSize(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package frontend
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats
+const (
+	AccessLogCommon   = "common"   // Apache Common Log Format
+	AccessLogCombined = "combined" // Common Log Format plus the referrer and user agent
+)
+
+// clfTime is the timestamp format of the Common Log Format
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// accessLog writes one line per request, lines are written whole so the log can be shared
+type accessLog struct {
+	mu       sync.Mutex
+	w        io.Writer
+	combined bool
+}
+
+// SetAccessLog makes the frontend write a line per request to w, in AccessLogCommon or
+// AccessLogCombined format. A nil w disables the access log.
+func (s *Server) SetAccessLog(w io.Writer, format string) {
+	if w == nil {
+		s.access = nil
+		return
+	}
+	s.access = &accessLog{w: w, combined: format != AccessLogCommon}
+}
+
+// log writes the line for req from client, answered with status and bytes of body at t
+func (a *accessLog) log(req *http.Request, client netip.Addr, status int, bytes int64, t time.Time) {
+	var b strings.Builder
+	host := req.RemoteAddr
+	if client.IsValid() {
+		host = client.String()
+	}
+	user := "-"
+	if u, _, ok := req.BasicAuth(); ok && u != "" {
+		user = escape(u)
+	}
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+	fmt.Fprintf(&b, "%s - %s [%s] \"%s %s %s\" %d %s", orDash(host), user, t.Format(clfTime),
+		escape(req.Method), escape(req.RequestURI), escape(req.Proto), status, size)
+	if a.combined {
+		fmt.Fprintf(&b, " \"%s\" \"%s\"", orDash(escape(req.Referer())), orDash(escape(req.UserAgent())))
+	}
+	b.WriteByte('\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, _ = io.WriteString(a.w, b.String())
+}
+
+// orDash returns s, or "-" when it is empty as the log format has it
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escape makes a client supplied value safe to put in a log line: quotes and backslashes are
+// escaped and control characters are written as \xhh, like Apache does
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,47 @@
+package frontend
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// BypassRule sends the requests it matches straight to the backend, past the cache. Every
+// field that is set must match: PathPrefix and Path the path of the request, Header and Cookie
+// by their presence on it.
+type BypassRule struct {
+	PathPrefix string
+	Path       *regexp.Regexp
+	Header     string
+	Cookie     string
+}
+
+// SetBypassRules sets the rules that keep requests away from the cache, whatever the backend
+// says about caching them. A request matching any rule is neither looked up nor stored, it is
+// passed to the backend and its response marked X-Cache: bypass.
+func (s *Server) SetBypassRules(rules []BypassRule) {
+	s.bypass = rules
+}
+
+// bypassed reports whether req matches a bypass rule. The cheap conditions are checked first,
+// the regular expression only when they all match.
+func (s *Server) bypassed(req *http.Request) bool {
+	for _, rule := range s.bypass {
+		if rule.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, rule.PathPrefix) {
+			continue
+		}
+		if rule.Header != "" && len(req.Header.Values(rule.Header)) == 0 {
+			continue
+		}
+		if rule.Cookie != "" {
+			if _, err := req.Cookie(rule.Cookie); err != nil {
+				continue
+			}
+		}
+		if rule.Path != nil && !rule.Path.MatchString(req.URL.Path) {
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package frontend
+
+import (
+	"maps"
+	"net/http"
+	"strings"
+)
+
+// notModified reports whether a client's conditional request is satisfied by the validators of a
+// cached object, so it can be answered with 304 Not Modified. As RFC 9110 section 13.2.2 says,
+// If-None-Match is evaluated when present and If-Modified-Since only when it isn't.
+func notModified(req *http.Request, header http.Header) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := header.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for candidate := range strings.SplitSeq(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || weakMatch(candidate, etag) {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ims)
+}
+
+// weakMatch compares two entity tags ignoring whether they are weak, the comparison a client's
+// If-None-Match gets
+func weakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// writeNotModified answers with 304 Not Modified and the headers of the cached object, less the
+// ones that describe a body that isn't sent
+func writeNotModified(resp http.ResponseWriter, header http.Header) {
+	maps.Copy(resp.Header(), header)
+	for _, name := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Transfer-Encoding", "Trailer"} {
+		resp.Header().Del(name)
+	}
+	resp.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,27 @@
+package frontend
+
+import "net/http"
+
+// ContentTypeSniff detects the Content-Type of a response that lacks one from its body
+const ContentTypeSniff = "sniff"
+
+// SetDefaultContentType sets what happens to responses from the backend without a Content-Type.
+// With ContentTypeSniff the type is detected from the body of responses that are cached, any
+// other value is set as the type of every such response. Empty leaves them as they are.
+func (s *Server) SetDefaultContentType(contentType string) {
+	s.defaultCT = contentType
+}
+
+// setContentType fills in a missing Content-Type. body is the buffered body, nil when the
+// response is streamed; a streamed response isn't sniffed.
+func (s *Server) setContentType(h http.Header, body []byte) {
+	if s.defaultCT == "" || h.Get("Content-Type") != "" {
+		return
+	}
+	switch {
+	case s.defaultCT != ContentTypeSniff:
+		h.Set("Content-Type", s.defaultCT)
+	case len(body) > 0:
+		h.Set("Content-Type", http.DetectContentType(body))
+	}
+}
@@ -0,0 +1,52 @@
+package frontend
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SetDeadlineHeader enables telling the backend how much time is left before the client
+// request's deadline. The remaining budget is sent in header as whole milliseconds.
+// An empty header name disables it.
+func (s *Server) SetDeadlineHeader(header string) {
+	s.deadlineHdr = header
+}
+
+// budgetFunc returns how long the backend for a host may take to answer
+type budgetFunc func(host string) time.Duration
+
+// SetDeadlineBudget sets how long the backend a host is routed to may take to answer, see
+// backend.Client.Budget. It bounds the deadline sent to the backend along with the write
+// timeout, as requests served by the frontend have no deadline of their own. nil disables it.
+func (s *Server) SetDeadlineBudget(budget func(host string) time.Duration) {
+	s.deadlineBudget = budget
+}
+
+// setDeadlineHeader sets the remaining budget of req on beReq: the earliest of the request
+// context's deadline, the write timeout and the backend's budget. Requests without any get no
+// header; a client supplied header of the same name is always dropped.
+func (s *Server) setDeadlineHeader(beReq, req *http.Request) {
+	if s.deadlineHdr == "" {
+		return
+	}
+	beReq.Header.Del(s.deadlineHdr)
+	deadline, ok := req.Context().Deadline()
+	earliest := func(d time.Duration) {
+		if d <= 0 {
+			return
+		}
+		if t := time.Now().Add(d); !ok || t.Before(deadline) {
+			deadline, ok = t, true
+		}
+	}
+	earliest(s.srv.WriteTimeout)
+	if s.deadlineBudget != nil {
+		earliest(s.deadlineBudget(beReq.Host))
+	}
+	if !ok {
+		return
+	}
+	remaining := max(time.Until(deadline), 0)
+	beReq.Header.Set(s.deadlineHdr, strconv.FormatInt(remaining.Milliseconds(), 10))
+}
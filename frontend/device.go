@@ -0,0 +1,59 @@
+package frontend
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// DefaultDeviceHeader is the request header used to tell the backend the client's device class
+const DefaultDeviceHeader = "X-Device-Type"
+
+// DefaultDeviceClass is the class of user agents that no rule matches
+const DefaultDeviceClass = "desktop"
+
+// DeviceRule puts user agents matching Pattern in device class Class
+type DeviceRule struct {
+	Class   string
+	Pattern *regexp.Regexp
+}
+
+// DefaultDeviceRules tells bots and mobile devices apart, anything else is a desktop
+func DefaultDeviceRules() []DeviceRule {
+	return []DeviceRule{
+		{Class: "bot", Pattern: regexp.MustCompile(`(?i)bot|crawl|spider|slurp|facebookexternalhit`)},
+		{Class: "mobile", Pattern: regexp.MustCompile(`(?i)mobi|android|iphone|ipad|ipod|blackberry|opera mini|windows phone`)},
+	}
+}
+
+// SetDeviceClasses enables device classification of the User-Agent. The first matching rule
+// decides the class, DefaultDeviceClass when none does. The class is folded into the cache key
+// and forwarded to the backend in header. Nil rules disable the feature.
+func (s *Server) SetDeviceClasses(rules []DeviceRule, header string) {
+	if header == "" {
+		header = DefaultDeviceHeader
+	}
+	s.devices = rules
+	s.deviceHdr = header
+}
+
+// deviceClass returns the device class of the client, or "" when classification is disabled
+func (s *Server) deviceClass(req *http.Request) string {
+	if s.devices == nil {
+		return ""
+	}
+	ua := req.UserAgent()
+	for _, rule := range s.devices {
+		if rule.Pattern.MatchString(ua) {
+			return rule.Class
+		}
+	}
+	return DefaultDeviceClass
+}
+
+// setDeviceHeader replaces any client supplied device header with the device class
+func (s *Server) setDeviceHeader(beReq *http.Request, class string) {
+	if s.devices == nil {
+		return
+	}
+	beReq.Header.Set(s.deviceHdr, class)
+}
@@ -0,0 +1,46 @@
+package frontend
+
+import (
+	"net/http"
+
+	"github.com/perbu/hazelnut/cache"
+)
+
+// SetIgnoreClientDirectives makes the cache ignore Cache-Control and Pragma on requests, for
+// deployments that don't trust their clients to decide when the backend is hit. By default a
+// client can refresh an object with no-cache or max-age=0, and bypass the cache with no-store.
+func (s *Server) SetIgnoreClientDirectives(ignore bool) {
+	s.ignoreCC = ignore
+}
+
+// clientDirective returns what the client asks of the cache, the default when it isn't trusted
+func (s *Server) clientDirective(req *http.Request) cache.RequestDirective {
+	if s.ignoreCC {
+		return cache.RequestDefault
+	}
+	return cache.RequestDirectiveFor(req.Header)
+}
+
+// SetCacheAuthorized caches responses to requests with an Authorization header like any other,
+// for deployments where the credentials don't change what the backend sends. By default they are
+// only cached when the response's Cache-Control explicitly allows a shared cache to store them.
+func (s *Server) SetCacheAuthorized(enabled bool) {
+	s.cacheAuth = enabled
+}
+
+// authorizedPrivate reports whether beResp answers a request with credentials and may be meant
+// for that user only, so it must not be cached
+func (s *Server) authorizedPrivate(req *http.Request, beResp *http.Response) bool {
+	return !s.cacheAuth && req.Header.Get("Authorization") != "" && !cache.SharedWithAuthorization(beResp.Header)
+}
+
+// missLabel is the X-Cache value of a response fetched from the backend for req
+func (s *Server) missLabel(req *http.Request) string {
+	switch s.clientDirective(req) {
+	case cache.RequestRefresh:
+		return "refresh"
+	case cache.RequestBypass:
+		return "bypass"
+	}
+	return "miss"
+}
@@ -0,0 +1,42 @@
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"github.com/perbu/hazelnut/cache"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+)
+
+// openBody opens the body file of an object the cache keeps on disk. It reports false when the
+// file is gone, because the object was evicted after the lookup, and it has to be fetched again.
+func (s *Server) openBody(ctx context.Context, key string, obj cache.ObjCore) (*os.File, bool) {
+	f, err := os.Open(obj.BodyFile)
+	if err != nil {
+		s.log(ctx).Debug("cached body is gone, treating as a miss", "key", fmt.Sprintf("%x", key), "error", err)
+		return nil, false
+	}
+	return f, true
+}
+
+// readBody returns the body of obj, read from f when the cache keeps it on disk
+func readBody(obj cache.ObjCore, f *os.File) ([]byte, error) {
+	if f == nil {
+		return obj.Body, nil
+	}
+	return io.ReadAll(f)
+}
+
+// serveFile serves an object whose body is in f without reading it into memory. Whole objects
+// go through http.ServeContent, which answers range and conditional requests from the file.
+func serveFile(resp http.ResponseWriter, req *http.Request, status int, header http.Header, f *os.File) {
+	if status == http.StatusOK {
+		serveRange(resp, req, header, f)
+		return
+	}
+	maps.Copy(resp.Header(), header)
+	resp.WriteHeader(status)
+	_, _ = io.Copy(resp, f)
+}
@@ -0,0 +1,126 @@
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"unicode/utf8"
+)
+
+// maxDumpBytes caps the preview of a body, whatever is configured
+const maxDumpBytes = 64 << 10
+
+// defaultRedactedHeaders are never dumped, the configured headers are redacted on top of these
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// bodyDump holds the body dump settings, a max of 0 disables dumping
+type bodyDump struct {
+	max    int
+	redact map[string]bool // canonical header names
+}
+
+// SetBodyDump enables logging a preview of up to maxBytes of every request and response body,
+// along with the headers and the cache key, at debug level. Bodies are previewed as they pass
+// through, nothing is read that the backend or the cache wouldn't read anyway. The values of the
+// redact headers, and of Authorization, Cookie and Set-Cookie, are left out. 0 disables it.
+func (s *Server) SetBodyDump(maxBytes int, redact []string) {
+	d := bodyDump{
+		max:    min(maxBytes, maxDumpBytes),
+		redact: make(map[string]bool),
+	}
+	for _, h := range append(defaultRedactedHeaders, redact...) {
+		d.redact[http.CanonicalHeaderKey(h)] = true
+	}
+	s.dump = d
+}
+
+// dumping reports whether bodies are dumped for requests with ctx
+func (s *Server) dumping(ctx context.Context) bool {
+	return s.dump.max > 0 && s.logger.Enabled(ctx, slog.LevelDebug)
+}
+
+// dumpRequest logs a preview of the body of beReq. The previewed bytes are put back in front
+// of the rest of the body, so the backend still gets all of it.
+func (s *Server) dumpRequest(key string, beReq *http.Request) {
+	if !s.dumping(beReq.Context()) {
+		return
+	}
+	var head []byte
+	more := false
+	if beReq.Body != nil && beReq.Body != http.NoBody {
+		head = make([]byte, s.dump.max+1)
+		n, _ := io.ReadFull(beReq.Body, head)
+		head = head[:n]
+		beReq.Body = prefixedBody{Reader: io.MultiReader(bytes.NewReader(head), beReq.Body), Closer: beReq.Body}
+		if more = n > s.dump.max; more {
+			head = head[:s.dump.max]
+		}
+	}
+	s.log(beReq.Context()).Debug("request body", "key", fmt.Sprintf("%x", key), "method", beReq.Method, "url", beReq.URL.String(),
+		"headers", s.redacted(beReq.Header), "body", preview(head), "truncated", more)
+}
+
+// dumpResponse arranges for a preview of the body of beResp to be logged. The preview is
+// captured while the body is read for the client or the cache; the returned function logs it
+// and must be called once reading is done.
+func (s *Server) dumpResponse(ctx context.Context, key string, beResp *http.Response) func() {
+	if !s.dumping(ctx) {
+		return func() {}
+	}
+	c := &captureBody{rc: beResp.Body, max: s.dump.max}
+	beResp.Body = c
+	return func() {
+		s.log(ctx).Debug("response body", "key", fmt.Sprintf("%x", key), "status", beResp.StatusCode,
+			"headers", s.redacted(beResp.Header), "body", preview(c.head), "truncated", c.n > int64(len(c.head)))
+	}
+}
+
+// redacted returns a copy of h with the values of the redacted headers replaced
+func (s *Server) redacted(h http.Header) http.Header {
+	out := h.Clone()
+	for name := range out {
+		if s.dump.redact[name] {
+			out[name] = []string{"[redacted]"}
+		}
+	}
+	return out
+}
+
+// preview returns b as text when it is valid UTF-8 and hex encoded otherwise
+func preview(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	return "hex:" + hex.EncodeToString(b)
+}
+
+// prefixedBody is a request body whose first bytes were already read for a preview
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// captureBody keeps the first max bytes read through it
+type captureBody struct {
+	rc   io.ReadCloser
+	max  int
+	head []byte
+	n    int64 // bytes read in total
+}
+
+func (c *captureBody) Read(p []byte) (int, error) {
+	n, err := c.rc.Read(p)
+	if room := c.max - len(c.head); room > 0 {
+		c.head = append(c.head, p[:min(n, room)]...)
+	}
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *captureBody) Close() error {
+	return c.rc.Close()
+}
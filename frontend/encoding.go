@@ -0,0 +1,199 @@
+package frontend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Objects are stored once, without a content encoding. The backend is asked for gzip when the
+// client accepts it and for the identity encoding otherwise, so a response that isn't cached can
+// be passed through as it is. A gzipped response is decompressed before it is cached, and hits
+// are compressed again for clients that accept gzip.
+
+// minGzipSize is the smallest body compressed on the way out, smaller ones hardly shrink
+const minGzipSize = 256
+
+// errCorruptGzip is returned by decodeObject when a gzipped body can't be decompressed
+var errCorruptGzip = errors.New("corrupt gzip body from backend")
+
+// SetGzip compresses responses served from the cache for clients that accept gzip, when their
+// type is worth compressing. It is on by default. Either way objects are stored uncompressed.
+func (s *Server) SetGzip(enabled bool) {
+	s.gzip = enabled
+}
+
+// acceptsGzip reports whether the client's Accept-Encoding allows a gzipped response
+func acceptsGzip(req *http.Request) bool {
+	accepted := false
+	for _, line := range req.Header.Values("Accept-Encoding") {
+		for coding := range strings.SplitSeq(line, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "x-gzip" && name != "*" {
+				continue
+			}
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+			if name != "*" && q == 0 {
+				// an explicit refusal beats a wildcard
+				return false
+			}
+			accepted = accepted || q > 0
+		}
+	}
+	return accepted
+}
+
+// setAcceptEncoding asks the backend for an encoding this cache can decode and the client can
+// take if the response is passed through
+func setAcceptEncoding(beReq, req *http.Request) {
+	if acceptsGzip(req) {
+		beReq.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		beReq.Header.Set("Accept-Encoding", "identity")
+	}
+}
+
+// decodable reports whether a body with the Content-Encoding in h can be stored uncompressed
+func decodable(h http.Header) bool {
+	switch strings.ToLower(h.Get("Content-Encoding")) {
+	case "", "identity", "gzip", "x-gzip":
+		return true
+	}
+	return false
+}
+
+// identity reports whether h says the body is in no content encoding
+func identity(h http.Header) bool {
+	switch strings.ToLower(h.Get("Content-Encoding")) {
+	case "", "identity":
+		return true
+	}
+	return false
+}
+
+// decodeObject returns the uncompressed body of a response that is about to be cached, and
+// removes its Content-Encoding. A strong ETag becomes weak, it named the gzipped bytes. On error
+// h is left as it is.
+func (s *Server) decodeObject(h http.Header, body []byte) ([]byte, error) {
+	switch strings.ToLower(h.Get("Content-Encoding")) {
+	case "gzip", "x-gzip":
+	case "identity":
+		h.Del("Content-Encoding")
+		return body, nil
+	default:
+		return body, nil
+	}
+	if len(body) == 0 {
+		// the answer to a HEAD request, or a response that has nothing to encode
+		return body, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return body, errCorruptGzip
+	}
+	decoded, err := s.readObject(zr)
+	switch {
+	case errors.Is(err, errObjectTooLarge), errors.Is(err, errBufferFull):
+		return body, err
+	case err != nil:
+		return body, errCorruptGzip
+	}
+	h.Del("Content-Encoding")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	return decoded, nil
+}
+
+// compressible reports whether a body of the Content-Type in h is worth compressing, text and
+// structured data are while images, video and archives are compressed already
+func compressible(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// gzipEligible reports whether a cached object may be sent gzipped to clients that accept it.
+// Ranges are served from the uncompressed body, and only a GET has a body to compress.
+func (s *Server) gzipEligible(req *http.Request, status int, h http.Header) bool {
+	if !s.gzip || req.Method != http.MethodGet || status != http.StatusOK || req.Header.Get("Range") != "" {
+		return false
+	}
+	size, err := strconv.Atoi(h.Get("Content-Length"))
+	return err == nil && size >= minGzipSize && compressible(h)
+}
+
+// varyEncoding adds Accept-Encoding to the Vary header of resp, so caches downstream keep the
+// gzipped and the uncompressed response apart. The slice is copied, it may be the object's.
+func varyEncoding(resp http.ResponseWriter) {
+	if !varies(resp.Header(), "Accept-Encoding") {
+		resp.Header()["Vary"] = slices.Concat(resp.Header().Values("Vary"), []string{"Accept-Encoding"})
+	}
+}
+
+// gzipWriters are reused, a gzip.Writer allocates several hundred kilobytes
+var gzipWriters = sync.Pool{
+	New: func() any {
+		zw, _ := gzip.NewWriterLevel(io.Discard, gzip.BestSpeed)
+		return zw
+	},
+}
+
+// writeObject writes a buffered object, cached or just stored, to the client. It is gzipped for
+// clients that accept it, unless the response said no-transform.
+func (s *Server) writeObject(resp http.ResponseWriter, req *http.Request, status int, h http.Header, body []byte, noTransform bool) error {
+	for name, values := range h {
+		resp.Header()[name] = values
+	}
+	setBodyLength(resp.Header(), status, len(body))
+	if !noTransform && s.gzipEligible(req, status, resp.Header()) {
+		return writeEncoded(resp, req, status, bytes.NewReader(body))
+	}
+	resp.WriteHeader(status)
+	_, err := resp.Write(body)
+	return err
+}
+
+// writeEncoded writes the body of an object eligible for gzip, whose headers are set already:
+// gzipped when the client accepts it, as it is otherwise
+func writeEncoded(resp http.ResponseWriter, req *http.Request, status int, body io.Reader) error {
+	varyEncoding(resp)
+	if !acceptsGzip(req) {
+		resp.WriteHeader(status)
+		_, err := io.Copy(resp, body)
+		return err
+	}
+	resp.Header().Del("Content-Length")
+	resp.Header().Set("Content-Encoding", "gzip")
+	resp.WriteHeader(status)
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	zw.Reset(resp)
+	if _, err := io.Copy(zw, body); err != nil {
+		return err
+	}
+	return zw.Close()
+}
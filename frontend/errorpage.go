@@ -0,0 +1,70 @@
+package frontend
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/perbu/hazelnut/backend"
+	"github.com/perbu/hazelnut/metrics"
+)
+
+// DefaultErrorPageContentType is the content type of a configured error page that doesn't set one
+const DefaultErrorPageContentType = "text/html; charset=utf-8"
+
+// SetErrorPage sets the page served when the backend can't be reached, is too slow or its
+// response is too large, in place of the backend package's built-in fallback. A status of 0 keeps
+// the status of the failure, 504 for a timeout and 502 otherwise. An empty content type means HTML
+// and an empty body a minimal page naming the status.
+func (s *Server) SetErrorPage(status int, contentType string, body []byte) {
+	s.errorPage = &errorPage{status: status, contentType: cmp.Or(contentType, DefaultErrorPageContentType), body: body}
+}
+
+// errorPage is the configured page for backend failures
+type errorPage struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// fallback counts a fallback response from the backend as an error, too_large when the verdict
+// says the response was refused for its size, a timeout when it is a 504, and returns the
+// configured error page in its place. Other responses, and any response when no page is
+// configured, are returned as they are.
+func (s *Server) fallback(beResp *http.Response, verdict backend.Cacheability) *http.Response {
+	if !backend.IsFallback(beResp) {
+		return beResp
+	}
+	reason := metrics.ReasonDial
+	switch {
+	case verdict.Reason == backend.UncacheableTooLarge:
+		reason = metrics.ReasonTooLarge
+	case beResp.StatusCode == http.StatusGatewayTimeout:
+		reason = metrics.ReasonTimeout
+	}
+	s.metrics.Errors.WithLabelValues(reason).Inc()
+	if s.errorPage == nil {
+		return beResp
+	}
+	_ = beResp.Body.Close()
+	status := cmp.Or(s.errorPage.status, beResp.StatusCode)
+	body := s.errorPage.body
+	if len(body) == 0 {
+		text := fmt.Sprintf("%d %s", status, http.StatusText(status))
+		body = fmt.Appendf(nil, "<html><head><title>%s</title></head><body><h1>%s</h1></body></html>\n", text, text)
+	}
+	header := http.Header{}
+	header.Set("Content-Type", s.errorPage.contentType)
+	header.Set("Cache-Control", "no-store")
+	// still a fallback, it isn't counted or cached as a backend response
+	header.Set("X-Backend-Name", beResp.Header.Get("X-Backend-Name"))
+	return &http.Response{
+		StatusCode:    status,
+		Status:        http.StatusText(status),
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
@@ -0,0 +1,189 @@
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"maps"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/perbu/hazelnut/metrics"
+)
+
+// esiMaxDepth is how deep ESI includes nest, includes below it are left out
+const esiMaxDepth = 3
+
+var (
+	esiIncludeTag = regexp.MustCompile(`(?s)<esi:include\s(.*?)/?>(?:\s*</esi:include>)?`)
+	esiRemoveTag  = regexp.MustCompile(`(?s)<esi:remove>.*?</esi:remove>`)
+	esiAttr       = regexp.MustCompile(`([a-z]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// esiDepthKey is the context key of the include depth of a fragment request
+type esiDepthKey struct{}
+
+// SetESI enables Edge Side Includes. HTML responses whose origin opted in with
+// Surrogate-Control: content="ESI/1.0" have their <esi:include> tags replaced by the fragments
+// they point at, fetched through the cache like any other request, and <esi:remove> blocks
+// dropped. Pages are cached with their tags, so each hit is assembled from fresh fragments.
+func (s *Server) SetESI(enabled bool) {
+	s.esi = enabled
+}
+
+// esiApplies reports whether a response with header h gets ESI processing
+func (s *Server) esiApplies(h http.Header) bool {
+	if !s.esi {
+		return false
+	}
+	if mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type")); err != nil || mediaType != "text/html" {
+		return false
+	}
+	for _, line := range h.Values("Surrogate-Control") {
+		for directive := range strings.SplitSeq(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if strings.EqualFold(name, "content") && strings.Contains(strings.ToUpper(value), "ESI/1.0") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeESI writes a response with header and a body with ESI tags, which are processed first.
+// A failed include without a fallback fails the whole response with a 502.
+func (s *Server) writeESI(resp http.ResponseWriter, req *http.Request, status int, header http.Header, body []byte) {
+	log := s.log(req.Context())
+	out, err := s.processESI(req, body)
+	if err != nil {
+		s.metrics.Errors.WithLabelValues(metrics.ReasonESI).Inc()
+		log.Warn("ESI include failed", "path", req.URL.Path, "error", err)
+		http.Error(resp, "ESI include failed", http.StatusBadGateway)
+		return
+	}
+	maps.Copy(resp.Header(), header)
+	// the surrogate header is for us, and the page isn't the one the length and ETag describe
+	resp.Header().Del("Surrogate-Control")
+	resp.Header().Del("Content-Length")
+	resp.Header().Del("Etag")
+	resp.WriteHeader(status)
+	if _, err := resp.Write(out); err != nil {
+		s.writeFailed(req, "write ESI response", err)
+	}
+}
+
+// processESI returns body with its includes replaced by their fragments and its remove blocks
+// dropped. The fragments are fetched concurrently.
+func (s *Server) processESI(req *http.Request, body []byte) ([]byte, error) {
+	body = esiRemoveTag.ReplaceAll(body, nil)
+	tags := esiIncludeTag.FindAllSubmatchIndex(body, -1)
+	if len(tags) == 0 {
+		return body, nil
+	}
+	depth, _ := req.Context().Value(esiDepthKey{}).(int)
+	fragments := make([][]byte, len(tags))
+	errs := make([]error, len(tags))
+	var wg sync.WaitGroup
+	for i, tag := range tags {
+		attrs := esiAttrs(body[tag[2]:tag[3]])
+		wg.Go(func() {
+			fragments[i], errs[i] = s.esiInclude(req, depth, attrs)
+		})
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	last := 0
+	for i, tag := range tags {
+		out.Write(body[last:tag[0]])
+		out.Write(fragments[i])
+		last = tag[1]
+	}
+	out.Write(body[last:])
+	return out.Bytes(), nil
+}
+
+// esiAttrs parses the attributes of an ESI tag
+func esiAttrs(tag []byte) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range esiAttr.FindAllSubmatch(tag, -1) {
+		attrs[string(m[1])] = html.UnescapeString(string(m[2]) + string(m[3]))
+	}
+	return attrs
+}
+
+// esiInclude returns the fragment of an include tag with attrs. When src fails, alt is tried, and
+// with onerror="continue" a failure leaves the include out instead of failing the page.
+func (s *Server) esiInclude(req *http.Request, depth int, attrs map[string]string) ([]byte, error) {
+	log := s.log(req.Context())
+	if depth >= esiMaxDepth {
+		log.Debug("ESI include nested too deep, left out", "src", attrs["src"], "depth", depth)
+		return nil, nil
+	}
+	fragment, err := s.fetchFragment(req, depth, attrs["src"])
+	if err != nil && attrs["alt"] != "" {
+		log.Debug("ESI include failed, trying alt", "src", attrs["src"], "alt", attrs["alt"], "error", err)
+		fragment, err = s.fetchFragment(req, depth, attrs["alt"])
+	}
+	if err != nil && attrs["onerror"] == "continue" {
+		log.Debug("ESI include failed, left out", "src", attrs["src"], "error", err)
+		return nil, nil
+	}
+	return fragment, err
+}
+
+// fetchFragment fetches the fragment at src, relative to the page req asked for, through the cache.
+// The fragment request carries the headers of the page request, so it gets the same variants.
+func (s *Server) fetchFragment(req *http.Request, depth int, src string) ([]byte, error) {
+	if src == "" {
+		return nil, errors.New("esi:include without src")
+	}
+	u, err := req.URL.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("esi:include src %q: %w", src, err)
+	}
+	sub := req.Clone(context.WithValue(req.Context(), esiDepthKey{}, depth+1))
+	sub.Method = http.MethodGet
+	sub.URL = u
+	sub.RequestURI = u.RequestURI()
+	if u.Host != "" {
+		sub.Host = u.Host
+	}
+	sub.Body = http.NoBody
+	sub.ContentLength = 0
+	for _, h := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "Accept-Encoding"} {
+		sub.Header.Del(h)
+	}
+	w := &fragmentWriter{header: make(http.Header), status: http.StatusOK}
+	s.cacheable(w, sub)
+	if w.status >= 400 {
+		return nil, fmt.Errorf("esi:include %s: status %d", u, w.status)
+	}
+	return w.body.Bytes(), nil
+}
+
+// fragmentWriter collects the response to a fragment request
+type fragmentWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *fragmentWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *fragmentWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *fragmentWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
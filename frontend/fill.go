@@ -0,0 +1,113 @@
+package frontend
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Reasons a cache fill is aborted, used as the "reason" label on the fills aborted counter
+const (
+	fillAbortBackend   = "backend"   // reading the body from the backend failed
+	fillAbortTooLarge  = "too_large" // the body turned out larger than the max object size
+	fillAbortEmpty     = "empty"     // there was no body to store
+	fillAbortTruncated = "truncated" // the body ended before its Content-Length
+	fillAbortCanceled  = "canceled"  // the client went away before the body was read
+	fillAbortSpill     = "spill"     // writing a body too large to buffer to a file failed
+)
+
+// Limits a miss can run into, used as the "limit" label on the fills rejected counter
+const (
+	fillLimitGlobal = "global"
+	fillLimitKey    = "key"
+)
+
+// SetFillEvents enables metrics and debug log events tracking the progress of cache fills
+func (s *Server) SetFillEvents(enabled bool) {
+	s.fillEvents = enabled
+}
+
+// fill tracks a single cache fill: a miss whose body is read from the backend to be stored
+type fill struct {
+	s   *Server
+	key string
+	t0  time.Time
+	log *slog.Logger
+}
+
+// startFill records the start of a fill for key by the request with ctx
+func (s *Server) startFill(ctx context.Context, key string) *fill {
+	f := &fill{s: s, key: key, t0: time.Now(), log: s.log(ctx)}
+	if s.fillEvents {
+		s.metrics.FillsStarted.Inc()
+		f.log.Debug("fill started", "key", key)
+	}
+	return f
+}
+
+// complete records a fill that stored an object of size bytes
+func (f *fill) complete(size int) {
+	if !f.s.fillEvents {
+		return
+	}
+	duration := time.Since(f.t0)
+	f.s.metrics.FillsCompleted.Inc()
+	f.s.metrics.FillBytes.Observe(float64(size))
+	f.s.metrics.FillDuration.Observe(duration.Seconds())
+	f.log.Debug("fill completed", "key", f.key, "bytes", size, "duration", duration)
+}
+
+// abort records a fill that didn't store anything
+func (f *fill) abort(reason string) {
+	if !f.s.fillEvents {
+		return
+	}
+	f.s.metrics.FillsAborted.WithLabelValues(reason).Inc()
+	f.log.Debug("fill aborted", "key", f.key, "reason", reason, "duration", time.Since(f.t0))
+}
+
+// SetFillLimits caps the number of misses fetching from the backend at the same time, in total
+// and for a single cache key. Misses over either limit are rejected with a 503. 0 means no limit.
+// ESI fragments are fetched within the slot of their page and aren't counted.
+func (s *Server) SetFillLimits(global, perKey int) {
+	s.fills.mu.Lock()
+	defer s.fills.mu.Unlock()
+	s.fills.global = global
+	s.fills.perKey = perKey
+}
+
+// fillLimiter counts the fills in progress, in total and per key
+type fillLimiter struct {
+	mu     sync.Mutex
+	global int // 0 means no limit
+	perKey int // 0 means no limit
+	total  int
+	keys   map[string]int
+}
+
+// acquire takes a slot for a fill of key. It returns the limit that was hit when there is no
+// slot, or a release func that must be called when the fill is done.
+func (l *fillLimiter) acquire(key string) (func(), string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.global > 0 && l.total >= l.global {
+		return nil, fillLimitGlobal
+	}
+	if l.perKey > 0 && l.keys[key] >= l.perKey {
+		return nil, fillLimitKey
+	}
+	if l.keys == nil {
+		l.keys = make(map[string]int)
+	}
+	l.total++
+	l.keys[key]++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.total--
+		if l.keys[key]--; l.keys[key] <= 0 {
+			delete(l.keys, key)
+		}
+	}, ""
+}
@@ -0,0 +1,102 @@
+package frontend
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/perbu/hazelnut/clientip"
+)
+
+// SetForwardedHeaders controls whether the backend is told who the client is with the
+// X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and Forwarded headers. Enabled by default.
+func (s *Server) SetForwardedHeaders(enabled bool) {
+	s.forwarded = enabled
+}
+
+// SetTrustedProxies sets the proxies in front of the frontend whose X-Forwarded-For is believed.
+// The client address used by GeoIP and the access log is then taken from it when the request
+// comes from one of them. The forwarding headers of anybody else are dropped before the backend
+// sees them, so clients can't pose as somebody else.
+func (s *Server) SetTrustedProxies(prefixes []netip.Prefix) {
+	s.proxies = clientip.Proxies(prefixes)
+}
+
+// clientAddr returns the address of the client of req, looking through trusted proxies
+func (s *Server) clientAddr(req *http.Request) netip.Addr {
+	return s.proxies.ClientAddr(req)
+}
+
+// setForwardedHeaders adds the client of req to beReq. The client address is appended to the
+// X-Forwarded-For and Forwarded chains, so the proxies in front of us are kept; with trusted
+// proxies set, only their chains are, anybody else's are replaced. X-Forwarded-Proto and
+// X-Forwarded-Host are kept only from a trusted proxy, which saw the original request. They
+// aren't in the cache key, so a client that could set them could poison what others are served.
+func (s *Server) setForwardedHeaders(beReq, req *http.Request) {
+	if !s.forwarded {
+		return
+	}
+	trusted := s.proxies.Trusted(clientip.Peer(req))
+	if len(s.proxies) > 0 && !trusted {
+		beReq.Header.Del("X-Forwarded-For")
+		beReq.Header.Del("Forwarded")
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if !trusted || beReq.Header.Get("X-Forwarded-Proto") == "" {
+		beReq.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if !trusted || beReq.Header.Get("X-Forwarded-Host") == "" {
+		beReq.Header.Del("X-Forwarded-Host")
+		if req.Host != "" {
+			beReq.Header.Set("X-Forwarded-Host", req.Host)
+		}
+	}
+
+	forwarded := "proto=" + proto
+	if req.Host != "" {
+		forwarded = "host=" + quote(req.Host) + ";" + forwarded
+	}
+	// the chain gets the peer, the proxies before it have added themselves
+	if addr := clientip.Peer(req); addr.IsValid() {
+		ip := addr.String()
+		if prior := beReq.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		beReq.Header.Set("X-Forwarded-For", ip)
+		node := addr.String()
+		if addr.Is6() {
+			node = `"[` + node + `]"`
+		}
+		forwarded = "for=" + node + ";" + forwarded
+	}
+	if prior := beReq.Header.Values("Forwarded"); len(prior) > 0 {
+		forwarded = strings.Join(prior, ", ") + ", " + forwarded
+	}
+	beReq.Header.Set("Forwarded", forwarded)
+}
+
+// quote makes v a quoted-string when it contains characters that aren't allowed in a token,
+// such as the colon of a host with a port
+func quote(v string) string {
+	for _, r := range v {
+		if !isTokenChar(r) {
+			return `"` + v + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	switch r {
+	case '!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~':
+		return true
+	}
+	return false
+}
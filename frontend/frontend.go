@@ -1,138 +1,544 @@
 package frontend
 
 import (
+	"bytes"
+	"cmp"
 	"context"
-	_ "embed"
 	"errors"
 	"fmt"
 	"github.com/perbu/hazelnut/backend"
 	"github.com/perbu/hazelnut/cache"
+	"github.com/perbu/hazelnut/clientip"
+	"github.com/perbu/hazelnut/geoip"
 	"github.com/perbu/hazelnut/metrics"
 	"io"
 	"log/slog"
 	"maps"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"os"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-//go:embed .version
-var embeddedVersion string
+// DefaultDrainTimeout is how long requests in flight get to finish on shutdown
+const DefaultDrainTimeout = 30 * time.Second
 
-const (
-	defaultTTL = 5 * time.Minute
-)
+// drainLogInterval is how often the requests still in flight are logged while draining
+const drainLogInterval = time.Second
 
 type Cache interface {
 	Get(key string) (cache.ObjCore, bool)
-	Set(key string, value cache.ObjCore)
+	Set(key string, value cache.ObjCore) error
+	SetWithTTL(key string, value cache.ObjCore, ttl time.Duration) error
+}
+
+// MethodPolicy controls whether responses to a request method are cached and for how long
+type MethodPolicy struct {
+	Cache bool          // cache responses to this method
+	TTL   time.Duration // overrides the TTL derived from the response headers, 0 keeps it
 }
 
 type Server struct {
-	cache      Cache
-	backend    backend.Fetcher
-	srv        *http.Server
-	logger     *slog.Logger
-	metrics    *metrics.Metrics
-	ignoreHost bool // Flag to determine if host should be ignored in cache keys
+	cache           Cache
+	backend         backend.Fetcher
+	srv             *http.Server
+	addrs           []string       // addresses listened on, all served by srv
+	lnMu            sync.Mutex     // guards listeners
+	listeners       []net.Listener // bound by Run
+	logger          *slog.Logger
+	metrics         *metrics.Metrics
+	methods         map[string]MethodPolicy // per-method caching policy, keyed by upper-case method
+	geo             geoip.Resolver          // optional, folds the client's country into the cache key
+	geoHeader       string                  // request header carrying the country to the backend
+	devices         []DeviceRule            // optional, folds the client's device class into the cache key
+	deviceHdr       string                  // request header carrying the device class to the backend
+	varyCookie      []string                // cookies folded into the key, allows caching Vary: Cookie responses
+	keyCookie       []string                // cookies folded into the key as well, without allowing Vary: Cookie
+	maxObjSize      int64                   // largest body that is buffered and cached, 0 means no limit
+	bufferLimit     int64                   // largest body buffered in memory, 0 means the max object size
+	negTTL          time.Duration           // TTL for negatively cached error responses, 0 disables
+	ttlJitter       int                     // percentage by which TTLs are randomly shortened, 0 disables
+	neg5xx          bool                    // also negatively cache 5xx responses
+	deadlineHdr     string                  // request header carrying the remaining deadline to the backend
+	deadlineBudget  budgetFunc              // optional, how long the backend a host is routed to may take
+	fillEvents      bool                    // emit cache fill metrics and debug events
+	key             cache.KeyPolicy         // which parts of a request make up its cache key
+	path            cache.PathPolicy        // how the path is canonicalized into the cache key
+	fwdPath         bool                    // send the canonical path to the backend instead of the client's
+	fills           fillLimiter             // caps the misses fetching from the backend at the same time
+	minLatency      time.Duration           // only cache responses that took at least this long to fetch
+	forwarded       bool                    // send X-Forwarded-* and Forwarded headers to the backend
+	integrity       bool                    // fingerprint cached objects and check them on hits
+	keyFunc         keyFunc                 // computes the cache key, nil means the key policy
+	logKeys         bool                    // log the readable components of cache keys at debug level
+	via             string                  // pseudonym in the Via headers added to requests and responses
+	dump            bodyDump                // log previews of request and response bodies at debug level
+	allow           string                  // Allow header of the response to OPTIONS *
+	access          *accessLog              // optional, Common or Combined Log Format access log
+	proxies         clientip.Proxies        // trusted proxies, whose X-Forwarded-For gives the client address
+	malformed       errorResponse           // served instead of a malformed backend response
+	rangeFill       bool                    // fill the cache with the whole object on range requests
+	drainTime       time.Duration           // how long requests in flight get to finish on shutdown
+	inFlight        atomic.Int64            // requests being served right now
+	defaultCT       string                  // Content-Type for responses without one, or ContentTypeSniff
+	keyProto        bool                    // fold the client's HTTP protocol version into the cache key
+	storeRetry      storeRetry              // how failed cache stores are retried
+	hitsHeader      bool                    // send X-Cache-Hits with the hit count of the object on hits
+	keyBackend      func(string) string     // optional, names the backend a host is routed to for the cache key
+	denyList        []string                // headers removed from backend responses
+	stripCookie     bool                    // keep Set-Cookie out of cached objects
+	ignoreCC        bool                    // ignore Cache-Control and Pragma sent by clients
+	cacheAuth       bool                    // cache responses to requests with Authorization whatever they say
+	esi             bool                    // process ESI tags in HTML responses that opt in
+	gzip            bool                    // compress cached objects for clients that accept gzip
+	errorPage       *errorPage              // optional, replaces the backend's fallback response
+	maintenance     atomic.Bool             // answer without the backends, see SetMaintenance
+	maintenancePage MaintenancePage
+	storeRules      []HeaderRule // applied to backend response headers before they are cached
+	clientRules     []HeaderRule // applied to response headers as they are sent to the client
+	bypass          []BypassRule // requests matching any of these are never cached
+	ttlRules        []TTLRule    // override the TTL of responses by path, the first match applies
 }
 
+// keyFunc has the signature of cache.KeyPolicy.Key
+type keyFunc func(r *http.Request, variants ...string) string
+
 func New(logger *slog.Logger, cache Cache, backend backend.Fetcher, addr string, metrics *metrics.Metrics, ignoreHost bool) *Server {
 	s := &Server{
-		cache:      cache,
-		backend:    backend,
-		logger:     logger.With("package", "frontend"),
-		metrics:    metrics,
-		ignoreHost: ignoreHost,
+		cache:     cache,
+		backend:   backend,
+		logger:    logger.With("package", "frontend"),
+		metrics:   metrics,
+		methods:   defaultMethodPolicies(),
+		forwarded: true,
+		gzip:      true,
+		via:       DefaultViaPseudonym,
 	}
+	s.key.IgnoreHost = ignoreHost
+	s.addrs = []string{addr}
+	s.SetServerOptions(nil)
+	s.SetMalformedResponse(0, "")
+	s.SetDrainTimeout(0)
+	s.SetStoreRetries(0, 0)
+	s.SetStripHeaders(nil, false)
 	s.srv = &http.Server{
 		Addr:    addr,
 		Handler: s,
+		// OPTIONS * is answered by ServeHTTP, with the configured Allow header
+		DisableGeneralOptionsHandler: true,
 	}
+	s.SetTimeouts(Timeouts{})
 	logger.Info("frontend configured", "addr", addr, "ignoreHost", ignoreHost)
 	return s
 }
 
-// ActualPort returns the actual port the service is listening on.
-// Only works after service is started and when using port 0 to get a random port.
-// this is useful for testing when the service is started with port 0.
-func (s *Server) ActualPort() int {
-	if s.srv == nil || s.srv.Addr == "" {
-		return 0
+// defaultMethodPolicies caches GET and HEAD using the TTL from the response headers
+func defaultMethodPolicies() map[string]MethodPolicy {
+	return map[string]MethodPolicy{
+		http.MethodGet:  {Cache: true},
+		http.MethodHead: {Cache: true},
+	}
+}
+
+// SetMethodPolicies overrides the caching policy for the given methods.
+// Methods not mentioned keep their default: GET and HEAD are cached, everything else is passed through.
+func (s *Server) SetMethodPolicies(policies map[string]MethodPolicy) {
+	methods := defaultMethodPolicies()
+	for method, policy := range policies {
+		methods[strings.ToUpper(method)] = policy
+	}
+	s.methods = methods
+}
+
+// SetQueryPolicy sets how the query string is normalized into the cache key
+func (s *Server) SetQueryPolicy(policy cache.QueryPolicy) {
+	s.key.Query = policy
+}
+
+// SetKeyPolicy sets which parts of a request make up its cache key. It replaces the ignoreHost
+// given to New and the query policy.
+func (s *Server) SetKeyPolicy(policy cache.KeyPolicy) {
+	s.key = policy
+}
+
+// CacheKey returns the key req is stored under, leaving out the GeoIP, device and protocol
+// variants but the backend it is routed to and its cookies
+func (s *Server) CacheKey(req *http.Request) string {
+	var variants []string
+	if s.keyBackend != nil {
+		variants = append(variants, "backend:"+s.keyBackend(req.Host))
+	}
+	return s.makeKey(s.keyRequest(req), append(variants, s.cookieVariants(req)...)...)
+}
+
+// makeKey returns the cache key for a request that has been through keyRequest
+func (s *Server) makeKey(r *http.Request, variants ...string) string {
+	if s.keyFunc != nil {
+		return s.keyFunc(r, variants...)
+	}
+	return s.key.Key(r, variants...)
+}
+
+// SetLogKeys logs the parts of each cacheable request that make up its cache key, such as the
+// host, path, normalized query, headers and variants, next to the hashed key at debug level, to
+// debug why requests do or don't share objects
+func (s *Server) SetLogKeys(enabled bool) {
+	s.logKeys = enabled
+}
+
+// SetKeyIntegrity enables key integrity mode: cached objects carry a fingerprint of the request
+// that filled them, and a hit with a fingerprint that doesn't match the request is logged,
+// counted and treated as a miss. This catches keying bugs at the cost of a second hash per request.
+func (s *Server) SetKeyIntegrity(enabled bool) {
+	s.integrity = enabled
+}
+
+// SetKeyProtocol folds the protocol version of the client's request, such as HTTP/1.1 or
+// HTTP/2.0, into the cache key, so clients speaking different versions never share objects
+func (s *Server) SetKeyProtocol(enabled bool) {
+	s.keyProto = enabled
+}
+
+// SetKeyBackend folds the backend a request is routed to, as named by fn for the request's
+// host, into the cache key. With ignoreHost this keeps hosts routed to different backends
+// apart, while hosts sharing a backend still share objects. A nil fn disables it.
+func (s *Server) SetKeyBackend(fn func(host string) string) {
+	s.keyBackend = fn
+}
+
+// SetHitsHeader makes hits carry an X-Cache-Hits header with the number of times the object
+// has been hit, this hit included, for debugging how well individual objects are cached
+func (s *Server) SetHitsHeader(enabled bool) {
+	s.hitsHeader = enabled
+}
+
+// SetMaxObjectSize sets the largest body that is cached. Misses that won't be cached,
+// including ones larger than this, are streamed to the client instead of being buffered.
+func (s *Server) SetMaxObjectSize(size int64) {
+	s.maxObjSize = size
+}
+
+// SetMinFetchLatency makes only responses that took at least d to fetch cacheable, the rest
+// are cheap enough to fetch again. Latency is measured until the backend's response headers
+// arrive. 0 caches regardless of latency.
+func (s *Server) SetMinFetchLatency(d time.Duration) {
+	s.minLatency = d
+}
+
+// SetNegativeCaching enables caching of 404 and 410 responses for ttl, and of 5xx responses
+// as well when include5xx is set. A ttl of 0 disables negative caching.
+func (s *Server) SetNegativeCaching(ttl time.Duration, include5xx bool) {
+	s.negTTL = ttl
+	s.neg5xx = include5xx
+}
+
+// minJitteredTTL is the shortest TTL jitter may lower a TTL to. Shorter TTLs aren't jittered.
+const minJitteredTTL = time.Second
+
+// SetTTLJitter shortens the TTLs of stored objects randomly by up to percent of the TTL, so
+// objects filled together don't all expire together and stampede the backend. Jitter never
+// lengthens a TTL: an object isn't served for longer than its origin allows. 0 disables.
+func (s *Server) SetTTLJitter(percent int) {
+	s.ttlJitter = percent
+}
+
+// jitterTTL returns ttl shortened by the configured jitter, never below minJitteredTTL
+func (s *Server) jitterTTL(ttl time.Duration) time.Duration {
+	spread := ttl * time.Duration(s.ttlJitter) / 100
+	if spread <= 0 || ttl <= minJitteredTTL {
+		return ttl
 	}
-	// If the service has a listener, get the actual port
-	if listener := s.srv.BaseContext; listener != nil {
-		if addr, ok := s.srv.BaseContext(nil).Value(http.LocalAddrContextKey).(net.Addr); ok {
-			if tcpAddr, ok := addr.(*net.TCPAddr); ok {
-				return tcpAddr.Port
+	return max(ttl-rand.N(spread+1), minJitteredTTL)
+}
+
+// negativeCacheable reports whether an error response may be negatively cached
+func (s *Server) negativeCacheable(beResp *http.Response) bool {
+	if s.negTTL <= 0 || backend.IsFallback(beResp) {
+		return false
+	}
+	switch {
+	case beResp.StatusCode == http.StatusNotFound, beResp.StatusCode == http.StatusGone:
+		return true
+	case beResp.StatusCode >= 500 && beResp.StatusCode <= 599:
+		return s.neg5xx
+	}
+	return false
+}
+
+// SetDrainTimeout sets how long Run waits for requests in flight to finish once its context
+// is done, before closing their connections. 0 means DefaultDrainTimeout.
+func (s *Server) SetDrainTimeout(d time.Duration) {
+	s.drainTime = cmp.Or(d, DefaultDrainTimeout)
+}
+
+// logDrain logs the number of requests still in flight every drainLogInterval until ctx is done
+// or none are left
+func (s *Server) logDrain(ctx context.Context) {
+	ticker := time.NewTicker(drainLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n := s.inFlight.Load()
+			if n == 0 {
+				return
 			}
+			s.logger.Info("draining", "in_flight", n)
 		}
 	}
-	return 0
 }
 
+// Run listens on every address and serves until ctx is done, then drains: it stops accepting
+// connections on all of them and returns once the requests in flight have finished or the drain
+// timeout has passed. When an address can't be bound nothing is served.
 func (s *Server) Run(ctx context.Context) error {
+	listeners, err := s.listen()
+	if err != nil {
+		return err
+	}
 	// Setup service shutdown when context is done
+	drained := make(chan struct{})
 	go func() {
+		defer close(drained)
 		<-ctx.Done()
-		s.logger.Info("shutting down service")
-		_ = s.srv.Shutdown(ctx)
+		s.logger.Info("shutting down service, draining", "timeout", s.drainTime, "in_flight", s.inFlight.Load())
+		dctx, cancel := context.WithTimeout(context.Background(), s.drainTime)
+		defer cancel()
+		go s.logDrain(dctx)
+		if err := s.srv.Shutdown(dctx); err != nil {
+			s.logger.Warn("drain timed out, closing connections", "error", err, "in_flight", s.inFlight.Load())
+			_ = s.srv.Close()
+		}
 	}()
 
-	// Start the service
-	if err := s.srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-		return fmt.Errorf("ListenAndServe: %w", err)
+	// Start the service, one http.Server serves all listeners and shuts them all down
+	errc := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		s.logger.Info("listening", "addr", ln.Addr().String())
+		go func() { errc <- s.srv.Serve(ln) }()
+	}
+	var serveErr error
+	for range listeners {
+		if err := <-errc; !errors.Is(err, http.ErrServerClosed) && serveErr == nil {
+			serveErr = fmt.Errorf("Serve: %w", err)
+			// stop serving on the other listeners too
+			_ = s.srv.Close()
+		}
+	}
+	if serveErr != nil {
+		return serveErr
 	}
+	// Serve returns as soon as the shutdown starts, wait for the drain
+	<-drained
 	return nil
 }
 
-func (s *Server) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	t0 := time.Now()
-	switch req.Method {
-	case http.MethodGet:
-		s.cacheable(resp, req)
-	case http.MethodHead:
+	s.inFlight.Add(1)
+	s.metrics.InFlight.Inc()
+	defer func() {
+		s.inFlight.Add(-1)
+		s.metrics.InFlight.Dec()
+	}()
+	id := requestID(req)
+	req = s.withRequestID(req, id)
+	log := s.log(req.Context())
+	resp := &responseRecorder{ResponseWriter: w, rules: s.clientRules, head: req.Method == http.MethodHead}
+	resp.Header().Set(backend.RequestIDHeader, id)
+	s.serve(resp, req)
+	if resp.implicit {
+		log.Debug("response body written without a status", "method", req.Method, "path", req.URL.Path)
+	}
+	s.metrics.ResponseBytes.WithLabelValues(resp.CacheStatus()).Add(float64(resp.bytes))
+	log.Info("request", "method", req.Method, "path", req.URL.Path, "status", resp.Status(), "bytes", resp.bytes,
+		"duration", time.Since(t0))
+	if s.access != nil {
+		s.access.log(req, s.clientAddr(req), resp.Status(), resp.bytes, t0)
+	}
+}
+
+// serve dispatches a request to the handler for its kind
+func (s *Server) serve(resp *responseRecorder, req *http.Request) {
+	defer s.recoverPanic(resp, req)
+	switch {
+	case isServerOptions(req):
+		s.serverOptions(resp)
+	case s.maintenanceBlocks(req):
+		s.serveMaintenance(resp)
+	case isUpgrade(req):
+		s.upgrade(resp, req)
+	case s.methods[req.Method].Cache && s.bypassed(req):
+		s.defaultMethod(resp, req, "bypass")
+	case s.methods[req.Method].Cache:
 		s.cacheable(resp, req)
 	default:
-		s.defaultMethod(resp, req)
+		s.defaultMethod(resp, req, "")
+	}
+}
+
+// recoverPanic keeps a panic in a handler from going unnoticed: it is counted and logged with its
+// stack, and the client gets a 500. When the response has started it can't be replaced, so the
+// connection is cut instead and the client doesn't take a partial body for a whole one.
+func (s *Server) recoverPanic(resp *responseRecorder, req *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		// a deliberate abort, net/http closes the connection without logging it
+		panic(v)
+	}
+	s.metrics.Panics.Inc()
+	s.log(req.Context()).Error("panic serving request", "method", req.Method, "path", req.URL.Path,
+		"panic", v, "stack", string(debug.Stack()))
+	if resp.status != 0 {
+		panic(http.ErrAbortHandler)
 	}
-	s.logger.Info("request", "method", req.Method, "path", req.URL.Path, "duration", time.Since(t0))
+	http.Error(resp, "internal server error", http.StatusInternalServerError)
 }
 
-// cacheable handles GET and HEAD requests, these can be cached and can have hits
+// cacheable handles requests whose method policy allows caching (GET and HEAD by default), these can have hits
 func (s *Server) cacheable(resp http.ResponseWriter, req *http.Request) {
 	t0 := time.Now()
-	key := cache.MakeKey(req, s.ignoreHost)
-	obj, found := s.cache.Get(key)
-	// req.Header.Get("Cache-Control") == "no-cache"
-	reqttl := calculateTTL(req.Header)
-	if found && reqttl > 0 {
+	log := s.log(req.Context())
+	country := s.country(req)
+	var variants []string
+	if country != "" {
+		variants = append(variants, "geo:"+country)
+	}
+	device := s.deviceClass(req)
+	if device != "" {
+		variants = append(variants, "device:"+device)
+	}
+	if s.keyProto {
+		variants = append(variants, "proto:"+req.Proto)
+	}
+	if s.keyBackend != nil {
+		variants = append(variants, "backend:"+s.keyBackend(req.Host))
+	}
+	variants = append(variants, s.cookieVariants(req)...)
+	kr := s.keyRequest(req)
+	key := s.makeKey(kr, variants...)
+	if s.logKeys {
+		log.Debug("cache key", "key", fmt.Sprintf("%x", key), "components", s.key.Components(kr, variants...))
+	}
+	// a client that sent no-cache or no-store doesn't get a cached object, unless it is immutable
+	directive := s.clientDirective(req)
+	var obj cache.ObjCore
+	var found bool
+	switch directive {
+	case cache.RequestDefault:
+		obj, found = s.cache.Get(key)
+	case cache.RequestRefresh:
+		// an immutable object won't change while it is fresh, a fresh copy is the same
+		if obj, found = s.cache.Get(key); found && obj.Immutable {
+			directive = cache.RequestDefault
+		} else {
+			obj, found = cache.ObjCore{}, false
+		}
+	}
+	var fingerprint string
+	if s.integrity {
+		fingerprint = s.key.Fingerprint(kr)
+		if found && obj.Fingerprint != "" && obj.Fingerprint != fingerprint {
+			// the object belongs to another request, serving it would hand out the wrong content
+			s.metrics.KeyCollisions.Inc()
+			log.Warn("cache key collision, treating as a miss", "key", fmt.Sprintf("%x", key), "path", req.URL.Path,
+				"fingerprint", fingerprint, "stored", obj.Fingerprint)
+			found = false
+		}
+	}
+	var bodyFile *os.File
+	if found && obj.BodyFile != "" {
+		if bodyFile, found = s.openBody(req.Context(), key, obj); found {
+			defer bodyFile.Close()
+		}
+	}
+	if found {
+		markCache(resp, metrics.CacheHit)
+		status := obj.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		xCache := "hit"
+		if status >= 400 {
+			xCache = "hit-negative"
+		}
 		// Increment cache hit counter
-		s.metrics.CacheHits.Inc()
+		s.metrics.CacheHits.WithLabelValues(metrics.StatusClass(status), req.Method).Inc()
 
-		maps.Copy(resp.Header(), obj.Headers)
-		resp.Header().Add("X-Cache", "hit")
+		resp.Header().Add("X-Cache", xCache)
 		resp.Header().Add("X-Cache-Latency", asciiFormat(time.Since(t0)))
-		resp.WriteHeader(http.StatusOK)
-		_, _ = resp.Write(obj.Body) // yolo
-		s.logger.Info("cache hit", "key", key, "duration", time.Since(t0), "path", req.URL.Path, "ignoreHost", s.ignoreHost)
+		if s.hitsHeader {
+			resp.Header().Set("X-Cache-Hits", strconv.FormatUint(obj.Hits, 10))
+		}
+		setOriginHeaders(resp.Header(), obj)
+		switch {
+		case !obj.NoTransform && s.esiApplies(obj.Headers):
+			body, err := readBody(obj, bodyFile)
+			if err != nil {
+				s.metrics.Errors.WithLabelValues(metrics.ReasonRead).Inc()
+				http.Error(resp, err.Error(), http.StatusInternalServerError)
+				break
+			}
+			s.writeESI(resp, req, status, obj.Headers, body)
+		case bodyFile != nil && !obj.NoTransform && s.gzipEligible(req, status, obj.Headers):
+			maps.Copy(resp.Header(), obj.Headers)
+			_ = writeEncoded(resp, req, status, bodyFile)
+		case bodyFile != nil:
+			serveFile(resp, req, status, obj.Headers, bodyFile)
+		case status == http.StatusOK && s.isRangeFill(req):
+			serveRange(resp, req, obj.Headers, bytes.NewReader(obj.Body))
+		case status == http.StatusOK && notModified(req, obj.Headers):
+			// the client has this version already
+			writeNotModified(resp, obj.Headers)
+		default:
+			_ = s.writeObject(resp, req, status, obj.Headers, obj.Body, obj.NoTransform) // yolo
+		}
+		log.Info("cache hit", "key", key, "duration", time.Since(t0), "path", req.URL.Path, "ignoreHost", s.key.IgnoreHost)
 		return
 	}
 
-	// Increment cache miss counter
-	s.metrics.CacheMisses.Inc()
-
-	// cache miss. fetch from backend
-	beReq := req.Clone(context.Background())
+	// cache miss. fetch from backend, unless too many fills are in progress already
+	if directive != cache.RequestBypass {
+		markCache(resp, metrics.CacheMiss)
+	}
+	if s.maintenance.Load() {
+		// only hits are served during maintenance
+		s.serveMaintenance(resp)
+		return
+	}
+	// the fragments of an ESI page are fetched while the page holds its slot, they don't take
+	// another or a limit of one would fail every page with a fragment to fetch
+	if _, fragment := req.Context().Value(esiDepthKey{}).(int); !fragment {
+		release, limit := s.fills.acquire(key)
+		if release == nil {
+			s.metrics.FillsRejected.WithLabelValues(limit).Inc()
+			log.Warn("cache miss rejected, too many fills in progress", "key", key, "limit", limit, "path", req.URL.Path)
+			http.Error(resp, "too many cache fills in progress", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+	}
+	// a client that goes away cancels the fetch, a partly read body is never stored
+	beReq := req.Clone(req.Context())
 	// clear the URI:
 	beReq.RequestURI = ""
 
-	// If original request is HEAD, convert to GET for backend fetch
-	// if req.Method == http.MethodHead {
-	//  	beReq.Method = http.MethodGet
-	// }
+	// HEAD shares its object with GET, fetch the whole response so it can fill the object
+	if req.Method == http.MethodHead {
+		beReq.Method = http.MethodGet
+	}
 
 	// URL scheme will be set by the backend
 
@@ -140,53 +546,399 @@ func (s *Server) cacheable(resp http.ResponseWriter, req *http.Request) {
 	if beReq.URL.Host == "" {
 		beReq.URL.Host = beReq.Host
 	}
+	s.forwardPath(beReq)
+	if s.isRangeFill(req) {
+		stripRange(beReq)
+	}
+	s.setCountryHeader(beReq, country)
+	s.setDeviceHeader(beReq, device)
+	s.setDeadlineHeader(beReq, req)
+	s.setForwardedHeaders(beReq, req)
+	s.addVia(beReq.Header, req.Proto, req.ProtoMajor, req.ProtoMinor)
+	setAcceptEncoding(beReq, req)
+	s.dumpRequest(key, beReq)
 
-	beResp, cacheable := s.backend.Fetch(beReq)
+	tFetch := time.Now()
+	beResp, verdict := s.backend.Fetch(beReq)
+	beResp = completeResponse(beResp)
+	if s.clientGone(req, beResp) {
+		return
+	}
+	beResp = s.fallback(beResp, verdict)
+	fetchLatency := time.Since(tFetch)
+	if err := validateResponse(beResp); err != nil {
+		beResp = s.replaceMalformed(beResp, req, err)
+		verdict = backend.Cacheability{Reason: backend.UncacheableMalformed}
+	}
+	defer s.dumpResponse(req.Context(), key, beResp)()
+	cacheable := verdict.Cacheable
+	if verdict.Reason == backend.UncacheableMethod {
+		// the method policy opted in to caching this method explicitly
+		cacheable = true
+	} else if !cacheable {
+		log.Debug("not caching response", "reason", verdict.Reason, "status", beResp.StatusCode, "path", req.URL.Path)
+	}
+
+	// Increment cache miss counter
+	s.metrics.CacheMisses.WithLabelValues(metrics.StatusClass(beResp.StatusCode), req.Method).Inc()
 
 	defer beResp.Body.Close()
-	body, err := io.ReadAll(beResp.Body)
-	if err != nil {
-		s.metrics.Errors.Inc()
+
+	// clean up headers before inserting into cache:
+	s.stripHeaders(beResp.Header)
+	applyHeaderRules(s.storeRules, beResp.Header)
+	s.addVia(beResp.Header, beResp.Proto, beResp.ProtoMajor, beResp.ProtoMinor)
+
+	// Error responses may be negatively cached for a short while, 404 and 410 as well when the
+	// cacheable status set takes them, so the negative TTL bounds them either way
+	negative := (cacheable || verdict.Reason == backend.UncacheableStatus) && s.negativeCacheable(beResp)
+	if negative {
+		cacheable = true
+	}
+
+	if cacheable && !decodable(beResp.Header) {
+		// only one encoding is stored, and this one can't be undone
+		cacheable = false
+		log.Debug("not caching response", "reason", "Content-Encoding", "encoding", beResp.Header.Get("Content-Encoding"))
+	}
+	noTransform := cache.NoTransform(beResp.Header)
+	if cacheable && noTransform && !identity(beResp.Header) {
+		// objects are stored decoded, which is a transformation this response forbids
+		cacheable = false
+		log.Debug("not caching response", "reason", "no-transform", "encoding", beResp.Header.Get("Content-Encoding"))
+	}
+	if cacheable && varies(beResp.Header, "Cookie") && len(s.varyCookie) == 0 {
+		// the response is per user, sharing it would leak it to other clients
+		cacheable = false
+		log.Debug("not caching response", "reason", "Vary: Cookie", "path", req.URL.Path)
+	}
+	if cacheable && s.authorizedPrivate(req, beResp) {
+		// the response may be for this user only, a shared cache needs explicit permission
+		cacheable = false
+		log.Debug("not caching response", "reason", "Authorization", "path", req.URL.Path)
+	}
+
+	// Calculate cache TTL based on response headers
+	ttl, fresh := cache.FreshnessFor(beResp.Header)
+	policy := s.methods[req.Method]
+	if fresh && policy.TTL > 0 {
+		// the method has a TTL override
+		ttl = policy.TTL
+	}
+	rule := s.ttlRule(req)
+	if rule != nil && (fresh || rule.Force) {
+		log.Info("TTL overridden by rule", "path", req.URL.Path, "ttl", rule.TTL, "headerTTL", ttl, "fresh", fresh,
+			"cacheControl", beResp.Header.Get("Cache-Control"))
+		ttl, fresh = rule.TTL, true
+	}
+	if cacheable && !fresh {
+		cacheable = false
+		log.Debug("not caching response", "reason", "fetch said so")
+	}
+	if negative {
+		ttl = s.negTTL
+	}
+	if cacheable && directive == cache.RequestBypass {
+		cacheable = false
+		log.Debug("not caching response", "reason", "client sent no-store")
+	}
+	if cacheable && fetchLatency < s.minLatency {
+		cacheable = false
+		log.Debug("not caching response", "reason", "cheap to fetch", "latency", fetchLatency, "min", s.minLatency)
+	}
+	if cacheable && s.maxObjSize > 0 && beResp.ContentLength > s.maxObjSize {
+		cacheable = false
+		log.Debug("not caching response", "reason", "larger than max object size", "contentLength", beResp.ContentLength)
+	}
+	if cacheable && s.bufferLimited() && beResp.ContentLength > s.bufferLimit && !s.canSpill(beResp.Header) {
+		cacheable = false
+		s.metrics.BufferOverflows.WithLabelValues(metrics.OverflowStream).Inc()
+		log.Debug("not caching response", "reason", "larger than buffer limit", "contentLength", beResp.ContentLength)
+	}
+
+	// Decide before reading: only bodies that will be stored are buffered, the rest is streamed
+	if !cacheable {
+		s.setContentType(beResp.Header, nil)
+		s.stream(resp, req, beResp, nil, t0)
+		log.Info("cache miss", "key", key, "duration", time.Since(t0), "path", req.URL.Path, "ignoreHost", s.key.IgnoreHost, "cacheable", cacheable)
+		return
+	}
+
+	fill := s.startFill(req.Context(), key)
+	body, err := s.readObject(beResp.Body)
+	var overflow *backend.OverflowError
+	switch {
+	case errors.Is(err, errBufferFull) && s.canSpill(beResp.Header):
+		objCore := cache.ObjCore{
+			Status:       beResp.StatusCode,
+			Fingerprint:  fingerprint,
+			Host:         req.Host,
+			URL:          req.URL.RequestURI(),
+			FetchLatency: fetchLatency,
+			Immutable:    cache.Immutable(beResp.Header),
+			NoTransform:  noTransform,
+		}
+		s.spill(resp, req, beResp, key, objCore, ttl, body, fill, t0)
+		return
+	case errors.Is(err, errBufferFull):
+		// too large to buffer and no file to spill it to
+		fill.abort(fillAbortTooLarge)
+		s.metrics.BufferOverflows.WithLabelValues(metrics.OverflowStream).Inc()
+		s.stream(resp, req, beResp, body, t0)
+		log.Info("cache miss, response larger than the buffer limit streamed", "key", key, "duration", time.Since(t0), "path", req.URL.Path)
+		return
+	case errors.Is(err, errObjectTooLarge), errors.As(err, &overflow) && overflow.StreamThrough:
+		// too large to cache after all, pass through what was buffered and the rest
+		fill.abort(fillAbortTooLarge)
+		s.stream(resp, req, beResp, body, t0)
+		log.Info("cache miss, oversized response streamed", "key", key, "duration", time.Since(t0), "path", req.URL.Path)
+		return
+	case overflow != nil:
+		fill.abort(fillAbortBackend)
+		s.metrics.Errors.WithLabelValues(metrics.ReasonRead).Inc()
+		http.Error(resp, err.Error(), http.StatusBadGateway)
+		return
+	case err != nil && canceled(req):
+		// the client went away, the read was canceled
+		fill.abort(fillAbortCanceled)
+		log.Info("client went away, cache fill canceled", "key", key, "path", req.URL.Path, "read", len(body))
+		return
+	case truncated(beResp.StatusCode, beResp.Header, int64(len(body)), err):
+		// never cached, and not passed on as if it were complete
+		fill.abort(fillAbortTruncated)
+		s.truncatedBody(req, beResp.Header, int64(len(body)))
+		http.Error(resp, "truncated response from backend", http.StatusBadGateway)
+		return
+	case err != nil:
+		fill.abort(fillAbortBackend)
+		s.metrics.Errors.WithLabelValues(metrics.ReasonRead).Inc()
 		http.Error(resp, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	// body dump for debugging purposes:
-	// s.logger.Debug("status code ", "status", beResp.StatusCode)
 
-	// clean up headers before inserting into cache:
-	for _, h := range headerDenyList() {
-		beResp.Header.Del(h)
+	originSize := int64(len(body))
+	decoded, err := s.decodeObject(beResp.Header, body)
+	switch {
+	case errors.Is(err, errBufferFull):
+		fill.abort(fillAbortTooLarge)
+		s.metrics.BufferOverflows.WithLabelValues(metrics.OverflowStream).Inc()
+		s.stream(resp, req, beResp, body, t0)
+		log.Info("cache miss, response larger than the buffer limit streamed", "key", key, "duration", time.Since(t0), "path", req.URL.Path)
+		return
+	case errors.Is(err, errObjectTooLarge):
+		fill.abort(fillAbortTooLarge)
+		s.stream(resp, req, beResp, body, t0)
+		log.Info("cache miss, oversized response streamed", "key", key, "duration", time.Since(t0), "path", req.URL.Path)
+		return
+	case err != nil:
+		fill.abort(fillAbortBackend)
+		s.metrics.Errors.WithLabelValues(metrics.ReasonRead).Inc()
+		http.Error(resp, err.Error(), http.StatusBadGateway)
+		return
 	}
-	// add a Via header to the cached response
-	beResp.Header.Add("Via", versionString())
+	body = decoded
 
-	if cacheable && len(body) > 0 {
+	s.setContentType(beResp.Header, body)
+	setBodyLength(beResp.Header, beResp.StatusCode, len(body))
+	if len(body) == 0 && !negative {
+		fill.abort(fillAbortEmpty)
+	} else {
 		objCore := cache.ObjCore{
-			Headers: beResp.Header,
-			Body:    body,
+			Status:       beResp.StatusCode,
+			Headers:      s.storedHeaders(beResp.Header),
+			Body:         body,
+			Fingerprint:  fingerprint,
+			Host:         req.Host,
+			URL:          req.URL.RequestURI(),
+			FetchLatency: fetchLatency,
+			OriginSize:   originSize,
+			Immutable:    cache.Immutable(beResp.Header),
+			NoTransform:  noTransform,
 		}
-
-		// Calculate cache TTL based on response headers
-		ttl := calculateTTL(beResp.Header)
-		if ttl > 0 {
-			resp.Header().Add("X-Cache-TTL", ttl.String())
-			s.cache.Set(key, objCore)
-			s.logger.Debug("caching response with TTL", "ttl", ttl.String(), "contentLength", len(body))
+		ttl = s.jitterTTL(ttl)
+		resp.Header().Add("X-Cache-TTL", ttl.String())
+		if negative {
+			s.store(req.Context(), key, func() error { return s.cache.SetWithTTL(key, objCore, ttl) })
+			log.Debug("negatively caching response", "ttl", ttl.String(), "status", beResp.StatusCode)
+		} else if rule != nil {
+			s.store(req.Context(), key, func() error { return s.cache.SetWithTTL(key, objCore, ttl) })
+			log.Debug("caching response with TTL from rule", "ttl", ttl.String(), "contentLength", len(body))
+		} else if policy.TTL > 0 {
+			s.store(req.Context(), key, func() error { return s.cache.SetWithTTL(key, objCore, ttl) })
+			log.Debug("caching response with method TTL", "ttl", ttl.String(), "method", req.Method, "contentLength", len(body))
+		} else if s.ttlJitter > 0 {
+			s.store(req.Context(), key, func() error { return s.cache.SetWithTTL(key, objCore, ttl) })
+			log.Debug("caching response with jittered TTL", "ttl", ttl.String(), "contentLength", len(body))
 		} else {
-			s.logger.Debug("not caching response", "reason", "fetch said so")
+			s.store(req.Context(), key, func() error { return s.cache.Set(key, objCore) })
+			log.Debug("caching response with TTL", "ttl", ttl.String(), "contentLength", len(body))
 		}
+		fill.complete(len(body))
 	}
 	// write the response to the client
+	resp.Header().Add("X-Cache", s.missLabel(req))
+	resp.Header().Add("X-Cache-Latency", asciiFormat(time.Since(t0)))
+	if !noTransform && s.esiApplies(beResp.Header) {
+		s.writeESI(resp, req, beResp.StatusCode, beResp.Header, body)
+	} else if beResp.StatusCode == http.StatusOK && s.isRangeFill(req) {
+		serveRange(resp, req, beResp.Header, bytes.NewReader(body))
+	} else {
+		if err := s.writeObject(resp, req, beResp.StatusCode, beResp.Header, body, noTransform); err != nil {
+			s.writeFailed(req, "write beResp.Body", err)
+		}
+	}
+	log.Info("cache miss", "key", key, "duration", time.Since(t0), "path", req.URL.Path, "ignoreHost", s.key.IgnoreHost, "cacheable", cacheable)
+}
+
+// setOriginHeaders tells the client how long the backend took to send the object and how large
+// it was, to find the objects that are slow or expensive to fill. Objects stored before this was
+// recorded, such as ones restored from an older snapshot, have neither.
+func setOriginHeaders(h http.Header, obj cache.ObjCore) {
+	if obj.FetchLatency > 0 {
+		h.Set("X-Origin-Latency", asciiFormat(obj.FetchLatency))
+		h.Set("X-Origin-Size", strconv.FormatInt(obj.OriginSize, 10))
+	}
+}
+
+// errObjectTooLarge is returned by readObject when the body exceeds the max object size
+var errObjectTooLarge = errors.New("object larger than max object size")
+
+// readObject buffers a body that is about to be cached. If it turns out to be larger than the
+// max object size, the bytes read so far are returned with errObjectTooLarge and the rest of
+// the body is left unread. The same goes for a buffer limit below the max object size, with
+// errBufferFull.
+func (s *Server) readObject(body io.Reader) ([]byte, error) {
+	limit, errTooLarge := s.maxObjSize, errObjectTooLarge
+	if s.bufferLimited() {
+		limit, errTooLarge = s.bufferLimit, errBufferFull
+	}
+	if limit <= 0 {
+		return io.ReadAll(body)
+	}
+	buf, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err == nil && int64(len(buf)) > limit {
+		return buf, errTooLarge
+	}
+	return buf, err
+}
+
+// clientGone reports whether the client went away while the backend was fetched, which cancels
+// the fetch. There is nobody left to answer, beResp is discarded. A request that ran out of time
+// still gets its error response.
+func (s *Server) clientGone(req *http.Request, beResp *http.Response) bool {
+	if !canceled(req) {
+		return false
+	}
+	_ = beResp.Body.Close()
+	s.log(req.Context()).Info("client went away, backend fetch canceled", "path", req.URL.Path)
+	return true
+}
+
+// canceled reports whether the client of req went away
+func canceled(req *http.Request) bool {
+	return errors.Is(req.Context().Err(), context.Canceled)
+}
+
+// stream writes a miss straight through to the client without caching it.
+// head holds any part of the body that was already read, the remainder is copied from the backend.
+func (s *Server) stream(resp http.ResponseWriter, req *http.Request, beResp *http.Response, head []byte, t0 time.Time) {
+	log := s.log(req.Context())
+	if !cache.NoTransform(beResp.Header) && s.esiApplies(beResp.Header) {
+		// the whole page is needed to process its tags
+		rest, err := io.ReadAll(beResp.Body)
+		if n := int64(len(head) + len(rest)); truncated(beResp.StatusCode, beResp.Header, n, err) {
+			s.truncatedBody(req, beResp.Header, n)
+			http.Error(resp, "truncated response from backend", http.StatusBadGateway)
+			return
+		}
+		if err != nil {
+			s.metrics.Errors.WithLabelValues(metrics.ReasonRead).Inc()
+			http.Error(resp, err.Error(), http.StatusBadGateway)
+			return
+		}
+		resp.Header().Add("X-Cache", s.missLabel(req))
+		resp.Header().Add("X-Cache-Latency", asciiFormat(time.Since(t0)))
+		s.writeESI(resp, req, beResp.StatusCode, beResp.Header, append(head, rest...))
+		return
+	}
 	maps.Copy(resp.Header(), beResp.Header)
-	resp.Header().Add("X-Cache", "miss")
+	resp.Header().Add("X-Cache", s.missLabel(req))
 	resp.Header().Add("X-Cache-Latency", asciiFormat(time.Since(t0)))
 	resp.WriteHeader(beResp.StatusCode)
-	if _, err := resp.Write(body); err != nil {
-		s.metrics.Errors.Inc()
-		s.logger.Warn("write beResp.Body", "err", err)
+	if req.Method == http.MethodHead {
+		// the body would be discarded, don't read it from the backend
+		return
 	}
-	s.logger.Info("cache miss", "key", key, "duration", time.Since(t0), "path", req.URL.Path, "ignoreHost", s.ignoreHost, "cacheable", cacheable)
-	// Add the X-Cache header to the response
+	if _, err := resp.Write(head); err != nil {
+		s.writeFailed(req, "write beResp.Body", err)
+		return
+	}
+	w := &writeErrWriter{w: flushWriter{w: resp, rc: http.NewResponseController(resp)}}
+	n, err := io.Copy(w, beResp.Body)
+	var overflow *backend.OverflowError
+	if errors.As(err, &overflow) && overflow.StreamThrough {
+		// the backend limit only prevents caching, keep going
+		var more int64
+		more, err = io.Copy(w, beResp.Body)
+		n += more
+	}
+	// the client got the Content-Length too, the server closes its connection when it's short
+	if n += int64(len(head)); truncated(beResp.StatusCode, beResp.Header, n, err) {
+		s.truncatedBody(req, beResp.Header, n)
+	} else if w.err != nil {
+		s.writeFailed(req, "write beResp.Body", w.err)
+	} else if err != nil {
+		s.metrics.Errors.WithLabelValues(metrics.ReasonRead).Inc()
+		log.Warn("read beResp.Body", "err", err)
+	}
+}
+
+// writeErrWriter remembers the error of the writer it wraps, to tell writing to the client from
+// reading the backend body that is copied to it
+type writeErrWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *writeErrWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// writeFailed counts and logs a response that couldn't be written to the client. A client that
+// went away in the middle is routine and counted apart from the errors on this side.
+func (s *Server) writeFailed(req *http.Request, msg string, err error) {
+	if disconnected(req, err) {
+		s.metrics.ClientDisconnects.Inc()
+		s.log(req.Context()).Info("client went away, response cut short", "path", req.URL.Path, "err", err)
+		return
+	}
+	s.metrics.Errors.WithLabelValues(metrics.ReasonWrite).Inc()
+	s.log(req.Context()).Warn(msg, "err", err)
+}
+
+// disconnected reports whether err, from writing the response to req, means the client went
+// away: the request was canceled, or the connection was closed or reset under the write
+func disconnected(req *http.Request, err error) bool {
+	return canceled(req) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed)
+}
+
+// flushWriter flushes after every write, so a streamed body reaches the client as it arrives
+// instead of sitting in the server's write buffer.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		_ = f.rc.Flush()
+	}
+	return n, err
 }
 
 // asciiFormat returns a human-readable string representation of a duration in ASCII format (header-safe)
@@ -202,11 +954,12 @@ func asciiFormat(since time.Duration) string {
 	}
 }
 
-// defaultMethod handles all other requests
-// no attempt at caching is made
-func (s *Server) defaultMethod(resp http.ResponseWriter, req *http.Request) {
-	// clone the request to avoid modifying the original
-	beReq := req.Clone(context.Background())
+// defaultMethod handles all other requests, and those that bypass the cache
+// no attempt at caching is made, xCache is the X-Cache of the response when set
+func (s *Server) defaultMethod(resp http.ResponseWriter, req *http.Request, xCache string) {
+	log := s.log(req.Context())
+	// clone the request to avoid modifying the original, a client that goes away cancels it
+	beReq := req.Clone(req.Context())
 	// Clear the URI
 	beReq.RequestURI = ""
 
@@ -216,25 +969,50 @@ func (s *Server) defaultMethod(resp http.ResponseWriter, req *http.Request) {
 	if beReq.URL.Host == "" {
 		beReq.URL.Host = beReq.Host
 	}
+	s.forwardPath(beReq)
+	s.setCountryHeader(beReq, s.country(req))
+	s.setDeviceHeader(beReq, s.deviceClass(req))
+	s.setDeadlineHeader(beReq, req)
+	s.setForwardedHeaders(beReq, req)
+	s.addVia(beReq.Header, req.Proto, req.ProtoMajor, req.ProtoMinor)
+	s.dumpRequest("", beReq)
 
-	beResp, _ := s.backend.Fetch(beReq)
+	beResp, verdict := s.backend.Fetch(beReq)
+	beResp = completeResponse(beResp)
+	if s.clientGone(req, beResp) {
+		return
+	}
+	beResp = s.fallback(beResp, verdict)
+	if err := validateResponse(beResp); err != nil {
+		beResp = s.replaceMalformed(beResp, req, err)
+	}
+	defer s.dumpResponse(req.Context(), "", beResp)()
 	defer beResp.Body.Close()
+	s.stripHeaders(beResp.Header)
+	applyHeaderRules(s.storeRules, beResp.Header)
+	s.addVia(beResp.Header, beResp.Proto, beResp.ProtoMajor, beResp.ProtoMinor)
 	maps.Copy(resp.Header(), beResp.Header)
+	if xCache != "" {
+		resp.Header().Add("X-Cache", xCache)
+	}
 	resp.WriteHeader(beResp.StatusCode)
 	if req.Method != http.MethodHead {
-		n, err := io.Copy(resp, beResp.Body)
-		if err != nil {
-			s.metrics.Errors.Inc()
-			s.logger.Warn("write beResp.Body", "err", err)
+		w := &writeErrWriter{w: flushWriter{w: resp, rc: http.NewResponseController(resp)}}
+		n, err := io.Copy(w, beResp.Body)
+		if truncated(beResp.StatusCode, beResp.Header, n, err) {
+			// the client got the Content-Length too, the server closes its connection
+			s.truncatedBody(req, beResp.Header, n)
+		} else if w.err != nil {
+			s.writeFailed(req, "write beResp.Body", w.err)
+		} else if err != nil {
+			s.metrics.Errors.WithLabelValues(metrics.ReasonRead).Inc()
+			log.Warn("read beResp.Body", "err", err)
 		}
-		s.logger.Info("body response written", "bytes", n)
+		log.Info("body response written", "bytes", n)
 	}
 }
 
-func versionString() string {
-	return fmt.Sprintf("hazelnut %s", embeddedVersion)
-}
-
+// headerDenyList returns the hop-by-hop headers, which are removed from backend responses by default
 func headerDenyList() []string {
 	return []string{
 		"connection",
@@ -242,102 +1020,9 @@ func headerDenyList() []string {
 		"proxy-authenticate",
 		"proxy-authorization",
 		"te",
-		"trailers",
+		"trailer",
+		"trailers", // the misspelling of RFC 2616, kept for origins that use it
 		"transfer-encoding",
 		"upgrade",
 	}
 }
-
-// calculateTTL determines appropriate cache lifetime from response headers
-// Returns 0 for objects that should use the default cache behavior (no expiration)
-// Considers:
-// - Cache-Control: max-age, s-maxage, no-cache, no-store, private, must-revalidate
-// - Expires header
-// - Age header
-func calculateTTL(headers http.Header) time.Duration {
-	// Check for Cache-Control directives that prevent caching
-	cacheControl := headers.Get("Cache-Control")
-	if cacheControl != "" {
-		directives := strings.SplitSeq(cacheControl, ",")
-		for directive := range directives {
-			directive = strings.TrimSpace(directive)
-
-			// Check for no-store directive - don't cache at all
-			if directive == "no-store" {
-				return 0 // Don't cache
-			}
-
-			// Check for private directive - typically shouldn't be cached by shared cache
-			if directive == "private" {
-				return 0
-			}
-
-			// Check for no-cache directive - can be stored but must be revalidated
-			if directive == "no-cache" {
-				return 0
-			}
-
-			// Check for s-maxage (takes precedence over max-age for shared caches)
-			if after, ok := strings.CutPrefix(directive, "s-maxage="); ok {
-				seconds, err := strconv.Atoi(after)
-				if err == nil && seconds > 0 {
-					return time.Duration(seconds) * time.Second
-				}
-			}
-
-			// Check for max-age
-			if after, ok := strings.CutPrefix(directive, "max-age="); ok {
-				seconds, err := strconv.Atoi(after)
-				if err == nil && seconds > 0 {
-					return time.Duration(seconds) * time.Second
-				}
-			}
-		}
-	}
-
-	// Check Expires header if no max-age was found
-	expires := headers.Get("Expires")
-	if expires != "" {
-		// Parse the expires header in various formats
-		formats := []string{
-			time.RFC1123,
-			time.RFC1123Z,
-			time.RFC850,
-			time.ANSIC,
-		}
-
-		var expiresTime time.Time
-		var err error
-
-		// Try each format until we find one that works
-		for _, format := range formats {
-			expiresTime, err = time.Parse(format, expires)
-			if err == nil {
-				break
-			}
-		}
-
-		if err == nil {
-			// Calculate TTL as difference between expiration time and now
-			ttl := time.Until(expiresTime)
-			if ttl > 0 {
-				// Account for Age header if present
-				age := headers.Get("Age")
-				if age != "" {
-					ageSeconds, err := strconv.Atoi(age)
-					if err == nil && ageSeconds > 0 {
-						ttl -= time.Duration(ageSeconds) * time.Second
-						if ttl <= 0 {
-							return 0 // Already expired
-						}
-					}
-				}
-				return ttl
-			}
-			return 0 // Already expired
-		}
-	}
-
-	// Default case: use default cache behavior
-	return defaultTTL
-}
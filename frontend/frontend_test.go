@@ -1,18 +1,42 @@
 package frontend
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"github.com/perbu/hazelnut/cache"
+	"github.com/perbu/hazelnut/cache/diskcache"
 	"github.com/perbu/hazelnut/cache/lrucache"
 	"io"
 	"log/slog"
+	"maps"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/perbu/hazelnut/backend"
 	"github.com/perbu/hazelnut/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestFrontend(t *testing.T) {
@@ -90,8 +114,8 @@ func TestFrontend(t *testing.T) {
 			t.Errorf("Unexpected response body: %s", body1)
 		}
 
-		// Small delay to ensure caching completes
-		time.Sleep(100 * time.Millisecond)
+		// Let the cache process the set
+		c.Wait()
 
 		// Second request to same URL (should be cache hit)
 		req2, _ := http.NewRequest("GET", ts.URL+"/cacheable", nil)
@@ -132,8 +156,8 @@ func TestFrontend(t *testing.T) {
 			t.Errorf("Unexpected response body: %s", body1)
 		}
 
-		// Small delay
-		time.Sleep(100 * time.Millisecond)
+		// Let the cache process the set
+		c.Wait()
 
 		// Second request to same URL (should still be cache miss due to no-store)
 		req2, _ := http.NewRequest("GET", ts.URL+"/non-cacheable", nil)
@@ -166,8 +190,8 @@ func TestFrontend(t *testing.T) {
 		// Read body
 		io.ReadAll(resp1.Body)
 
-		// Small delay
-		time.Sleep(100 * time.Millisecond)
+		// Let the cache process the set
+		c.Wait()
 
 		// Second request with different host (should be cache miss)
 		req2, _ := http.NewRequest("GET", ts.URL+"/cacheable", nil)
@@ -238,8 +262,8 @@ func TestFrontend(t *testing.T) {
 		// Read body
 		body1, _ := io.ReadAll(resp1.Body)
 
-		// Small delay
-		time.Sleep(100 * time.Millisecond)
+		// Let the cache process the set
+		c.Wait()
 
 		// Second request with different host but same path
 		req2, _ := http.NewRequest("GET", tsIgnore.URL+"/shared-path", nil)
@@ -262,4 +286,3290 @@ func TestFrontend(t *testing.T) {
 			t.Errorf("Response bodies should match when ignoreHost=true")
 		}
 	})
+
+	t.Run("Metrics are labeled by status class and method", func(t *testing.T) {
+		hits := m.CacheHits.WithLabelValues("2xx", http.MethodGet)
+		before := testutil.ToFloat64(hits)
+
+		// /cacheable was filled by an earlier subtest, so this is a hit
+		req, _ := http.NewRequest("GET", ts.URL+"/cacheable", nil)
+		req.Host = "example.com"
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		_, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if got := testutil.ToFloat64(hits) - before; got != 1 {
+			t.Errorf("Expected 2xx/GET hit counter to increase by 1, got %v", got)
+		}
+	})
+}
+
+func TestOversizedResponses(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	large := strings.Repeat("x", 4096)
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		if r.URL.Path == "/sized" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+		} else {
+			// flush first so the body is sent chunked, without a Content-Length
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, large)
+	})
+
+	newFrontend := func(t *testing.T, policy string) (*httptest.Server, *Server, *lrucache.LRUCache) {
+		b := newTestBackend(t, logger, origin)
+		b.SetMaxResponseBytes(1024, policy)
+		f, c := newTestServer(t, b)
+		ts := httptest.NewServer(f)
+		t.Cleanup(ts.Close)
+		return ts, f, c
+	}
+
+	t.Run("Abort policy serves an error", func(t *testing.T) {
+		ts, _, _ := newFrontend(t, backend.OversizeAbort)
+		resp, err := http.Get(ts.URL + "/large")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("Expected status 502, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Abort on the Content-Length counts as too_large", func(t *testing.T) {
+		ts, f, _ := newFrontend(t, backend.OversizeAbort)
+		resp, err := http.Get(ts.URL + "/sized")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("Expected status 502, got %d", resp.StatusCode)
+		}
+		if got := testutil.ToFloat64(f.metrics.Errors.WithLabelValues(metrics.ReasonTooLarge)); got != 1 {
+			t.Errorf("Expected 1 too_large error, got %v", got)
+		}
+		if got := testutil.ToFloat64(f.metrics.Errors.WithLabelValues(metrics.ReasonDial)); got != 0 {
+			t.Errorf("Expected no dial errors, got %v", got)
+		}
+	})
+
+	t.Run("Stream policy passes the body through uncached", func(t *testing.T) {
+		ts, _, c := newFrontend(t, backend.OversizeStream)
+		for i := range 2 {
+			resp, err := http.Get(ts.URL + "/large")
+			if err != nil {
+				t.Fatalf("Request %d failed: %v", i, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != large {
+				t.Errorf("Request %d: expected full %d byte body, got %d bytes", i, len(large), len(body))
+			}
+			if resp.Header.Get("X-Cache") != "miss" {
+				t.Errorf("Request %d: expected X-Cache: miss, got %s", i, resp.Header.Get("X-Cache"))
+			}
+			c.Wait()
+		}
+	})
+}
+
+func TestMethodPolicies(t *testing.T) {
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+	f.SetMethodPolicies(map[string]MethodPolicy{
+		"post": {Cache: true, TTL: 30 * time.Second},
+		"GET":  {Cache: true, TTL: 10 * time.Second},
+	})
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	do := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		_, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Wait()
+		return resp
+	}
+
+	tests := []struct {
+		method string
+		ttl    string
+	}{
+		{http.MethodPost, "30s"},
+		{http.MethodGet, "10s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			path := "/method-" + tt.method
+			miss := do(tt.method, path)
+			if got := miss.Header.Get("X-Cache-TTL"); got != tt.ttl {
+				t.Errorf("Expected X-Cache-TTL %s, got %q", tt.ttl, got)
+			}
+			hit := do(tt.method, path)
+			if got := hit.Header.Get("X-Cache"); got != "hit" {
+				t.Errorf("Expected second %s to be a hit, got %q", tt.method, got)
+			}
+		})
+	}
+
+	t.Run("Cached methods don't share entries", func(t *testing.T) {
+		// /method-POST is cached for POST only
+		resp := do(http.MethodGet, "/method-POST")
+		if got := resp.Header.Get("X-Cache"); got != "miss" {
+			t.Errorf("Expected GET after POST to miss, got %q", got)
+		}
+	})
+
+	t.Run("Uncached methods pass through", func(t *testing.T) {
+		resp := do(http.MethodPut, "/method-PUT")
+		if got := resp.Header.Get("X-Cache"); got != "" {
+			t.Errorf("Expected no X-Cache header for PUT, got %q", got)
+		}
+	})
+
+	t.Run("Cached methods still check the response", func(t *testing.T) {
+		var calls atomic.Int64
+		f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			if r.URL.Path == "/cookie" {
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+			}
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "oops")
+		}))
+		f.SetMethodPolicies(map[string]MethodPolicy{"POST": {Cache: true}})
+
+		for _, path := range []string{"/error", "/cookie"} {
+			before := calls.Load()
+			for range 2 {
+				rec := httptest.NewRecorder()
+				f.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://example.com"+path, nil))
+				c.Wait()
+				if got := rec.Header().Get("X-Cache"); got != "miss" {
+					t.Errorf("%s: expected every POST to miss, got %q", path, got)
+				}
+			}
+			if got := calls.Load() - before; got != 2 {
+				t.Errorf("%s: expected the response not to be cached, got %d backend calls", path, got)
+			}
+		}
+	})
+}
+
+func TestDeviceClasses(t *testing.T) {
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		fmt.Fprintf(w, "markup for %q", r.Header.Get(DefaultDeviceHeader))
+	}))
+	f.SetDeviceClasses(DefaultDeviceRules(), "")
+
+	const (
+		iphone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148"
+		android = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/120.0 Mobile Safari/537.36"
+		desktop = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36"
+		bot     = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	)
+	get := func(ua string, spoofed string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/device", nil)
+		req.Header.Set("User-Agent", ua)
+		if spoofed != "" {
+			req.Header.Set(DefaultDeviceHeader, spoofed)
+		}
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		c.Wait() // let ristretto process a set
+		return rec
+	}
+
+	if got := get(iphone, "").Body.String(); got != `markup for "mobile"` {
+		t.Errorf("Unexpected body for a mobile client: %s", got)
+	}
+	rec := get(desktop, "mobile")
+	if rec.Header().Get("X-Cache") != "miss" || rec.Body.String() != `markup for "desktop"` {
+		t.Errorf("Expected a separate entry for a desktop client, got %s: %s", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	rec = get(android, "")
+	if rec.Header().Get("X-Cache") != "hit" || rec.Body.String() != `markup for "mobile"` {
+		t.Errorf("Expected another mobile client to share the mobile entry, got %s: %s", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if got := get(bot, "").Body.String(); got != `markup for "bot"` {
+		t.Errorf("Expected bots to get their own entry, got: %s", got)
+	}
+}
+
+// stubResolver maps client IPs to countries without a GeoIP database
+type stubResolver map[string]string
+
+func (r stubResolver) Country(ip netip.Addr) (string, bool) {
+	country, ok := r[ip.String()]
+	return country, ok
+}
+
+func TestGeoIP(t *testing.T) {
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		fmt.Fprintf(w, "content for %q", r.Header.Get(DefaultCountryHeader))
+	}))
+	f.SetGeoIP(stubResolver{"203.0.113.1": "NO", "198.51.100.1": "DE"}, "")
+
+	get := func(remoteAddr string, spoofed string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/geo", nil)
+		req.RemoteAddr = remoteAddr
+		if spoofed != "" {
+			req.Header.Set(DefaultCountryHeader, spoofed)
+		}
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		c.Wait()
+		return rec
+	}
+
+	if got := get("203.0.113.1:1234", "").Body.String(); got != `content for "NO"` {
+		t.Errorf("Unexpected body for NO client: %s", got)
+	}
+	if got := get("198.51.100.1:1234", "").Body.String(); got != `content for "DE"` {
+		t.Errorf("Expected a separate entry for DE client, got: %s", got)
+	}
+	rec := get("203.0.113.1:4321", "")
+	if rec.Header().Get("X-Cache") != "hit" || rec.Body.String() != `content for "NO"` {
+		t.Errorf("Expected NO client to hit its own entry, got %s: %s", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	// Unresolvable clients don't get to pick a country by sending the header themselves
+	if got := get("192.0.2.1:1234", "DE").Body.String(); got != `content for ""` {
+		t.Errorf("Expected spoofed country header to be dropped, got: %s", got)
+	}
+}
+
+func TestVaryCookie(t *testing.T) {
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Vary", "Accept-Encoding, Cookie")
+		session, _ := r.Cookie("session")
+		lang, _ := r.Cookie("lang")
+		fmt.Fprintf(w, "session=%s lang=%s", session.Value, lang.Value)
+	})
+
+	newServer := func(t *testing.T, varyCookies []string) *Server {
+		f, _ := newTestFrontend(t, origin)
+		f.SetVaryCookies(varyCookies)
+		return f
+	}
+	get := func(f *Server, session, lang string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/profile", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		req.AddCookie(&http.Cookie{Name: "lang", Value: lang})
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		f.cache.(*lrucache.LRUCache).Wait()
+		return rec
+	}
+
+	t.Run("Vary: Cookie responses are not shared by default", func(t *testing.T) {
+		f := newServer(t, nil)
+		get(f, "alice", "en")
+		rec := get(f, "bob", "en")
+		if got := rec.Body.String(); got != "session=bob lang=en" {
+			t.Errorf("Bob got someone else's response: %s", got)
+		}
+		if rec.Header().Get("X-Cache") == "hit" {
+			t.Errorf("Expected Vary: Cookie response not to be cached")
+		}
+	})
+
+	t.Run("Configured cookies are folded into the key", func(t *testing.T) {
+		f := newServer(t, []string{"lang"})
+		get(f, "alice", "en")
+		if rec := get(f, "alice", "de"); rec.Header().Get("X-Cache") == "hit" {
+			t.Errorf("Expected a different lang cookie to miss")
+		}
+		rec := get(f, "alice", "en")
+		if rec.Header().Get("X-Cache") != "hit" || rec.Body.String() != "session=alice lang=en" {
+			t.Errorf("Expected hit for same lang cookie, got %s: %s", rec.Header().Get("X-Cache"), rec.Body.String())
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/profile", nil)
+		req.AddCookie(&http.Cookie{Name: "lang", Value: "en"})
+		if _, found := f.cache.Get(f.CacheKey(req)); !found {
+			t.Error("Expected CacheKey to find the object stored for the same lang cookie")
+		}
+	})
+
+	t.Run("Key cookies don't make Vary: Cookie cacheable", func(t *testing.T) {
+		f := newServer(t, nil)
+		f.SetKeyCookies([]string{"lang"})
+		get(f, "alice", "en")
+		if rec := get(f, "alice", "en"); rec.Header().Get("X-Cache") == "hit" {
+			t.Errorf("Expected Vary: Cookie response not to be cached")
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/profile", nil)
+		req.AddCookie(&http.Cookie{Name: "lang", Value: "en"})
+		f.SetVaryCookies([]string{"lang"})
+		f.SetKeyCookies(nil)
+		withVary := f.CacheKey(req)
+		f.SetVaryCookies(nil)
+		f.SetKeyCookies([]string{"lang"})
+		if f.CacheKey(req) != withVary {
+			t.Error("Expected key cookies to be folded in as vary cookies are")
+		}
+	})
+}
+
+func TestStreaming(t *testing.T) {
+	release := make(chan struct{})
+	large := strings.Repeat("y", 4096)
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			// sends the first part and waits for the client to have seen it
+			w.Header().Set("Cache-Control", "no-store")
+			fmt.Fprint(w, "first part;")
+			w.(http.Flusher).Flush()
+			<-release
+			fmt.Fprint(w, "second part")
+		case "/large":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.(http.Flusher).Flush()
+			fmt.Fprint(w, large)
+		}
+	}))
+	f.SetMaxObjectSize(1024)
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	t.Run("Uncacheable responses are streamed", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/slow")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.Header.Get("X-Cache") != "miss" {
+			t.Errorf("Expected X-Cache: miss, got %q", resp.Header.Get("X-Cache"))
+		}
+		first := make([]byte, len("first part;"))
+		if _, err := io.ReadFull(resp.Body, first); err != nil {
+			t.Fatalf("Failed to read first part before the backend finished: %v", err)
+		}
+		close(release)
+		rest, _ := io.ReadAll(resp.Body)
+		if got := string(first) + string(rest); got != "first part;second part" {
+			t.Errorf("Unexpected body: %q", got)
+		}
+	})
+
+	t.Run("Objects over the max object size are streamed uncached", func(t *testing.T) {
+		for i := range 2 {
+			resp, err := http.Get(ts.URL + "/large")
+			if err != nil {
+				t.Fatalf("Request %d failed: %v", i, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != large {
+				t.Errorf("Request %d: expected %d byte body, got %d bytes", i, len(large), len(body))
+			}
+			if resp.Header.Get("X-Cache") != "miss" {
+				t.Errorf("Request %d: expected X-Cache: miss, got %q", i, resp.Header.Get("X-Cache"))
+			}
+			c.Wait()
+		}
+	})
+}
+
+func TestNegativeCaching(t *testing.T) {
+	var fetches atomic.Int32
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		switch r.URL.Path {
+		case "/missing", "/missing-too":
+			http.NotFound(w, r)
+		case "/unavailable":
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+		}
+	}))
+	f.SetNegativeCaching(10*time.Second, false)
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		_, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Wait()
+		return resp
+	}
+
+	t.Run("404 is negatively cached", func(t *testing.T) {
+		fetches.Store(0)
+		get("/missing")
+		resp := get("/missing")
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected cached 404, got %d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Cache"); got != "hit-negative" {
+			t.Errorf("Expected X-Cache: hit-negative, got %q", got)
+		}
+		if n := fetches.Load(); n != 1 {
+			t.Errorf("Expected 1 backend fetch, got %d", n)
+		}
+	})
+
+	t.Run("404 gets the negative TTL", func(t *testing.T) {
+		// 404 is in the default cacheable set, without negative caching it would get DefaultTTL
+		if got := get("/missing-too").Header.Get("X-Cache-TTL"); got != "10s" {
+			t.Errorf("Expected X-Cache-TTL: 10s, got %q", got)
+		}
+	})
+
+	t.Run("5xx is not negatively cached unless enabled", func(t *testing.T) {
+		fetches.Store(0)
+		get("/unavailable")
+		resp := get("/unavailable")
+		if got := resp.Header.Get("X-Cache"); got != "miss" {
+			t.Errorf("Expected X-Cache: miss, got %q", got)
+		}
+		if n := fetches.Load(); n != 2 {
+			t.Errorf("Expected 2 backend fetches, got %d", n)
+		}
+	})
+}
+
+func TestDeadlineHeader(t *testing.T) {
+	f, _ := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprint(w, r.Header.Get("X-Request-Deadline"))
+	}))
+	f.SetDeadlineHeader("X-Request-Deadline")
+
+	t.Run("Remaining budget is forwarded", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/deadline", nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		ms, err := strconv.Atoi(rec.Body.String())
+		if err != nil {
+			t.Fatalf("Expected a millisecond budget, got %q", rec.Body.String())
+		}
+		if ms <= 0 || ms > 5000 {
+			t.Errorf("Expected budget in (0, 5000] ms, got %d", ms)
+		}
+	})
+
+	t.Run("No deadline, no header", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/deadline", nil)
+		req.Header.Set("X-Request-Deadline", "99999")
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		if got := rec.Body.String(); got != "" {
+			t.Errorf("Expected no deadline header, got %q", got)
+		}
+	})
+
+	t.Run("Backend budget and write timeout", func(t *testing.T) {
+		f.SetDeadlineBudget(func(string) time.Duration { return 3 * time.Second })
+		defer f.SetDeadlineBudget(nil)
+		for _, tc := range []struct {
+			write time.Duration
+			limit int
+		}{{0, 3000}, {2 * time.Second, 2000}, {10 * time.Second, 3000}} {
+			f.SetTimeouts(Timeouts{Write: tc.write})
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/deadline", nil)
+			req.Header.Set("X-Request-Deadline", "99999")
+			rec := httptest.NewRecorder()
+			f.ServeHTTP(rec, req)
+			ms, err := strconv.Atoi(rec.Body.String())
+			if err != nil {
+				t.Fatalf("Write timeout %v: expected a millisecond budget, got %q", tc.write, rec.Body.String())
+			}
+			if ms <= tc.limit-1000 || ms > tc.limit {
+				t.Errorf("Write timeout %v: expected budget in (%d, %d] ms, got %d", tc.write, tc.limit-1000, tc.limit, ms)
+			}
+		}
+		f.SetTimeouts(Timeouts{})
+	})
+}
+
+func TestFillEvents(t *testing.T) {
+	f, _ := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		fmt.Fprint(w, "filled body")
+	}))
+	m := f.metrics
+	f.SetFillEvents(true)
+
+	fillBytes := func() (count uint64, sum float64) {
+		var metric dto.Metric
+		if err := m.FillBytes.(prometheus.Metric).Write(&metric); err != nil {
+			t.Fatalf("Failed to read fill bytes histogram: %v", err)
+		}
+		return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+	}
+	started := testutil.ToFloat64(m.FillsStarted)
+	completed := testutil.ToFloat64(m.FillsCompleted)
+	count, sum := fillBytes()
+
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/fill", nil))
+	if rec.Body.String() != "filled body" {
+		t.Fatalf("Unexpected body: %q", rec.Body.String())
+	}
+
+	if got := testutil.ToFloat64(m.FillsStarted) - started; got != 1 {
+		t.Errorf("Expected 1 fill started, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.FillsCompleted) - completed; got != 1 {
+		t.Errorf("Expected 1 fill completed, got %v", got)
+	}
+	newCount, newSum := fillBytes()
+	if newCount-count != 1 || newSum-sum != float64(len("filled body")) {
+		t.Errorf("Expected one fill of %d bytes to be observed, got %d fills of %v bytes", len("filled body"), newCount-count, newSum-sum)
+	}
+}
+
+func TestPathForwarding(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "page")
+	})
+
+	tests := []struct {
+		forward string
+		want    string
+	}{
+		{PathForwardRaw, "/Docs//Intro/./"},
+		{PathForwardCanonical, "/docs/intro/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.forward, func(t *testing.T) {
+			mu.Lock()
+			seen = nil
+			mu.Unlock()
+			f, c := newTestFrontend(t, origin)
+			f.SetPathPolicy(cache.PathPolicy{Lowercase: true, Clean: true}, tt.forward)
+
+			rec := httptest.NewRecorder()
+			f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/Docs//Intro/./", nil))
+			if got := rec.Header().Get("X-Cache"); got != "miss" {
+				t.Fatalf("Expected a miss, got %q", got)
+			}
+			c.Wait() // let ristretto process the set
+
+			// The canonical form shares the entry no matter what the backend was sent
+			rec = httptest.NewRecorder()
+			f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/docs/intro/", nil))
+			if got := rec.Header().Get("X-Cache"); got != "hit" {
+				t.Errorf("Expected the canonical path to hit, got %q", got)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(seen) != 1 || seen[0] != tt.want {
+				t.Errorf("Expected the backend to see [%s], got %v", tt.want, seen)
+			}
+		})
+	}
+}
+
+func TestFillLimits(t *testing.T) {
+	arrived := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-unblock
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "slow")
+	}))
+	m := f.metrics
+	f.SetFillLimits(2, 1)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		return rec
+	}
+
+	// Two fills in progress: one for /a, one for /b
+	var wg sync.WaitGroup
+	for _, path := range []string{"/a", "/b"} {
+		wg.Go(func() {
+			if rec := get(path); rec.Code != http.StatusOK {
+				t.Errorf("Expected the fill of %s to succeed, got %d", path, rec.Code)
+			}
+		})
+		<-arrived
+	}
+
+	keyBefore := testutil.ToFloat64(m.FillsRejected.WithLabelValues("key"))
+	globalBefore := testutil.ToFloat64(m.FillsRejected.WithLabelValues("global"))
+
+	if rec := get("/c"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a miss over the global limit to be shed with 503, got %d", rec.Code)
+	}
+	if got := testutil.ToFloat64(m.FillsRejected.WithLabelValues("global")) - globalBefore; got != 1 {
+		t.Errorf("Expected 1 global rejection, got %v", got)
+	}
+
+	unblock <- struct{}{}
+	unblock <- struct{}{}
+	wg.Wait()
+
+	// Without a global limit, the per-key limit still sheds a second concurrent miss for the same key
+	f.SetFillLimits(0, 1)
+	wg.Go(func() { get("/d") })
+	<-arrived
+	if rec := get("/d"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a second miss for the same key to be shed with 503, got %d", rec.Code)
+	}
+	if got := testutil.ToFloat64(m.FillsRejected.WithLabelValues("key")) - keyBefore; got != 1 {
+		t.Errorf("Expected 1 per-key rejection, got %v", got)
+	}
+	unblock <- struct{}{}
+	wg.Wait()
+
+	c.Wait() // let ristretto process the set
+	if rec := get("/a"); rec.Header().Get("X-Cache") != "hit" {
+		t.Errorf("Expected the completed fill to be cached, got X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestMinFetchLatency(t *testing.T) {
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	f.SetMinFetchLatency(50 * time.Millisecond)
+
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		c.Wait() // let ristretto process a set
+		return rec.Header().Get("X-Cache")
+	}
+
+	t.Run("Fast response isn't cached", func(t *testing.T) {
+		get("/fast")
+		if got := get("/fast"); got != "miss" {
+			t.Errorf("Expected a cheap response to miss again, got %q", got)
+		}
+	})
+
+	t.Run("Slow response is cached", func(t *testing.T) {
+		get("/slow")
+		if got := get("/slow"); got != "hit" {
+			t.Errorf("Expected an expensive response to be cached, got %q", got)
+		}
+	})
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	f, _ := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		for _, h := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+			w.Header().Set("Seen-"+h, r.Header.Get(h))
+		}
+	}))
+
+	do := func(remote string, header http.Header) http.Header {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com:8080/fwd", nil)
+		req.RemoteAddr = remote
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		return rec.Header()
+	}
+
+	t.Run("Headers are added", func(t *testing.T) {
+		got := do("192.0.2.10:1234", nil)
+		want := map[string]string{
+			"Seen-X-Forwarded-For":   "192.0.2.10",
+			"Seen-X-Forwarded-Proto": "http",
+			"Seen-X-Forwarded-Host":  "example.com:8080",
+			"Seen-Forwarded":         `for=192.0.2.10;host="example.com:8080";proto=http`,
+		}
+		for name, value := range want {
+			if got.Get(name) != value {
+				t.Errorf("%s: expected %q, got %q", name, value, got.Get(name))
+			}
+		}
+	})
+
+	t.Run("Chains are appended to", func(t *testing.T) {
+		// without trusted proxies, the load balancer's chain is kept but its proto and host aren't
+		got := do("[2001:db8::1]:1234", http.Header{
+			"X-Forwarded-For":   {"198.51.100.1"},
+			"X-Forwarded-Proto": {"https"},
+			"X-Forwarded-Host":  {"evil.example"},
+			"Forwarded":         {"for=198.51.100.1"},
+		})
+		want := map[string]string{
+			"Seen-X-Forwarded-For":   "198.51.100.1, 2001:db8::1",
+			"Seen-X-Forwarded-Proto": "http",
+			"Seen-X-Forwarded-Host":  "example.com:8080",
+			"Seen-Forwarded":         `for=198.51.100.1, for="[2001:db8::1]";host="example.com:8080";proto=http`,
+		}
+		for name, value := range want {
+			if got.Get(name) != value {
+				t.Errorf("%s: expected %q, got %q", name, value, got.Get(name))
+			}
+		}
+	})
+
+	t.Run("Trusted proxies", func(t *testing.T) {
+		f.SetTrustedProxies([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+		defer f.SetTrustedProxies(nil)
+		spoofed := http.Header{
+			"X-Forwarded-For":   {"198.51.100.1"},
+			"X-Forwarded-Proto": {"https"},
+			"X-Forwarded-Host":  {"evil.example"},
+			"Forwarded":         {"for=198.51.100.1"},
+		}
+		got := do("192.0.2.10:1234", spoofed)
+		want := map[string]string{
+			"Seen-X-Forwarded-For":   "192.0.2.10",
+			"Seen-X-Forwarded-Proto": "http",
+			"Seen-X-Forwarded-Host":  "example.com:8080",
+			"Seen-Forwarded":         `for=192.0.2.10;host="example.com:8080";proto=http`,
+		}
+		for name, value := range want {
+			if got.Get(name) != value {
+				t.Errorf("Untrusted client, %s: expected %q, got %q", name, value, got.Get(name))
+			}
+		}
+	})
+
+	t.Run("Trusted TLS-terminating proxy", func(t *testing.T) {
+		f.SetTrustedProxies([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+		defer f.SetTrustedProxies(nil)
+		got := do("10.0.0.1:1234", http.Header{
+			"X-Forwarded-For":   {"198.51.100.1"},
+			"X-Forwarded-Proto": {"https"},
+			"X-Forwarded-Host":  {"www.example.com"},
+			"Forwarded":         {"for=198.51.100.1;proto=https"},
+		})
+		want := map[string]string{
+			"Seen-X-Forwarded-For":   "198.51.100.1, 10.0.0.1",
+			"Seen-X-Forwarded-Proto": "https",
+			"Seen-X-Forwarded-Host":  "www.example.com",
+			"Seen-Forwarded":         `for=198.51.100.1;proto=https, for=10.0.0.1;host="example.com:8080";proto=http`,
+		}
+		for name, value := range want {
+			if got.Get(name) != value {
+				t.Errorf("%s: expected %q, got %q", name, value, got.Get(name))
+			}
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		f.SetForwardedHeaders(false)
+		defer f.SetForwardedHeaders(true)
+		got := do("192.0.2.10:1234", nil)
+		if v := got.Get("Seen-X-Forwarded-For"); v != "" {
+			t.Errorf("Expected no X-Forwarded-For, got %q", v)
+		}
+		if v := got.Get("Seen-Forwarded"); v != "" {
+			t.Errorf("Expected no Forwarded, got %q", v)
+		}
+	})
+}
+
+func TestKeyIntegrity(t *testing.T) {
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, r.URL.Path)
+	})
+
+	newFrontend := func(t *testing.T, integrity bool) *Server {
+		f, _ := newTestFrontend(t, origin)
+		// a deliberately broken key function that puts every request under the same key
+		f.keyFunc = func(*http.Request, ...string) string { return "broken" }
+		f.SetKeyIntegrity(integrity)
+		return f
+	}
+	get := func(f *Server, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		f.cache.(*lrucache.LRUCache).Wait() // let ristretto process a set
+		return rec
+	}
+
+	t.Run("Without integrity the wrong object is served", func(t *testing.T) {
+		f := newFrontend(t, false)
+		get(f, "/a")
+		if rec := get(f, "/b"); rec.Body.String() != "/a" {
+			t.Errorf("Expected the broken key to serve /a for /b, got %q", rec.Body.String())
+		}
+	})
+
+	t.Run("With integrity the collision is caught", func(t *testing.T) {
+		f := newFrontend(t, true)
+		before := testutil.ToFloat64(f.metrics.KeyCollisions)
+		get(f, "/a")
+		rec := get(f, "/b")
+		if rec.Body.String() != "/b" || rec.Header().Get("X-Cache") != "miss" {
+			t.Errorf("Expected the collision to be a miss for /b, got %q with X-Cache %q", rec.Body.String(), rec.Header().Get("X-Cache"))
+		}
+		if got := testutil.ToFloat64(f.metrics.KeyCollisions) - before; got != 1 {
+			t.Errorf("Expected 1 key collision, got %v", got)
+		}
+		if rec := get(f, "/b"); rec.Header().Get("X-Cache") != "hit" {
+			t.Errorf("Expected the matching request to hit, got X-Cache %q", rec.Header().Get("X-Cache"))
+		}
+	})
+}
+
+func TestOriginHeaders(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	b := &stubFetcher{resp: func() *http.Response {
+		time.Sleep(20 * time.Millisecond)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			Body:       io.NopCloser(strings.NewReader("content")),
+		}
+	}}
+	f := New(logger, c, b, "localhost:8080", metrics.NewWithRegistry(prometheus.NewRegistry()), false)
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/slow", nil))
+		c.Wait() // let ristretto process a set
+		return rec
+	}
+
+	if rec := get(); rec.Header().Get("X-Origin-Latency") != "" {
+		t.Errorf("Expected no origin headers on a miss, got X-Origin-Latency %q", rec.Header().Get("X-Origin-Latency"))
+	}
+	rec := get()
+	if rec.Header().Get("X-Cache") != "hit" {
+		t.Fatalf("Expected a hit, got X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+	if got := rec.Header().Get("X-Origin-Size"); got != "7" {
+		t.Errorf("Expected X-Origin-Size 7, got %q", got)
+	}
+	latency, err := time.ParseDuration(strings.TrimSuffix(rec.Header().Get("X-Origin-Latency"), "s") + "s")
+	if err != nil || latency < 20*time.Millisecond || latency > time.Second {
+		t.Errorf("Expected the fetch latency of about 20ms, got %q", rec.Header().Get("X-Origin-Latency"))
+	}
+}
+
+func TestLogKeys(t *testing.T) {
+	var logs strings.Builder
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	b := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			Body:       io.NopCloser(strings.NewReader("ok")),
+		}
+	}}
+	f := New(logger, c, b, "localhost:8080", metrics.NewWithRegistry(prometheus.NewRegistry()), false)
+	f.SetKeyPolicy(cache.KeyPolicy{Headers: []string{"Accept-Language"}})
+	request := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/a?b=2&a=1", nil)
+		req.Header.Set("Accept-Language", "nl")
+		return req
+	}
+	get := func() { f.ServeHTTP(httptest.NewRecorder(), request()) }
+
+	get()
+	if strings.Contains(logs.String(), "cache key") {
+		t.Errorf("Expected no key components without log keys, got %s", logs.String())
+	}
+
+	f.SetLogKeys(true)
+	logs.Reset()
+	get()
+	want := fmt.Sprintf("key=%x components.host=example.com components.path=/a components.query=\"a=1&b=2\" components.headers=\"[Accept-Language=nl]\"",
+		f.CacheKey(request()))
+	if !strings.Contains(logs.String(), `msg="cache key"`) || !strings.Contains(logs.String(), want) {
+		t.Errorf("Expected the key components logged as %s, got %s", want, logs.String())
+	}
+}
+
+func TestBodyDump(t *testing.T) {
+	var logs strings.Builder
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	b := newTestBackend(t, slog.New(slog.NewTextHandler(io.Discard, nil)), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Secret", "hunter2")
+		fmt.Fprintf(w, "got %d bytes: %s", len(body), body)
+	}))
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	f := New(logger, c, b, "localhost:8080", metrics.NewWithRegistry(prometheus.NewRegistry()), false)
+	f.SetBodyDump(8, []string{"x-secret"})
+
+	t.Run("Request body reaches the backend whole", func(t *testing.T) {
+		logs.Reset()
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/post", strings.NewReader("0123456789abcdef"))
+		req.Header.Set("Authorization", "Bearer token")
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		if got := rec.Body.String(); got != "got 16 bytes: 0123456789abcdef" {
+			t.Errorf("Expected the backend to get the whole body, got %q", got)
+		}
+		out := logs.String()
+		if !strings.Contains(out, `msg="request body"`) || !strings.Contains(out, "body=01234567 truncated=true") {
+			t.Errorf("Expected a truncated request body preview, got %s", out)
+		}
+		if strings.Contains(out, "Bearer token") || strings.Contains(out, "hunter2") {
+			t.Errorf("Expected sensitive headers to be redacted, got %s", out)
+		}
+	})
+
+	t.Run("Cached body is intact", func(t *testing.T) {
+		logs.Reset()
+		f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/get", nil))
+		c.Wait() // let ristretto process a set
+		if !strings.Contains(logs.String(), `body="got 0 by" truncated=true`) {
+			t.Errorf("Expected a response body preview, got %s", logs.String())
+		}
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/get", nil))
+		if rec.Header().Get("X-Cache") != "hit" || rec.Body.String() != "got 0 bytes: " {
+			t.Errorf("Expected the whole body to be cached, got %q with X-Cache %q", rec.Body.String(), rec.Header().Get("X-Cache"))
+		}
+	})
+
+	t.Run("Binary bodies are hex encoded", func(t *testing.T) {
+		if got := preview([]byte{0xff, 0x00}); got != "hex:ff00" {
+			t.Errorf("Expected hex preview, got %q", got)
+		}
+	})
+}
+
+func TestServerOptions(t *testing.T) {
+	var backendCalls atomic.Int64
+	f, _ := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls.Add(1)
+		w.Header().Set("Allow", "GET")
+	}))
+
+	options := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodOptions, target, nil)
+		req.Host = "example.com"
+		f.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Default Allow", func(t *testing.T) {
+		rec := options("*")
+		if rec.Code != http.StatusOK || rec.Header().Get("Allow") != "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS" {
+			t.Errorf("Expected 200 with the default Allow, got %d with %q", rec.Code, rec.Header().Get("Allow"))
+		}
+		if backendCalls.Load() != 0 {
+			t.Errorf("Expected OPTIONS * to be answered without a backend call, got %d", backendCalls.Load())
+		}
+	})
+
+	t.Run("Configured Allow", func(t *testing.T) {
+		f.SetServerOptions([]string{"get", "head"})
+		defer f.SetServerOptions(nil)
+		if got := options("*").Header().Get("Allow"); got != "GET, HEAD" {
+			t.Errorf("Expected the configured Allow, got %q", got)
+		}
+	})
+
+	t.Run("Resource OPTIONS is forwarded", func(t *testing.T) {
+		rec := options("/resource")
+		if rec.Header().Get("Allow") != "GET" || backendCalls.Load() != 1 {
+			t.Errorf("Expected OPTIONS /resource to reach the backend, got Allow %q and %d calls", rec.Header().Get("Allow"), backendCalls.Load())
+		}
+	})
+}
+
+func TestAccessLog(t *testing.T) {
+	f, _ := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "hello")
+	}))
+
+	get := func(path string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = "example.com"
+		req.RemoteAddr = "192.0.2.7:51234"
+		req.Header.Set("Referer", "https://example.org/")
+		req.Header.Set("User-Agent", `curl/8.0 "quoted"`)
+		f.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// the timestamp varies, everything around it doesn't
+	check := func(t *testing.T, line, prefix, suffix string) {
+		t.Helper()
+		if !strings.HasPrefix(line, prefix) || !strings.HasSuffix(line, suffix) {
+			t.Errorf("Expected a line like %s[...]%s, got %q", prefix, suffix, line)
+		}
+	}
+
+	t.Run("Combined", func(t *testing.T) {
+		var out strings.Builder
+		f.SetAccessLog(&out, AccessLogCombined)
+		get("/hello?x=1")
+		check(t, out.String(), "192.0.2.7 - - [",
+			`] "GET /hello?x=1 HTTP/1.1" 200 5 "https://example.org/" "curl/8.0 \"quoted\""`+"\n")
+	})
+
+	t.Run("Common", func(t *testing.T) {
+		var out strings.Builder
+		f.SetAccessLog(&out, AccessLogCommon)
+		get("/missing")
+		check(t, out.String(), "192.0.2.7 - - [", `] "GET /missing HTTP/1.1" 404 19`+"\n")
+	})
+
+	t.Run("Client behind a trusted proxy", func(t *testing.T) {
+		var out strings.Builder
+		f.SetAccessLog(&out, AccessLogCommon)
+		f.SetTrustedProxies([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+		defer f.SetTrustedProxies(nil)
+		req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+		req.RemoteAddr = "192.0.2.7:51234"
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		f.ServeHTTP(httptest.NewRecorder(), req)
+		check(t, out.String(), "203.0.113.9 - - [", `] "GET /hello HTTP/1.1" 200 5`+"\n")
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		f.SetAccessLog(nil, "")
+		get("/hello")
+	})
+}
+
+// newTestServer returns a frontend fetching from fetcher, with a cache and metrics of its own
+func newTestServer(t *testing.T, fetcher backend.Fetcher) (*Server, *lrucache.LRUCache) {
+	t.Helper()
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return New(logger, c, fetcher, "localhost:8080", metrics.NewWithRegistry(prometheus.NewRegistry()), false), c
+}
+
+// newTestFrontend starts an origin serving handler and returns a frontend in front of it
+func newTestFrontend(t *testing.T, handler http.Handler) (*Server, *lrucache.LRUCache) {
+	t.Helper()
+	return newTestServer(t, newTestBackend(t, slog.New(slog.NewTextHandler(io.Discard, nil)), handler))
+}
+
+// newTestBackend starts an origin serving handler and returns a backend client for it
+func newTestBackend(t *testing.T, logger *slog.Logger, handler http.Handler) *backend.Client {
+	t.Helper()
+	origin := httptest.NewServer(handler)
+	t.Cleanup(origin.Close)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(origin.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Failed to parse the origin address: %v", err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	b := backend.New(logger, host, portNum)
+	b.SetScheme("http")
+	return b
+}
+
+// stubFetcher returns a canned response without a backend
+type stubFetcher struct {
+	resp  func() *http.Response
+	calls atomic.Int64
+}
+
+func (f *stubFetcher) Fetch(*http.Request) (*http.Response, backend.Cacheability) {
+	f.calls.Add(1)
+	return f.resp(), backend.Cacheability{Cacheable: true}
+}
+
+func TestNilResponseBody(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New()
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": {"max-age=60"}}}
+	}}
+	f := New(logger, c, fetcher, "localhost:8080", m, false)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost} {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(method, "http://example.com/empty", nil))
+		if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+			t.Errorf("%s: expected an empty 200, got %d with %q", method, rec.Code, rec.Body.String())
+		}
+		if length := rec.Header().Get("Content-Length"); method != http.MethodPost && length != "0" {
+			t.Errorf("%s: expected Content-Length 0, got %q", method, length)
+		}
+	}
+
+	// no header either
+	fetcher.resp = func() *http.Response { return &http.Response{StatusCode: http.StatusOK} }
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/bare", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("Expected an empty 200, got %d with %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMalformedResponses(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New()
+
+	tests := []struct {
+		name   string
+		modify func(r *http.Response)
+	}{
+		{"status out of range", func(r *http.Response) { r.StatusCode = 999 }},
+		{"informational status", func(r *http.Response) { r.StatusCode = http.StatusContinue }},
+		{"newline in header value", func(r *http.Response) { r.Header["X-Injected"] = []string{"a\r\nSet-Cookie: evil=1"} }},
+		{"invalid header name", func(r *http.Response) { r.Header["Bad Name"] = []string{"x"} }},
+		{"conflicting content length", func(r *http.Response) { r.Header["Content-Length"] = []string{"2", "3"} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := &stubFetcher{resp: func() *http.Response {
+				r := &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        http.Header{"Cache-Control": {"max-age=60"}},
+					Body:          io.NopCloser(strings.NewReader("ok")),
+					ContentLength: 2,
+				}
+				tt.modify(r)
+				return r
+			}}
+			c, err := lrucache.New(100, 1024*1024)
+			if err != nil {
+				t.Fatalf("Failed to create cache: %v", err)
+			}
+			f := New(logger, c, fetcher, "localhost:8080", m, false)
+			f.SetMalformedResponse(http.StatusServiceUnavailable, "backend broke\n")
+			before := testutil.ToFloat64(m.Errors.WithLabelValues(metrics.ReasonMalformed))
+
+			for range 2 {
+				rec := httptest.NewRecorder()
+				f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/broken", nil))
+				c.Wait() // let ristretto process a set, there shouldn't be one
+				if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "backend broke\n" {
+					t.Errorf("Expected the configured error response, got %d: %q", rec.Code, rec.Body.String())
+				}
+				if rec.Header().Get("X-Injected") != "" || rec.Header().Get("Set-Cookie") != "" {
+					t.Errorf("Expected none of the malformed headers to reach the client, got %v", rec.Header())
+				}
+			}
+			if fetcher.calls.Load() != 2 {
+				t.Errorf("Expected the error response not to be cached, got %d backend calls", fetcher.calls.Load())
+			}
+			if got := testutil.ToFloat64(m.Errors.WithLabelValues(metrics.ReasonMalformed)) - before; got != 2 {
+				t.Errorf("Expected 2 malformed errors counted, got %v", got)
+			}
+		})
+	}
+}
+
+// failingWriter is a client whose connection breaks with err on the first write of the body
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	err error
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
+
+func TestClientDisconnects(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.NewWithRegistry(prometheus.NewRegistry())
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"no-store"}},
+			Body:       io.NopCloser(strings.NewReader("hello")),
+		}
+	}}
+	f := New(logger, c, fetcher, "localhost:8080", m, false)
+
+	tests := []struct {
+		name        string
+		err         error
+		disconnects float64
+		errors      float64
+	}{
+		{"broken pipe", fmt.Errorf("write tcp: %w", syscall.EPIPE), 1, 0},
+		{"connection reset", &net.OpError{Op: "write", Net: "tcp", Err: syscall.ECONNRESET}, 1, 0},
+		{"closed connection", net.ErrClosed, 1, 0},
+		{"other error", errors.New("disk on fire"), 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, method := range []string{http.MethodGet, http.MethodPost} {
+				disconnects := testutil.ToFloat64(m.ClientDisconnects)
+				writeErrors := testutil.ToFloat64(m.Errors.WithLabelValues(metrics.ReasonWrite))
+				w := failingWriter{ResponseRecorder: httptest.NewRecorder(), err: tt.err}
+				f.ServeHTTP(w, httptest.NewRequest(method, "http://example.com/gone", nil))
+				if got := testutil.ToFloat64(m.ClientDisconnects) - disconnects; got != tt.disconnects {
+					t.Errorf("%s: expected %v client disconnects, got %v", method, tt.disconnects, got)
+				}
+				if got := testutil.ToFloat64(m.Errors.WithLabelValues(metrics.ReasonWrite)) - writeErrors; got != tt.errors {
+					t.Errorf("%s: expected %v write errors, got %v", method, tt.errors, got)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseRecorder(t *testing.T) {
+	t.Run("Explicit status", func(t *testing.T) {
+		r := &responseRecorder{ResponseWriter: httptest.NewRecorder()}
+		r.WriteHeader(http.StatusNotFound)
+		r.WriteHeader(http.StatusOK) // superfluous, the first one counts
+		fmt.Fprint(r, "not here")
+		if r.Status() != http.StatusNotFound || r.bytes != 8 || r.implicit {
+			t.Errorf("Expected 404 with 8 bytes, got %d with %d bytes, implicit %v", r.Status(), r.bytes, r.implicit)
+		}
+	})
+
+	t.Run("Body without a status", func(t *testing.T) {
+		r := &responseRecorder{ResponseWriter: httptest.NewRecorder()}
+		fmt.Fprint(r, "hello")
+		if r.Status() != http.StatusOK || r.bytes != 5 || !r.implicit {
+			t.Errorf("Expected an implicit 200 with 5 bytes, got %d with %d bytes, implicit %v", r.Status(), r.bytes, r.implicit)
+		}
+	})
+
+	t.Run("Flush reaches the client's writer", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		r := &responseRecorder{ResponseWriter: rec}
+		if err := http.NewResponseController(r).Flush(); err != nil || !rec.Flushed {
+			t.Errorf("Expected the flush to pass through, got %v", err)
+		}
+	})
+}
+
+func TestRangeFill(t *testing.T) {
+	var fetches atomic.Int64
+	var sawRange atomic.Bool
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if r.Header.Get("Range") != "" {
+			sawRange.Store(true)
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "abcdefghijklmnopqrstuvwxyz")
+	}))
+	f.SetRangeFill(true)
+
+	get := func(rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/alphabet", nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		c.Wait() // let ristretto process a set
+		return rec
+	}
+
+	tests := []struct {
+		rng    string
+		status int
+		body   string
+		xCache string
+	}{
+		{"bytes=0-4", http.StatusPartialContent, "abcde", "miss"},
+		{"bytes=5-9", http.StatusPartialContent, "fghij", "hit"},
+		{"bytes=-3", http.StatusPartialContent, "xyz", "hit"},
+		{"bytes=100-", http.StatusRequestedRangeNotSatisfiable, "", "hit"},
+		{"", http.StatusOK, "abcdefghijklmnopqrstuvwxyz", "hit"},
+	}
+	for _, tt := range tests {
+		rec := get(tt.rng)
+		body := rec.Body.String()
+		if tt.status == http.StatusRequestedRangeNotSatisfiable {
+			body = ""
+		}
+		if rec.Code != tt.status || body != tt.body || rec.Header().Get("X-Cache") != tt.xCache {
+			t.Errorf("Range %q: expected %d %q (%s), got %d %q (%s)", tt.rng, tt.status, tt.body, tt.xCache,
+				rec.Code, body, rec.Header().Get("X-Cache"))
+		}
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("Expected a single backend fetch, got %d", fetches.Load())
+	}
+	if sawRange.Load() {
+		t.Error("Expected the backend to be asked for the whole object")
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// keep net/http from sniffing on the origin side
+		w.Header()["Content-Type"] = nil
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/typed" {
+			w.Header().Set("Content-Type", "text/css")
+		}
+		fmt.Fprint(w, "<!DOCTYPE html><html><body>hi</body></html>")
+	})
+
+	tests := []struct {
+		name        string
+		contentType string
+		path        string
+		want        string
+	}{
+		{"Sniffed", ContentTypeSniff, "/untyped", "text/html; charset=utf-8"},
+		{"Configured default", "application/octet-stream", "/untyped", "application/octet-stream"},
+		{"Backend type kept", ContentTypeSniff, "/typed", "text/css"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, c := newTestFrontend(t, origin)
+			f.SetDefaultContentType(tt.contentType)
+
+			f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil))
+			c.Wait() // let ristretto process a set
+			obj, found := c.Get(f.CacheKey(httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)))
+			if !found {
+				t.Fatal("Expected the response to be cached")
+			}
+			if got := obj.Headers.Get("Content-Type"); got != tt.want {
+				t.Errorf("Expected the cached Content-Type %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestKeyProtocol(t *testing.T) {
+	var fetches atomic.Int32
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "content")
+	})
+
+	get := func(f *Server, proto string) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+		req.Proto = proto
+		req.ProtoMajor, req.ProtoMinor, _ = http.ParseHTTPVersion(proto)
+		f.ServeHTTP(httptest.NewRecorder(), req)
+		f.cache.(*lrucache.LRUCache).Wait() // let ristretto process a set
+	}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		fetches int32
+	}{
+		{"Protocols share objects by default", false, 1},
+		{"Protocols get separate objects", true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, _ := newTestFrontend(t, origin)
+			f.SetKeyProtocol(tt.enabled)
+
+			fetches.Store(0)
+			get(f, "HTTP/1.1")
+			get(f, "HTTP/2.0")
+			get(f, "HTTP/1.1")
+			get(f, "HTTP/2.0")
+			if got := fetches.Load(); got != tt.fetches {
+				t.Errorf("Expected %d backend fetches, got %d", tt.fetches, got)
+			}
+		})
+	}
+}
+
+// flakyCache fails the first failures stores, like an external cache having a blip
+type flakyCache struct {
+	*lrucache.LRUCache
+	failures atomic.Int32
+}
+
+func (c *flakyCache) Set(key string, value cache.ObjCore) error {
+	if c.failures.Add(-1) >= 0 {
+		return errors.New("connection reset")
+	}
+	return c.LRUCache.Set(key, value)
+}
+
+func TestStoreRetries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name     string
+		failures int32
+		fetches  int64
+		errors   float64
+	}{
+		{"Store succeeds on a retry", 2, 1, 0},
+		{"Store gives up after the retries", 10, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lru, err := lrucache.New(100, 1024*1024)
+			if err != nil {
+				t.Fatalf("Failed to create cache: %v", err)
+			}
+			c := &flakyCache{LRUCache: lru}
+			c.failures.Store(tt.failures)
+			fetcher := &stubFetcher{resp: func() *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Cache-Control": {"max-age=60"}},
+					Body:       io.NopCloser(strings.NewReader("content")),
+				}
+			}}
+			// metrics of its own, a retry of an earlier run may still be counting
+			m := metrics.NewWithRegistry(prometheus.NewRegistry())
+			f := New(logger, c, fetcher, "localhost:8080", m, false)
+			f.SetStoreRetries(3, time.Millisecond)
+			before := testutil.ToFloat64(m.Errors.WithLabelValues(metrics.ReasonStore))
+
+			get := func() *httptest.ResponseRecorder {
+				rec := httptest.NewRecorder()
+				f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+				return rec
+			}
+			if rec := get(); rec.Code != http.StatusOK || rec.Body.String() != "content" {
+				t.Errorf("Expected the miss to be served while the store fails, got %d %q", rec.Code, rec.Body.String())
+			}
+			time.Sleep(50 * time.Millisecond) // let the retries run and ristretto process the set
+			get()
+			if got := fetcher.calls.Load(); got != tt.fetches {
+				t.Errorf("Expected %d backend fetches, got %d", tt.fetches, got)
+			}
+			if got := testutil.ToFloat64(m.Errors.WithLabelValues(metrics.ReasonStore)) - before; got != tt.errors {
+				t.Errorf("Expected %v store errors, got %v", tt.errors, got)
+			}
+		})
+	}
+}
+
+func TestHitsHeader(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New()
+
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			Body:       io.NopCloser(strings.NewReader("content")),
+		}
+	}}
+	f := New(logger, c, fetcher, "localhost:8080", m, false)
+	f.SetHitsHeader(true)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		c.Wait() // let ristretto process a set
+		return rec
+	}
+	if got := get("/a").Header().Get("X-Cache-Hits"); got != "" {
+		t.Errorf("Expected no X-Cache-Hits on a miss, got %q", got)
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		if got := get("/a").Header().Get("X-Cache-Hits"); got != want {
+			t.Errorf("Expected X-Cache-Hits %s, got %q", want, got)
+		}
+	}
+	get("/b")
+	if got := get("/b").Header().Get("X-Cache-Hits"); got != "1" {
+		t.Errorf("Expected another object to count its own hits, got %q", got)
+	}
+}
+
+func TestDiskBodies(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New()
+
+	large := bytes.Repeat([]byte("0123456789"), 100_000) // 1 MB
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Cache-Control": {"max-age=60"}, "Content-Type": {"video/mp4"}},
+			Body:          io.NopCloser(bytes.NewReader(large)),
+			ContentLength: int64(len(large)),
+		}
+	}}
+	c, err := diskcache.New(t.TempDir(), 10<<20)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	f := New(logger, c, fetcher, "localhost:8080", m, false)
+
+	get := func(rangeHdr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/movie.mp4", nil)
+		if rangeHdr != "" {
+			req.Header.Set("Range", rangeHdr)
+		}
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := get(""); rec.Header().Get("X-Cache") != "miss" || rec.Body.Len() != len(large) {
+		t.Fatalf("Expected a miss with the whole object, got %s with %d bytes", rec.Header().Get("X-Cache"), rec.Body.Len())
+	}
+	obj, found := c.Get(f.CacheKey(httptest.NewRequest(http.MethodGet, "http://example.com/movie.mp4", nil)))
+	if !found || obj.BodyFile == "" || obj.Body != nil {
+		t.Fatalf("Expected the body to be cached on disk, got %+v", obj)
+	}
+
+	rec := get("bytes=500000-500009")
+	if rec.Code != http.StatusPartialContent || rec.Header().Get("X-Cache") != "hit" {
+		t.Fatalf("Expected a 206 hit, got %d with X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if got := rec.Body.String(); got != "0123456789" {
+		t.Errorf("Expected the range to be served from disk, got %q", got)
+	}
+	if got := rec.Header().Get("Content-Range"); got != fmt.Sprintf("bytes 500000-500009/%d", len(large)) {
+		t.Errorf("Unexpected Content-Range %q", got)
+	}
+	if rec := get(""); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), large) {
+		t.Errorf("Expected the whole object to be served from disk, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	// an eviction between the lookup and opening the file turns the hit into a miss
+	if err := os.Remove(obj.BodyFile); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if rec := get(""); rec.Header().Get("X-Cache") != "miss" || rec.Body.Len() != len(large) {
+		t.Errorf("Expected a miss once the body is gone, got %s with %d bytes", rec.Header().Get("X-Cache"), rec.Body.Len())
+	}
+	if got := fetcher.calls.Load(); got != 2 {
+		t.Errorf("Expected 2 backend fetches, got %d", got)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	var received []string
+	b := newTestBackend(t, logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("X-Request-Id"))
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "hello")
+	}))
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	f := New(logger, c, b, "localhost:8080", metrics.NewWithRegistry(prometheus.NewRegistry()), false)
+
+	get := func(path, id string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		if id != "" {
+			req.Header.Set("X-Request-Id", id)
+		}
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		c.Wait() // let ristretto process a set
+		return rec.Header().Get("X-Request-Id")
+	}
+
+	if got := get("/a", "trace-1"); got != "trace-1" {
+		t.Errorf("Expected the client's request ID to be echoed, got %q", got)
+	}
+	if len(received) != 1 || received[0] != "trace-1" {
+		t.Errorf("Expected the backend to receive trace-1, got %q", received)
+	}
+	for _, line := range []string{`msg="fetching from backend"`, `msg=request `} {
+		if !strings.Contains(logs.String(), line) {
+			t.Fatalf("Expected a log line with %s, got:\n%s", line, logs.String())
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if (strings.Contains(line, "fetching from backend") || strings.Contains(line, "msg=request ")) &&
+			!strings.Contains(line, "request_id=trace-1") {
+			t.Errorf("Expected request_id=trace-1 in %q", line)
+		}
+	}
+
+	// A hit echoes the ID of the request it serves, not that of the fill
+	if got := get("/a", "trace-2"); got != "trace-2" {
+		t.Errorf("Expected trace-2 on a hit, got %q", got)
+	}
+	if len(received) != 1 {
+		t.Errorf("Expected a hit, the backend got %d requests", len(received))
+	}
+
+	generated := get("/b", "")
+	if generated == "" {
+		t.Fatal("Expected a generated request ID")
+	}
+	if received[len(received)-1] != generated {
+		t.Errorf("Expected the backend to receive %q, got %q", generated, received[len(received)-1])
+	}
+	if other := get("/c", ""); other == generated {
+		t.Errorf("Expected a new request ID per request, got %q twice", other)
+	}
+
+	// IDs that don't fit in a log line or header are replaced
+	for _, bad := range []string{"with space", strings.Repeat("x", 129)} {
+		if got := get("/d", bad); got == bad || got == "" {
+			t.Errorf("Expected %q to be replaced, got %q", bad, got)
+		}
+	}
+}
+
+func TestStripHeaders(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New()
+
+	var sessions atomic.Int64
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Cache-Control": {"max-age=60"},
+				"Set-Cookie":    {fmt.Sprintf("session=user%d", sessions.Add(1))},
+				"X-Powered-By":  {"PHP/5.6"},
+				"Keep-Alive":    {"timeout=5"},
+			},
+			Body: io.NopCloser(strings.NewReader("content")),
+		}
+	}}
+	newServer := func() *Server {
+		c, err := lrucache.New(100, 1024*1024)
+		if err != nil {
+			t.Fatalf("Failed to create cache: %v", err)
+		}
+		return New(logger, c, fetcher, "localhost:8080", m, false)
+	}
+	do := func(f *Server, method string) http.Header {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(method, "http://example.com/account", nil))
+		f.cache.(*lrucache.LRUCache).Wait() // let ristretto process a set
+		return rec.Header()
+	}
+
+	t.Run("set-cookie leaks through hits by default", func(t *testing.T) {
+		f := newServer()
+		first := do(f, http.MethodGet).Get("Set-Cookie")
+		if got := do(f, http.MethodGet).Get("Set-Cookie"); got != first {
+			t.Errorf("Expected the hit to carry the cookie of the fill %q, got %q", first, got)
+		}
+	})
+
+	t.Run("set-cookie stripped from cached objects", func(t *testing.T) {
+		f := newServer()
+		f.SetStripSetCookie(true)
+		calls := fetcher.calls.Load()
+		miss := do(f, http.MethodGet)
+		if miss.Get("Set-Cookie") == "" {
+			t.Error("Expected the client of the fill to get its cookie")
+		}
+		hit := do(f, http.MethodGet)
+		if hit.Get("X-Cache") != "hit" {
+			t.Fatalf("Expected a hit, got X-Cache %q", hit.Get("X-Cache"))
+		}
+		if got := hit.Get("Set-Cookie"); got != "" {
+			t.Errorf("Expected no cookie on a hit, got %q", got)
+		}
+		if got := fetcher.calls.Load() - calls; got != 1 {
+			t.Errorf("Expected 1 backend fetch, got %d", got)
+		}
+	})
+
+	t.Run("configured headers removed on both paths", func(t *testing.T) {
+		f := newServer()
+		f.SetStripHeaders([]string{"x-powered-by"}, false)
+		for _, method := range []string{http.MethodGet, http.MethodGet, http.MethodPost} {
+			h := do(f, method)
+			for _, name := range []string{"X-Powered-By", "Keep-Alive"} {
+				if got := h.Get(name); got != "" {
+					t.Errorf("Expected %s to be stripped from a %s, got %q", name, method, got)
+				}
+			}
+		}
+	})
+
+	t.Run("replace drops the hop-by-hop defaults", func(t *testing.T) {
+		f := newServer()
+		f.SetStripHeaders([]string{"X-Powered-By"}, true)
+		h := do(f, http.MethodPost)
+		if got := h.Get("X-Powered-By"); got != "" {
+			t.Errorf("Expected X-Powered-By to be stripped, got %q", got)
+		}
+		if got := h.Get("Keep-Alive"); got == "" {
+			t.Error("Expected Keep-Alive to be kept when the list is replaced")
+		}
+	})
+}
+
+func TestClientDirectives(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New()
+
+	var version atomic.Int64
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			Body:       io.NopCloser(strings.NewReader(fmt.Sprintf("v%d", version.Add(1)))),
+		}
+	}}
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	f := New(logger, c, fetcher, "localhost:8080", m, false)
+
+	get := func(header http.Header) (xCache, body string) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+		maps.Copy(req.Header, header)
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		c.Wait() // let ristretto process a set
+		return rec.Header().Get("X-Cache"), rec.Body.String()
+	}
+
+	steps := []struct {
+		name   string
+		header http.Header
+		xCache string
+		body   string
+	}{
+		{"first fetch", nil, "miss", "v1"},
+		{"hit", nil, "hit", "v1"},
+		{"no-cache refreshes", http.Header{"Cache-Control": {"no-cache"}}, "refresh", "v2"},
+		{"refreshed object is cached", nil, "hit", "v2"},
+		{"max-age=0 refreshes", http.Header{"Cache-Control": {"max-age=0"}}, "refresh", "v3"},
+		{"pragma refreshes", http.Header{"Pragma": {"no-cache"}}, "refresh", "v4"},
+		{"no-store bypasses", http.Header{"Cache-Control": {"no-store"}}, "bypass", "v5"},
+		{"bypassed response isn't cached", nil, "hit", "v4"},
+	}
+	for _, step := range steps {
+		xCache, body := get(step.header)
+		if xCache != step.xCache || body != step.body {
+			t.Errorf("%s: expected %s %q, got %s %q", step.name, step.xCache, step.body, xCache, body)
+		}
+	}
+
+	f.SetIgnoreClientDirectives(true)
+	for _, header := range []http.Header{{"Cache-Control": {"no-cache"}}, {"Cache-Control": {"no-store"}}} {
+		if xCache, body := get(header); xCache != "hit" || body != "v4" {
+			t.Errorf("Expected %v to be ignored, got %s %q", header, xCache, body)
+		}
+	}
+}
+
+func TestVia(t *testing.T) {
+	var requestVia atomic.Value
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestVia.Store(r.Header.Values("Via"))
+		w.Header().Set("Via", "1.0 origin-proxy")
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "content")
+	})
+	f, c := newTestFrontend(t, origin)
+	f.SetVia("cache-1.example.com")
+
+	for _, tt := range []struct {
+		name, method, xCache string
+	}{
+		{"miss", http.MethodGet, "miss"},
+		{"hit", http.MethodGet, "hit"},
+		{"not cached", http.MethodPost, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			requestVia.Store([]string(nil))
+			req := httptest.NewRequest(tt.method, "http://example.com/page", nil)
+			req.Header.Set("Via", "2.0 edge")
+			rec := httptest.NewRecorder()
+			f.ServeHTTP(rec, req)
+			c.Wait() // let ristretto process a set
+			if rec.Header().Get("X-Cache") != tt.xCache {
+				t.Fatalf("Expected X-Cache %q, got %q", tt.xCache, rec.Header().Get("X-Cache"))
+			}
+			if got, want := rec.Header().Values("Via"), []string{"1.0 origin-proxy", "1.1 cache-1.example.com"}; !slices.Equal(got, want) {
+				t.Errorf("Expected response Via %q, got %q", want, got)
+			}
+			want := []string{"2.0 edge", "1.1 cache-1.example.com"}
+			if tt.xCache == "hit" {
+				want = nil
+			}
+			if got := requestVia.Load().([]string); !slices.Equal(got, want) {
+				t.Errorf("Expected request Via %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestImmutable(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var version atomic.Int64
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"public, max-age=60, immutable"}},
+			Body:       io.NopCloser(strings.NewReader(fmt.Sprintf("v%d", version.Add(1)))),
+		}
+	}}
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	f := New(logger, c, fetcher, "localhost:8080", metrics.NewWithRegistry(prometheus.NewRegistry()), false)
+
+	get := func(header http.Header) (xCache, body string) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/app.3f9a.js", nil)
+		maps.Copy(req.Header, header)
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		c.Wait() // let ristretto process a set
+		return rec.Header().Get("X-Cache"), rec.Body.String()
+	}
+
+	steps := []struct {
+		name   string
+		header http.Header
+		xCache string
+		body   string
+	}{
+		{"first fetch", nil, "miss", "v1"},
+		{"no-cache is a hit", http.Header{"Cache-Control": {"no-cache"}}, "hit", "v1"},
+		{"max-age=0 is a hit", http.Header{"Cache-Control": {"max-age=0"}}, "hit", "v1"},
+		{"pragma is a hit", http.Header{"Pragma": {"no-cache"}}, "hit", "v1"},
+		{"no-store still bypasses", http.Header{"Cache-Control": {"no-store"}}, "bypass", "v2"},
+	}
+	for _, step := range steps {
+		xCache, body := get(step.header)
+		if xCache != step.xCache || body != step.body {
+			t.Errorf("%s: expected %s %q, got %s %q", step.name, step.xCache, step.body, xCache, body)
+		}
+	}
+	if got := fetcher.calls.Load(); got != 2 {
+		t.Errorf("Expected 2 backend fetches, got %d", got)
+	}
+}
+
+func TestNoTransform(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	page := `<esi:include src="/frag"/>` + strings.Repeat("text worth compressing ", 50)
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write([]byte(page))
+	zw.Close()
+	fetcher := backend.FetcherFunc(func(req *http.Request) (*http.Response, backend.Cacheability) {
+		h := http.Header{
+			"Cache-Control":     {"max-age=60, no-transform"},
+			"Content-Type":      {"text/html"},
+			"Surrogate-Control": {`content="ESI/1.0"`},
+		}
+		body := page
+		switch req.URL.Path {
+		case "/gzipped":
+			h.Set("Content-Encoding", "gzip")
+			body = gzipped.String()
+		case "/frag":
+			body = "fragment"
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: h, Body: io.NopCloser(strings.NewReader(body))},
+			backend.Cacheability{Cacheable: true}
+	})
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	f := New(logger, c, fetcher, "localhost:8080", metrics.NewWithRegistry(prometheus.NewRegistry()), false)
+	f.SetESI(true)
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		c.Wait() // let ristretto process a set
+		return rec
+	}
+
+	for _, want := range []string{"miss", "hit"} {
+		rec := get("/page")
+		if rec.Header().Get("X-Cache") != want || rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != page {
+			t.Errorf("Expected a %s served as the backend sent it, got %s with Content-Encoding %q and body %.40q",
+				want, rec.Header().Get("X-Cache"), rec.Header().Get("Content-Encoding"), rec.Body.String())
+		}
+	}
+
+	// stored objects are decoded, which no-transform forbids, so a gzipped response is passed on as it is
+	for range 2 {
+		rec := get("/gzipped")
+		if rec.Header().Get("X-Cache") != "miss" || rec.Header().Get("Content-Encoding") != "gzip" || rec.Body.String() != gzipped.String() {
+			t.Errorf("Expected the gzipped response passed on and not cached, got %s with Content-Encoding %q",
+				rec.Header().Get("X-Cache"), rec.Header().Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestESI(t *testing.T) {
+	var fragments atomic.Int64
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := func(body string) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Surrogate-Control", `content="ESI/1.0"`)
+			w.Header().Set("Cache-Control", "max-age=60")
+			fmt.Fprint(w, body)
+		}
+		switch r.URL.Path {
+		case "/page":
+			page(`<p><esi:include src="/frag"/><esi:remove>no esi</esi:remove>` +
+				`<esi:include src="/broken" alt="/alt"></esi:include><esi:include src="/broken" onerror="continue"/></p>`)
+		case "/failing":
+			page(`<p><esi:include src="/broken"/></p>`)
+		case "/nested":
+			page(`[<esi:include src="/nested"/>]`)
+		case "/plain":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Cache-Control", "max-age=60")
+			fmt.Fprint(w, `<esi:include src="/frag"/>`)
+		case "/frag":
+			w.Header().Set("Cache-Control", "no-store")
+			fmt.Fprintf(w, "frag-%d", fragments.Add(1))
+		case "/alt":
+			fmt.Fprint(w, "alt")
+		default:
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}
+	})
+	f, c := newTestFrontend(t, origin)
+	f.SetESI(true)
+	m := f.metrics
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		c.Wait() // let ristretto process a set
+		return rec
+	}
+
+	rec := get("/page")
+	if got := rec.Body.String(); got != "<p>frag-1alt</p>" {
+		t.Errorf("Expected the includes to be processed, got %q", got)
+	}
+	if rec.Header().Get("Surrogate-Control") != "" || rec.Header().Get("Content-Length") != "" {
+		t.Errorf("Expected Surrogate-Control and Content-Length to be removed, got %v", rec.Header())
+	}
+	// the page is cached with its tags, a hit gets a fresh fragment
+	rec = get("/page")
+	if got := rec.Body.String(); rec.Header().Get("X-Cache") != "hit" || got != "<p>frag-2alt</p>" {
+		t.Errorf("Expected a hit with a fresh fragment, got %s %q", rec.Header().Get("X-Cache"), got)
+	}
+
+	esiErrors := testutil.ToFloat64(m.Errors.WithLabelValues(metrics.ReasonESI))
+	if rec := get("/failing"); rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected a failed include to fail the page, got %d %q", rec.Code, rec.Body.String())
+	}
+	if got := testutil.ToFloat64(m.Errors.WithLabelValues(metrics.ReasonESI)) - esiErrors; got != 1 {
+		t.Errorf("Expected 1 ESI error, got %v", got)
+	}
+
+	if got := get("/nested").Body.String(); got != "[[[[]]]]" {
+		t.Errorf("Expected includes to stop at depth %d, got %q", esiMaxDepth, got)
+	}
+
+	t.Run("Fragments of a page that holds the only fill slot", func(t *testing.T) {
+		f.SetFillLimits(1, 0)
+		defer f.SetFillLimits(0, 0)
+		c.Flush()
+		rec := get("/page")
+		if got := rec.Body.String(); rec.Code != http.StatusOK || !strings.HasPrefix(got, "<p>frag-") {
+			t.Errorf("Expected the fragments of a missed page to be fetched, got %d %q", rec.Code, got)
+		}
+	})
+
+	if got := get("/plain").Body.String(); got != `<esi:include src="/frag"/>` {
+		t.Errorf("Expected a page without Surrogate-Control to be left alone, got %q", got)
+	}
+	f.SetESI(false)
+	if got := get("/page").Body.String(); !strings.Contains(got, "<esi:include") {
+		t.Errorf("Expected no processing with ESI disabled, got %q", got)
+	}
+}
+
+func TestErrorPage(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New()
+
+	// a backend that refuses connections
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	hostParts := strings.Split(strings.TrimPrefix(closed.URL, "http://"), ":")
+	port := 80
+	fmt.Sscanf(hostParts[1], "%d", &port)
+	b := backend.New(logger, hostParts[0], port)
+	b.SetScheme("http")
+
+	tests := []struct {
+		name        string
+		configure   func(f *Server)
+		status      int
+		contentType string
+		body        string
+	}{
+		{"built-in fallback", func(*Server) {}, http.StatusBadGateway, "text/html", "I have a confuse"},
+		{"defaults", func(f *Server) { f.SetErrorPage(0, "", nil) }, http.StatusBadGateway,
+			DefaultErrorPageContentType, "<h1>502 Bad Gateway</h1>"},
+		{"configured", func(f *Server) { f.SetErrorPage(503, "text/plain", []byte("down for maintenance")) },
+			http.StatusServiceUnavailable, "text/plain", "down for maintenance"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := lrucache.New(100, 1024*1024)
+			if err != nil {
+				t.Fatalf("Failed to create cache: %v", err)
+			}
+			f := New(logger, c, b, "localhost:8080", m, false)
+			tt.configure(f)
+			// GET goes through the cacheable path, POST through the default one
+			for _, method := range []string{http.MethodGet, http.MethodPost} {
+				rec := httptest.NewRecorder()
+				f.ServeHTTP(rec, httptest.NewRequest(method, "http://example.com/page", nil))
+				if rec.Code != tt.status || rec.Header().Get("Content-Type") != tt.contentType ||
+					!strings.Contains(rec.Body.String(), tt.body) {
+					t.Errorf("%s: expected %d %s containing %q, got %d %s %q", method, tt.status, tt.contentType,
+						tt.body, rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+				}
+			}
+			c.Wait() // let ristretto process a set
+			if _, found := c.Get(f.CacheKey(httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))); found {
+				t.Error("Expected the error page not to be cached")
+			}
+		})
+	}
+}
+
+func TestFallbackTimeout(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New()
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	// the fallback the backend serves for a request that timed out
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusGatewayTimeout,
+			Header:     http.Header{"X-Backend-Name": {"nuts"}},
+			Body:       io.NopCloser(strings.NewReader("slow")),
+		}
+	}}
+	f := New(logger, c, fetcher, "localhost:8080", m, false)
+	f.SetErrorPage(0, "", nil)
+
+	timeouts, dials := m.Errors.WithLabelValues(metrics.ReasonTimeout), m.Errors.WithLabelValues(metrics.ReasonDial)
+	beforeTimeouts, beforeDials := testutil.ToFloat64(timeouts), testutil.ToFloat64(dials)
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/slow", nil))
+	if rec.Code != http.StatusGatewayTimeout || !strings.Contains(rec.Body.String(), "<h1>504 Gateway Timeout</h1>") {
+		t.Errorf("Expected the error page with the timeout status, got %d %q", rec.Code, rec.Body.String())
+	}
+	if got := testutil.ToFloat64(timeouts) - beforeTimeouts; got != 1 {
+		t.Errorf("Expected 1 timeout error, got %v", got)
+	}
+	if got := testutil.ToFloat64(dials) - beforeDials; got != 0 {
+		t.Errorf("Expected no dial errors, got %v", got)
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New()
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusMovedPermanently,
+			Header: http.Header{
+				"Cache-Control": {"max-age=60"},
+				"Server":        {"origin/1.0"},
+				"Location":      {"http://origin.internal/new"},
+				"Link":          {"</style.css>; rel=preload"},
+			},
+			Body: io.NopCloser(strings.NewReader("moved")),
+		}
+	}}
+	f := New(logger, c, fetcher, "localhost:8080", m, false)
+	f.SetHeaderRules([]HeaderRule{
+		{Action: HeaderRemove, Name: "Server"},
+		{Action: HeaderRewrite, Name: "Location", Value: "https://www.example.com/$1",
+			Pattern: regexp.MustCompile(`^http://origin\.internal/(.*)`)},
+	}, []HeaderRule{
+		{Action: HeaderSet, Name: "Strict-Transport-Security", Value: "max-age=31536000"},
+		{Action: HeaderAdd, Name: "Link", Value: "</app.js>; rel=preload"},
+		{Action: HeaderRemove, Name: "X-Cache-Latency"},
+	})
+
+	for _, want := range []string{"miss", "hit", "hit"} {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/old", nil))
+		c.Wait() // let ristretto process a set
+		h := rec.Header()
+		if got := h.Get("X-Cache"); got != want {
+			t.Fatalf("Expected X-Cache %s, got %q", want, got)
+		}
+		if got := h.Get("Strict-Transport-Security"); got != "max-age=31536000" {
+			t.Errorf("%s: expected the security header, got %q", want, got)
+		}
+		if got := h.Values("Link"); len(got) != 2 {
+			t.Errorf("%s: expected the backend's and the added Link, got %q", want, got)
+		}
+		if h.Get("Server") != "" || h.Get("X-Cache-Latency") != "" {
+			t.Errorf("%s: expected Server and X-Cache-Latency removed, got %v", want, h)
+		}
+		if got := h.Get("Location"); got != "https://www.example.com/new" {
+			t.Errorf("%s: expected the rewritten Location, got %q", want, got)
+		}
+	}
+
+	obj, found := c.Get(f.CacheKey(httptest.NewRequest(http.MethodGet, "http://example.com/old", nil)))
+	if !found {
+		t.Fatal("Expected the response to be cached")
+	}
+	if obj.Headers.Get("Location") != "https://www.example.com/new" || obj.Headers.Get("Server") != "" {
+		t.Errorf("Expected the store rules applied to the cached object, got %v", obj.Headers)
+	}
+	if obj.Headers.Get("Strict-Transport-Security") != "" || len(obj.Headers.Values("Link")) != 1 {
+		t.Errorf("Expected the client rules not to change the cached object, got %v", obj.Headers)
+	}
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	// a WebSocket echo origin, just enough of RFC 6455 for short unfragmented frames
+	f, _ := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			w.Header().Set("Cache-Control", "max-age=60")
+			fmt.Fprint(w, "not a websocket")
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("Origin failed to hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+		rw.Flush()
+		for {
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(rw, header); err != nil {
+				return
+			}
+			mask := make([]byte, 4)
+			payload := make([]byte, header[1]&0x7f)
+			io.ReadFull(rw, mask)
+			io.ReadFull(rw, payload)
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+			rw.Write(append([]byte{header[0], byte(len(payload))}, payload...))
+			rw.Flush()
+		}
+	}))
+	proxy := httptest.NewServer(f)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Failed to connect to the proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Failed to read the handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Expected the backend's handshake, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp.Header.Get("X-Cache") != "" {
+		t.Errorf("Expected the upgrade to bypass the cache, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+
+	for _, msg := range []string{"hello", "nuts"} {
+		mask := []byte{1, 2, 3, 4}
+		frame := append([]byte{0x81, 0x80 | byte(len(msg))}, mask...)
+		for i := range len(msg) {
+			frame = append(frame, msg[i]^mask[i%4])
+		}
+		conn.Write(frame)
+		echo := make([]byte, 2+len(msg))
+		if _, err := io.ReadFull(br, echo); err != nil {
+			t.Fatalf("Failed to read the echo: %v", err)
+		}
+		if got := string(echo[2:]); echo[0] != 0x81 || got != msg {
+			t.Errorf("Expected the text frame %q echoed, got %q", msg, got)
+		}
+	}
+
+	// a plain request to the same path is still served and cached
+	plain, err := http.Get(proxy.URL + "/chat")
+	if err != nil {
+		t.Fatalf("Plain request failed: %v", err)
+	}
+	body, _ := io.ReadAll(plain.Body)
+	plain.Body.Close()
+	if string(body) != "not a websocket" || plain.Header.Get("X-Cache") != "miss" {
+		t.Errorf("Expected a plain cache miss, got %q %q", plain.Header.Get("X-Cache"), body)
+	}
+}
+
+func TestChunkedResponseFraming(t *testing.T) {
+	// a chunked response with a trailer
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(w, "first chunk, ")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "second chunk")
+		w.Header().Set("X-Checksum", "abc123")
+	}))
+
+	const body = "first chunk, second chunk"
+	for _, want := range []string{"miss", "hit"} {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/chunked", nil))
+		c.Wait() // let ristretto process a set
+		if rec.Header().Get("X-Cache") != want || rec.Body.String() != body {
+			t.Fatalf("Expected a %s with the whole body, got %q %q", want, rec.Header().Get("X-Cache"), rec.Body.String())
+		}
+		if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(body)) {
+			t.Errorf("%s: expected Content-Length %d, got %q", want, len(body), got)
+		}
+		if rec.Header().Get("Transfer-Encoding") != "" || rec.Header().Get("Trailer") != "" || rec.Header().Get("X-Checksum") != "" {
+			t.Errorf("%s: expected no Transfer-Encoding and the trailer dropped, got %v", want, rec.Header())
+		}
+	}
+}
+
+func TestBypassRules(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New()
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	var fetches atomic.Int64
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		fetches.Add(1)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			Body:       io.NopCloser(strings.NewReader("content")),
+		}
+	}}
+	f := New(logger, c, fetcher, "localhost:8080", m, false)
+	f.SetBypassRules([]BypassRule{
+		{PathPrefix: "/admin"},
+		{Path: regexp.MustCompile(`^/(login|logout)$`)},
+		{PathPrefix: "/account", Cookie: "session"},
+		{Header: "Authorization"},
+	})
+
+	tests := []struct {
+		name    string
+		path    string
+		header  http.Header
+		xCache  string
+		fetches int64 // backend fetches for two requests
+	}{
+		{"path prefix", "/admin/users", nil, "bypass", 2},
+		{"path regex", "/login", nil, "bypass", 2},
+		{"regex doesn't match", "/login/help", nil, "hit", 1},
+		{"prefix and cookie", "/account", http.Header{"Cookie": {"session=abc"}}, "bypass", 2},
+		{"prefix without cookie", "/account/public", nil, "hit", 1},
+		{"header", "/page", http.Header{"Authorization": {"Bearer token"}}, "bypass", 2},
+		{"no rule", "/page", nil, "hit", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.Flush()
+			before := fetches.Load()
+			var rec *httptest.ResponseRecorder
+			for range 2 {
+				rec = httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+				maps.Copy(req.Header, tt.header)
+				f.ServeHTTP(rec, req)
+				c.Wait() // let ristretto process a set
+			}
+			if got := rec.Header().Get("X-Cache"); got != tt.xCache || rec.Body.String() != "content" {
+				t.Errorf("Expected X-Cache %s with the content, got %q %q", tt.xCache, got, rec.Body.String())
+			}
+			if got := fetches.Load() - before; got != tt.fetches {
+				t.Errorf("Expected %d backend fetches, got %d", tt.fetches, got)
+			}
+		})
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	var mu sync.Mutex
+	var methods []string
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "no-store")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		fmt.Fprint(w, "body of "+r.URL.Path)
+	}))
+
+	request := func(method, path, xCache string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(method, "http://example.com"+path, nil))
+		c.Wait() // let ristretto process a set
+		body := "body of " + path
+		if got := rec.Header().Get("X-Cache"); rec.Code != http.StatusOK || got != xCache {
+			t.Errorf("%s %s: expected 200 %s, got %d %q", method, path, xCache, rec.Code, got)
+		}
+		if method == http.MethodHead {
+			body = ""
+		}
+		if rec.Body.String() != body {
+			t.Errorf("%s %s: expected body %q, got %q", method, path, body, rec.Body.String())
+		}
+		if got := rec.Header().Get("Content-Length"); got != "" && got != strconv.Itoa(len("body of "+path)) {
+			t.Errorf("%s %s: expected the Content-Length of the GET body, got %s", method, path, got)
+		}
+	}
+	fetched := func(want ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if !slices.Equal(methods, want) {
+			t.Errorf("Expected backend requests %v, got %v", want, methods)
+		}
+		methods = nil
+	}
+
+	// a HEAD miss fetches the whole object, later GETs and HEADs are hits
+	request(http.MethodHead, "/head-first", "miss")
+	request(http.MethodGet, "/head-first", "hit")
+	request(http.MethodHead, "/head-first", "hit")
+	fetched(http.MethodGet)
+
+	// a cached GET satisfies a HEAD without a body
+	request(http.MethodGet, "/get-first", "miss")
+	request(http.MethodHead, "/get-first", "hit")
+	fetched(http.MethodGet)
+
+	// a HEAD that can't be cached gets no body either
+	request(http.MethodHead, "/private", "miss")
+	request(http.MethodGet, "/private", "miss")
+	fetched(http.MethodGet, http.MethodGet)
+}
+
+func TestH2C(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			Body:       io.NopCloser(strings.NewReader("content")),
+		}
+	}}
+	f := New(logger, c, fetcher, "127.0.0.1:0", metrics.NewWithRegistry(prometheus.NewRegistry()), false)
+	f.SetH2C(true)
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	go func() { done <- f.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(f.ActualPorts()) < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Listener didn't come up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	url := fmt.Sprintf("http://127.0.0.1:%d/page", f.ActualPorts()[0])
+
+	h2c := new(http.Protocols)
+	h2c.SetUnencryptedHTTP2(true)
+	http1 := new(http.Protocols)
+	http1.SetHTTP1(true)
+	for _, tt := range []struct {
+		name      string
+		protocols *http.Protocols
+		major     int
+	}{
+		{"h2c client", h2c, 2},
+		{"HTTP/1.1 client", http1, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{Protocols: tt.protocols}}
+			defer client.CloseIdleConnections()
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.ProtoMajor != tt.major || string(body) != "content" {
+				t.Errorf("Expected the content over HTTP/%d, got %q over %s", tt.major, body, resp.Proto)
+			}
+		})
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New()
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			Body:       io.NopCloser(strings.NewReader("content")),
+		}
+	}}
+
+	t.Run("serves every address", func(t *testing.T) {
+		f := New(logger, c, fetcher, "127.0.0.1:0", m, false)
+		f.SetListenAddrs([]string{"127.0.0.1:0", "127.0.0.1:0"})
+		ctx, cancel := context.WithCancel(t.Context())
+		done := make(chan error, 1)
+		go func() { done <- f.Run(ctx) }()
+
+		deadline := time.Now().Add(2 * time.Second)
+		for len(f.ActualPorts()) < 2 {
+			if time.Now().After(deadline) {
+				t.Fatal("Listeners didn't come up")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		ports := f.ActualPorts()
+		if ports[0] == ports[1] || ports[0] == 0 {
+			t.Fatalf("Expected two distinct ports, got %v", ports)
+		}
+		for _, port := range ports {
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/page", port))
+			if err != nil {
+				t.Fatalf("Request to port %d failed: %v", port, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "content" {
+				t.Errorf("Expected the content on port %d, got %q", port, body)
+			}
+		}
+
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Expected a clean shutdown, got %v", err)
+		}
+		for _, port := range ports {
+			if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+				conn.Close()
+				t.Errorf("Expected port %d closed after shutdown", port)
+			}
+		}
+	})
+
+	t.Run("fails when an address is taken", func(t *testing.T) {
+		taken, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer taken.Close()
+		f := New(logger, c, fetcher, "127.0.0.1:0", m, false)
+		f.SetListenAddrs([]string{"127.0.0.1:0", taken.Addr().String()})
+		if err := f.Run(t.Context()); err == nil || !strings.Contains(err.Error(), taken.Addr().String()) {
+			t.Errorf("Expected the taken address to fail Run, got %v", err)
+		}
+	})
+}
+
+func TestResponseBytes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New()
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			Body:       io.NopCloser(strings.NewReader("content")),
+		}
+	}}
+	f := New(logger, c, fetcher, "localhost:8080", m, false)
+
+	before := map[string]float64{}
+	for _, status := range []string{metrics.CacheHit, metrics.CacheMiss, metrics.CacheBypass} {
+		before[status] = testutil.ToFloat64(m.ResponseBytes.WithLabelValues(status))
+	}
+	request := func(method string, header http.Header) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "http://example.com/bytes", nil)
+		maps.Copy(req.Header, header)
+		f.ServeHTTP(rec, req)
+		c.Wait() // let ristretto process a set
+	}
+	request(http.MethodGet, nil)                                        // miss
+	request(http.MethodGet, nil)                                        // hit
+	request(http.MethodGet, nil)                                        // hit
+	request(http.MethodHead, nil)                                       // hit without a body
+	request(http.MethodPost, nil)                                       // not a cached method
+	request(http.MethodGet, http.Header{"Cache-Control": {"no-store"}}) // bypassed by the client
+	request(http.MethodGet, http.Header{"Cache-Control": {"no-cache"}}) // refreshed
+
+	for status, want := range map[string]float64{metrics.CacheHit: 14, metrics.CacheMiss: 14, metrics.CacheBypass: 14} {
+		if got := testutil.ToFloat64(m.ResponseBytes.WithLabelValues(status)) - before[status]; got != want {
+			t.Errorf("Expected %v %s bytes, got %v", want, status, got)
+		}
+	}
+}
+
+func TestTruncatedBodies(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New()
+
+	// promises 100 bytes and hangs up after 10
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("Hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		cc := "max-age=60"
+		if r.URL.Path == "/uncacheable" {
+			cc = "no-store"
+		}
+		fmt.Fprintf(rw, "HTTP/1.1 200 OK\r\nCache-Control: %s\r\nContent-Length: 100\r\n\r\n0123456789", cc)
+		_ = rw.Flush()
+	})
+	b := newTestBackend(t, logger, origin)
+
+	// a Fetcher that ends the body early without an error
+	short := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}, "Content-Length": {"100"}},
+			Body:       io.NopCloser(strings.NewReader("0123456789")),
+		}
+	}}
+
+	for _, tt := range []struct {
+		name    string
+		fetcher backend.Fetcher
+	}{
+		{"connection dropped", b},
+		{"short body", short},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := lrucache.New(100, 1024*1024)
+			if err != nil {
+				t.Fatalf("Failed to create cache: %v", err)
+			}
+			f := New(logger, c, tt.fetcher, "localhost:8080", m, false)
+			before := testutil.ToFloat64(m.Errors.WithLabelValues(metrics.ReasonTruncated))
+			for range 2 {
+				rec := httptest.NewRecorder()
+				f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/cacheable", nil))
+				if rec.Code != http.StatusBadGateway {
+					t.Errorf("Expected a truncated body to be a 502, got %d with %q", rec.Code, rec.Body.String())
+				}
+				c.Wait() // let ristretto process a set
+			}
+			if got := testutil.ToFloat64(m.Errors.WithLabelValues(metrics.ReasonTruncated)) - before; got != 2 {
+				t.Errorf("Expected 2 truncations, the body never cached, got %v", got)
+			}
+		})
+	}
+
+	t.Run("streamed", func(t *testing.T) {
+		c, err := lrucache.New(100, 1024*1024)
+		if err != nil {
+			t.Fatalf("Failed to create cache: %v", err)
+		}
+		proxy := httptest.NewServer(New(logger, c, b, "localhost:8080", m, false))
+		defer proxy.Close()
+		before := testutil.ToFloat64(m.Errors.WithLabelValues(metrics.ReasonTruncated))
+		resp, err := http.Get(proxy.URL + "/uncacheable")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if _, err := io.ReadAll(resp.Body); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected the client to see the body cut short, got %v", err)
+		}
+		if got := testutil.ToFloat64(m.Errors.WithLabelValues(metrics.ReasonTruncated)) - before; got != 1 {
+			t.Errorf("Expected 1 truncation, got %v", got)
+		}
+	})
+}
+
+func TestAuthorizedRequests(t *testing.T) {
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", r.URL.Query().Get("cc"))
+		fmt.Fprintf(w, "account of %q", r.Header.Get("Authorization"))
+	})
+
+	newServer := func(t *testing.T, cacheAuthorized bool) *Server {
+		f, _ := newTestFrontend(t, origin)
+		f.SetCacheAuthorized(cacheAuthorized)
+		return f
+	}
+	get := func(f *Server, cc, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/account?cc="+url.QueryEscape(cc), nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		f.cache.(*lrucache.LRUCache).Wait()
+		return rec
+	}
+
+	t.Run("a response to alice doesn't leak to others", func(t *testing.T) {
+		f := newServer(t, false)
+		get(f, "max-age=60", "alice")
+		if rec := get(f, "max-age=60", "alice"); rec.Header().Get("X-Cache") == "hit" {
+			t.Errorf("Expected the response to alice not to be cached")
+		}
+		for _, auth := range []string{"bob", ""} {
+			rec := get(f, "max-age=60", auth)
+			if strings.Contains(rec.Body.String(), "alice") {
+				t.Errorf("Expected %q not to get alice's response, got %s", auth, rec.Body.String())
+			}
+		}
+	})
+
+	for _, cc := range []string{"public, max-age=60", "s-maxage=60", "max-age=60, must-revalidate"} {
+		t.Run("shared with "+cc, func(t *testing.T) {
+			f := newServer(t, false)
+			get(f, cc, "alice")
+			if rec := get(f, cc, "bob"); rec.Header().Get("X-Cache") != "hit" {
+				t.Errorf("Expected the response to be cached, got %s", rec.Header().Get("X-Cache"))
+			}
+		})
+	}
+
+	t.Run("cached when configured", func(t *testing.T) {
+		f := newServer(t, true)
+		get(f, "max-age=60", "alice")
+		if rec := get(f, "max-age=60", "alice"); rec.Header().Get("X-Cache") != "hit" {
+			t.Errorf("Expected the response to be cached, got %s", rec.Header().Get("X-Cache"))
+		}
+	})
+
+	t.Run("requests without credentials are cached", func(t *testing.T) {
+		f := newServer(t, false)
+		get(f, "max-age=60", "")
+		if rec := get(f, "max-age=60", ""); rec.Header().Get("X-Cache") != "hit" {
+			t.Errorf("Expected the response to be cached, got %s", rec.Header().Get("X-Cache"))
+		}
+	})
+}
+
+func TestTTLJitter(t *testing.T) {
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age="+r.URL.Query().Get("max-age"))
+		fmt.Fprint(w, "hello")
+	}))
+	f.SetTTLJitter(10)
+	ttlOf := func(path, maxAge string) time.Duration {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com"+path+"?max-age="+maxAge, nil))
+		ttl, err := time.ParseDuration(rec.Header().Get("X-Cache-TTL"))
+		if err != nil {
+			t.Fatalf("Expected an X-Cache-TTL, got %q", rec.Header().Get("X-Cache-TTL"))
+		}
+		return ttl
+	}
+
+	ttls := make(map[string]time.Duration)
+	for i := range 20 {
+		path := fmt.Sprintf("/burst/%d", i)
+		ttl := ttlOf(path, "1000")
+		if ttl < 900*time.Second || ttl > 1000*time.Second {
+			t.Errorf("Expected a TTL at most 10%% below 1000s, got %v", ttl)
+		}
+		ttls[path+"?max-age=1000"] = ttl
+	}
+	if spread := slices.Collect(maps.Values(ttls)); slices.Min(spread) == slices.Max(spread) {
+		t.Errorf("Expected the TTLs to be spread, all were %v", spread[0])
+	}
+
+	// the objects are stored with the TTL they were sent with
+	c.Wait()
+	stored := 0
+	c.Range(func(key string, obj cache.ObjCore, expires time.Time) bool {
+		stored++
+		if d := time.Until(expires) - ttls[obj.URL]; d > 0 || d < -time.Second {
+			t.Errorf("Expected %s to expire in %v, expires in %v", obj.URL, ttls[obj.URL], time.Until(expires))
+		}
+		return true
+	})
+	if stored != len(ttls) {
+		t.Errorf("Expected %d objects to be cached, got %d", len(ttls), stored)
+	}
+
+	if ttl := ttlOf("/short", "1"); ttl != time.Second {
+		t.Errorf("Expected a TTL at the floor not to be jittered, got %v", ttl)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	lastModified := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "version one")
+	}))
+	f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/doc", nil))
+	c.Wait()
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"matching etag", map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified},
+		{"matching weak etag", map[string]string{"If-None-Match": `W/"v1"`}, http.StatusNotModified},
+		{"etag in a list", map[string]string{"If-None-Match": `"v0", "v1"`}, http.StatusNotModified},
+		{"any etag", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"other etag", map[string]string{"If-None-Match": `"v2"`}, http.StatusOK},
+		{"not modified since", map[string]string{"If-Modified-Since": lastModified.Format(http.TimeFormat)}, http.StatusNotModified},
+		{"modified since", map[string]string{"If-Modified-Since": lastModified.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK},
+		{"invalid date", map[string]string{"If-Modified-Since": "yesterday"}, http.StatusOK},
+		{"etag wins over date", map[string]string{
+			"If-None-Match":     `"v2"`,
+			"If-Modified-Since": lastModified.Format(http.TimeFormat),
+		}, http.StatusOK},
+		{"unconditional", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/doc", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			f.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, rec.Code)
+			}
+			if rec.Header().Get("X-Cache") != "hit" {
+				t.Errorf("Expected a hit, got %q", rec.Header().Get("X-Cache"))
+			}
+			if rec.Header().Get("ETag") != `"v1"` {
+				t.Errorf("Expected the ETag to be sent, got %q", rec.Header().Get("ETag"))
+			}
+			if tt.status == http.StatusNotModified {
+				if rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != "" || rec.Header().Get("Content-Type") != "" {
+					t.Errorf("Expected no body or body headers, got %q %v", rec.Body.String(), rec.Header())
+				}
+			} else if rec.Body.String() != "version one" {
+				t.Errorf("Expected the full body, got %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestTTLRules(t *testing.T) {
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cc := r.URL.Query().Get("cc"); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		fmt.Fprint(w, "hello")
+	}))
+	f.SetTTLRules([]TTLRule{
+		{PathPrefix: "/static/", TTL: time.Hour},
+		{Path: regexp.MustCompile(`^/forced/`), TTL: 10 * time.Minute, Force: true},
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		cc     string
+		ttl    string // X-Cache-TTL of the miss, empty when not cached
+		cached bool
+	}{
+		{"max-age overridden", "/static/a", "max-age=60", "1h0m0s", true},
+		{"no headers", "/static/b", "", "1h0m0s", true},
+		{"no-store kept without force", "/static/c", "no-store", "", false},
+		{"no-cache forced", "/forced/d", "no-cache", "10m0s", true},
+		{"private forced", "/forced/e", "private, max-age=60", "10m0s", true},
+		{"no rule", "/other", "max-age=60", "1m0s", true},
+		{"no rule, no-store", "/other/f", "no-store", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "http://example.com" + tt.path + "?cc=" + url.QueryEscape(tt.cc)
+			rec := httptest.NewRecorder()
+			f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if got := rec.Header().Get("X-Cache-TTL"); got != tt.ttl {
+				t.Errorf("Expected X-Cache-TTL %q, got %q", tt.ttl, got)
+			}
+			c.Wait()
+			rec = httptest.NewRecorder()
+			f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if hit := rec.Header().Get("X-Cache") == "hit"; hit != tt.cached {
+				t.Errorf("Expected cached to be %v, got X-Cache %q", tt.cached, rec.Header().Get("X-Cache"))
+			}
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	page := strings.Repeat("hello, compressible world. ", 40)
+
+	var fetches atomic.Int64
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("ETag", `"page"`)
+		switch r.URL.Path {
+		case "/br":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "br")
+			fmt.Fprint(w, "not really brotli")
+			return
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, "tiny")
+			return
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		if r.Header.Get("Accept-Encoding") == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			fmt.Fprint(zw, page)
+			zw.Close()
+			return
+		}
+		fmt.Fprint(w, page)
+	}))
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		c.Wait()
+		return rec
+	}
+	body := func(t *testing.T, rec *httptest.ResponseRecorder, gzipped bool) string {
+		t.Helper()
+		if got := rec.Header().Get("Content-Encoding") == "gzip"; got != gzipped {
+			t.Fatalf("Expected gzipped to be %v, got Content-Encoding %q", gzipped, rec.Header().Get("Content-Encoding"))
+		}
+		if !gzipped {
+			if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(rec.Body.Len()) {
+				t.Errorf("Expected Content-Length %d, got %q", rec.Body.Len(), cl)
+			}
+			return rec.Body.String()
+		}
+		zr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("Expected a gzipped body: %v", err)
+		}
+		decoded, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("Expected a gzipped body: %v", err)
+		}
+		return string(decoded)
+	}
+
+	t.Run("stored once, served in either encoding", func(t *testing.T) {
+		rec := get("/page", "gzip, deflate, br")
+		if got := body(t, rec, true); got != page {
+			t.Errorf("Expected the page, got %q", got)
+		}
+		for _, tt := range []struct {
+			acceptEncoding string
+			gzipped        bool
+		}{
+			{"", false},
+			{"gzip", true},
+			{"br;q=1.0, gzip;q=0.5", true},
+			{"gzip;q=0", false},
+			{"*", true},
+			{"*, gzip;q=0", false},
+			{"identity", false},
+		} {
+			rec := get("/page", tt.acceptEncoding)
+			if rec.Header().Get("X-Cache") != "hit" {
+				t.Errorf("Expected a hit for %q, got %q", tt.acceptEncoding, rec.Header().Get("X-Cache"))
+			}
+			if got := body(t, rec, tt.gzipped); got != page {
+				t.Errorf("Expected the page for %q, got %q", tt.acceptEncoding, got)
+			}
+			if !varies(rec.Header(), "Accept-Encoding") {
+				t.Errorf("Expected Vary: Accept-Encoding, got %v", rec.Header().Values("Vary"))
+			}
+			if etag := rec.Header().Get("ETag"); etag != `W/"page"` {
+				t.Errorf("Expected the ETag of the gzipped body to be weak, got %q", etag)
+			}
+		}
+		obj, _ := c.Get(cache.MakeKey(httptest.NewRequest(http.MethodGet, "http://example.com/page", nil), false, cache.QueryPolicy{}))
+		if string(obj.Body) != page || obj.Headers.Get("Content-Encoding") != "" {
+			t.Errorf("Expected the object to be stored uncompressed, got %q %v", obj.Body, obj.Headers)
+		}
+	})
+
+	t.Run("a client without gzip fills the cache", func(t *testing.T) {
+		if got := body(t, get("/page2", ""), false); got != page {
+			t.Errorf("Expected the page, got %q", got)
+		}
+		if got := body(t, get("/page2", "gzip"), true); got != page {
+			t.Errorf("Expected the page, got %q", got)
+		}
+	})
+
+	t.Run("small and already compressed bodies are sent as they are", func(t *testing.T) {
+		for _, path := range []string{"/small", "/image"} {
+			get(path, "gzip")
+			rec := get(path, "gzip")
+			if rec.Header().Get("X-Cache") != "hit" {
+				t.Errorf("Expected a hit for %s, got %q", path, rec.Header().Get("X-Cache"))
+			}
+			body(t, rec, false)
+		}
+	})
+
+	t.Run("encodings that can't be decoded aren't cached", func(t *testing.T) {
+		before := fetches.Load()
+		get("/br", "br")
+		rec := get("/br", "br")
+		if rec.Header().Get("X-Cache") == "hit" || fetches.Load()-before != 2 {
+			t.Errorf("Expected a br response not to be cached, got %q", rec.Header().Get("X-Cache"))
+		}
+		if rec.Header().Get("Content-Encoding") != "br" {
+			t.Errorf("Expected the response to be passed through, got %v", rec.Header())
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		f.SetGzip(false)
+		defer f.SetGzip(true)
+		if got := body(t, get("/page", "gzip"), false); got != page {
+			t.Errorf("Expected the page, got %q", got)
+		}
+	})
+}
+
+func TestClientCancellation(t *testing.T) {
+	started := make(chan struct{}, 1)
+	aborted := make(chan struct{}, 1)
+	f, c := newTestFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Length", "1000")
+		if r.URL.Path == "/headers" {
+			// hang before the response headers
+			started <- struct{}{}
+		} else {
+			// send half the body, then hang
+			w.Write(bytes.Repeat([]byte("x"), 500))
+			w.(http.Flusher).Flush()
+			started <- struct{}{}
+		}
+		select {
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+
+	for _, tt := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/headers"},
+		{http.MethodGet, "/body"},
+		{http.MethodPost, "/body"},
+	} {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req := httptest.NewRequestWithContext(ctx, tt.method, "http://example.com"+tt.path, nil)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				f.ServeHTTP(httptest.NewRecorder(), req)
+			}()
+			<-started
+			cancel()
+			select {
+			case <-aborted:
+			case <-time.After(2 * time.Second):
+				t.Fatal("Expected the backend request to be aborted when the client went away")
+			}
+			<-done
+			c.Wait()
+			if _, found := c.Get(cache.MakeKey(req, false, cache.QueryPolicy{})); found {
+				t.Error("Expected nothing to be cached from the canceled fetch")
+			}
+		})
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.NewWithRegistry(prometheus.NewRegistry())
+
+	var inFlight float64
+	fetcher := backend.FetcherFunc(func(req *http.Request) (*http.Response, backend.Cacheability) {
+		inFlight = testutil.ToFloat64(m.InFlight)
+		panic("fetcher bug")
+	})
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	f := New(logger, c, fetcher, "localhost:8080", m, false)
+
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+	if inFlight != 1 {
+		t.Errorf("Expected 1 request in flight during the fetch, got %v", inFlight)
+	}
+	if got := testutil.ToFloat64(m.InFlight); got != 0 {
+		t.Errorf("Expected no requests in flight after the panic, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.Panics); got != 1 {
+		t.Errorf("Expected 1 panic counted, got %v", got)
+	}
+}
+
+func TestBufferLimit(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.NewWithRegistry(prometheus.NewRegistry())
+
+	large := bytes.Repeat([]byte("0123456789"), 100_000) // 1 MB
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}, "Content-Type": {"video/mp4"}},
+			Body:       io.NopCloser(bytes.NewReader(large)),
+			// unknown length, the limit is found while reading
+			ContentLength: -1,
+		}
+	}}
+	get := func(f *Server, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		return rec
+	}
+	overflows := func(action string) float64 {
+		return testutil.ToFloat64(m.BufferOverflows.WithLabelValues(action))
+	}
+
+	t.Run("Spilled to a disk cache", func(t *testing.T) {
+		dir := t.TempDir()
+		c, err := diskcache.New(dir, 10<<20)
+		if err != nil {
+			t.Fatalf("Failed to create cache: %v", err)
+		}
+		f := New(logger, c, fetcher, "localhost:8080", m, false)
+		f.SetBufferLimit(64 << 10)
+		if rec := get(f, "/spill"); rec.Header().Get("X-Cache") != "miss" || !bytes.Equal(rec.Body.Bytes(), large) {
+			t.Fatalf("Expected a miss with the whole object, got %s with %d bytes", rec.Header().Get("X-Cache"), rec.Body.Len())
+		}
+		obj, found := c.Get(f.CacheKey(httptest.NewRequest(http.MethodGet, "http://example.com/spill", nil)))
+		if !found || obj.Headers.Get("Content-Length") != strconv.Itoa(len(large)) {
+			t.Fatalf("Expected the spilled object to be cached with its length, got %+v", obj)
+		}
+		if rec := get(f, "/spill"); rec.Header().Get("X-Cache") != "hit" || !bytes.Equal(rec.Body.Bytes(), large) {
+			t.Errorf("Expected a hit with the whole object, got %s with %d bytes", rec.Header().Get("X-Cache"), rec.Body.Len())
+		}
+		if temps, _ := filepath.Glob(filepath.Join(dir, "spill-*")); len(temps) != 0 {
+			t.Errorf("Expected no spill files left behind, got %v", temps)
+		}
+		if got := overflows(metrics.OverflowSpill); got != 1 {
+			t.Errorf("Expected 1 spill, got %v", got)
+		}
+	})
+
+	t.Run("Larger than the max object size", func(t *testing.T) {
+		c, err := diskcache.New(t.TempDir(), 10<<20)
+		if err != nil {
+			t.Fatalf("Failed to create cache: %v", err)
+		}
+		f := New(logger, c, fetcher, "localhost:8080", m, false)
+		f.SetBufferLimit(64 << 10)
+		f.SetMaxObjectSize(512 << 10)
+		before := overflows(metrics.OverflowStream)
+		if rec := get(f, "/huge"); !bytes.Equal(rec.Body.Bytes(), large) {
+			t.Fatalf("Expected the whole object to be streamed, got %d bytes", rec.Body.Len())
+		}
+		if _, found := c.Get(f.CacheKey(httptest.NewRequest(http.MethodGet, "http://example.com/huge", nil))); found {
+			t.Error("Expected an object larger than the max object size not to be cached")
+		}
+		if got := overflows(metrics.OverflowStream) - before; got != 1 {
+			t.Errorf("Expected 1 streamed overflow, got %v", got)
+		}
+	})
+
+	t.Run("Streamed past a memory cache", func(t *testing.T) {
+		c, err := lrucache.New(100, 10<<20)
+		if err != nil {
+			t.Fatalf("Failed to create cache: %v", err)
+		}
+		f := New(logger, c, fetcher, "localhost:8080", m, false)
+		f.SetBufferLimit(64 << 10)
+		before := overflows(metrics.OverflowStream)
+		if rec := get(f, "/stream"); !bytes.Equal(rec.Body.Bytes(), large) {
+			t.Fatalf("Expected the whole object to be streamed, got %d bytes", rec.Body.Len())
+		}
+		c.Wait()
+		if _, found := c.Get(f.CacheKey(httptest.NewRequest(http.MethodGet, "http://example.com/stream", nil))); found {
+			t.Error("Expected an object larger than the buffer limit not to be cached in memory")
+		}
+		if got := overflows(metrics.OverflowStream) - before; got != 1 {
+			t.Errorf("Expected 1 streamed overflow, got %v", got)
+		}
+	})
+}
+
+func TestMaintenance(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.NewWithRegistry(prometheus.NewRegistry())
+
+	fetcher := &stubFetcher{resp: func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			Body:       io.NopCloser(strings.NewReader("from the backend")),
+		}
+	}}
+	c, err := lrucache.New(100, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	f := New(logger, c, fetcher, "localhost:8080", m, false)
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		c.Wait()
+		return rec
+	}
+	get("/cached")
+
+	f.SetMaintenancePage(MaintenancePage{ContentType: "text/plain", Body: []byte("back soon"), RetryAfter: 2 * time.Minute})
+	f.SetMaintenance(true)
+	if !f.Maintenance() || testutil.ToFloat64(m.Maintenance) != 1 {
+		t.Fatal("Expected maintenance mode to be on")
+	}
+	calls := fetcher.calls.Load()
+	for _, path := range []string{"/cached", "/other"} {
+		rec := get(path)
+		if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "back soon" {
+			t.Errorf("%s: expected the maintenance page, got %d %q", path, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Retry-After"); got != "120" {
+			t.Errorf("%s: expected Retry-After 120, got %q", path, got)
+		}
+	}
+	if got := fetcher.calls.Load(); got != calls {
+		t.Errorf("Expected no backend fetches during maintenance, got %d", got-calls)
+	}
+
+	t.Run("Hits are served", func(t *testing.T) {
+		f.SetMaintenancePage(MaintenancePage{ServeHits: true})
+		if rec := get("/cached"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "hit" {
+			t.Errorf("Expected a hit, got %d with X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+		}
+		rec := get("/other")
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "60" {
+			t.Errorf("Expected the default maintenance page for a miss, got %d with Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+		}
+		if got := fetcher.calls.Load(); got != calls {
+			t.Errorf("Expected no backend fetches during maintenance, got %d", got-calls)
+		}
+	})
+
+	f.SetMaintenance(false)
+	if rec := get("/other"); rec.Code != http.StatusOK || testutil.ToFloat64(m.Maintenance) != 0 {
+		t.Errorf("Expected the backend to be used again, got %d", rec.Code)
+	}
 }
@@ -0,0 +1,43 @@
+package frontend
+
+import (
+	"net/http"
+
+	"github.com/perbu/hazelnut/geoip"
+)
+
+// DefaultCountryHeader is the request header used to tell the backend the client's country
+const DefaultCountryHeader = "X-Country-Code"
+
+// SetGeoIP enables country lookups of the client IP. The country is folded into the cache key
+// and forwarded to the backend in header. A nil resolver disables the feature.
+func (s *Server) SetGeoIP(resolver geoip.Resolver, header string) {
+	if header == "" {
+		header = DefaultCountryHeader
+	}
+	s.geo = resolver
+	s.geoHeader = header
+}
+
+// country returns the country of the client, or "" when GeoIP is disabled or the lookup fails
+func (s *Server) country(req *http.Request) string {
+	if s.geo == nil {
+		return ""
+	}
+	country, ok := s.geo.Country(s.clientAddr(req))
+	if !ok {
+		return ""
+	}
+	return country
+}
+
+// setCountryHeader replaces any client supplied country header with the resolved country
+func (s *Server) setCountryHeader(beReq *http.Request, country string) {
+	if s.geo == nil {
+		return
+	}
+	beReq.Header.Del(s.geoHeader)
+	if country != "" {
+		beReq.Header.Set(s.geoHeader, country)
+	}
+}
@@ -0,0 +1,18 @@
+package frontend
+
+import "net/http"
+
+// SetH2C makes the frontend speak HTTP/2 without TLS (h2c) next to HTTP/1.1 on the same
+// listeners, for a load balancer that terminates TLS and talks HTTP/2 to it. Clients are told
+// apart by the HTTP/2 connection preface, upgrading HTTP/1.1 connections isn't supported. It
+// has to be called before Run.
+func (s *Server) SetH2C(enabled bool) {
+	if !enabled {
+		s.srv.Protocols = nil // the defaults of net/http
+		return
+	}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	s.srv.Protocols = protocols
+}
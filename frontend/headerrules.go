@@ -0,0 +1,57 @@
+package frontend
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+)
+
+// Actions of a HeaderRule
+const (
+	HeaderSet     = "set"     // replace the header with Value
+	HeaderAdd     = "add"     // add Value to the header
+	HeaderRemove  = "remove"  // remove the header
+	HeaderRewrite = "rewrite" // replace matches of Pattern in each value with Value, $1 expands a group
+)
+
+// HeaderRule changes one response header
+type HeaderRule struct {
+	Action  string
+	Name    string
+	Value   string
+	Pattern *regexp.Regexp // HeaderRewrite only
+}
+
+// SetHeaderRules sets the rules applied to response headers. The store rules are applied to
+// backend responses after the denied headers are stripped, so they are cached as changed and
+// every client of the object sees the change. The client rules are applied to every response
+// as it is sent, hits, misses and responses Hazelnut makes up itself, after the X-Cache headers
+// are set. Rules are applied in order.
+func (s *Server) SetHeaderRules(store, client []HeaderRule) {
+	s.storeRules = store
+	s.clientRules = client
+}
+
+// applyHeaderRules applies rules to h in order. The value slices of h may be shared with a
+// cached object, they are replaced rather than changed.
+func applyHeaderRules(rules []HeaderRule, h http.Header) {
+	for _, rule := range rules {
+		name := http.CanonicalHeaderKey(rule.Name)
+		switch rule.Action {
+		case HeaderSet:
+			h[name] = []string{rule.Value}
+		case HeaderAdd:
+			h[name] = append(slices.Clip(h[name]), rule.Value)
+		case HeaderRemove:
+			delete(h, name)
+		case HeaderRewrite:
+			if values := h[name]; len(values) > 0 {
+				rewritten := make([]string, len(values))
+				for i, v := range values {
+					rewritten[i] = rule.Pattern.ReplaceAllString(v, rule.Value)
+				}
+				h[name] = rewritten
+			}
+		}
+	}
+}
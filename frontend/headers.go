@@ -0,0 +1,60 @@
+package frontend
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/perbu/hazelnut/backend"
+)
+
+// SetStripHeaders sets the headers removed from backend responses before they are cached or
+// passed on, on top of the hop-by-hop headers, or instead of them when replace is set.
+func (s *Server) SetStripHeaders(headers []string, replace bool) {
+	var deny []string
+	if !replace {
+		deny = headerDenyList()
+	}
+	for _, h := range headers {
+		deny = append(deny, http.CanonicalHeaderKey(h))
+	}
+	s.denyList = deny
+}
+
+// SetStripSetCookie keeps Set-Cookie out of cached objects. The client whose request filled
+// the object still gets its cookie, hits never carry one, so a cookie isn't handed out to
+// other clients through the shared cache.
+func (s *Server) SetStripSetCookie(enabled bool) {
+	s.stripCookie = enabled
+}
+
+// stripHeaders removes the denied headers from the headers of a backend response
+func (s *Server) stripHeaders(h http.Header) {
+	for _, name := range s.denyList {
+		h.Del(name)
+	}
+	// the ID of the request that filled the object, not of the ones it is served to
+	h.Del(backend.RequestIDHeader)
+}
+
+// setBodyLength frames a buffered body of n bytes with an explicit Content-Length. The origin's
+// Transfer-Encoding and the Trailer announcing its trailers are removed: trailers are never
+// passed on, cached or not. Statuses that can't have a body get no Content-Length.
+func setBodyLength(h http.Header, status, n int) {
+	h.Del("Transfer-Encoding")
+	h.Del("Trailer")
+	if status == http.StatusNoContent || status == http.StatusNotModified || status < 200 {
+		h.Del("Content-Length")
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(n))
+}
+
+// storedHeaders returns the headers of a backend response as they are cached
+func (s *Server) storedHeaders(h http.Header) http.Header {
+	if !s.stripCookie || len(h.Values("Set-Cookie")) == 0 {
+		return h
+	}
+	h = h.Clone()
+	h.Del("Set-Cookie")
+	return h
+}
@@ -0,0 +1,51 @@
+package frontend
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+)
+
+// SetListenAddrs sets the addresses the frontend listens on, replacing the one passed to New.
+// The same handler serves all of them, for dual-stack setups or an internal and an external
+// port. An empty list keeps the address passed to New.
+func (s *Server) SetListenAddrs(addrs []string) {
+	if len(addrs) > 0 {
+		s.addrs = addrs
+	}
+}
+
+// listen binds a listener for every address. When one can't be bound, the ones already bound
+// are closed again.
+func (s *Server) listen() ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(s.addrs))
+	for _, addr := range s.addrs {
+		ln, err := net.Listen("tcp", cmp.Or(addr, ":http"))
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("net.Listen(%q): %w", addr, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	s.lnMu.Lock()
+	s.listeners = listeners
+	s.lnMu.Unlock()
+	return listeners, nil
+}
+
+// ActualPorts returns the ports the frontend listens on, in the order of its addresses. It is
+// empty until Run has bound them, after that it has the port picked for an address with port 0,
+// which is useful in tests.
+func (s *Server) ActualPorts() []int {
+	s.lnMu.Lock()
+	defer s.lnMu.Unlock()
+	var ports []int
+	for _, ln := range s.listeners {
+		if tcpAddr, ok := ln.Addr().(*net.TCPAddr); ok {
+			ports = append(ports, tcpAddr.Port)
+		}
+	}
+	return ports
+}
@@ -0,0 +1,72 @@
+package frontend
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultMaintenanceRetryAfter is how long clients are asked to wait during maintenance when the
+// page doesn't say
+const DefaultMaintenanceRetryAfter = time.Minute
+
+// MaintenancePage is what clients get while maintenance mode is on, always with a 503
+type MaintenancePage struct {
+	ContentType string        // default HTML
+	Body        []byte        // default a minimal page saying the service is unavailable
+	RetryAfter  time.Duration // sent in Retry-After, default DefaultMaintenanceRetryAfter
+	ServeHits   bool          // keep serving cached objects, only requests that need the backend get the page
+}
+
+// SetMaintenancePage sets the page served while maintenance mode is on
+func (s *Server) SetMaintenancePage(page MaintenancePage) {
+	s.maintenancePage = page
+}
+
+// SetMaintenance turns maintenance mode on or off. While it is on no request reaches the
+// backends: they are answered with the maintenance page, or from the cache when the page says
+// hits are still served.
+func (s *Server) SetMaintenance(on bool) {
+	if s.maintenance.Swap(on) == on {
+		return
+	}
+	if on {
+		s.metrics.Maintenance.Set(1)
+		s.logger.Warn("maintenance mode on, the backends are not used", "serveHits", s.maintenancePage.ServeHits)
+	} else {
+		s.metrics.Maintenance.Set(0)
+		s.logger.Info("maintenance mode off")
+	}
+}
+
+// Maintenance reports whether maintenance mode is on
+func (s *Server) Maintenance() bool {
+	return s.maintenance.Load()
+}
+
+// maintenanceBlocks reports whether req gets the maintenance page without a cache lookup
+func (s *Server) maintenanceBlocks(req *http.Request) bool {
+	if !s.maintenance.Load() {
+		return false
+	}
+	return !s.maintenancePage.ServeHits || !s.methods[req.Method].Cache || isUpgrade(req) || s.bypassed(req)
+}
+
+// serveMaintenance writes the maintenance page
+func (s *Server) serveMaintenance(resp http.ResponseWriter) {
+	page := s.maintenancePage
+	body := page.Body
+	if len(body) == 0 {
+		text := fmt.Sprintf("%d %s", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+		body = fmt.Appendf(nil, "<html><head><title>%s</title></head><body><h1>%s</h1><p>Down for maintenance.</p></body></html>\n", text, text)
+	}
+	retryAfter := cmp.Or(page.RetryAfter, DefaultMaintenanceRetryAfter)
+	resp.Header().Set("Content-Type", cmp.Or(page.ContentType, DefaultErrorPageContentType))
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	resp.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	resp.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = resp.Write(body)
+}
@@ -0,0 +1,125 @@
+package frontend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/perbu/hazelnut/metrics"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Default response served in place of a malformed backend response
+const (
+	DefaultMalformedStatus = http.StatusBadGateway
+	DefaultMalformedBody   = "malformed response from backend\n"
+)
+
+// SetMalformedResponse sets the response served instead of a backend response that violates
+// HTTP. A status of 0 or an empty body keeps the default.
+func (s *Server) SetMalformedResponse(status int, body string) {
+	if status == 0 {
+		status = DefaultMalformedStatus
+	}
+	if body == "" {
+		body = DefaultMalformedBody
+	}
+	s.malformed = errorResponse{status: status, body: body}
+}
+
+// errorResponse is an error response served by hazelnut itself
+type errorResponse struct {
+	status int
+	body   string
+}
+
+// malformedResponse returns the response that replaces a malformed one, it is never cached
+func (s *Server) malformedResponse() *http.Response {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Cache-Control", "no-store")
+	return &http.Response{
+		StatusCode:    s.malformed.status,
+		Status:        http.StatusText(s.malformed.status),
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewBufferString(s.malformed.body)),
+		ContentLength: int64(len(s.malformed.body)),
+	}
+}
+
+// replaceMalformed discards a backend response that failed validation and returns the
+// configured error response in its place
+func (s *Server) replaceMalformed(beResp *http.Response, req *http.Request, err error) *http.Response {
+	s.metrics.Errors.WithLabelValues(metrics.ReasonMalformed).Inc()
+	s.log(req.Context()).Warn("malformed backend response", "error", err, "host", req.Host, "path", req.URL.Path)
+	_ = beResp.Body.Close()
+	return s.malformedResponse()
+}
+
+// completeResponse gives a backend response without a body an empty one, and one without a header
+// an empty header, so it can be read, changed and closed like any other. http.Client never returns
+// such a response, other Fetchers may.
+func completeResponse(beResp *http.Response) *http.Response {
+	if beResp.Body == nil {
+		beResp.Body = http.NoBody
+	}
+	if beResp.Header == nil {
+		beResp.Header = http.Header{}
+	}
+	return beResp
+}
+
+// truncated reports whether a backend body of n bytes was cut short: the read failed with an
+// unexpected EOF, which net/http returns when the connection drops before the advertised
+// Content-Length, or it ended cleanly short of the Content-Length, as a Fetcher other than
+// http.Client may let happen. Statuses that can't have a body are never truncated.
+func truncated(status int, h http.Header, n int64, err error) bool {
+	if status == http.StatusNoContent || status == http.StatusNotModified || status < 200 {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	length, perr := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	return err == nil && perr == nil && n < length
+}
+
+// truncatedBody counts and logs a backend body that was cut short of n bytes
+func (s *Server) truncatedBody(req *http.Request, h http.Header, n int64) {
+	s.metrics.Errors.WithLabelValues(metrics.ReasonTruncated).Inc()
+	s.log(req.Context()).Warn("truncated backend response", "host", req.Host, "path", req.URL.Path,
+		"contentLength", h.Get("Content-Length"), "received", n)
+}
+
+// validateResponse checks the parts of a backend response that are copied to the client or
+// the cache. Go's client rejects most broken responses, this catches what slips through.
+func validateResponse(resp *http.Response) error {
+	switch {
+	case resp.StatusCode < 100 || resp.StatusCode > 599:
+		return fmt.Errorf("status %d out of range", resp.StatusCode)
+	case resp.StatusCode < 200:
+		return fmt.Errorf("informational status %d as the final response", resp.StatusCode)
+	case resp.ContentLength < -1:
+		return fmt.Errorf("negative content length %d", resp.ContentLength)
+	}
+	for name, values := range resp.Header {
+		if name == "" || strings.IndexFunc(name, func(r rune) bool { return !isTokenChar(r) }) >= 0 {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		for _, v := range values {
+			if strings.ContainsAny(v, "\r\n\x00") {
+				return fmt.Errorf("invalid value for header %s", name)
+			}
+		}
+	}
+	if lengths := resp.Header.Values("Content-Length"); len(lengths) > 0 {
+		for _, l := range lengths {
+			if n, err := strconv.ParseInt(l, 10, 64); err != nil || n < 0 || l != lengths[0] {
+				return errors.New("invalid or conflicting Content-Length")
+			}
+		}
+	}
+	return nil
+}
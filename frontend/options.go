@@ -0,0 +1,42 @@
+package frontend
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultServerOptions are the methods advertised in response to OPTIONS *, hazelnut forwards all of them
+var defaultServerOptions = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+// SetServerOptions sets the methods listed in the Allow header of the response to OPTIONS *.
+// An empty list restores the default.
+func (s *Server) SetServerOptions(methods []string) {
+	if len(methods) == 0 {
+		methods = defaultServerOptions
+	}
+	upper := make([]string, len(methods))
+	for i, m := range methods {
+		upper[i] = strings.ToUpper(m)
+	}
+	s.allow = strings.Join(upper, ", ")
+}
+
+// isServerOptions reports whether req is OPTIONS *, which asks about the server rather than a resource
+func isServerOptions(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.RequestURI == "*"
+}
+
+// serverOptions answers OPTIONS * at the edge instead of forwarding it
+func (s *Server) serverOptions(resp http.ResponseWriter) {
+	resp.Header().Set("Allow", s.allow)
+	resp.Header().Set("Content-Length", "0")
+	resp.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,42 @@
+package frontend
+
+import (
+	"github.com/perbu/hazelnut/cache"
+	"net/http"
+)
+
+// How the request path is sent to the backend
+const (
+	PathForwardRaw       = "raw"       // the path as the client sent it
+	PathForwardCanonical = "canonical" // the path as it went into the cache key
+)
+
+// SetPathPolicy sets how the request path is canonicalized into the cache key and whether the
+// backend sees the canonical path (PathForwardCanonical) or the client's (PathForwardRaw, the default).
+func (s *Server) SetPathPolicy(policy cache.PathPolicy, forward string) {
+	s.path = policy
+	s.fwdPath = forward == PathForwardCanonical
+}
+
+// keyRequest returns req with its path canonicalized, for use in the cache key.
+// req itself is returned when the policy doesn't change anything.
+func (s *Server) keyRequest(req *http.Request) *http.Request {
+	canonical := s.path.Canonical(req.URL.Path)
+	if canonical == req.URL.Path {
+		return req
+	}
+	kr := *req
+	u := *req.URL
+	u.Path, u.RawPath = canonical, ""
+	kr.URL = &u
+	return &kr
+}
+
+// forwardPath rewrites the path of beReq to its canonical form when that is configured
+func (s *Server) forwardPath(beReq *http.Request) {
+	if !s.fwdPath {
+		return
+	}
+	beReq.URL.Path = s.path.Canonical(beReq.URL.Path)
+	beReq.URL.RawPath = ""
+}
@@ -0,0 +1,43 @@
+package frontend
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// SetRangeFill makes range requests cacheable. A range request that misses fetches the whole
+// object from the backend, stores it, and the requested range is cut from the stored copy, so
+// further ranges of the same object are hits. When disabled, range requests are passed to the
+// backend as they are and their partial responses aren't cached.
+func (s *Server) SetRangeFill(enabled bool) {
+	s.rangeFill = enabled
+}
+
+// isRangeFill reports whether req is a range request that is served from the whole object
+func (s *Server) isRangeFill(req *http.Request) bool {
+	return s.rangeFill && req.Header.Get("Range") != "" &&
+		(req.Method == http.MethodGet || req.Method == http.MethodHead)
+}
+
+// stripRange removes the range headers from beReq so the backend sends the whole object
+func stripRange(beReq *http.Request) {
+	beReq.Header.Del("Range")
+	beReq.Header.Del("If-Range")
+}
+
+// serveRange serves the range req asks for out of a whole object with header and content.
+// The response headers beyond those of the object, like X-Cache, must be set already.
+// http.ServeContent takes care of multiple ranges, If-Range and unsatisfiable ranges.
+func serveRange(resp http.ResponseWriter, req *http.Request, header http.Header, content io.ReadSeeker) {
+	for name, values := range header {
+		resp.Header()[name] = values
+	}
+	// ServeContent sets the length of the range
+	resp.Header().Del("Content-Length")
+	var modtime time.Time
+	if lm, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		modtime = lm
+	}
+	http.ServeContent(resp, req, "", modtime, content)
+}
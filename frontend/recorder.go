@@ -0,0 +1,71 @@
+package frontend
+
+import (
+	"net/http"
+
+	"github.com/perbu/hazelnut/metrics"
+)
+
+// responseRecorder wraps the client's ResponseWriter and records the status and the number
+// of body bytes written, for the request log, the access log and metrics. It applies the
+// client header rules just before the headers are sent, and discards the body of a response
+// to a HEAD request, which is served from the same object as a GET.
+type responseRecorder struct {
+	http.ResponseWriter
+	rules    []HeaderRule // client header rules
+	head     bool         // the request is a HEAD, the body isn't sent
+	status   int          // status passed to WriteHeader, or 200 when the body was written first
+	bytes    int64        // body bytes written
+	implicit bool         // the body was written without calling WriteHeader first
+	cache    string       // cache status of the response, bypass when not set
+}
+
+// markCache sets the cache status of the response written to w, when it goes to a client
+func markCache(w http.ResponseWriter, status string) {
+	if r, ok := w.(*responseRecorder); ok {
+		r.cache = status
+	}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		applyHeaderRules(r.rules, r.Header())
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+		r.implicit = true
+		applyHeaderRules(r.rules, r.Header())
+	}
+	if r.head {
+		return len(p), nil
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, streaming needs its Flush
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// CacheStatus returns the cache status of the response, for the response bytes metric
+func (r *responseRecorder) CacheStatus() string {
+	if r.cache == "" {
+		return metrics.CacheBypass
+	}
+	return r.cache
+}
+
+// Status returns the status sent to the client, 200 when nothing was written at all
+func (r *responseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
@@ -0,0 +1,49 @@
+package frontend
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"net/http"
+
+	"github.com/perbu/hazelnut/backend"
+)
+
+// maxRequestIDLen is the longest request ID accepted from a client
+const maxRequestIDLen = 128
+
+// loggerKey is the context key of the logger of a request
+type loggerKey struct{}
+
+// requestID returns the request ID the client sent, or a new one when it sent none or one that
+// isn't fit for log lines and headers
+func requestID(req *http.Request) string {
+	id := req.Header.Get(backend.RequestIDHeader)
+	if id == "" || len(id) > maxRequestIDLen {
+		return rand.Text()
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return rand.Text()
+		}
+	}
+	return id
+}
+
+// withRequestID tags req with the request ID id: it is sent to the backend in the request ID
+// header, and the context carries it for the backend's log lines, along with a logger that
+// adds it to the log lines of the frontend.
+func (s *Server) withRequestID(req *http.Request, id string) *http.Request {
+	req.Header.Set(backend.RequestIDHeader, id)
+	ctx := backend.WithRequestID(req.Context(), id)
+	ctx = context.WithValue(ctx, loggerKey{}, s.logger.With("request_id", id))
+	return req.WithContext(ctx)
+}
+
+// log returns the logger of the request with ctx, or the server's logger outside of requests
+func (s *Server) log(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return s.logger
+}
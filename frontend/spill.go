@@ -0,0 +1,168 @@
+package frontend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/perbu/hazelnut/cache"
+	"github.com/perbu/hazelnut/metrics"
+)
+
+// errBufferFull is returned by readObject when the body exceeds the buffer limit
+var errBufferFull = errors.New("object larger than the buffer limit")
+
+// fileCache is implemented by caches that keep bodies in files. A body too large to buffer is
+// written to a file made by CreateTemp, which SetFileWithTTL moves into the cache.
+type fileCache interface {
+	CreateTemp() (*os.File, error)
+	SetFileWithTTL(key string, value cache.ObjCore, ttl time.Duration) error
+}
+
+// SetBufferLimit sets the largest body a miss buffers in memory, 0 means no limit but the max
+// object size. With a cache that keeps bodies in files, larger bodies are spilled to a file and
+// stored from there; with the others they are streamed to the client and not cached.
+func (s *Server) SetBufferLimit(limit int64) {
+	s.bufferLimit = limit
+}
+
+// bufferLimited reports whether the buffer limit is below the max object size, so some objects
+// that could be cached are too large to buffer
+func (s *Server) bufferLimited() bool {
+	return s.bufferLimit > 0 && (s.maxObjSize <= 0 || s.bufferLimit < s.maxObjSize)
+}
+
+// canSpill reports whether a response with headers h that outgrows the buffer limit can be
+// written to a file and cached. Only bodies that are stored as they are can: a compressed one
+// would have to be decoded in memory, and ESI is processed in memory.
+func (s *Server) canSpill(h http.Header) bool {
+	if _, ok := s.cache.(fileCache); !ok {
+		return false
+	}
+	return identity(h) && (cache.NoTransform(h) || !s.esiApplies(h))
+}
+
+// spill stores a miss whose body outgrew the buffer limit through a file. head, the part read
+// already, and the rest of the body are written to a file of the cache, which takes it over, and
+// the client is served from the file. When the body turns out larger than the max object size
+// it is streamed to the client from the file and the backend instead, and not cached.
+func (s *Server) spill(resp http.ResponseWriter, req *http.Request, beResp *http.Response, key string, obj cache.ObjCore, ttl time.Duration, head []byte, f *fill, t0 time.Time) {
+	log := s.log(req.Context())
+	fc := s.cache.(fileCache)
+	file, err := fc.CreateTemp()
+	if err != nil {
+		log.Warn("can't spill to disk, streaming", "key", key, "error", err)
+		f.abort(fillAbortTooLarge)
+		s.metrics.BufferOverflows.WithLabelValues(metrics.OverflowStream).Inc()
+		s.stream(resp, req, beResp, head, t0)
+		return
+	}
+	defer func() {
+		_ = file.Close()
+		// gone unless the cache refused the object
+		_ = os.Remove(file.Name())
+	}()
+
+	body := &readErrReader{r: beResp.Body}
+	if s.maxObjSize > 0 {
+		body.r = io.LimitReader(beResp.Body, s.maxObjSize-int64(len(head))+1)
+	}
+	n, err := io.Copy(file, io.MultiReader(bytes.NewReader(head), body))
+	switch {
+	case err != nil && body.err == nil:
+		// the disk is full or failing, and the bytes that didn't make it to the file are lost
+		log.Warn("spilling to disk failed", "key", key, "error", err)
+		f.abort(fillAbortSpill)
+		s.metrics.Errors.WithLabelValues(metrics.ReasonStore).Inc()
+		http.Error(resp, "spilling to disk failed", http.StatusInternalServerError)
+		return
+	case err != nil && canceled(req):
+		f.abort(fillAbortCanceled)
+		log.Info("client went away, cache fill canceled", "key", key, "path", req.URL.Path, "read", n)
+		return
+	case truncated(beResp.StatusCode, beResp.Header, n, err):
+		f.abort(fillAbortTruncated)
+		s.truncatedBody(req, beResp.Header, n)
+		http.Error(resp, "truncated response from backend", http.StatusBadGateway)
+		return
+	case err != nil:
+		f.abort(fillAbortBackend)
+		s.metrics.Errors.WithLabelValues(metrics.ReasonRead).Inc()
+		http.Error(resp, err.Error(), http.StatusBadGateway)
+		return
+	case s.maxObjSize > 0 && n > s.maxObjSize:
+		f.abort(fillAbortTooLarge)
+		s.metrics.BufferOverflows.WithLabelValues(metrics.OverflowStream).Inc()
+		s.streamFile(resp, req, beResp, file, t0)
+		log.Info("cache miss, oversized response streamed", "key", key, "duration", time.Since(t0), "path", req.URL.Path)
+		return
+	}
+	s.metrics.BufferOverflows.WithLabelValues(metrics.OverflowSpill).Inc()
+
+	s.setContentType(beResp.Header, head)
+	setBodyLength(beResp.Header, beResp.StatusCode, int(n))
+	obj.Headers = s.storedHeaders(beResp.Header)
+	obj.BodyFile = file.Name()
+	obj.OriginSize = n
+	ttl = s.jitterTTL(ttl)
+	resp.Header().Add("X-Cache-TTL", ttl.String())
+	if err := fc.SetFileWithTTL(key, obj, ttl); err != nil {
+		s.metrics.Errors.WithLabelValues(metrics.ReasonStore).Inc()
+		log.Warn("cache store failed, object not cached", "key", key, "error", err)
+	} else {
+		log.Debug("caching spilled response", "ttl", ttl.String(), "contentLength", n)
+	}
+	f.complete(int(n))
+
+	// the file is served from the open descriptor, wherever it was moved
+	resp.Header().Add("X-Cache", s.missLabel(req))
+	resp.Header().Add("X-Cache-Latency", asciiFormat(time.Since(t0)))
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		s.metrics.Errors.WithLabelValues(metrics.ReasonRead).Inc()
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !obj.NoTransform && s.gzipEligible(req, beResp.StatusCode, beResp.Header) {
+		for name, values := range beResp.Header {
+			resp.Header()[name] = values
+		}
+		_ = writeEncoded(resp, req, beResp.StatusCode, file)
+	} else {
+		serveFile(resp, req, beResp.StatusCode, beResp.Header, file)
+	}
+	log.Info("cache miss", "key", key, "duration", time.Since(t0), "path", req.URL.Path, "ignoreHost", s.key.IgnoreHost, "spilled", true)
+}
+
+// streamFile streams a miss to the client from the part of its body spilled to file and the
+// rest from the backend
+func (s *Server) streamFile(resp http.ResponseWriter, req *http.Request, beResp *http.Response, file *os.File, t0 time.Time) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		s.metrics.Errors.WithLabelValues(metrics.ReasonRead).Inc()
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rest := beResp.Body
+	beResp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(file, rest), rest}
+	s.stream(resp, req, beResp, nil, t0)
+}
+
+// readErrReader remembers the error of the reader it wraps, to tell reading the backend body
+// from writing the file it is copied to
+type readErrReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,56 @@
+package frontend
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/perbu/hazelnut/metrics"
+)
+
+// Default retries of a failed cache store
+const (
+	DefaultStoreRetries = 3
+	DefaultStoreBackoff = 50 * time.Millisecond
+)
+
+// storeRetry is how failed cache stores are retried
+type storeRetry struct {
+	retries int
+	backoff time.Duration // before the first retry, doubled for every next one
+}
+
+// SetStoreRetries sets how often a cache store that failed, as stores to an external cache can,
+// is retried, and the backoff before the first retry. The backoff doubles for every next retry.
+// Retries run in the background, the client gets its response without waiting for them.
+// 0 means the defaults.
+func (s *Server) SetStoreRetries(retries int, backoff time.Duration) {
+	s.storeRetry = storeRetry{
+		retries: cmp.Or(retries, DefaultStoreRetries),
+		backoff: cmp.Or(backoff, DefaultStoreBackoff),
+	}
+}
+
+// store stores an object in the cache with set, retrying in the background when it fails
+func (s *Server) store(ctx context.Context, key string, set func() error) {
+	err := set()
+	if err == nil {
+		return
+	}
+	log := s.log(ctx)
+	log.Debug("cache store failed, retrying", "key", fmt.Sprintf("%x", key), "error", err)
+	go func() {
+		backoff := s.storeRetry.backoff
+		for attempt := 1; attempt <= s.storeRetry.retries; attempt++ {
+			time.Sleep(backoff)
+			if err = set(); err == nil {
+				log.Debug("cache store succeeded", "key", fmt.Sprintf("%x", key), "attempt", attempt)
+				return
+			}
+			backoff *= 2
+		}
+		s.metrics.Errors.WithLabelValues(metrics.ReasonStore).Inc()
+		log.Warn("cache store failed, object not cached", "key", fmt.Sprintf("%x", key), "error", err)
+	}()
+}
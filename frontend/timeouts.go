@@ -0,0 +1,33 @@
+package frontend
+
+import (
+	"cmp"
+	"time"
+)
+
+// Default client timeouts. There is no default write timeout: it bounds the whole response,
+// and would cut off legitimate slow downloads of large objects.
+const (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultReadTimeout       = time.Minute
+	DefaultIdleTimeout       = 2 * time.Minute
+)
+
+// Timeouts protect the frontend against slow clients holding connections open
+type Timeouts struct {
+	ReadHeader time.Duration // reading the request line and headers, this is what stops slowloris
+	Read       time.Duration // reading the whole request, body included
+	Write      time.Duration // writing the whole response, 0 means no limit
+	Idle       time.Duration // a keep-alive connection waiting for its next request
+}
+
+// SetTimeouts sets the client timeouts of the frontend. Zero values of ReadHeader, Read and
+// Idle mean their default. Write counts from the end of the request headers until the response
+// is written in full, however large it is, so it must leave room for the slowest legitimate
+// download of the largest object. It has to be called before Run.
+func (s *Server) SetTimeouts(t Timeouts) {
+	s.srv.ReadHeaderTimeout = cmp.Or(t.ReadHeader, DefaultReadHeaderTimeout)
+	s.srv.ReadTimeout = cmp.Or(t.Read, DefaultReadTimeout)
+	s.srv.WriteTimeout = t.Write
+	s.srv.IdleTimeout = cmp.Or(t.Idle, DefaultIdleTimeout)
+}
@@ -0,0 +1,39 @@
+package frontend
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TTLRule sets the TTL of the responses to the requests it matches, in place of the one their
+// headers give. Every path condition that is set must match. Without Force it only changes how
+// long a cacheable response is kept; with Force responses whose Cache-Control forbids caching,
+// with no-store, private or no-cache, are cached as well.
+type TTLRule struct {
+	PathPrefix string
+	Path       *regexp.Regexp
+	TTL        time.Duration
+	Force      bool
+}
+
+// SetTTLRules sets the rules that override the TTL of responses by the path of the request. The
+// first rule that matches applies.
+func (s *Server) SetTTLRules(rules []TTLRule) {
+	s.ttlRules = rules
+}
+
+// ttlRule returns the first TTL rule matching req, nil when none does
+func (s *Server) ttlRule(req *http.Request) *TTLRule {
+	for i, rule := range s.ttlRules {
+		if rule.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, rule.PathPrefix) {
+			continue
+		}
+		if rule.Path != nil && !rule.Path.MatchString(req.URL.Path) {
+			continue
+		}
+		return &s.ttlRules[i]
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+
+	"github.com/perbu/hazelnut/backend"
+)
+
+// isUpgrade reports whether req asks to switch protocols, like a WebSocket handshake does
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, line := range req.Header.Values("Connection") {
+		for token := range strings.SplitSeq(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgrade passes a request to switch protocols through to the backend, bypassing the cache.
+// When the backend switches, the client's connection is hijacked and spliced to the
+// backend's until either side closes it. Any other answer is passed on as it is.
+func (s *Server) upgrade(resp *responseRecorder, req *http.Request) {
+	log := s.log(req.Context())
+	upgrader, ok := s.backend.(backend.Upgrader)
+	if !ok {
+		http.Error(resp, "connection upgrades are not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+	// the connection outlives the handler's part of the request, the context only carries the request ID
+	beReq := req.Clone(context.WithoutCancel(req.Context()))
+	beReq.RequestURI = ""
+	if beReq.URL.Host == "" {
+		beReq.URL.Host = beReq.Host
+	}
+	s.forwardPath(beReq)
+	s.setForwardedHeaders(beReq, req)
+	s.addVia(beReq.Header, req.Proto, req.ProtoMajor, req.ProtoMinor)
+
+	beResp := s.fallback(completeResponse(upgrader.Upgrade(beReq)), backend.Cacheability{})
+	defer beResp.Body.Close()
+	if beResp.StatusCode != http.StatusSwitchingProtocols {
+		// the backend declined, the response is an ordinary one
+		s.stripHeaders(beResp.Header)
+		s.addVia(beResp.Header, beResp.Proto, beResp.ProtoMajor, beResp.ProtoMinor)
+		maps.Copy(resp.Header(), beResp.Header)
+		resp.WriteHeader(beResp.StatusCode)
+		if _, err := io.Copy(resp, beResp.Body); err != nil {
+			log.Warn("write upgrade response body", "err", err)
+		}
+		return
+	}
+	backConn, ok := beResp.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Error("backend switched protocols without a writable connection")
+		http.Error(resp, "bad upgrade from backend", http.StatusBadGateway)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(resp).Hijack()
+	if err != nil {
+		log.Error("hijacking the client connection failed", "error", err)
+		http.Error(resp, "connection upgrades are not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	// Connection and Upgrade are the handshake itself, the hop-by-hop headers stay
+	header := beResp.Header.Clone()
+	header.Set(backend.RequestIDHeader, resp.Header().Get(backend.RequestIDHeader))
+	s.addVia(header, beResp.Proto, beResp.ProtoMajor, beResp.ProtoMinor)
+	applyHeaderRules(s.clientRules, header)
+	fmt.Fprintf(rw, "HTTP/1.1 %s\r\n", beResp.Status)
+	_ = header.Write(rw)
+	_, _ = rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		s.writeFailed(req, "write upgrade response", err)
+		return
+	}
+	resp.status = http.StatusSwitchingProtocols
+	log.Info("connection upgraded", "upgrade", beResp.Header.Get("Upgrade"), "path", req.URL.Path)
+
+	// copy both ways until one side is done, then close both to end the other
+	errc := make(chan error, 2)
+	var sent int64
+	go func() {
+		// rw holds anything the client sent after the handshake
+		_, err := io.Copy(backConn, rw)
+		errc <- err
+	}()
+	go func() {
+		var err error
+		sent, err = io.Copy(conn, backConn)
+		errc <- err
+	}()
+	err = <-errc
+	_ = conn.Close()
+	_ = backConn.Close()
+	<-errc
+	resp.bytes += sent
+	log.Debug("upgraded connection closed", "error", err, "bytesSent", sent)
+}
@@ -0,0 +1,49 @@
+package frontend
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// SetVaryCookies lists the cookies that are folded into the cache key.
+// Responses with Vary: Cookie are only cached when this list is set, and are then
+// shared between all clients that send the same values for these cookies.
+func (s *Server) SetVaryCookies(names []string) {
+	s.varyCookie = names
+}
+
+// SetKeyCookies lists cookies that are folded into the cache key like those of SetVaryCookies,
+// without making responses with Vary: Cookie cacheable
+func (s *Server) SetKeyCookies(names []string) {
+	s.keyCookie = names
+}
+
+// cookieVariants returns the key variants for the configured cookies
+func (s *Server) cookieVariants(req *http.Request) []string {
+	if len(s.varyCookie) == 0 && len(s.keyCookie) == 0 {
+		return nil
+	}
+	variants := make([]string, 0, len(s.varyCookie)+len(s.keyCookie))
+	for _, name := range slices.Concat(s.varyCookie, s.keyCookie) {
+		value := ""
+		if c, err := req.Cookie(name); err == nil {
+			value = c.Value
+		}
+		variants = append(variants, "cookie:"+name+"="+value)
+	}
+	return variants
+}
+
+// varies reports whether the response Vary header lists the request header name, or is "*"
+func varies(h http.Header, name string) bool {
+	for _, v := range h.Values("Vary") {
+		for field := range strings.SplitSeq(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package frontend
+
+import (
+	"cmp"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultViaPseudonym names Hazelnut in Via headers unless SetVia names it otherwise
+const DefaultViaPseudonym = "hazelnut"
+
+// SetVia sets the pseudonym Hazelnut adds itself to Via headers under, such as the host name of
+// the cache. An empty pseudonym means DefaultViaPseudonym.
+func (s *Server) SetVia(pseudonym string) {
+	s.via = cmp.Or(pseudonym, DefaultViaPseudonym)
+}
+
+// addVia appends Hazelnut to the Via header h of a message it received with the protocol proto,
+// as RFC 9110 section 7.6.3 has it: the protocol version and the pseudonym, like "1.1 hazelnut".
+// Proxies before it in the chain are kept.
+func (s *Server) addVia(h http.Header, proto string, major, minor int) {
+	version, ok := strings.CutPrefix(proto, "HTTP/")
+	if !ok {
+		// a response made up here rather than received, or a protocol other than HTTP
+		version = "1.1"
+		if major > 0 {
+			version = strconv.Itoa(major) + "." + strconv.Itoa(minor)
+		}
+	}
+	h.Add("Via", version+" "+s.via)
+}
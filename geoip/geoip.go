@@ -0,0 +1,48 @@
+// Package geoip resolves client IP addresses to ISO country codes
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// Resolver maps a client IP address to an ISO 3166-1 alpha-2 country code.
+// The bool is false when the country can't be determined.
+type Resolver interface {
+	Country(ip netip.Addr) (string, bool)
+}
+
+// MaxMind resolves countries using a MaxMind GeoIP2/GeoLite2 Country or City database
+type MaxMind struct {
+	db *maxminddb.Reader
+}
+
+// Open opens the MaxMind database at path
+func Open(path string) (*MaxMind, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("maxminddb.Open(%q): %w", path, err)
+	}
+	return &MaxMind{db: db}, nil
+}
+
+// Country looks up the country for ip. Private, loopback and otherwise non-routable
+// addresses are never in the database and are skipped without a lookup.
+func (m *MaxMind) Country(ip netip.Addr) (string, bool) {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return "", false
+	}
+	var iso string
+	if err := m.db.Lookup(ip).DecodePath(&iso, "country", "iso_code"); err != nil || iso == "" {
+		return "", false
+	}
+	return iso, true
+}
+
+// Close releases the database
+func (m *MaxMind) Close() error {
+	return m.db.Close()
+}
@@ -0,0 +1,109 @@
+package geoip
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeDB writes a MaxMind DB that maps prefix, an IPv4 /24, to country and nothing else.
+// The search tree has one node for every bit of the prefix, with 24 bit records.
+func writeDB(t *testing.T, prefix netip.Prefix, country string) string {
+	t.Helper()
+	str := func(s string) []byte { return append([]byte{0x40 | byte(len(s))}, s...) }
+
+	const nodeCount = 24
+	record := func(b []byte, v int) []byte { return append(b, byte(v>>16), byte(v>>8), byte(v)) }
+	addr := prefix.Addr().As4()
+	var db []byte
+	for i := range nodeCount {
+		next := i + 1
+		if next == nodeCount {
+			next = nodeCount + 16 // the first record of the data section
+		}
+		if addr[i/8]>>(7-i%8)&1 == 0 {
+			db = record(record(db, next), nodeCount)
+		} else {
+			db = record(record(db, nodeCount), next)
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+
+	// {"country": {"iso_code": country}}
+	db = append(db, 0xe1)
+	db = append(db, str("country")...)
+	db = append(db, 0xe1)
+	db = append(db, str("iso_code")...)
+	db = append(db, str(country)...)
+
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	db = append(db, 0xe3)
+	db = append(db, str("node_count")...)
+	db = append(db, 0xc1, nodeCount)
+	db = append(db, str("record_size")...)
+	db = append(db, 0xa1, 24)
+	db = append(db, str("ip_version")...)
+	db = append(db, 0xa1, 4)
+
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, db, 0o644); err != nil {
+		t.Fatalf("Failed to write the database: %v", err)
+	}
+	return path
+}
+
+func TestCountry(t *testing.T) {
+	db, err := Open(writeDB(t, netip.MustParsePrefix("81.2.69.0/24"), "GB"))
+	if err != nil {
+		t.Fatalf("Failed to open the database: %v", err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		ip      string
+		country string
+		found   bool
+	}{
+		{"81.2.69.142", "GB", true},
+		{"::ffff:81.2.69.142", "GB", true},
+		{"81.2.70.1", "", false},
+		{"10.0.0.1", "", false},
+		{"127.0.0.1", "", false},
+		{"::1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			country, found := db.Country(netip.MustParseAddr(tt.ip))
+			if country != tt.country || found != tt.found {
+				t.Errorf("Expected %q %v, got %q %v", tt.country, tt.found, country, found)
+			}
+		})
+	}
+	if country, found := db.Country(netip.Addr{}); found {
+		t.Errorf("Expected no country for an invalid address, got %q", country)
+	}
+}
+
+func TestSkipsNonRoutable(t *testing.T) {
+	// without a database, any lookup would panic
+	m := &MaxMind{}
+	for _, ip := range []string{"192.168.1.1", "127.0.0.1", "169.254.0.1", "0.0.0.0", "fe80::1", "::"} {
+		if country, found := m.Country(netip.MustParseAddr(ip)); found {
+			t.Errorf("Expected %s to be skipped, got %q", ip, country)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("Expected an error for a missing database")
+	}
+	path := filepath.Join(t.TempDir(), "broken.mmdb")
+	if err := os.WriteFile(path, []byte("not a database"), 0o644); err != nil {
+		t.Fatalf("Failed to write the database: %v", err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Error("Expected an error for a file that isn't a database")
+	}
+}
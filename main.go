@@ -1,6 +1,7 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"flag"
 	"fmt"
@@ -10,9 +11,13 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/perbu/hazelnut/backend"
 	"github.com/perbu/hazelnut/config"
+	"github.com/perbu/hazelnut/frontend"
 	"github.com/perbu/hazelnut/service"
 	"github.com/perbu/hazelnut/version"
+	"github.com/perbu/hazelnut/warmup"
+	"gopkg.in/yaml.v3"
 )
 
 func main() {
@@ -22,15 +27,16 @@ func main() {
 		_, _ = fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	fmt.Println("clean exit")
 }
 
 func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 	// Parse command line flags
 	var configPath string
+	var validate bool
 	fs := flag.NewFlagSet("hazelnut", flag.ExitOnError)
 	fs.SetOutput(stderr)
 	fs.StringVar(&configPath, "config", "config.yaml", "Path to configuration file")
+	fs.BoolVar(&validate, "validate", false, "Check the configuration file, print the resolved settings and exit without starting the server")
 	if err := fs.Parse(args); err != nil {
 		return fmt.Errorf("parsing flags: %w", err)
 	}
@@ -40,16 +46,22 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 	if err != nil {
 		return fmt.Errorf("loading config: %w", err)
 	}
+	if validate {
+		return printConfig(stdout, cfg)
+	}
 	var handler slog.Handler
-	// Initialize logger with configured log level
+	// Initialize logger with configured log level. The level is kept in a LevelVar
+	// so a SIGHUP reload can change it.
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(cfg.GetLogLevel())
 	switch cfg.Logging.Format {
 	case "text":
 		handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-			Level: cfg.GetLogLevel(),
+			Level: logLevel,
 		})
 	case "json":
 		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
-			Level: cfg.GetLogLevel(),
+			Level: logLevel,
 		})
 	}
 	logger := slog.New(handler)
@@ -62,5 +74,139 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 		return fmt.Errorf("creating service: %w", err)
 	}
 
-	return srv.Run(ctx)
+	// Reload the configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				reload(srv, configPath, logLevel, logger)
+			}
+		}
+	}()
+
+	if err := srv.Run(ctx); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintln(stdout, "clean exit")
+	return nil
+}
+
+// printConfig writes cfg as YAML, with the defaults for settings the file leaves out filled in.
+// Credentials are masked, the output tends to end up in CI logs.
+func printConfig(w io.Writer, cfg *config.Config) error {
+	resolved := withDefaults(*cfg)
+	for _, secret := range []*string{&resolved.Admin.Password, &resolved.Admin.Token} {
+		if *secret != "" {
+			*secret = "********"
+		}
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&resolved); err != nil {
+		return fmt.Errorf("printing config: %w", err)
+	}
+	return enc.Close()
+}
+
+// withDefaults returns cfg with the settings left unset replaced by the defaults they stand for,
+// so the printed config shows what the server runs with. Backend request headers may carry
+// credentials and are masked.
+func withDefaults(cfg config.Config) config.Config {
+	cfg.DefaultBackend = backendDefaults(cfg.DefaultBackend)
+	if cfg.VirtualHosts != nil {
+		hosts := make(map[string]config.BackendConfig, len(cfg.VirtualHosts))
+		for host, bc := range cfg.VirtualHosts {
+			hosts[host] = backendDefaults(bc)
+		}
+		cfg.VirtualHosts = hosts
+	}
+
+	fc := &cfg.Frontend
+	fc.Listen = fc.GetListenAddrs()
+	fc.Forwarded = ptr(fc.GetForwarded())
+	fc.Gzip = ptr(fc.GetGzip())
+	fc.Via = cmp.Or(fc.Via, frontend.DefaultViaPseudonym)
+	fc.Malformed.Status = cmp.Or(fc.Malformed.Status, frontend.DefaultMalformedStatus)
+	fc.Malformed.Body = cmp.Or(fc.Malformed.Body, frontend.DefaultMalformedBody)
+	fc.Timeouts.ReadHeader = cmp.Or(fc.Timeouts.ReadHeader, frontend.DefaultReadHeaderTimeout)
+	fc.Timeouts.Read = cmp.Or(fc.Timeouts.Read, frontend.DefaultReadTimeout)
+	fc.Timeouts.Idle = cmp.Or(fc.Timeouts.Idle, frontend.DefaultIdleTimeout)
+	fc.Maintenance.ContentType = cmp.Or(fc.Maintenance.ContentType, frontend.DefaultErrorPageContentType)
+	fc.Maintenance.RetryAfter = cmp.Or(fc.Maintenance.RetryAfter, frontend.DefaultMaintenanceRetryAfter)
+
+	cc := &cfg.Cache
+	cc.Type = cmp.Or(cc.Type, "lru")
+	cc.MaxObjectSize = cmp.Or(cc.MaxObjectSize, cc.MaxCost)
+	if cc.Type == "tiered" {
+		cc.DiskSize = cmp.Or(cc.DiskSize, cc.MaxCost)
+	}
+	cc.Key.Host = ptr(!cc.GetIgnoreHost())
+	cc.Key.Path = ptr(cc.Key.GetPath())
+	cc.Key.Method = ptr(cc.Key.GetMethod())
+	cc.Query.Mode = cmp.Or(cc.Query.Mode, "full")
+	cc.Path.Forward = cmp.Or(cc.Path.Forward, "raw")
+	cc.HostConflict = cmp.Or(cc.HostConflict, "warn")
+	cc.StoreRetries = cmp.Or(cc.StoreRetries, frontend.DefaultStoreRetries)
+	cc.StoreBackoff = cmp.Or(cc.StoreBackoff, frontend.DefaultStoreBackoff)
+	cc.StatsInterval = cmp.Or(cc.StatsInterval, service.DefaultStatsInterval)
+
+	cfg.Logging.AccessFormat = cmp.Or(cfg.Logging.AccessFormat, frontend.AccessLogCombined)
+	cfg.GeoIP.Header = cmp.Or(cfg.GeoIP.Header, frontend.DefaultCountryHeader)
+	cfg.Devices.Header = cmp.Or(cfg.Devices.Header, frontend.DefaultDeviceHeader)
+	cfg.Warmup.Concurrency = cmp.Or(cfg.Warmup.Concurrency, warmup.DefaultConcurrency)
+	cfg.Shutdown.DrainTimeout = cmp.Or(cfg.Shutdown.DrainTimeout, frontend.DefaultDrainTimeout)
+	if len(cfg.Admin.Allow) == 0 {
+		allow, _ := cfg.Admin.GetAllow() // the loopback default always parses
+		for _, prefix := range allow {
+			cfg.Admin.Allow = append(cfg.Admin.Allow, prefix.String())
+		}
+	}
+	return cfg
+}
+
+// backendDefaults returns bc with its defaults filled in and its request header values masked
+func backendDefaults(bc config.BackendConfig) config.BackendConfig {
+	bc.DialTimeout = cmp.Or(bc.DialTimeout, backend.DefaultDialTimeout)
+	bc.ResponseTimeout = cmp.Or(bc.ResponseTimeout, backend.DefaultResponseTimeout)
+	bc.OversizePolicy = cmp.Or(bc.OversizePolicy, backend.OversizeAbort)
+	if len(bc.CacheableStatus) == 0 {
+		bc.CacheableStatus = backend.DefaultCacheableStatus()
+	}
+	bc.HTTP2 = ptr(bc.GetHTTP2())
+	bc.MaxIdleConns = cmp.Or(bc.MaxIdleConns, backend.DefaultMaxIdleConns)
+	bc.MaxIdlePerHost = cmp.Or(bc.MaxIdlePerHost, backend.DefaultMaxIdleConnsPerHost)
+	bc.IdleConnTimeout = cmp.Or(bc.IdleConnTimeout, backend.DefaultIdleConnTimeout)
+	if bc.RequestHeaders != nil {
+		masked := make(map[string]string, len(bc.RequestHeaders))
+		for name := range bc.RequestHeaders {
+			masked[name] = "********"
+		}
+		bc.RequestHeaders = masked
+	}
+	return bc
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// reload re-reads the config file and applies it to the running service.
+// If the new config can't be loaded or applied, the old one stays in effect.
+func reload(srv *service.Server, configPath string, logLevel *slog.LevelVar, logger *slog.Logger) {
+	logger.Info("reloading configuration", "config", configPath)
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		logger.Error("reload failed, keeping current configuration", "error", err)
+		return
+	}
+	if err := srv.Reload(cfg); err != nil {
+		logger.Error("reload failed, keeping current configuration", "error", err)
+		return
+	}
+	logLevel.Set(cfg.GetLogLevel())
 }
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/perbu/hazelnut/cache/lrucache"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -132,3 +136,69 @@ func TestProxy(t *testing.T) {
 		}
 	})
 }
+
+func TestValidateFlag(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		return path
+	}
+
+	t.Run("Valid config", func(t *testing.T) {
+		path := write(t, "default_backend:\n  target: http://origin:8000\n  request_headers:\n    Authorization: Bearer s3cret\n"+
+			"virtualhosts:\n  static.example.com:\n    target: http://static:8000\n    request_headers:\n      X-Api-Key: abc123\n"+
+			"admin:\n  username: ops\n  password: hunter2\n")
+		var stdout, stderr bytes.Buffer
+		if err := run(context.Background(), []string{"-config", path, "-validate"}, &stdout, &stderr); err != nil {
+			t.Fatalf("Expected the config to validate, got %v", err)
+		}
+		out := stdout.String()
+		if !strings.Contains(out, "target: http://origin:8000") {
+			t.Errorf("Expected the backend in the printed config, got:\n%s", out)
+		}
+		if !strings.Contains(out, "level: info") {
+			t.Errorf("Expected the default log level in the printed config, got:\n%s", out)
+		}
+		if strings.Contains(out, "hunter2") || !strings.Contains(out, "password: '********'") {
+			t.Errorf("Expected the password masked, got:\n%s", out)
+		}
+		if strings.Contains(out, "s3cret") || strings.Contains(out, "abc123") || !strings.Contains(out, "X-Api-Key: '********'") {
+			t.Errorf("Expected the backend request headers masked, got:\n%s", out)
+		}
+		for _, want := range []string{"http2: true", "max_idle_conns: 1000", "oversize_policy: abort", "forwarded: true", "dial_timeout: 10s"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("Expected the default %q in the printed config, got:\n%s", want, out)
+			}
+		}
+		if strings.Contains(out, "clean exit") {
+			t.Errorf("Expected only the config on stdout, got:\n%s", out)
+		}
+
+		// the printed config is a valid config of its own
+		stdout.Reset()
+		if err := run(context.Background(), []string{"-config", write(t, out), "-validate"}, &stdout, &stderr); err != nil {
+			t.Errorf("Expected the printed config to validate, got %v", err)
+		}
+	})
+
+	t.Run("Invalid config", func(t *testing.T) {
+		path := write(t, "logging:\n  level: loud\n")
+		var stdout, stderr bytes.Buffer
+		err := run(context.Background(), []string{"-config", path, "-validate"}, &stdout, &stderr)
+		if err == nil || !strings.Contains(err.Error(), "logging.level") {
+			t.Errorf("Expected a logging.level error, got %v", err)
+		}
+		if stdout.Len() != 0 {
+			t.Errorf("Expected nothing printed for an invalid config, got:\n%s", stdout.String())
+		}
+	})
+
+	t.Run("Example config", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		if err := run(context.Background(), []string{"-config", "config.example.yaml", "-validate"}, &stdout, &stderr); err != nil {
+			t.Errorf("Expected config.example.yaml to validate, got %v", err)
+		}
+	})
+}
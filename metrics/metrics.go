@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"fmt"
 	"github.com/perbu/hazelnut/version"
 	"github.com/prometheus/client_golang/prometheus"
 	colVersion "github.com/prometheus/client_golang/prometheus/collectors/version"
@@ -9,11 +10,69 @@ import (
 	"sync"
 )
 
+// Error reasons used as the "reason" label on the errors counter
+const (
+	ReasonDial  = "dial"
+	ReasonRead  = "read"
+	ReasonWrite = "write"
+	// ReasonTimeout is a backend that didn't connect or answer in time, served as a 504
+	ReasonTimeout = "timeout"
+	// ReasonMalformed is a backend response that violates HTTP, it is replaced by an error response
+	ReasonMalformed = "malformed"
+	// ReasonStore is an object that couldn't be stored in the cache, retries included
+	ReasonStore = "store"
+	// ReasonTruncated is a backend body cut short of its Content-Length, it is never cached
+	ReasonTruncated = "truncated"
+	// ReasonESI is an ESI include that failed without a fallback, the page is replaced by an error response
+	ReasonESI = "esi"
+	// ReasonTooLarge is a backend response over max_response_bytes aborted before its body was read
+	ReasonTooLarge = "too_large"
+)
+
+// Actions used as the "action" label on the buffer overflows counter
+const (
+	OverflowSpill  = "spill"  // written to a file and cached from there
+	OverflowStream = "stream" // streamed to the client and not cached
+)
+
+// Cache statuses used as the "cache" label on the response bytes counter
+const (
+	CacheHit    = "hit"
+	CacheMiss   = "miss"   // fetched from the backend to be cached, refreshes included
+	CacheBypass = "bypass" // passed to the backend past the cache, like uncached methods
+)
+
 // Metrics contains Prometheus metrics for Hazelnut
 type Metrics struct {
-	CacheHits   prometheus.Counter
-	CacheMisses prometheus.Counter
-	Errors      prometheus.Counter
+	CacheHits   *prometheus.CounterVec // labels: status, method
+	CacheMisses *prometheus.CounterVec // labels: status, method
+	Errors      *prometheus.CounterVec // labels: reason
+
+	// Requests to the backends, labeled with the backend, like https://origin.example.com:443
+	BackendRequests *prometheus.CounterVec // labels: backend
+	BackendFailures *prometheus.CounterVec // labels: backend
+
+	// Cache fills, a fill is a miss whose body is read from the backend to be stored
+	FillsStarted   prometheus.Counter
+	FillsCompleted prometheus.Counter
+	FillsAborted   *prometheus.CounterVec // labels: reason
+	FillBytes      prometheus.Histogram
+	FillDuration   prometheus.Histogram
+	FillsRejected  *prometheus.CounterVec // labels: limit
+	// Cacheable misses whose body was larger than the buffer limit
+	BufferOverflows *prometheus.CounterVec // labels: action
+
+	Evictions     prometheus.Counter
+	KeyCollisions prometheus.Counter
+	HitRatio      prometheus.Gauge       // hits over lookups in the last stats interval
+	ResponseBytes *prometheus.CounterVec // labels: cache
+
+	InFlight prometheus.Gauge   // requests being served right now
+	Panics   prometheus.Counter // handlers that panicked, the request got a 500 or a cut connection
+	// Responses that couldn't be written because the client went away, which isn't an error here
+	ClientDisconnects prometheus.Counter
+
+	Maintenance prometheus.Gauge // 1 while maintenance mode is on
 }
 
 var (
@@ -21,26 +80,112 @@ var (
 	instance *Metrics
 )
 
-// New creates a new Metrics instance with initialized Prometheus counters
-// Uses a singleton pattern to avoid duplicate registration in tests
+// New returns the Metrics registered with the default Prometheus registry. It is a singleton,
+// every call returns the same instance, so the metrics are registered once.
 func New() *Metrics {
 	once.Do(func() {
-		promVersion.Version = version.Version
-		prometheus.MustRegister(colVersion.NewCollector("hazelnut"))
-		instance = &Metrics{
-			CacheHits: promauto.NewCounter(prometheus.CounterOpts{
-				Name: "hazelnut_cache_hits_total",
-				Help: "The total number of cache hits",
-			}),
-			CacheMisses: promauto.NewCounter(prometheus.CounterOpts{
-				Name: "hazelnut_cache_misses_total",
-				Help: "The total number of cache misses",
-			}),
-			Errors: promauto.NewCounter(prometheus.CounterOpts{
-				Name: "hazelnut_errors_total",
-				Help: "The total number of errors",
-			}),
-		}
+		instance = NewWithRegistry(prometheus.DefaultRegisterer)
 	})
 	return instance
 }
+
+// NewWithRegistry creates a new Metrics instance registered with reg, for embedders running
+// several instances in one process and for tests that want a clean registry. It panics when
+// reg already has the Hazelnut metrics registered.
+func NewWithRegistry(reg prometheus.Registerer) *Metrics {
+	promVersion.Version = version.Version
+	reg.MustRegister(colVersion.NewCollector("hazelnut"))
+	factory := promauto.With(reg)
+	return &Metrics{
+		CacheHits: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "hazelnut_cache_hits_total",
+			Help: "The total number of cache hits, by response status class and method",
+		}, []string{"status", "method"}),
+		CacheMisses: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "hazelnut_cache_misses_total",
+			Help: "The total number of cache misses, by response status class and method",
+		}, []string{"status", "method"}),
+		Errors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "hazelnut_errors_total",
+			Help: "The total number of errors, by reason (dial, read, write)",
+		}, []string{"reason"}),
+		FillsStarted: factory.NewCounter(prometheus.CounterOpts{
+			Name: "hazelnut_cache_fills_started_total",
+			Help: "The total number of cache fills started",
+		}),
+		FillsCompleted: factory.NewCounter(prometheus.CounterOpts{
+			Name: "hazelnut_cache_fills_completed_total",
+			Help: "The total number of cache fills that stored an object",
+		}),
+		FillsAborted: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "hazelnut_cache_fills_aborted_total",
+			Help: "The total number of cache fills aborted, by reason (backend, too_large, empty, truncated, canceled, spill)",
+		}, []string{"reason"}),
+		BackendRequests: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "hazelnut_backend_requests_total",
+			Help: "The total number of requests sent to a backend, by backend",
+		}, []string{"backend"}),
+		BackendFailures: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "hazelnut_backend_failures_total",
+			Help: "The total number of backend requests that failed and were answered with an error, by backend",
+		}, []string{"backend"}),
+		FillBytes: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "hazelnut_cache_fill_bytes",
+			Help:    "Size of completed cache fills in bytes",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10), // 1KiB .. 256MiB
+		}),
+		FillDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "hazelnut_cache_fill_duration_seconds",
+			Help:    "Time taken to read a cache fill from the backend",
+			Buckets: prometheus.DefBuckets,
+		}),
+		FillsRejected: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "hazelnut_cache_fills_rejected_total",
+			Help: "The total number of misses rejected because too many fills were in progress, by limit (global, key)",
+		}, []string{"limit"}),
+		BufferOverflows: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "hazelnut_buffer_overflows_total",
+			Help: "The total number of cacheable misses whose body was larger than the buffer limit, by action (spill, stream)",
+		}, []string{"action"}),
+		Evictions: factory.NewCounter(prometheus.CounterOpts{
+			Name: "hazelnut_cache_evictions_total",
+			Help: "The total number of objects evicted or expired from the cache",
+		}),
+		KeyCollisions: factory.NewCounter(prometheus.CounterOpts{
+			Name: "hazelnut_cache_key_collisions_total",
+			Help: "The total number of hits whose object was filled by a different request, with key integrity enabled",
+		}),
+		ResponseBytes: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "hazelnut_response_bytes_total",
+			Help: "The total number of response body bytes written to clients, by cache status (hit, miss, bypass)",
+		}, []string{"cache"}),
+		HitRatio: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "hazelnut_cache_hit_ratio",
+			Help: "The ratio of cache lookups that hit over the last stats interval",
+		}),
+		InFlight: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "hazelnut_inflight_requests",
+			Help: "The number of client requests being served",
+		}),
+		Panics: factory.NewCounter(prometheus.CounterOpts{
+			Name: "hazelnut_panics_total",
+			Help: "The total number of requests whose handler panicked",
+		}),
+		ClientDisconnects: factory.NewCounter(prometheus.CounterOpts{
+			Name: "hazelnut_client_disconnects_total",
+			Help: "The total number of responses cut short because the client went away",
+		}),
+		Maintenance: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "hazelnut_maintenance",
+			Help: "Whether maintenance mode is on (1) or off (0)",
+		}),
+	}
+}
+
+// StatusClass returns the status class label ("2xx", "3xx", ...) for a HTTP status code
+func StatusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
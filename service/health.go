@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/perbu/hazelnut/backend"
+	"github.com/perbu/hazelnut/version"
+)
+
+// readyProbeTimeout bounds the backend probes of a readiness check
+const readyProbeTimeout = 2 * time.Second
+
+// healthResponse is the body of the liveness and readiness endpoints
+type healthResponse struct {
+	Status   string                 `json:"status"`
+	Backends []backend.BackendState `json:"backends,omitempty"`
+}
+
+// healthz is the liveness endpoint, it answers 200 as long as the service is up
+func healthz(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// readyz returns the readiness endpoint: it probes the backends and answers 200 when at least
+// one of them is reachable, 503 otherwise. The body lists the state of every backend. Without a
+// router, when the service was given a Fetcher of its own, it is always ready.
+func readyz(router *backend.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if router == nil {
+			writeHealth(w, http.StatusOK, healthResponse{Status: "ready"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), readyProbeTimeout)
+		defer cancel()
+		states := router.Probe(ctx)
+		if slices.ContainsFunc(states, func(s backend.BackendState) bool { return s.Reachable }) {
+			writeHealth(w, http.StatusOK, healthResponse{Status: "ready", Backends: states})
+			return
+		}
+		writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Backends: states})
+	}
+}
+
+func writeHealth(w http.ResponseWriter, status int, v healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// buildInfo returns the build information endpoint, info is read when the service starts
+func buildInfo(info version.BuildInfo) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(info)
+	}
+}
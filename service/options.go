@@ -0,0 +1,57 @@
+package service
+
+import (
+	"github.com/perbu/hazelnut/backend"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option customizes a service created by New
+type Option func(*options)
+
+// options collects the Options given to New
+type options struct {
+	registry    *prometheus.Registry // nil means the default Prometheus registry
+	middlewares []backend.FetchMiddleware
+	cache       Cache           // nil means the cache the configuration describes
+	fetcher     backend.Fetcher // nil means the configured backends
+}
+
+// WithRegistry registers the service's metrics with reg, and serves reg on the metrics port,
+// instead of using the process wide default registry. Every service in a process needs its own
+// registry, the default one can only hold one set of Hazelnut metrics.
+func WithRegistry(reg *prometheus.Registry) Option {
+	return func(o *options) {
+		o.registry = reg
+	}
+}
+
+// WithFetchMiddleware wraps the backend fetches of the frontend in middlewares, to add
+// authentication, change requests or mock the backend in tests. The first middleware is the
+// outermost, see backend.Chain. Repeated options add to the chain. Virtual hosts are routed
+// inside it, the middlewares see every fetch whichever backend it goes to, and keep applying
+// after a reload.
+func WithFetchMiddleware(middlewares ...backend.FetchMiddleware) Option {
+	return func(o *options) {
+		o.middlewares = append(o.middlewares, middlewares...)
+	}
+}
+
+// WithCache serves from c instead of the cache the configuration describes, such as one backed
+// by Redis. cache.type, maxobj, maxcost and disk_dir then don't apply, maxcost still bounds the
+// size of the objects cached unless max_object_size is set. Evictions are counted when c has a
+// SetOnEvict(cache.EvictFunc) method, and it can be persisted when it has Range.
+func WithCache(c Cache) Option {
+	return func(o *options) {
+		o.cache = c
+	}
+}
+
+// WithFetcher fetches misses with f instead of the configured backends, which aren't created.
+// A *backend.Router becomes Server.Backend and is probed by /readyz and reloaded like the one
+// the service would create. Any other Fetcher is used as it is: Server.Backend is nil, Reload
+// leaves the backends alone and /readyz doesn't probe them. Middlewares wrap f.
+func WithFetcher(f backend.Fetcher) Option {
+	return func(o *options) {
+		o.fetcher = f
+	}
+}
@@ -1,17 +1,36 @@
 package service
 
 import (
+	"cmp"
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/perbu/hazelnut/cache"
+	"github.com/perbu/hazelnut/cache/diskcache"
 	"github.com/perbu/hazelnut/cache/lrucache"
+	"github.com/perbu/hazelnut/cache/mapcache"
+	"github.com/perbu/hazelnut/cache/persist"
+	"github.com/perbu/hazelnut/cache/surrogate"
+	"github.com/perbu/hazelnut/cache/tieredcache"
 	"io"
 	"log/slog"
+	"maps"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/perbu/hazelnut/admin"
 	"github.com/perbu/hazelnut/backend"
 	"github.com/perbu/hazelnut/config"
 	"github.com/perbu/hazelnut/frontend"
+	"github.com/perbu/hazelnut/geoip"
 	"github.com/perbu/hazelnut/metrics"
+	"github.com/perbu/hazelnut/version"
+	"github.com/perbu/hazelnut/warmup"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/sync/errgroup"
 	"net/http"
@@ -19,135 +38,636 @@ import (
 
 // Server represents a Hazelnut service instance
 type Server struct {
-	Config   *config.Config
+	Config   *config.Config // replaced by Reload, read it while no reload can run
 	Logger   *slog.Logger
 	Cache    Cache
 	Backend  *backend.Router
 	Frontend *frontend.Server
 	Metrics  *metrics.Metrics
+	Admin    *admin.Handler
+
+	persister *persist.Persister // nil unless cache.persist.dir is set
+	warmer    *warmup.Warmer     // nil unless warmup URLs or a sitemap are configured
+	accessLog io.Closer          // the access log file, nil unless logging to a file
+	geoip     io.Closer          // the GeoIP database, nil unless geoip.database is set
+	metrics   *http.Server       // serves the metrics and the admin API, nil when disabled
+	configMu  sync.RWMutex       // guards Config against Reload, for the goroutines Run starts
 }
 
 type Cache interface {
 	Get(key string) (cache.ObjCore, bool)
-	Set(key string, value cache.ObjCore)
+	Set(key string, value cache.ObjCore) error
+	SetWithTTL(key string, value cache.ObjCore, ttl time.Duration) error
+	Delete(key string) bool
+	Flush()
+	Stats() cache.Stats
+}
+
+// evictNotifier is implemented by caches that report evictions, as the built-in ones do
+type evictNotifier interface {
+	SetOnEvict(fn cache.EvictFunc)
 }
 
 // New creates a new Hazelnut service with the provided configuration
-func New(ctx context.Context, cfg *config.Config, logger *slog.Logger) (*Server, error) {
+func New(ctx context.Context, cfg *config.Config, logger *slog.Logger, opts ...Option) (*Server, error) {
 	if logger == nil {
 		logger = slog.Default()
 	}
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
 
 	logger.Info("initializing hazelnut service")
 
 	// Initialize metrics
 	logger.Info("initializing metrics")
-	m := metrics.New()
+	var m *metrics.Metrics
+	var metricsHandler http.Handler
+	if o.registry != nil {
+		m = metrics.NewWithRegistry(o.registry)
+		metricsHandler = promhttp.HandlerFor(o.registry, promhttp.HandlerOpts{})
+	} else {
+		m = metrics.New()
+		metricsHandler = promhttp.Handler()
+	}
 
 	// Initialize cache
-	maxObj := cfg.Cache.GetMaxObjects()
-	maxSize := cfg.Cache.GetMaxSize()
-	logger.Info("initializing cache", "maxObjects", maxObj, "maxSize", maxSize)
-
-	c, err := lrucache.New(maxObj, maxSize)
+	maxObj, err := cfg.Cache.GetMaxObjects()
 	if err != nil {
-		return nil, fmt.Errorf("cache.New: %w", err)
+		return nil, fmt.Errorf("cache.maxobj: %w", err)
 	}
-
-	// Initialize default backend
-	scheme, backendHost, backendPort, err := cfg.DefaultBackend.ParseTarget()
+	maxSize, err := cfg.Cache.GetMaxSize()
+	if err != nil {
+		return nil, fmt.Errorf("cache.maxcost: %w", err)
+	}
+	maxObjectSize, err := cfg.Cache.GetMaxObjectSize()
 	if err != nil {
-		return nil, fmt.Errorf("parsing default backend target: %w", err)
+		return nil, fmt.Errorf("cache.max_object_size: %w", err)
 	}
-	logger.Info("initializing default backend", "scheme", scheme, "host", backendHost, "port", backendPort)
-	defaultBackend := backend.New(logger, backendHost, backendPort)
-	defaultBackend.SetScheme(scheme)
+	bufferLimit, err := cfg.Cache.GetBufferLimit()
+	if err != nil {
+		return nil, fmt.Errorf("cache.buffer_limit: %w", err)
+	}
+	diskSize, err := cfg.Cache.GetDiskSize()
+	if err != nil {
+		return nil, fmt.Errorf("cache.disk_size: %w", err)
+	}
+	if maxObjectSize == 0 {
+		// nothing larger than the whole cache can be stored anyway
+		maxObjectSize = maxSize
+		if cfg.Cache.Type == "tiered" {
+			// objects too large for memory go to disk
+			maxObjectSize = max(maxSize, diskSize)
+		}
+	}
+	logger.Info("initializing cache", "type", cmp.Or(cfg.Cache.Type, "lru"), "maxObjects", maxObj, "maxSize", maxSize, "maxObjectSize", maxObjectSize,
+		"bufferLimit", bufferLimit)
 
-	// Create the backend router with the default backend
-	backendRouter := backend.NewRouter(logger, defaultBackend)
+	var tags *surrogate.Index
+	if cfg.Cache.SurrogateKeys {
+		tags = surrogate.New()
+	}
+	onEvict := func(key string, size int64) {
+		m.Evictions.Inc()
+		if tags != nil {
+			tags.Evicted(key)
+		}
+		logger.Debug("cache eviction", "key", fmt.Sprintf("%x", key), "size", size)
+	}
+	var c Cache
+	if o.cache != nil {
+		logger.Info("using the cache given to New", "type", fmt.Sprintf("%T", o.cache))
+		if n, ok := o.cache.(evictNotifier); ok {
+			n.SetOnEvict(onEvict)
+		}
+		c = o.cache
+	} else if cfg.Cache.Type == "tiered" {
+		logger.Info("keeping the long tail of the cache on disk", "dir", cfg.Cache.DiskDir, "diskSize", diskSize,
+			"demote", cfg.Cache.Demote)
+		lc, err := lrucache.New(maxObj, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("cache.New: %w", err)
+		}
+		dc, err := diskcache.New(cfg.Cache.DiskDir, diskSize)
+		if err != nil {
+			return nil, fmt.Errorf("diskcache.New: %w", err)
+		}
+		tc := tieredcache.New(lc, dc, cfg.Cache.Demote)
+		tc.SetOnEvict(onEvict)
+		c = tc
+	} else if cfg.Cache.DiskDir != "" {
+		logger.Info("keeping cached bodies on disk", "dir", cfg.Cache.DiskDir)
+		dc, err := diskcache.New(cfg.Cache.DiskDir, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("diskcache.New: %w", err)
+		}
+		dc.SetOnEvict(onEvict)
+		c = dc
+	} else if cfg.Cache.Type == "map" {
+		logger.Info("using the map cache, bounded by maxcost only", "maxSize", maxSize)
+		mc := mapcache.New()
+		mc.SetMaxSize(maxSize)
+		mc.SetOnEvict(onEvict)
+		c = mc
+	} else {
+		lc, err := lrucache.New(maxObj, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("cache.New: %w", err)
+		}
+		lc.SetOnEvict(onEvict)
+		c = lc
+	}
 
-	// Add virtual host backends if configured
-	for host, backendCfg := range cfg.VirtualHosts {
-		scheme, vHost, vPort, err := backendCfg.ParseTarget()
+	var persister *persist.Persister
+	// the disk cache can't be persisted, validation rejects persisting it
+	if pc, ok := c.(persist.Cache); ok && cfg.Cache.Persist.Dir != "" {
+		persister = persist.New(logger, pc, cfg.Cache.Persist.Dir, cfg.Cache.Persist.Interval)
+		// A damaged snapshot only costs us a warm start, it doesn't prevent startup
+		n, err := persister.Restore()
 		if err != nil {
-			return nil, fmt.Errorf("parsing virtual host backend target: %w", err)
+			logger.Warn("cache snapshot could not be fully restored", "dir", cfg.Cache.Persist.Dir, "error", err)
 		}
-		logger.Info("initializing virtual host backend",
-			"virtualHost", host,
-			"target", vHost,
-			"port", vPort,
-			"scheme", scheme)
+		logger.Info("cache restored from snapshot", "dir", cfg.Cache.Persist.Dir, "objects", n)
+	}
+	// bans iterate over the cache itself, the surrogate index doesn't offer that
+	ranger, _ := c.(admin.Ranger)
+	if tags != nil {
+		// objects restored from the snapshot keep their surrogate keys
+		if pc, ok := c.(persist.Cache); ok {
+			pc.Range(func(key string, value cache.ObjCore, _ time.Time) bool {
+				tags.Track(key, value)
+				return true
+			})
+		}
+		tags.Cache = c
+		c = tags
+		if fc, ok := tags.Cache.(surrogate.FileCache); ok {
+			// bodies too large to buffer are still stored from files
+			c = &surrogate.FileIndex{Index: tags, Files: fc}
+		}
+	}
 
-		vBackend := backend.New(logger, vHost, vPort)
-		vBackend.SetScheme(scheme)
-		backendRouter.AddBackend(host, vBackend)
+	fetcher := o.fetcher
+	backendRouter, _ := fetcher.(*backend.Router)
+	if fetcher == nil {
+		// Initialize the default and virtual host backends
+		defaultBackend, vhostBackends, err := newBackends(logger, cfg, m)
+		if err != nil {
+			return nil, err
+		}
+
+		// Create the backend router with the default backend
+		backendRouter = backend.NewRouter(logger, defaultBackend)
+
+		// Add virtual host backends if configured
+		for host, vBackend := range vhostBackends {
+			backendRouter.AddBackend(host, vBackend)
+		}
+		fetcher = backendRouter
+	} else {
+		logger.Info("using the fetcher given to New, the configured backends aren't created", "type", fmt.Sprintf("%T", fetcher))
 	}
 
 	// Initialize frontend
-	listenAddr := cfg.Frontend.GetListenAddr()
-	logger.Info("initializing frontend", "listenAddr", listenAddr, "ignoreHost", cfg.Cache.IgnoreHost)
-	f := frontend.New(logger, c, backendRouter, listenAddr, m, cfg.Cache.IgnoreHost)
+	listenAddrs := cfg.Frontend.GetListenAddrs()
+	logger.Info("initializing frontend", "listenAddrs", listenAddrs, "ignoreHost", cfg.Cache.GetIgnoreHost())
+	f := frontend.New(logger, c, backend.Chain(fetcher, o.middlewares...), listenAddrs[0], m, cfg.Cache.GetIgnoreHost())
+	f.SetListenAddrs(listenAddrs)
+	if len(cfg.Cache.Methods) > 0 {
+		policies := make(map[string]frontend.MethodPolicy, len(cfg.Cache.Methods))
+		for method, mc := range cfg.Cache.Methods {
+			policies[method] = frontend.MethodPolicy{Cache: mc.Cache, TTL: mc.TTL}
+		}
+		f.SetMethodPolicies(policies)
+	}
+	if cfg.Cache.GetIgnoreHost() && cfg.Cache.HostConflict == "backend" && backendRouter != nil {
+		// set even without virtual hosts, they may be added by a reload
+		logger.Info("cache keys include the routed backend")
+		f.SetKeyBackend(func(host string) string { return backendRouter.GetBackend(host).Name() })
+	} else if cfg.Cache.GetIgnoreHost() && len(cfg.VirtualHosts) > 0 {
+		logger.Warn("cache.ignorehost is set with virtual hosts, hosts routed to different backends share cache keys",
+			"virtualHosts", len(cfg.VirtualHosts))
+	}
+	f.SetVaryCookies(cfg.Cache.VaryCookies)
+	f.SetMaxObjectSize(maxObjectSize)
+	f.SetBufferLimit(bufferLimit)
+	f.SetNegativeCaching(cfg.Cache.NegativeTTL, cfg.Cache.Negative5xx)
+	f.SetMinFetchLatency(cfg.Cache.MinFetchLatency)
+	f.SetDeadlineHeader(cfg.Frontend.DeadlineHeader)
+	if backendRouter != nil {
+		f.SetDeadlineBudget(func(host string) time.Duration { return backendRouter.GetBackend(host).Budget() })
+	}
+	f.SetVia(cfg.Frontend.Via)
+	f.SetForwardedHeaders(cfg.Frontend.GetForwarded())
+	proxies, err := cfg.Frontend.GetTrustedProxies()
+	if err != nil {
+		return nil, fmt.Errorf("frontend.trusted_proxies: %w", err)
+	}
+	f.SetTrustedProxies(proxies)
+	f.SetGzip(cfg.Frontend.GetGzip())
+	f.SetServerOptions(cfg.Frontend.OptionsAllow)
+	f.SetMalformedResponse(cfg.Frontend.Malformed.Status, cfg.Frontend.Malformed.Body)
+	if ep := cfg.Frontend.ErrorPage; ep != (config.ErrorPageConfig{}) {
+		body := []byte(ep.Body)
+		if ep.File != "" {
+			if body, err = os.ReadFile(ep.File); err != nil {
+				return nil, fmt.Errorf("frontend.error_page.file: %w", err)
+			}
+		}
+		f.SetErrorPage(ep.Status, ep.ContentType, body)
+	}
+	mc := cfg.Frontend.Maintenance
+	page := frontend.MaintenancePage{ContentType: mc.ContentType, Body: []byte(mc.Body), RetryAfter: mc.RetryAfter, ServeHits: mc.ServeHits}
+	if mc.File != "" {
+		if page.Body, err = os.ReadFile(mc.File); err != nil {
+			return nil, fmt.Errorf("frontend.maintenance.file: %w", err)
+		}
+	}
+	f.SetMaintenancePage(page)
+	f.SetMaintenance(mc.Enabled)
+	f.SetTimeouts(frontend.Timeouts(cfg.Frontend.Timeouts))
+	f.SetH2C(cfg.Frontend.H2C)
+	f.SetStripHeaders(cfg.Frontend.StripHeaders.Headers, cfg.Frontend.StripHeaders.Replace)
+	f.SetStripSetCookie(cfg.Frontend.StripHeaders.SetCookie)
+	storeRules, err := headerRules(cfg.Frontend.HeaderRules.Store)
+	if err != nil {
+		return nil, fmt.Errorf("frontend.header_rules.store: %w", err)
+	}
+	clientRules, err := headerRules(cfg.Frontend.HeaderRules.Client)
+	if err != nil {
+		return nil, fmt.Errorf("frontend.header_rules.client: %w", err)
+	}
+	f.SetHeaderRules(storeRules, clientRules)
+	bypass := make([]frontend.BypassRule, len(cfg.Cache.Bypass))
+	for i, rule := range cfg.Cache.Bypass {
+		bypass[i] = frontend.BypassRule{PathPrefix: rule.PathPrefix, Header: rule.Header, Cookie: rule.Cookie}
+		if rule.Path != "" {
+			if bypass[i].Path, err = regexp.Compile(rule.Path); err != nil {
+				return nil, fmt.Errorf("cache.bypass[%d].path: %w", i, err)
+			}
+		}
+	}
+	f.SetBypassRules(bypass)
+	ttlRules := make([]frontend.TTLRule, len(cfg.Cache.TTLRules))
+	for i, rule := range cfg.Cache.TTLRules {
+		ttlRules[i] = frontend.TTLRule{PathPrefix: rule.PathPrefix, TTL: rule.TTL, Force: rule.Force}
+		if rule.Path != "" {
+			if ttlRules[i].Path, err = regexp.Compile(rule.Path); err != nil {
+				return nil, fmt.Errorf("cache.ttl_rules[%d].path: %w", i, err)
+			}
+		}
+	}
+	f.SetTTLRules(ttlRules)
+	f.SetFillEvents(cfg.Cache.FillEvents)
+	f.SetFillLimits(cfg.Cache.MaxFills, cfg.Cache.MaxFillsPerKey)
+	f.SetKeyIntegrity(cfg.Cache.KeyIntegrity)
+	f.SetKeyProtocol(cfg.Cache.KeyProtocol)
+	f.SetLogKeys(cfg.Cache.LogKeys)
+	f.SetHitsHeader(cfg.Cache.HitsHeader)
+	f.SetTTLJitter(cfg.Cache.TTLJitter)
+	f.SetIgnoreClientDirectives(cfg.Cache.IgnoreClientCC)
+	f.SetCacheAuthorized(cfg.Cache.CacheAuthorized)
+	f.SetESI(cfg.Cache.ESI)
+	f.SetStoreRetries(cfg.Cache.StoreRetries, cfg.Cache.StoreBackoff)
+	f.SetRangeFill(cfg.Cache.RangeFill)
+	f.SetDefaultContentType(cfg.Cache.ContentType)
+	f.SetBodyDump(cfg.Logging.DumpBodies, cfg.Logging.RedactHeaders)
+	var accessLog io.Closer
+	switch cfg.Logging.AccessLog {
+	case "":
+	case "stdout":
+		f.SetAccessLog(os.Stdout, cfg.Logging.AccessFormat)
+	default:
+		file, err := os.OpenFile(cfg.Logging.AccessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("logging.access_log: %w", err)
+		}
+		f.SetAccessLog(file, cfg.Logging.AccessFormat)
+		accessLog = file
+	}
+	f.SetKeyPolicy(cache.KeyPolicy{
+		IgnoreHost:   cfg.Cache.GetIgnoreHost(),
+		IgnorePath:   !cfg.Cache.Key.GetPath(),
+		IgnoreMethod: !cfg.Cache.Key.GetMethod(),
+		Query: cache.QueryPolicy{
+			Mode:   cfg.Cache.Query.Mode,
+			Params: cfg.Cache.Query.Params,
+			Ignore: cfg.Cache.Query.Ignore,
+		},
+		Headers: cfg.Cache.Key.Headers,
+	})
+	f.SetKeyCookies(cfg.Cache.Key.Cookies)
+	f.SetPathPolicy(cache.PathPolicy{
+		Lowercase: cfg.Cache.Path.Lowercase,
+		Clean:     cfg.Cache.Path.Clean,
+	}, cfg.Cache.Path.Forward)
+	var geoipDB io.Closer
+	if cfg.GeoIP.Database != "" {
+		// A missing or broken database only disables GeoIP, it doesn't prevent startup
+		db, err := geoip.Open(cfg.GeoIP.Database)
+		if err != nil {
+			logger.Warn("GeoIP disabled, database could not be opened", "error", err)
+		} else {
+			logger.Info("GeoIP enabled", "database", cfg.GeoIP.Database)
+			f.SetGeoIP(db, cfg.GeoIP.Header)
+			geoipDB = db
+		}
+	}
+
+	if cfg.Devices.Enabled {
+		rules := frontend.DefaultDeviceRules()
+		if len(cfg.Devices.Rules) > 0 {
+			rules = make([]frontend.DeviceRule, len(cfg.Devices.Rules))
+			for i, rule := range cfg.Devices.Rules {
+				pattern, err := regexp.Compile(rule.Pattern)
+				if err != nil {
+					return nil, fmt.Errorf("devices.rules[%d].pattern: %w", i, err)
+				}
+				rules[i] = frontend.DeviceRule{Class: rule.Class, Pattern: pattern}
+			}
+		}
+		logger.Info("device classification enabled", "rules", len(rules))
+		f.SetDeviceClasses(rules, cfg.Devices.Header)
+	}
+
+	allow, err := cfg.Admin.GetAllow()
+	if err != nil {
+		return nil, fmt.Errorf("admin.allow: %w", err)
+	}
+	adminHandler := admin.New(logger, c, f.CacheKey, allow)
+	adminHandler.SetTrustedProxies(proxies)
+	adminHandler.SetMaintainer(f)
+	if tags != nil {
+		adminHandler.SetPurger(tags)
+	}
+	if ranger != nil {
+		adminHandler.SetRanger(ranger)
+	}
 
-	// Create metrics HTTP service with a separate mux
+	// Create metrics HTTP service with a separate mux, it serves the admin API, health checks
+	// and build information as well
 	metricsAddr := ":9091" // Default metrics port
 	if cfg.Frontend.MetricsPort != 0 {
 		metricsAddr = fmt.Sprintf(":%d", cfg.Frontend.MetricsPort)
 	}
 
-	// Skip starting metrics service in test environment
+	// Skip the metrics service in test environment. It is started by Run and stopped after
+	// the frontend has drained, so the final metrics can still be scraped.
+	var metricsServer *http.Server
 	if metricsAddr != ":0" {
+		// the probes stay open, everything else requires the admin credentials when they are set
+		creds := admin.Credentials{Username: cfg.Admin.Username, Password: cfg.Admin.Password, Token: cfg.Admin.Token}
 		metricsMux := http.NewServeMux()
-		metricsMux.Handle("/metrics", promhttp.Handler())
+		metricsMux.Handle("/metrics", admin.RequireAuth(logger, metricsHandler, creds))
+		metricsMux.Handle("/cache/", admin.RequireAuth(logger, adminHandler, creds))
+		metricsMux.Handle("/maintenance", admin.RequireAuth(logger, adminHandler, creds))
+		metricsMux.HandleFunc("/healthz", healthz)
+		metricsMux.HandleFunc("/readyz", readyz(backendRouter))
+		metricsMux.Handle("/buildinfo", admin.RequireAuth(logger, buildInfo(version.Info()), creds))
 
-		metricsServer := &http.Server{
+		metricsServer = &http.Server{
 			Addr:    metricsAddr,
 			Handler: metricsMux,
 		}
+	}
+	f.SetDrainTimeout(cfg.Shutdown.DrainTimeout)
 
-		go func() {
-			logger.Info("starting metrics service", "addr", metricsAddr)
-			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				logger.Error("metrics service failed", "error", err)
-			}
-		}()
-
-		// Ensure metrics service shuts down when context is done
-		go func() {
-			<-ctx.Done()
-			logger.Info("shutting down metrics service")
-			_ = metricsServer.Shutdown(context.Background())
-		}()
+	var warmer *warmup.Warmer
+	if len(cfg.Warmup.URLs) > 0 || cfg.Warmup.Sitemap != "" {
+		warmer = warmup.New(logger, f, cfg.Warmup.Concurrency)
 	}
 
-	return &Server{
+	srv := &Server{
 		Config:   cfg,
 		Logger:   logger,
 		Cache:    c,
 		Backend:  backendRouter,
 		Frontend: f,
 		Metrics:  m,
-	}, nil
+		Admin:    adminHandler,
+
+		persister: persister,
+		warmer:    warmer,
+		accessLog: accessLog,
+		geoip:     geoipDB,
+		metrics:   metricsServer,
+	}
+	// sampled until ctx is done, whether or not Run is called
+	go srv.reportStats(ctx, cmp.Or(cfg.Cache.StatsInterval, DefaultStatsInterval), cfg.Cache.LogStats)
+	return srv, nil
 }
 
-// GetActualPort returns the actual port the service is listening on
-func (s *Server) GetActualPort() int {
-	return s.Frontend.ActualPort()
+// newBackends creates the default backend and one backend per configured virtual host. Every
+// backend is checked before it returns, the errors of all the broken ones are joined.
+func newBackends(logger *slog.Logger, cfg *config.Config, m *metrics.Metrics) (*backend.Client, map[string]*backend.Client, error) {
+	var errs []error
+	var defaultBackend *backend.Client
+	scheme, backendHost, backendPort, err := cfg.DefaultBackend.ParseTarget()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("parsing default backend target: %w", err))
+	} else {
+		logger.Info("initializing default backend", "scheme", scheme, "host", backendHost, "port", backendPort)
+		defaultBackend, err = newBackend(logger, cfg.DefaultBackend, m, scheme, backendHost, backendPort)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("default backend: %w", err))
+		}
+	}
+
+	vhostBackends := make(map[string]*backend.Client, len(cfg.VirtualHosts))
+	for _, host := range slices.Sorted(maps.Keys(cfg.VirtualHosts)) {
+		backendCfg := cfg.VirtualHosts[host]
+		scheme, vHost, vPort, err := backendCfg.ParseTarget()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("parsing virtual host %s backend target: %w", host, err))
+			continue
+		}
+		logger.Info("initializing virtual host backend",
+			"virtualHost", host,
+			"target", vHost,
+			"port", vPort,
+			"scheme", scheme)
+
+		b, err := newBackend(logger, backendCfg, m, scheme, vHost, vPort)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("virtual host %s backend: %w", host, err))
+			continue
+		}
+		vhostBackends[host] = b
+	}
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+	logger.Info("backends configured", "default", defaultBackend.Name(), "virtualHosts", len(vhostBackends))
+	return defaultBackend, vhostBackends, nil
 }
 
-// Run starts the Hazelnut service and blocks until the context is canceled
+// headerRules converts configured header rules, compiling their patterns
+func headerRules(cfg []config.HeaderRuleConfig) ([]frontend.HeaderRule, error) {
+	rules := make([]frontend.HeaderRule, len(cfg))
+	for i, rule := range cfg {
+		rules[i] = frontend.HeaderRule{Action: rule.Action, Name: rule.Name, Value: rule.Value}
+		if rule.Match != "" {
+			pattern, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("[%d].match: %w", i, err)
+			}
+			rules[i].Pattern = pattern
+		}
+	}
+	return rules, nil
+}
+
+// newBackend creates a backend client for a parsed target and applies the per-backend settings
+func newBackend(logger *slog.Logger, cfg config.BackendConfig, m *metrics.Metrics, scheme, host string, port int) (*backend.Client, error) {
+	maxResponseBytes, err := cfg.GetMaxResponseBytes()
+	if err != nil {
+		return nil, fmt.Errorf("max_response_bytes: %w", err)
+	}
+	var rootCAs *x509.CertPool
+	if cfg.CAFile != "" {
+		rootCAs, err = backend.LoadCAFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %w", err)
+		}
+	}
+	b := backend.New(logger, host, port)
+	b.SetScheme(scheme)
+	b.SetTLS(cfg.InsecureSkipTLS, rootCAs)
+	b.SetServerName(cfg.ServerName)
+	b.SetMaxResponseBytes(maxResponseBytes, cfg.OversizePolicy)
+	b.SetCacheSetCookie(cfg.CacheSetCookie)
+	b.SetCacheableStatus(cfg.CacheableStatus)
+	b.SetHTTP2(cfg.GetHTTP2())
+	b.SetConnectionPool(cfg.MaxIdleConns, cfg.MaxIdlePerHost, cfg.IdleConnTimeout)
+	b.SetTimeouts(cfg.DialTimeout, cfg.ResponseTimeout, cfg.Timeout)
+	b.SetMetrics(m)
+	b.SetRequestHeaders(cfg.RequestHeaders)
+	return b, nil
+}
+
+// Reload applies a new configuration to the running service.
+// The backends and virtual hosts are swapped live. All backends are built before anything is
+// swapped, so an invalid configuration leaves the running one untouched. Settings that require
+// a listener restart (listen address, metrics port, TLS) or a new cache are not applied; a
+// warning is logged when they differ. The backends aren't reloaded either when New was given a
+// Fetcher other than a Router. The log level is owned by the caller's handler.
+func (s *Server) Reload(cfg *config.Config) error {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	var defaultBackend *backend.Client
+	var vhostBackends map[string]*backend.Client
+	if s.Backend != nil {
+		var err error
+		defaultBackend, vhostBackends, err = newBackends(s.Logger, cfg, s.Metrics)
+		if err != nil {
+			return fmt.Errorf("reload: %w", err)
+		}
+	}
+	if !reflect.DeepEqual(cfg.Frontend, s.Config.Frontend) {
+		s.Logger.Warn("frontend settings changed, restart required for them to take effect")
+	}
+	if !reflect.DeepEqual(cfg.Cache, s.Config.Cache) {
+		s.Logger.Warn("cache settings changed, restart required for them to take effect")
+	}
+	if !reflect.DeepEqual(cfg.Admin, s.Config.Admin) {
+		s.Logger.Warn("admin settings changed, restart required for them to take effect")
+	}
+	if s.Backend != nil {
+		s.Backend.Replace(defaultBackend, vhostBackends)
+	} else if !reflect.DeepEqual(cfg.DefaultBackend, s.Config.DefaultBackend) || !reflect.DeepEqual(cfg.VirtualHosts, s.Config.VirtualHosts) {
+		s.Logger.Warn("backend settings changed, they don't apply to the fetcher given to New")
+	}
+	s.Config = cfg
+	s.Logger.Info("configuration reloaded", "virtualHosts", len(vhostBackends))
+	return nil
+}
+
+// config returns the configuration in effect, it may be replaced by Reload at any time
+func (s *Server) config() *config.Config {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.Config
+}
+
+// warmup requests the configured URLs and the URLs in the sitemap
+func (s *Server) warmup(ctx context.Context) {
+	t0 := time.Now()
+	cfg := s.config().Warmup
+	urls := cfg.URLs
+	if cfg.Sitemap != "" {
+		fromSitemap, err := s.warmer.Sitemap(ctx, cfg.Sitemap)
+		if err != nil {
+			s.Logger.Warn("warmup sitemap could not be loaded", "sitemap", cfg.Sitemap, "error", err)
+		}
+		urls = append(slices.Clip(urls), fromSitemap...)
+	}
+	warmed := s.warmer.Warm(ctx, urls)
+	s.Logger.Info("cache warmup done", "urls", len(urls), "warmed", warmed, "duration", time.Since(t0))
+}
+
+// GetActualPorts returns the ports the service is listening on, once it runs
+func (s *Server) GetActualPorts() []int {
+	return s.Frontend.ActualPorts()
+}
+
+// Run starts the Hazelnut service and blocks until the context is canceled. Shutdown is ordered:
+// the frontend drains first, then the metrics service stays up for the final scrape window.
 func (s *Server) Run(ctx context.Context) error {
-	eg := new(errgroup.Group)
+	if s.metrics != nil {
+		go func() {
+			s.Logger.Info("starting metrics service", "addr", s.metrics.Addr)
+			if err := s.metrics.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				s.Logger.Error("metrics service failed", "error", err)
+			}
+		}()
+		defer s.stopMetrics()
+	}
+	eg, egCtx := errgroup.WithContext(ctx)
 	eg.Go(func() error {
 		return s.Frontend.Run(ctx)
 	})
+	if s.warmer != nil {
+		// warming goes through the frontend handler directly, it doesn't wait for the listener
+		go s.warmup(egCtx)
+	}
+	if s.persister != nil {
+		// egCtx is done when the frontend fails as well, the last snapshot is saved either way
+		eg.Go(func() error {
+			return s.persister.Run(egCtx)
+		})
+	}
 
 	// Wait for the context to be done
-	if err := eg.Wait(); err != nil {
+	err := eg.Wait()
+	if s.accessLog != nil {
+		_ = s.accessLog.Close()
+	}
+	if s.geoip != nil {
+		_ = s.geoip.Close()
+	}
+	if err != nil {
 		return fmt.Errorf("frontend.Run: %w", err)
 	}
 	return nil
 }
 
+// stopMetrics stops the metrics service once the final scrape window has passed
+func (s *Server) stopMetrics() {
+	shutdown := s.config().Shutdown
+	if d := shutdown.FinalScrape; d > 0 {
+		s.Logger.Info("waiting for a final metrics scrape", "delay", d)
+		time.Sleep(d)
+	}
+	s.Logger.Info("shutting down metrics service")
+	ctx, cancel := context.WithTimeout(context.Background(), cmp.Or(shutdown.DrainTimeout, frontend.DefaultDrainTimeout))
+	defer cancel()
+	if err := s.metrics.Shutdown(ctx); err != nil {
+		s.Logger.Warn("metrics service drain timed out, closing connections", "error", err)
+		_ = s.metrics.Close()
+	}
+}
+
 // LoadAndRun loads a configuration file and runs a Hazelnut service
 // This is a convenience function for applications that want to run Hazelnut
 // with minimal code
@@ -1,18 +1,34 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/perbu/hazelnut/backend"
+	"github.com/perbu/hazelnut/cache"
+	"github.com/perbu/hazelnut/cache/lrucache"
+	"github.com/perbu/hazelnut/cache/mapcache"
+	"github.com/perbu/hazelnut/cache/tieredcache"
 	"github.com/perbu/hazelnut/config"
+	"github.com/perbu/hazelnut/metrics"
+	"github.com/perbu/hazelnut/version"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestServer(t *testing.T) {
@@ -128,7 +144,1059 @@ func TestServerConfig(t *testing.T) {
 		t.Errorf("Expected backend scheme to be https, got %s", srv.Backend.GetScheme())
 	}
 
-	if srv.Frontend.ActualPort() != 0 {
-		t.Errorf("Expected frontend port to be 0 (random), got %d", srv.Frontend.ActualPort())
+	if ports := srv.Frontend.ActualPorts(); len(ports) != 0 {
+		t.Errorf("Expected no frontend ports before Run, got %v", ports)
+	}
+	if _, ok := srv.Cache.(*lrucache.LRUCache); !ok {
+		t.Errorf("Expected the bounded lru cache by default, got %T", srv.Cache)
+	}
+
+	cfg.Cache.Type = "map"
+	srv, err = New(ctx, cfg, logger, WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Failed to create service with a map cache: %v", err)
+	}
+	if _, ok := srv.Cache.(*mapcache.MAPCache); !ok {
+		t.Errorf("Expected the map cache, got %T", srv.Cache)
+	}
+
+	cfg.Cache.Type, cfg.Cache.DiskDir = "tiered", t.TempDir()
+	srv, err = New(ctx, cfg, logger, WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Failed to create service with a tiered cache: %v", err)
+	}
+	if _, ok := srv.Cache.(*tieredcache.TieredCache); !ok {
+		t.Errorf("Expected the tiered cache, got %T", srv.Cache)
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := &config.Config{
+		DefaultBackend: config.BackendConfig{Target: "http://localhost:8000"},
+		Frontend:       config.FrontendConfig{BaseURL: "http://localhost:0", MetricsPort: 9091},
+		Cache:          config.CacheConfig{MaxObj: "100", MaxCost: "1M"},
+		Admin:          config.AdminConfig{Token: "t0ken"},
+	}
+	srv, err := New(t.Context(), cfg, logger, WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	get := func(path, token string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		srv.metrics.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for _, path := range []string{"/metrics", "/cache/stats", "/buildinfo"} {
+		if status := get(path, ""); status != http.StatusUnauthorized {
+			t.Errorf("Expected %s to require the token, got %d", path, status)
+		}
+		if status := get(path, "t0ken"); status != http.StatusOK {
+			t.Errorf("Expected %s to accept the token, got %d", path, status)
+		}
+	}
+	if status := get("/healthz", ""); status != http.StatusOK {
+		t.Errorf("Expected the health check to stay open, got %d", status)
+	}
+}
+
+func TestBackendErrors(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := &config.Config{
+		DefaultBackend: config.BackendConfig{Target: "http://localhost:8000"},
+		VirtualHosts: map[string]config.BackendConfig{
+			"a.example.com": {Target: "ftp://a.example.com"},
+			"b.example.com": {Target: "http://b.example.com"},
+			"c.example.com": {Target: "http://c.example.com", CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		},
+		Frontend: config.FrontendConfig{BaseURL: "http://localhost:0"},
+		Cache:    config.CacheConfig{MaxObj: "100", MaxCost: "1M"},
+	}
+	_, err := New(t.Context(), cfg, logger, WithRegistry(prometheus.NewRegistry()))
+	if err == nil {
+		t.Fatal("Expected the broken virtual hosts to fail startup")
+	}
+	for _, want := range []string{"a.example.com", "c.example.com"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected the error to name %s, got %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "b.example.com") {
+		t.Errorf("Expected the good virtual host not to be reported, got %v", err)
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	newOrigin := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-store")
+			fmt.Fprint(w, name)
+		}))
+	}
+	originA := newOrigin("origin-a")
+	defer originA.Close()
+	originB := newOrigin("origin-b")
+	defer originB.Close()
+
+	newConfig := func(target string) *config.Config {
+		return &config.Config{
+			DefaultBackend: config.BackendConfig{Target: target},
+			Frontend: config.FrontendConfig{
+				BaseURL: "http://localhost:0",
+			},
+			Cache: config.CacheConfig{
+				MaxObj:  "100",
+				MaxCost: "1M",
+			},
+		}
+	}
+
+	srv, err := New(t.Context(), newConfig(originA.URL), logger)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	ts := httptest.NewServer(srv.Frontend)
+	defer ts.Close()
+
+	get := func() string {
+		resp, err := http.Get(ts.URL + "/")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if got := get(); got != "origin-a" {
+		t.Fatalf("Expected origin-a before reload, got %q", got)
+	}
+
+	if err := srv.Reload(newConfig(originB.URL)); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if got := get(); got != "origin-b" {
+		t.Errorf("Expected origin-b after reload, got %q", got)
+	}
+
+	// An invalid config is rejected and the running one is kept
+	if err := srv.Reload(newConfig("http://%zz")); err == nil {
+		t.Errorf("Expected reload with an invalid target to fail")
+	}
+	if got := get(); got != "origin-b" {
+		t.Errorf("Expected origin-b after failed reload, got %q", got)
+	}
+}
+
+func TestReloadWhileRunning(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer originServer.Close()
+
+	newConfig := func() *config.Config {
+		return &config.Config{
+			DefaultBackend: config.BackendConfig{Target: originServer.URL},
+			Frontend: config.FrontendConfig{
+				BaseURL:     fmt.Sprintf("http://localhost:%d", freePort(t)),
+				MetricsPort: freePort(t),
+			},
+			Cache:    config.CacheConfig{MaxObj: "100", MaxCost: "1M"},
+			Warmup:   config.WarmupConfig{URLs: []string{originServer.URL + "/a", originServer.URL + "/b"}},
+			Shutdown: config.ShutdownConfig{FinalScrape: time.Millisecond},
+		}
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	srv, err := New(ctx, newConfig(), logger, WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+
+	// warmup and shutdown read the config while SIGHUPs replace it, go test -race checks them
+	for range 20 {
+		if err := srv.Reload(newConfig()); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the context was canceled")
+	}
+}
+
+func TestEvictionCounter(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	// both caches evict once the bodies outgrow maxcost, the map cache at random
+	for _, cacheType := range []string{"lru", "map"} {
+		t.Run(cacheType, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: config.BackendConfig{
+					Target:  "http://example.com",
+					Timeout: 30 * time.Second,
+				},
+				Frontend: config.FrontendConfig{
+					BaseURL: "http://localhost:0",
+				},
+				Cache: config.CacheConfig{
+					Type:    cacheType,
+					MaxObj:  "10",
+					MaxCost: "1K",
+				},
+			}
+			srv, err := New(t.Context(), cfg, logger, WithRegistry(prometheus.NewRegistry()))
+			if err != nil {
+				t.Fatalf("Failed to create service: %v", err)
+			}
+
+			body := []byte(strings.Repeat("x", 200))
+			for i := range 20 {
+				srv.Cache.Set(fmt.Sprintf("key-%d", i), cache.ObjCore{Headers: make(http.Header), Body: body})
+				// ristretto applies sets asynchronously, give it a moment
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for testutil.ToFloat64(srv.Metrics.Evictions) == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("Expected hazelnut_cache_evictions_total to increase")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// freePort returns a TCP port that was free a moment ago
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestShutdownOrder(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	inFlight := make(chan struct{})
+	release := make(chan struct{})
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(inFlight)
+		<-release
+		fmt.Fprint(w, "slow")
+	}))
+	defer originServer.Close()
+
+	frontendPort, metricsPort := freePort(t), freePort(t)
+	cfg := &config.Config{
+		DefaultBackend: config.BackendConfig{
+			Target: originServer.URL,
+		},
+		Frontend: config.FrontendConfig{
+			BaseURL:     fmt.Sprintf("http://localhost:%d", frontendPort),
+			MetricsPort: metricsPort,
+		},
+		Cache: config.CacheConfig{
+			MaxObj:  "100",
+			MaxCost: "1M",
+		},
+		Shutdown: config.ShutdownConfig{
+			FinalScrape: 300 * time.Millisecond,
+		},
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	srv, err := New(ctx, cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+
+	metricsURL := fmt.Sprintf("http://localhost:%d/metrics", metricsPort)
+	scrape := func() error {
+		resp, err := http.Get(metricsURL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("scrape: %s", resp.Status)
+		}
+		return nil
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for scrape() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Metrics service didn't come up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d/slow", frontendPort))
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		slow <- err
+	}()
+	<-inFlight
+	cancel()
+
+	time.Sleep(50 * time.Millisecond) // the frontend is draining now
+	if err := scrape(); err != nil {
+		t.Errorf("Expected metrics to be scrapeable while the frontend drains: %v", err)
+	}
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("Expected the request in flight to finish: %v", err)
+	}
+	if err := scrape(); err != nil {
+		t.Errorf("Expected metrics to be scrapeable in the final scrape window: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Run failed: %v", err)
+	}
+	if err := scrape(); err == nil {
+		t.Error("Expected the metrics service to be stopped after Run")
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be written by the server and read by the test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDrainTimeout(t *testing.T) {
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	inFlight := make(chan struct{})
+	release := make(chan struct{})
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(inFlight)
+		<-release
+	}))
+	defer originServer.Close()
+	defer close(release)
+
+	frontendPort := freePort(t)
+	cfg := &config.Config{
+		DefaultBackend: config.BackendConfig{
+			Target: originServer.URL,
+		},
+		Frontend: config.FrontendConfig{
+			BaseURL: fmt.Sprintf("http://localhost:%d", frontendPort),
+		},
+		Cache: config.CacheConfig{
+			MaxObj:  "100",
+			MaxCost: "1M",
+		},
+		Shutdown: config.ShutdownConfig{
+			DrainTimeout: 100 * time.Millisecond,
+		},
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	srv, err := New(ctx, cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+
+	go func() {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			resp, err := http.Get(fmt.Sprintf("http://localhost:%d/stuck", frontendPort))
+			if err == nil {
+				resp.Body.Close()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	<-inFlight
+	t0 := time.Now()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Run to return once the drain timed out")
+	}
+	if d := time.Since(t0); d < 100*time.Millisecond {
+		t.Errorf("Expected the request in flight to get the drain timeout, Run returned after %v", d)
+	}
+	if !strings.Contains(logs.String(), "in_flight=1") {
+		t.Errorf("Expected the drain timeout to log the requests in flight, got:\n%s", logs.String())
+	}
+}
+
+func TestHealth(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer originServer.Close()
+	hostParts := strings.Split(strings.TrimPrefix(originServer.URL, "http://"), ":")
+	port, _ := strconv.Atoi(hostParts[1])
+	up := backend.New(logger, hostParts[0], port)
+	down := backend.New(logger, "127.0.0.1", freePort(t))
+
+	rec := httptest.NewRecorder()
+	healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected liveness to be 200, got %d", rec.Code)
+	}
+
+	tests := []struct {
+		name      string
+		router    func() *backend.Router
+		status    int
+		reachable []bool
+	}{
+		{"Default backend up", func() *backend.Router {
+			r := backend.NewRouter(logger, up)
+			r.AddBackend("down.example.com", down)
+			return r
+		}, http.StatusOK, []bool{true, false}},
+		{"Virtual host up", func() *backend.Router {
+			r := backend.NewRouter(logger, down)
+			r.AddBackend("up.example.com", up)
+			return r
+		}, http.StatusOK, []bool{false, true}},
+		{"All down", func() *backend.Router {
+			return backend.NewRouter(logger, down)
+		}, http.StatusServiceUnavailable, []bool{false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			readyz(tt.router())(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, rec.Code)
+			}
+			var body healthResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode the body: %v", err)
+			}
+			if len(body.Backends) != len(tt.reachable) {
+				t.Fatalf("Expected %d backend states, got %+v", len(tt.reachable), body.Backends)
+			}
+			for i, want := range tt.reachable {
+				if got := body.Backends[i]; got.Reachable != want || (got.Error == "") != want {
+					t.Errorf("Expected backend %d reachable: %v, got %+v", i, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	rec := httptest.NewRecorder()
+	buildInfo(version.Info())(rec, httptest.NewRequest(http.MethodGet, "/buildinfo", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	var info version.BuildInfo
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatalf("Failed to decode the body: %v", err)
+	}
+	if want := strings.TrimSpace(version.Version); want == "" || info.Version != want {
+		t.Errorf("Expected version %q, got %q", want, info.Version)
+	}
+	if info.GoVersion == "" {
+		t.Error("Expected a Go version")
+	}
+}
+
+func TestWithRegistry(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "content")
+	}))
+	defer originServer.Close()
+
+	newService := func(reg *prometheus.Registry) *Server {
+		cfg := &config.Config{
+			DefaultBackend: config.BackendConfig{
+				Target: originServer.URL,
+			},
+			Frontend: config.FrontendConfig{
+				BaseURL: "http://localhost:0",
+			},
+			Cache: config.CacheConfig{
+				MaxObj:  "100",
+				MaxCost: "1M",
+			},
+		}
+		srv, err := New(t.Context(), cfg, logger, WithRegistry(reg))
+		if err != nil {
+			t.Fatalf("Failed to create service: %v", err)
+		}
+		return srv
+	}
+	regA, regB := prometheus.NewRegistry(), prometheus.NewRegistry()
+	a, b := newService(regA), newService(regB)
+
+	for range 3 {
+		a.Frontend.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		time.Sleep(10 * time.Millisecond) // let ristretto process a set
+	}
+	if got := testutil.ToFloat64(a.Metrics.CacheMisses.WithLabelValues("2xx", http.MethodGet)); got != 1 {
+		t.Errorf("Expected 1 miss in the first registry, got %v", got)
+	}
+	if got := testutil.ToFloat64(a.Metrics.CacheHits.WithLabelValues("2xx", http.MethodGet)); got != 2 {
+		t.Errorf("Expected 2 hits in the first registry, got %v", got)
+	}
+	if n, err := testutil.GatherAndCount(regB, "hazelnut_cache_hits_total", "hazelnut_cache_misses_total"); err != nil || n != 0 {
+		t.Errorf("Expected no requests counted in the second registry, got %d series (%v)", n, err)
+	}
+	if b.Metrics == a.Metrics || b.Metrics == metrics.New() {
+		t.Error("Expected each service to have its own metrics")
+	}
+}
+
+func TestWithFetchMiddleware(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "token "+r.Header.Get("X-Token"))
+	}))
+	defer originServer.Close()
+
+	var fetches atomic.Int64
+	counting := func(next backend.Fetcher) backend.Fetcher {
+		return backend.FetcherFunc(func(req *http.Request) (*http.Response, backend.Cacheability) {
+			fetches.Add(1)
+			return next.Fetch(req)
+		})
+	}
+	cfg := &config.Config{
+		DefaultBackend: config.BackendConfig{Target: originServer.URL},
+		Frontend:       config.FrontendConfig{BaseURL: "http://localhost:0"},
+		Cache:          config.CacheConfig{MaxObj: "100", MaxCost: "1M"},
+	}
+	srv, err := New(t.Context(), cfg, logger, WithRegistry(prometheus.NewRegistry()),
+		WithFetchMiddleware(counting), WithFetchMiddleware(backend.InjectHeaders(http.Header{"X-Token": {"secret"}})))
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	for range 2 {
+		rec := httptest.NewRecorder()
+		srv.Frontend.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		if rec.Body.String() != "token secret" {
+			t.Errorf("Expected the injected header to reach the origin, got %q", rec.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond) // let ristretto process a set
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("Expected only the miss to pass the middlewares, got %d fetches", n)
+	}
+}
+
+func TestWithCacheAndFetcher(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := &config.Config{
+		DefaultBackend: config.BackendConfig{Target: "http://unused.invalid"},
+		Frontend:       config.FrontendConfig{BaseURL: "http://localhost:0"},
+		Cache:          config.CacheConfig{MaxObj: "100", MaxCost: "1M"},
+	}
+	c := mapcache.New()
+	var fetches atomic.Int64
+	fetcher := backend.FetcherFunc(func(req *http.Request) (*http.Response, backend.Cacheability) {
+		fetches.Add(1)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			Body:       io.NopCloser(strings.NewReader("from the fetcher")),
+		}, backend.Cacheability{Cacheable: true}
+	})
+	srv, err := New(t.Context(), cfg, logger, WithRegistry(prometheus.NewRegistry()), WithCache(c), WithFetcher(fetcher))
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	if srv.Cache != Cache(c) || srv.Backend != nil {
+		t.Fatalf("Expected the given cache and no router, got %T and %v", srv.Cache, srv.Backend)
+	}
+
+	for range 2 {
+		rec := httptest.NewRecorder()
+		srv.Frontend.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		if rec.Body.String() != "from the fetcher" {
+			t.Errorf("Expected the fetcher's response, got %q", rec.Body.String())
+		}
+	}
+	if n, objects := fetches.Load(), c.Stats().Objects; n != 1 || objects != 1 {
+		t.Errorf("Expected 1 fetch and the object in the given cache, got %d fetches and %d objects", n, objects)
+	}
+
+	rec := httptest.NewRecorder()
+	readyz(srv.Backend)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected a service with its own fetcher to be ready, got %d", rec.Code)
+	}
+	reloaded := *cfg
+	reloaded.DefaultBackend.Target = "http://other.invalid"
+	if err := srv.Reload(&reloaded); err != nil {
+		t.Errorf("Expected reload to leave the fetcher alone, got %v", err)
+	}
+
+	// a router is used as the service's own
+	router := backend.NewRouter(logger, backend.New(logger, "localhost", 80))
+	srv, err = New(t.Context(), cfg, logger, WithRegistry(prometheus.NewRegistry()), WithFetcher(router))
+	if err != nil {
+		t.Fatalf("Failed to create service with a router: %v", err)
+	}
+	if srv.Backend != router {
+		t.Error("Expected the given router to be the service's backend")
+	}
+}
+
+func TestSlowClientTimeout(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer originServer.Close()
+
+	frontendPort := freePort(t)
+	cfg := &config.Config{
+		DefaultBackend: config.BackendConfig{
+			Target: originServer.URL,
+		},
+		Frontend: config.FrontendConfig{
+			BaseURL:  fmt.Sprintf("http://localhost:%d", frontendPort),
+			Timeouts: config.TimeoutsConfig{ReadHeader: 100 * time.Millisecond},
+		},
+		Cache: config.CacheConfig{
+			MaxObj:  "100",
+			MaxCost: "1M",
+		},
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	srv, err := New(ctx, cfg, logger)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	go func() { _ = srv.Run(ctx) }()
+
+	addr := fmt.Sprintf("localhost:%d", frontendPort)
+	conn, err := net.Dial("tcp", addr)
+	for deadline := time.Now().Add(2 * time.Second); err != nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		t.Fatalf("Frontend didn't come up: %v", err)
+	}
+	defer conn.Close()
+
+	// a slowloris client: it starts a request and never finishes the headers
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	t0 := time.Now()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.Copy(io.Discard, conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("Expected the frontend to close the connection of a client that doesn't send its headers")
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Errorf("Expected the connection to be closed after the read header timeout, took %v", d)
+	}
+}
+
+func TestIgnoreHostConflict(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	origin := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			fmt.Fprint(w, name)
+		}))
+	}
+	originA, originB := origin("origin A"), origin("origin B")
+	defer originA.Close()
+	defer originB.Close()
+
+	tests := []struct {
+		name   string
+		policy string
+		bodyB  string
+	}{
+		{"Warn shares keys across backends", "warn", "origin A"},
+		{"Backend keeps backends apart", "backend", "origin B"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: config.BackendConfig{Target: originA.URL},
+				VirtualHosts: map[string]config.BackendConfig{
+					"a.example.com": {Target: originA.URL},
+					"b.example.com": {Target: originB.URL},
+				},
+				Frontend: config.FrontendConfig{BaseURL: "http://localhost:0"},
+				Cache: config.CacheConfig{
+					MaxObj:       "100",
+					MaxCost:      "1M",
+					IgnoreHost:   true,
+					HostConflict: tt.policy,
+				},
+			}
+			srv, err := New(t.Context(), cfg, logger, WithRegistry(prometheus.NewRegistry()))
+			if err != nil {
+				t.Fatalf("Failed to create service: %v", err)
+			}
+			get := func(host string) string {
+				rec := httptest.NewRecorder()
+				srv.Frontend.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil))
+				time.Sleep(10 * time.Millisecond) // let ristretto process a set
+				return rec.Body.String()
+			}
+			if got := get("a.example.com"); got != "origin A" {
+				t.Fatalf("Expected a.example.com to get origin A, got %q", got)
+			}
+			if got := get("b.example.com"); got != tt.bodyB {
+				t.Errorf("Expected b.example.com to get %q, got %q", tt.bodyB, got)
+			}
+			if got := get("www.example.com"); got != "origin A" {
+				t.Errorf("Expected a host on the default backend to get origin A, got %q", got)
+			}
+
+			// the admin API finds objects under the key that includes the backend
+			req := httptest.NewRequest(http.MethodGet, "/cache/object?url="+url.QueryEscape("http://b.example.com/page"), nil)
+			req.RemoteAddr = "127.0.0.1:1234"
+			rec := httptest.NewRecorder()
+			srv.Admin.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Errorf("Expected the admin API to find the object of b.example.com, got %d: %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	t.Run("Error refuses the configuration", func(t *testing.T) {
+		cfg := &config.Config{
+			DefaultBackend: config.BackendConfig{Target: originA.URL},
+			VirtualHosts:   map[string]config.BackendConfig{"b.example.com": {Target: originB.URL}},
+			Frontend:       config.FrontendConfig{BaseURL: "http://localhost:0"},
+			Cache:          config.CacheConfig{MaxObj: "100", MaxCost: "1M", IgnoreHost: true, HostConflict: "error"},
+			Logging:        config.LoggingConfig{Level: "info", Format: "text"},
+		}
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "cache.ignorehost_conflict") {
+			t.Errorf("Expected the conflict to be rejected, got: %v", err)
+		}
+	})
+}
+
+func TestCacheableStatusPerHost(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var fetches atomic.Int64
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		http.NotFound(w, r)
+	}))
+	defer originServer.Close()
+
+	cfg := &config.Config{
+		DefaultBackend: config.BackendConfig{Target: originServer.URL},
+		VirtualHosts: map[string]config.BackendConfig{
+			"static.example.com": {Target: originServer.URL, CacheableStatus: []int{200}},
+		},
+		Frontend: config.FrontendConfig{BaseURL: "http://localhost:0"},
+		Cache:    config.CacheConfig{MaxObj: "100", MaxCost: "1M"},
+	}
+	srv, err := New(t.Context(), cfg, logger, WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	for host, want := range map[string]int64{"www.example.com": 1, "static.example.com": 2} {
+		fetches.Store(0)
+		for range 2 {
+			rec := httptest.NewRecorder()
+			srv.Frontend.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/missing", nil))
+			time.Sleep(10 * time.Millisecond) // let ristretto process a set
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("%s: expected status 404, got %d", host, rec.Code)
+			}
+		}
+		if got := fetches.Load(); got != want {
+			t.Errorf("%s: expected %d backend fetches, got %d", host, want, got)
+		}
+	}
+}
+
+func TestDeadlineHeader(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprint(w, r.Header.Get("X-Request-Deadline"))
+	}))
+	defer originServer.Close()
+
+	cfg := &config.Config{
+		DefaultBackend: config.BackendConfig{Target: originServer.URL, Timeout: 2 * time.Second},
+		VirtualHosts: map[string]config.BackendConfig{
+			"slow.example.com": {Target: originServer.URL, DialTimeout: time.Second, ResponseTimeout: 4 * time.Second},
+		},
+		Frontend: config.FrontendConfig{BaseURL: "http://localhost:0", DeadlineHeader: "X-Request-Deadline"},
+		Cache:    config.CacheConfig{MaxObj: "100", MaxCost: "1M"},
+	}
+	srv, err := New(t.Context(), cfg, logger, WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	// requests served by the frontend have no deadline, the backend's timeouts give the budget
+	for host, limit := range map[string]int{"www.example.com": 2000, "slow.example.com": 5000} {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/deadline", nil)
+		req.Header.Set("X-Request-Deadline", "99999")
+		rec := httptest.NewRecorder()
+		srv.Frontend.ServeHTTP(rec, req)
+		ms, err := strconv.Atoi(rec.Body.String())
+		if err != nil {
+			t.Fatalf("%s: expected a millisecond budget, got %q", host, rec.Body.String())
+		}
+		if ms <= limit-1000 || ms > limit {
+			t.Errorf("%s: expected budget in (%d, %d] ms, got %d", host, limit-1000, limit, ms)
+		}
+	}
+}
+
+func TestSurrogateKeys(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		switch r.URL.Path {
+		case "/product/1", "/category/shoes":
+			w.Header().Set("Surrogate-Key", "product-1")
+		}
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer originServer.Close()
+
+	cfg := &config.Config{
+		DefaultBackend: config.BackendConfig{Target: originServer.URL},
+		Frontend:       config.FrontendConfig{BaseURL: "http://localhost:0"},
+		Cache:          config.CacheConfig{MaxObj: "100", MaxCost: "1M", SurrogateKeys: true},
+	}
+	srv, err := New(t.Context(), cfg, logger, WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		srv.Frontend.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		time.Sleep(10 * time.Millisecond) // let ristretto process a set
+		return rec.Header().Get("X-Cache")
+	}
+	paths := []string{"/product/1", "/category/shoes", "/product/2"}
+	for _, path := range paths {
+		get(path)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/cache/surrogate?key=product-1", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rec := httptest.NewRecorder()
+	srv.Admin.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for path, want := range map[string]string{"/product/1": "miss", "/category/shoes": "miss", "/product/2": "hit"} {
+		if got := get(path); got != want {
+			t.Errorf("Expected a %s for %s after the purge, got %q", want, path, got)
+		}
+	}
+}
+
+func TestSurrogateKeysSpill(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	large := strings.Repeat("0123456789", 100_000) // 1 MB
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Surrogate-Key", "video-1")
+		fmt.Fprint(w, large)
+	}))
+	defer originServer.Close()
+
+	cfg := &config.Config{
+		DefaultBackend: config.BackendConfig{Target: originServer.URL},
+		Frontend:       config.FrontendConfig{BaseURL: "http://localhost:0"},
+		Cache: config.CacheConfig{
+			MaxObj:        "100",
+			MaxCost:       "10M",
+			DiskDir:       t.TempDir(),
+			BufferLimit:   "64K",
+			SurrogateKeys: true,
+		},
+	}
+	srv, err := New(t.Context(), cfg, logger, WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	get := func() string {
+		rec := httptest.NewRecorder()
+		srv.Frontend.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/video", nil))
+		if rec.Body.Len() != len(large) {
+			t.Errorf("Expected the whole body, got %d bytes", rec.Body.Len())
+		}
+		return rec.Header().Get("X-Cache")
+	}
+	get()
+	if got := get(); got != "hit" {
+		t.Fatalf("Expected the spilled object to be cached, got %q", got)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/cache/surrogate?key=video-1", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rec := httptest.NewRecorder()
+	srv.Admin.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"purged":1`) {
+		t.Fatalf("Expected the spilled object to be purged, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := get(); got != "miss" {
+		t.Errorf("Expected a miss after the purge, got %q", got)
+	}
+}
+
+func TestBan(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	originServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer originServer.Close()
+
+	// with surrogate keys the cache is wrapped, bans still have to reach its objects
+	cfg := &config.Config{
+		DefaultBackend: config.BackendConfig{Target: originServer.URL},
+		Frontend:       config.FrontendConfig{BaseURL: "http://localhost:0"},
+		Cache:          config.CacheConfig{MaxObj: "100", MaxCost: "1M", SurrogateKeys: true},
+	}
+	srv, err := New(t.Context(), cfg, logger, WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		srv.Frontend.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		time.Sleep(10 * time.Millisecond) // let ristretto process a set
+		return rec.Header().Get("X-Cache")
+	}
+	for _, path := range []string{"/products/1", "/products/2?color=red", "/about"} {
+		get(path)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/cache/ban?url="+url.QueryEscape("^/products/"), nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rec := httptest.NewRecorder()
+	srv.Admin.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	time.Sleep(10 * time.Millisecond) // let ristretto process the deletes
+
+	for path, want := range map[string]string{"/products/1": "miss", "/products/2?color=red": "miss", "/about": "hit"} {
+		if got := get(path); got != want {
+			t.Errorf("Expected a %s for %s after the ban, got %q", want, path, got)
+		}
+	}
+}
+
+func TestStatsReport(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	cfg := &config.Config{
+		DefaultBackend: config.BackendConfig{Target: "http://localhost:8000"},
+		Frontend:       config.FrontendConfig{BaseURL: "http://localhost:0"},
+		Cache:          config.CacheConfig{Type: "map", MaxObj: "100", MaxCost: "1M", StatsInterval: time.Hour, LogStats: true},
+	}
+	srv, err := New(ctx, cfg, logger, WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	// no lookups yet, the gauge stays at 0 instead of dividing by zero
+	last := srv.sampleStats(srv.Cache.Stats(), false)
+	if got := testutil.ToFloat64(srv.Metrics.HitRatio); got != 0 {
+		t.Errorf("Expected a hit ratio of 0 before any traffic, got %v", got)
+	}
+
+	srv.Cache.Set("a", cache.ObjCore{Body: []byte("body")})
+	srv.Cache.Get("a")
+	srv.Cache.Get("a")
+	srv.Cache.Get("a")
+	srv.Cache.Get("b")
+	last = srv.sampleStats(last, true)
+	if got := testutil.ToFloat64(srv.Metrics.HitRatio); got != 0.75 {
+		t.Errorf("Expected a hit ratio of 0.75, got %v", got)
+	}
+	for _, want := range []string{"cache stats", "hits=3", "misses=1", "hitRatio=0.75", "objects=1", "bytes=4"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("Expected %q in the stats log, got: %s", want, logs.String())
+		}
+	}
+
+	// an idle interval keeps the ratio, otherwise it is over the last interval only
+	last = srv.sampleStats(last, false)
+	if got := testutil.ToFloat64(srv.Metrics.HitRatio); got != 0.75 {
+		t.Errorf("Expected an idle interval to keep the hit ratio, got %v", got)
+	}
+	srv.Cache.Get("b")
+	srv.sampleStats(last, false)
+	if got := testutil.ToFloat64(srv.Metrics.HitRatio); got != 0 {
+		t.Errorf("Expected a hit ratio of 0 over the last interval, got %v", got)
 	}
 }
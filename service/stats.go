@@ -0,0 +1,48 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/perbu/hazelnut/cache"
+)
+
+// DefaultStatsInterval is how often the cache statistics are sampled
+const DefaultStatsInterval = time.Minute
+
+// reportStats samples the cache statistics every interval until ctx is done, see sampleStats
+func (s *Server) reportStats(ctx context.Context, interval time.Duration, logStats bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := s.Cache.Stats()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			last = s.sampleStats(last, logStats)
+		}
+	}
+}
+
+// sampleStats sets the hit ratio gauge to the ratio of the lookups since the last sample, and
+// logs a summary with logStats. An interval without lookups leaves the gauge as it was. It
+// returns the statistics the next sample is compared with.
+func (s *Server) sampleStats(last cache.Stats, logStats bool) cache.Stats {
+	stats := s.Cache.Stats()
+	if stats.Hits < last.Hits || stats.Misses < last.Misses {
+		// the counters were reset, by a flush for instance
+		last = cache.Stats{}
+	}
+	hits, misses := stats.Hits-last.Hits, stats.Misses-last.Misses
+	var ratio float64
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+		s.Metrics.HitRatio.Set(ratio)
+	}
+	if logStats {
+		s.Logger.Info("cache stats", "hits", hits, "misses", misses, "hitRatio", ratio,
+			"objects", stats.Objects, "bytes", stats.Bytes)
+	}
+	return stats
+}
@@ -2,7 +2,46 @@ package version
 
 import (
 	_ "embed"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
 )
 
 //go:embed .version
 var Version string
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`   // VCS revision the binary was built from
+	BuildTime string `json:"build_time,omitempty"` // commit time of the revision, as recorded by the go command
+	Modified  bool   `json:"modified,omitempty"`   // the working tree had local changes
+}
+
+// Info returns the build information of the binary. It is read once, the first time it is needed.
+var Info = sync.OnceValue(func() BuildInfo {
+	info := BuildInfo{
+		Version:   strings.TrimSpace(Version),
+		GoVersion: runtime.Version(),
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if bi.GoVersion != "" {
+		info.GoVersion = bi.GoVersion
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.BuildTime = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+})
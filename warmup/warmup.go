@@ -0,0 +1,184 @@
+// Package warmup fills the cache ahead of client traffic by requesting a list of URLs,
+// or the URLs listed in a sitemap, through the frontend.
+package warmup
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultConcurrency is the number of URLs warmed at the same time when none is configured
+const DefaultConcurrency = 4
+
+// maxSitemapBytes caps the size of a sitemap, the protocol allows 50MB uncompressed
+const maxSitemapBytes = 50 << 20
+
+// Warmer requests URLs through a handler, normally the frontend, so their responses are cached
+type Warmer struct {
+	handler     http.Handler
+	client      *http.Client // fetches sitemaps
+	concurrency int
+	logger      *slog.Logger
+}
+
+// New creates a warmer that sends its requests to handler, concurrency at a time
+func New(logger *slog.Logger, handler http.Handler, concurrency int) *Warmer {
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	return &Warmer{
+		handler:     handler,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		concurrency: concurrency,
+		logger:      logger.With("package", "warmup"),
+	}
+}
+
+// Warm requests every URL and returns how many got a successful response
+func (w *Warmer) Warm(ctx context.Context, urls []string) int {
+	var warmed atomic.Int64
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range min(w.concurrency, len(urls)) {
+		wg.Go(func() {
+			for u := range jobs {
+				if w.warmOne(ctx, u) {
+					warmed.Add(1)
+				}
+			}
+		})
+	}
+	for _, u := range urls {
+		select {
+		case jobs <- u:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return int(warmed.Load())
+}
+
+// warmOne requests a single URL, it reports whether the response was successful
+func (w *Warmer) warmOne(ctx context.Context, u string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		w.logger.Warn("invalid warmup URL", "url", u, "error", err)
+		return false
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	rw := &discardWriter{header: make(http.Header)}
+	w.handler.ServeHTTP(rw, req)
+	if rw.status >= 400 {
+		w.logger.Warn("warmup request failed", "url", u, "status", rw.status)
+		return false
+	}
+	w.logger.Debug("warmed", "url", u, "status", rw.status)
+	return true
+}
+
+// WarmSitemap fetches the sitemap at sitemapURL and warms every URL in it. A sitemap index
+// is followed one level down.
+func (w *Warmer) WarmSitemap(ctx context.Context, sitemapURL string) (int, error) {
+	urls, err := w.Sitemap(ctx, sitemapURL)
+	if err != nil {
+		return 0, err
+	}
+	return w.Warm(ctx, urls), nil
+}
+
+// sitemap is a urlset or a sitemapindex, only the locations are of interest
+type sitemap struct {
+	XMLName  xml.Name
+	URLs     []location `xml:"url"`
+	Sitemaps []location `xml:"sitemap"`
+}
+
+type location struct {
+	Loc string `xml:"loc"`
+}
+
+// Sitemap returns the URLs listed in the sitemap at sitemapURL. The sitemaps of a sitemap
+// index are fetched as well, a sitemap that fails to load is skipped with a warning.
+func (w *Warmer) Sitemap(ctx context.Context, sitemapURL string) ([]string, error) {
+	sm, err := w.fetchSitemap(ctx, sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+	urls := locations(sm.URLs)
+	for _, child := range locations(sm.Sitemaps) {
+		csm, err := w.fetchSitemap(ctx, child)
+		if err != nil {
+			w.logger.Warn("skipping sitemap", "url", child, "error", err)
+			continue
+		}
+		urls = append(urls, locations(csm.URLs)...)
+	}
+	return urls, nil
+}
+
+func (w *Warmer) fetchSitemap(ctx context.Context, sitemapURL string) (*sitemap, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sitemapURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching sitemap: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching sitemap: %s", resp.Status)
+	}
+	var sm sitemap
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxSitemapBytes)).Decode(&sm); err != nil {
+		return nil, fmt.Errorf("parsing sitemap: %w", err)
+	}
+	if sm.XMLName.Local != "urlset" && sm.XMLName.Local != "sitemapindex" {
+		return nil, fmt.Errorf("parsing sitemap: unexpected root element <%s>", sm.XMLName.Local)
+	}
+	return &sm, nil
+}
+
+// locations returns the non-empty locations
+func locations(locs []location) []string {
+	urls := make([]string, 0, len(locs))
+	for _, l := range locs {
+		if loc := strings.TrimSpace(l.Loc); loc != "" {
+			urls = append(urls, loc)
+		}
+	}
+	return urls
+}
+
+// discardWriter is a ResponseWriter that keeps the status and drops the body
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (d *discardWriter) Header() http.Header { return d.header }
+
+func (d *discardWriter) Write(p []byte) (int, error) {
+	if d.status == 0 {
+		d.status = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (d *discardWriter) WriteHeader(status int) {
+	if d.status == 0 {
+		d.status = status
+	}
+}
@@ -0,0 +1,105 @@
+package warmup
+
+import (
+	"fmt"
+	"github.com/perbu/hazelnut/backend"
+	"github.com/perbu/hazelnut/cache/lrucache"
+	"github.com/perbu/hazelnut/frontend"
+	"github.com/perbu/hazelnut/metrics"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmSitemap(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var pages atomic.Int64
+	var origin *httptest.Server
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap_index.xml":
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>%[1]s/sitemap.xml</loc></sitemap>
+  <sitemap><loc>%[1]s/missing.xml</loc></sitemap>
+</sitemapindex>`, origin.URL)
+		case "/sitemap.xml":
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%[1]s/a</loc></url>
+  <url><loc>
+    %[1]s/b
+  </loc></url>
+  <url><loc>%[1]s/c</loc><lastmod>2024-01-01</lastmod></url>
+</urlset>`, origin.URL)
+		case "/a", "/b", "/c":
+			pages.Add(1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			fmt.Fprint(w, "page ", r.URL.Path)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	hostParts := strings.Split(strings.TrimPrefix(origin.URL, "http://"), ":")
+	port := 80
+	fmt.Sscanf(hostParts[1], "%d", &port)
+
+	newFrontend := func(t *testing.T) *frontend.Server {
+		c, err := lrucache.New(100, 1024*1024)
+		if err != nil {
+			t.Fatalf("Failed to create cache: %v", err)
+		}
+		b := backend.New(logger, hostParts[0], port)
+		b.SetScheme("http")
+		return frontend.New(logger, c, b, "localhost:8080", metrics.New(), false)
+	}
+	assertWarm := func(t *testing.T, f *frontend.Server) {
+		time.Sleep(10 * time.Millisecond) // let ristretto process the sets
+		for _, path := range []string{"/a", "/b", "/c"} {
+			rec := httptest.NewRecorder()
+			f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, origin.URL+path, nil))
+			if got := rec.Header().Get("X-Cache"); got != "hit" {
+				t.Errorf("Expected %s to be warmed, got X-Cache %q", path, got)
+			}
+		}
+	}
+
+	t.Run("Sitemap", func(t *testing.T) {
+		pages.Store(0)
+		f := newFrontend(t)
+		warmed, err := New(logger, f, 2).WarmSitemap(t.Context(), origin.URL+"/sitemap.xml")
+		if err != nil {
+			t.Fatalf("WarmSitemap failed: %v", err)
+		}
+		if warmed != 3 || pages.Load() != 3 {
+			t.Errorf("Expected 3 URLs warmed with 3 origin requests, got %d and %d", warmed, pages.Load())
+		}
+		assertWarm(t, f)
+	})
+
+	t.Run("Sitemap index", func(t *testing.T) {
+		f := newFrontend(t)
+		warmed, err := New(logger, f, 2).WarmSitemap(t.Context(), origin.URL+"/sitemap_index.xml")
+		if err != nil {
+			t.Fatalf("WarmSitemap failed: %v", err)
+		}
+		if warmed != 3 {
+			t.Errorf("Expected 3 URLs warmed, the missing sitemap skipped, got %d", warmed)
+		}
+		assertWarm(t, f)
+	})
+
+	t.Run("Not a sitemap", func(t *testing.T) {
+		if _, err := New(logger, newFrontend(t), 2).WarmSitemap(t.Context(), origin.URL+"/a"); err == nil {
+			t.Error("Expected an error for a document that isn't a sitemap")
+		}
+	})
+}